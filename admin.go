@@ -0,0 +1,304 @@
+package apnsservice
+
+// This source code includes the optional admin HTTP handler. It is a backend
+// for an ops dashboard: list apps and their queues, trigger a test push,
+// reload certs or the whole fleet, and close or reopen connections.
+// The handler has no authentication of its own; mount it behind the
+// caller's auth middleware on an internal listener.
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// adminApp is one app in the admin app list.
+type adminApp struct {
+	ConnectionStatus
+	Protocol    Protocol     `json:"protocol"`
+	LogLevel    LogLevel     `json:"logLevel"`
+	Suppressed  int64        `json:"suppressed"`
+	Queue       QueueStat    `json:"queue"`
+	SocketStats []SocketStat `json:"socketStats"`
+	Classes     []ClassStat  `json:"classes"`
+}
+
+// adminPush is the body of a push request.
+type adminPush struct {
+	Token   string                 `json:"token"`
+	Alert   string                 `json:"alert"`
+	Badge   *int                   `json:"badge"`
+	Sound   string                 `json:"sound"`
+	Data    map[string]interface{} `json:"data"`
+	Options PushOptions            `json:"options"`
+}
+
+// AdminHandler returns an http.Handler serving these endpoints:
+//
+//	GET  /apps              list registered apps with their ConnectionStatus and stats
+//	GET  /apps/{id}         one app
+//	POST /apps/{id}/push    push the adminPush JSON body and answer its apnsId
+//	POST /apps/{id}/cert    relaunch the app with the AppCert JSON body
+//	POST /apps/{id}/close   close the connection
+//	POST /apps/{id}/reopen  relaunch the connection with its current cert
+//	POST /apps/{id}/reset   reset the circuit breaker
+//	POST /apps/{id}/pause   stop draining the queue and hold new pushes
+//	POST /apps/{id}/resume  drain the queue and flush held pushes
+//	POST /apps/{id}/log     set the log level from the body {"level": "debug"}
+//	POST /reload            plan a reload of the Config JSON body; ?apply=true applies it
+//
+// The endpoints under /apps/{id} act on the app's iOS connection, or on its
+// Android or Web Push connection with ?platform=android or ?platform=web.
+// A relaunch keeps the connection's options, including those set from code.
+// Mount it under a prefix with http.StripPrefix.
+func AdminHandler() http.Handler {
+	return http.HandlerFunc(serveAdmin)
+}
+
+// serveAdmin routes one admin request.
+func serveAdmin(w http.ResponseWriter, r *http.Request) {
+	listPath := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(listPath) == 1 && listPath[0] == "apps":
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, adminApps())
+	case len(listPath) == 1 && listPath[0] == "reload":
+		if !requireMethod(w, r, http.MethodPost) {
+			return
+		}
+		adminReload(w, r)
+	case len(listPath) >= 2 && listPath[0] == "apps":
+		appID, err := strconv.Atoi(listPath[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid app id")
+			return
+		}
+		platform := PlatformIOS
+		if strPlatform := r.URL.Query().Get("platform"); strPlatform != "" {
+			platform = Platform(strPlatform)
+		}
+		if !isKnownPlatform(platform) {
+			writeError(w, http.StatusBadRequest, "unknown platform")
+			return
+		}
+		connectionAPNS := getPlatformConnection(appID, platform)
+		if connectionAPNS == nil {
+			writeError(w, http.StatusNotFound, "app is not registered")
+			return
+		}
+		strAction := ""
+		if len(listPath) > 2 {
+			strAction = listPath[2]
+		}
+		adminAppAction(w, r, connectionAPNS, strAction)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// adminAppAction serves the endpoints under /apps/{id}.
+func adminAppAction(w http.ResponseWriter, r *http.Request, a *connectionAPNS, strAction string) {
+	if strAction == "" {
+		if requireMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, a.adminApp())
+		}
+		return
+	}
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	switch strAction {
+	case "push":
+		var body adminPush
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		payload := apns.Payload{
+			Token:     body.Token,
+			AlertText: body.Alert,
+			Sound:     body.Sound,
+			ExtraData: body.Data,
+		}
+		if body.Badge != nil {
+			if *body.Badge < 0 {
+				writeError(w, http.StatusBadRequest, "badge is negative")
+				return
+			}
+			payload.Badge = apns.NewBadgeNumber(uint32(*body.Badge))
+		}
+		if body.Options.ApnsID == "" {
+			body.Options.ApnsID = NewApnsID()
+		}
+		err := PushWithOptions(a.appID, a.platform, payload, body.Options)
+		if err != nil {
+			intStatus := http.StatusBadRequest
+			switch {
+			case errors.Is(err, ErrNotActive), errors.Is(err, ErrQueueFull):
+				intStatus = http.StatusServiceUnavailable
+			case errors.Is(err, ErrRateLimited):
+				intStatus = http.StatusTooManyRequests
+			case errors.Is(err, ErrDuplicate):
+				intStatus = http.StatusConflict
+			case errors.Is(err, ErrPayloadTooLarge):
+				intStatus = http.StatusRequestEntityTooLarge
+			}
+			writeError(w, intStatus, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"apnsId": body.Options.ApnsID})
+	case "cert":
+		if a.platform != PlatformIOS {
+			writeError(w, http.StatusBadRequest, "cert applies to ios connections")
+			return
+		}
+		var appCert AppCert
+		if err := json.NewDecoder(r.Body).Decode(&appCert); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		appCert.AppID = a.appID
+		adminRelaunch(w, a, appCert)
+	case "reopen":
+		adminRelaunch(w, a, *a.cert)
+	case "reset":
+		a.resetBreaker()
+		writeJSON(w, http.StatusOK, a.adminApp())
+	case "pause":
+		if err := a.pauseConnection(); err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, a.adminApp())
+	case "resume":
+		a.resumeConnection()
+		writeJSON(w, http.StatusOK, a.adminApp())
+	case "log":
+		var body struct {
+			Level LogLevel `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := checkLogLevel(body.Level); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		a.setLogLevel(body.Level)
+		utils.Info.Println(a.stringID, " log level set to", body.Level, "by admin")
+		writeJSON(w, http.StatusOK, a.adminApp())
+	case "close":
+		a.closeOnPurpose()
+		utils.Info.Println(a.stringID, " connection closed by admin")
+		writeJSON(w, http.StatusOK, a.adminApp())
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// adminRelaunch replaces the connection with one using appCert. The new
+// connection keeps the platform, client and options of the old one.
+func adminRelaunch(w http.ResponseWriter, a *connectionAPNS, appCert AppCert) {
+	connectionAPNS := newConnection(a.appID, a.stringID, &appCert)
+	connectionAPNS.platform = a.platform
+	connectionAPNS.options = a.options
+	connectionAPNS.fcm = a.fcm
+	connectionAPNS.webPush = a.webPush
+	if err := storeConnection(&connectionAPNS, a.isLogging, true); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.Info.Println(a.stringID, a.platform, " connection relaunched by admin")
+	writeJSON(w, http.StatusOK, getPlatformConnection(a.appID, a.platform).adminApp())
+}
+
+// adminReload plans, and with ?apply=true applies, a reload of the posted Config.
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	var config Config
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	plan, err := PlanReload(config)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.URL.Query().Get("apply") == "true" {
+		if err := ApplyReload(plan); err != nil {
+			intStatus := http.StatusInternalServerError
+			if err == ErrStalePlan {
+				intStatus = http.StatusConflict
+			}
+			writeError(w, intStatus, err.Error())
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// adminApps lists every registered app ordered by appID.
+func adminApps() []adminApp {
+	mutexAPNS.RLock()
+	listConnections := make([]*connectionAPNS, 0, len(mapAPNS))
+	for _, connectionAPNS := range mapAPNS {
+		listConnections = append(listConnections, connectionAPNS)
+	}
+	mutexAPNS.RUnlock()
+
+	listApps := make([]adminApp, 0, len(listConnections))
+	for _, connectionAPNS := range listConnections {
+		listApps = append(listApps, connectionAPNS.adminApp())
+	}
+	sort.Slice(listApps, func(i, j int) bool {
+		return listApps[i].AppID < listApps[j].AppID
+	})
+	return listApps
+}
+
+// adminApp describes the connection for the admin handler.
+func (a *connectionAPNS) adminApp() adminApp {
+	app := adminApp{
+		ConnectionStatus: a.connectionStatus(),
+		Protocol:         a.options.Protocol,
+		LogLevel:         a.getLogLevel(),
+		Classes:          a.classes.snapshot(),
+		Suppressed:       a.suppressedCount(),
+		Queue:            a.queueStats(),
+	}
+	if a.pool != nil {
+		app.SocketStats = a.socketStats()
+	}
+	return app
+}
+
+// requireMethod answers 405 unless the request uses strMethod.
+func requireMethod(w http.ResponseWriter, r *http.Request, strMethod string) bool {
+	if r.Method == strMethod {
+		return true
+	}
+	w.Header().Set("Allow", strMethod)
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+// writeJSON writes value as a JSON response.
+func writeJSON(w http.ResponseWriter, intStatus int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(intStatus)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError writes a JSON error response.
+func writeError(w http.ResponseWriter, intStatus int, strMessage string) {
+	writeJSON(w, intStatus, map[string]string{"error": strMessage})
+}
@@ -0,0 +1,79 @@
+package apnsservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// serveAdminRequest runs one request through the admin handler.
+func serveAdminRequest(strMethod string, strURL string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	AdminHandler().ServeHTTP(w, httptest.NewRequest(strMethod, strURL, nil))
+	return w
+}
+
+func TestAdminPlatformLookup(t *testing.T) {
+	const appID = 9701
+	SetConnectionOptions(appID, ConnectionOptions{})
+	if err := LaunchConnectionWithTransport(appID, "platforms", NewMockTransport(), false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+	android := newConnection(appID, "platforms", &AppCert{AppID: appID})
+	android.platform = PlatformAndroid
+	android.options.Mock = NewMockTransport()
+	if err := storeConnection(&android, false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		strURL   string
+		intCode  int
+		platform Platform
+	}{
+		{"/apps/9701", http.StatusOK, PlatformIOS},
+		{"/apps/9701?platform=android", http.StatusOK, PlatformAndroid},
+		{"/apps/9701?platform=web", http.StatusNotFound, ""},
+		{"/apps/9701?platform=bogus", http.StatusBadRequest, ""},
+	} {
+		w := serveAdminRequest(http.MethodGet, test.strURL)
+		if w.Code != test.intCode {
+			t.Errorf("%s: status %d, want %d", test.strURL, w.Code, test.intCode)
+			continue
+		}
+		if test.platform == "" {
+			continue
+		}
+		var app adminApp
+		if err := json.Unmarshal(w.Body.Bytes(), &app); err != nil {
+			t.Fatal(err)
+		}
+		if app.Platform != test.platform {
+			t.Errorf("%s: platform %s, want %s", test.strURL, app.Platform, test.platform)
+		}
+	}
+}
+
+func TestAdminReopenKeepsOptions(t *testing.T) {
+	const appID = 9702
+	SetConnectionOptions(appID, ConnectionOptions{DeadLetterSink: &deadLetters{}, Sockets: 3})
+	if err := LaunchConnectionWithTransport(appID, "reopen", NewMockTransport(), false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+	first := getConnection(appID)
+	SetConnectionOptions(appID, ConnectionOptions{})
+
+	if w := serveAdminRequest(http.MethodPost, "/apps/9702/reopen"); w.Code != http.StatusOK {
+		t.Fatalf("reopen: status %d %s", w.Code, w.Body.String())
+	}
+	a := getConnection(appID)
+	if a == first {
+		t.Fatal("connection was not relaunched")
+	}
+	if a.options.Mock == nil || a.options.DeadLetterSink == nil || a.options.Sockets != 3 {
+		t.Fatalf("relaunched with options %+v", a.options)
+	}
+}
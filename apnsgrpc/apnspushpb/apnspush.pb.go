@@ -0,0 +1,897 @@
+// This source code includes the gRPC front-end of apnsservice for services
+// written in other languages. Generate the Go code with go generate ./apnsgrpc.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: apnspushpb/apnspush.proto
+
+package apnspushpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type PushOptions struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Priority       int32                  `protobuf:"varint,1,opt,name=priority,proto3" json:"priority,omitempty"`                                   // 10, 5 or 0 for Apple's default
+	ExpirationUnix int64                  `protobuf:"varint,2,opt,name=expiration_unix,json=expirationUnix,proto3" json:"expiration_unix,omitempty"` // 0 for Apple's default
+	CollapseId     string                 `protobuf:"bytes,3,opt,name=collapse_id,json=collapseId,proto3" json:"collapse_id,omitempty"`
+	PushType       string                 `protobuf:"bytes,4,opt,name=push_type,json=pushType,proto3" json:"push_type,omitempty"`
+	CorrelationId  string                 `protobuf:"bytes,5,opt,name=correlation_id,json=correlationId,proto3" json:"correlation_id,omitempty"`
+	Class          string                 `protobuf:"bytes,6,opt,name=class,proto3" json:"class,omitempty"`
+	IdempotencyKey string                 `protobuf:"bytes,7,opt,name=idempotency_key,json=idempotencyKey,proto3" json:"idempotency_key,omitempty"` // a repeat within the app's window returns ALREADY_EXISTS
+	ApnsId         string                 `protobuf:"bytes,8,opt,name=apns_id,json=apnsId,proto3" json:"apns_id,omitempty"`                         // a UUID; the server generates one when empty
+	Topic          string                 `protobuf:"bytes,9,opt,name=topic,proto3" json:"topic,omitempty"`                                         // apns-topic, the app's default when empty
+	UserId         string                 `protobuf:"bytes,10,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`                        // the user pushed to, checked against their preferences
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *PushOptions) Reset() {
+	*x = PushOptions{}
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PushOptions) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushOptions) ProtoMessage() {}
+
+func (x *PushOptions) ProtoReflect() protoreflect.Message {
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushOptions.ProtoReflect.Descriptor instead.
+func (*PushOptions) Descriptor() ([]byte, []int) {
+	return file_apnspushpb_apnspush_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *PushOptions) GetPriority() int32 {
+	if x != nil {
+		return x.Priority
+	}
+	return 0
+}
+
+func (x *PushOptions) GetExpirationUnix() int64 {
+	if x != nil {
+		return x.ExpirationUnix
+	}
+	return 0
+}
+
+func (x *PushOptions) GetCollapseId() string {
+	if x != nil {
+		return x.CollapseId
+	}
+	return ""
+}
+
+func (x *PushOptions) GetPushType() string {
+	if x != nil {
+		return x.PushType
+	}
+	return ""
+}
+
+func (x *PushOptions) GetCorrelationId() string {
+	if x != nil {
+		return x.CorrelationId
+	}
+	return ""
+}
+
+func (x *PushOptions) GetClass() string {
+	if x != nil {
+		return x.Class
+	}
+	return ""
+}
+
+func (x *PushOptions) GetIdempotencyKey() string {
+	if x != nil {
+		return x.IdempotencyKey
+	}
+	return ""
+}
+
+func (x *PushOptions) GetApnsId() string {
+	if x != nil {
+		return x.ApnsId
+	}
+	return ""
+}
+
+func (x *PushOptions) GetTopic() string {
+	if x != nil {
+		return x.Topic
+	}
+	return ""
+}
+
+func (x *PushOptions) GetUserId() string {
+	if x != nil {
+		return x.UserId
+	}
+	return ""
+}
+
+type Notification struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	Token            string                 `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	Alert            string                 `protobuf:"bytes,2,opt,name=alert,proto3" json:"alert,omitempty"`
+	Badge            *int32                 `protobuf:"varint,3,opt,name=badge,proto3,oneof" json:"badge,omitempty"`
+	Sound            string                 `protobuf:"bytes,4,opt,name=sound,proto3" json:"sound,omitempty"`
+	Category         string                 `protobuf:"bytes,5,opt,name=category,proto3" json:"category,omitempty"`
+	ContentAvailable bool                   `protobuf:"varint,6,opt,name=content_available,json=contentAvailable,proto3" json:"content_available,omitempty"`
+	CustomJson       string                 `protobuf:"bytes,7,opt,name=custom_json,json=customJson,proto3" json:"custom_json,omitempty"` // JSON object of custom keys
+	Options          *PushOptions           `protobuf:"bytes,8,opt,name=options,proto3" json:"options,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *Notification) Reset() {
+	*x = Notification{}
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Notification) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Notification) ProtoMessage() {}
+
+func (x *Notification) ProtoReflect() protoreflect.Message {
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Notification.ProtoReflect.Descriptor instead.
+func (*Notification) Descriptor() ([]byte, []int) {
+	return file_apnspushpb_apnspush_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Notification) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *Notification) GetAlert() string {
+	if x != nil {
+		return x.Alert
+	}
+	return ""
+}
+
+func (x *Notification) GetBadge() int32 {
+	if x != nil && x.Badge != nil {
+		return *x.Badge
+	}
+	return 0
+}
+
+func (x *Notification) GetSound() string {
+	if x != nil {
+		return x.Sound
+	}
+	return ""
+}
+
+func (x *Notification) GetCategory() string {
+	if x != nil {
+		return x.Category
+	}
+	return ""
+}
+
+func (x *Notification) GetContentAvailable() bool {
+	if x != nil {
+		return x.ContentAvailable
+	}
+	return false
+}
+
+func (x *Notification) GetCustomJson() string {
+	if x != nil {
+		return x.CustomJson
+	}
+	return ""
+}
+
+func (x *Notification) GetOptions() *PushOptions {
+	if x != nil {
+		return x.Options
+	}
+	return nil
+}
+
+type PushRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AppId         int32                  `protobuf:"varint,1,opt,name=app_id,json=appId,proto3" json:"app_id,omitempty"`
+	Notification  *Notification          `protobuf:"bytes,2,opt,name=notification,proto3" json:"notification,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PushRequest) Reset() {
+	*x = PushRequest{}
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PushRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushRequest) ProtoMessage() {}
+
+func (x *PushRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushRequest.ProtoReflect.Descriptor instead.
+func (*PushRequest) Descriptor() ([]byte, []int) {
+	return file_apnspushpb_apnspush_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *PushRequest) GetAppId() int32 {
+	if x != nil {
+		return x.AppId
+	}
+	return 0
+}
+
+func (x *PushRequest) GetNotification() *Notification {
+	if x != nil {
+		return x.Notification
+	}
+	return nil
+}
+
+type PushResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ApnsId        string                 `protobuf:"bytes,1,opt,name=apns_id,json=apnsId,proto3" json:"apns_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PushResponse) Reset() {
+	*x = PushResponse{}
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PushResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushResponse) ProtoMessage() {}
+
+func (x *PushResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushResponse.ProtoReflect.Descriptor instead.
+func (*PushResponse) Descriptor() ([]byte, []int) {
+	return file_apnspushpb_apnspush_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *PushResponse) GetApnsId() string {
+	if x != nil {
+		return x.ApnsId
+	}
+	return ""
+}
+
+type PushManyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AppId         int32                  `protobuf:"varint,1,opt,name=app_id,json=appId,proto3" json:"app_id,omitempty"`
+	Notifications []*Notification        `protobuf:"bytes,2,rep,name=notifications,proto3" json:"notifications,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PushManyRequest) Reset() {
+	*x = PushManyRequest{}
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PushManyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushManyRequest) ProtoMessage() {}
+
+func (x *PushManyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushManyRequest.ProtoReflect.Descriptor instead.
+func (*PushManyRequest) Descriptor() ([]byte, []int) {
+	return file_apnspushpb_apnspush_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *PushManyRequest) GetAppId() int32 {
+	if x != nil {
+		return x.AppId
+	}
+	return 0
+}
+
+func (x *PushManyRequest) GetNotifications() []*Notification {
+	if x != nil {
+		return x.Notifications
+	}
+	return nil
+}
+
+type PushError struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Index         int32                  `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"` // index into PushManyRequest.notifications
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PushError) Reset() {
+	*x = PushError{}
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PushError) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushError) ProtoMessage() {}
+
+func (x *PushError) ProtoReflect() protoreflect.Message {
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushError.ProtoReflect.Descriptor instead.
+func (*PushError) Descriptor() ([]byte, []int) {
+	return file_apnspushpb_apnspush_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *PushError) GetIndex() int32 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *PushError) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+type PushManyResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Accepted      int32                  `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	Errors        []*PushError           `protobuf:"bytes,2,rep,name=errors,proto3" json:"errors,omitempty"`
+	ApnsIds       []string               `protobuf:"bytes,3,rep,name=apns_ids,json=apnsIds,proto3" json:"apns_ids,omitempty"` // by index, empty for the failed entries
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PushManyResponse) Reset() {
+	*x = PushManyResponse{}
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PushManyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushManyResponse) ProtoMessage() {}
+
+func (x *PushManyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushManyResponse.ProtoReflect.Descriptor instead.
+func (*PushManyResponse) Descriptor() ([]byte, []int) {
+	return file_apnspushpb_apnspush_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PushManyResponse) GetAccepted() int32 {
+	if x != nil {
+		return x.Accepted
+	}
+	return 0
+}
+
+func (x *PushManyResponse) GetErrors() []*PushError {
+	if x != nil {
+		return x.Errors
+	}
+	return nil
+}
+
+func (x *PushManyResponse) GetApnsIds() []string {
+	if x != nil {
+		return x.ApnsIds
+	}
+	return nil
+}
+
+type RegisterAppRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AppId         int32                  `protobuf:"varint,1,opt,name=app_id,json=appId,proto3" json:"app_id,omitempty"`
+	StringId      string                 `protobuf:"bytes,2,opt,name=string_id,json=stringId,proto3" json:"string_id,omitempty"`
+	IsDev         bool                   `protobuf:"varint,3,opt,name=is_dev,json=isDev,proto3" json:"is_dev,omitempty"`
+	Cert          []byte                 `protobuf:"bytes,4,opt,name=cert,proto3" json:"cert,omitempty"`
+	RsaKey        []byte                 `protobuf:"bytes,5,opt,name=rsa_key,json=rsaKey,proto3" json:"rsa_key,omitempty"`
+	AuthKey       []byte                 `protobuf:"bytes,6,opt,name=auth_key,json=authKey,proto3" json:"auth_key,omitempty"`
+	KeyId         string                 `protobuf:"bytes,7,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	TeamId        string                 `protobuf:"bytes,8,opt,name=team_id,json=teamId,proto3" json:"team_id,omitempty"`
+	IsLogging     bool                   `protobuf:"varint,9,opt,name=is_logging,json=isLogging,proto3" json:"is_logging,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegisterAppRequest) Reset() {
+	*x = RegisterAppRequest{}
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterAppRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterAppRequest) ProtoMessage() {}
+
+func (x *RegisterAppRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterAppRequest.ProtoReflect.Descriptor instead.
+func (*RegisterAppRequest) Descriptor() ([]byte, []int) {
+	return file_apnspushpb_apnspush_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *RegisterAppRequest) GetAppId() int32 {
+	if x != nil {
+		return x.AppId
+	}
+	return 0
+}
+
+func (x *RegisterAppRequest) GetStringId() string {
+	if x != nil {
+		return x.StringId
+	}
+	return ""
+}
+
+func (x *RegisterAppRequest) GetIsDev() bool {
+	if x != nil {
+		return x.IsDev
+	}
+	return false
+}
+
+func (x *RegisterAppRequest) GetCert() []byte {
+	if x != nil {
+		return x.Cert
+	}
+	return nil
+}
+
+func (x *RegisterAppRequest) GetRsaKey() []byte {
+	if x != nil {
+		return x.RsaKey
+	}
+	return nil
+}
+
+func (x *RegisterAppRequest) GetAuthKey() []byte {
+	if x != nil {
+		return x.AuthKey
+	}
+	return nil
+}
+
+func (x *RegisterAppRequest) GetKeyId() string {
+	if x != nil {
+		return x.KeyId
+	}
+	return ""
+}
+
+func (x *RegisterAppRequest) GetTeamId() string {
+	if x != nil {
+		return x.TeamId
+	}
+	return ""
+}
+
+func (x *RegisterAppRequest) GetIsLogging() bool {
+	if x != nil {
+		return x.IsLogging
+	}
+	return false
+}
+
+type RegisterAppResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegisterAppResponse) Reset() {
+	*x = RegisterAppResponse{}
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterAppResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterAppResponse) ProtoMessage() {}
+
+func (x *RegisterAppResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterAppResponse.ProtoReflect.Descriptor instead.
+func (*RegisterAppResponse) Descriptor() ([]byte, []int) {
+	return file_apnspushpb_apnspush_proto_rawDescGZIP(), []int{8}
+}
+
+type StreamFeedbackRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AppId         int32                  `protobuf:"varint,1,opt,name=app_id,json=appId,proto3" json:"app_id,omitempty"` // 0 streams every app
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamFeedbackRequest) Reset() {
+	*x = StreamFeedbackRequest{}
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamFeedbackRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamFeedbackRequest) ProtoMessage() {}
+
+func (x *StreamFeedbackRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamFeedbackRequest.ProtoReflect.Descriptor instead.
+func (*StreamFeedbackRequest) Descriptor() ([]byte, []int) {
+	return file_apnspushpb_apnspush_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *StreamFeedbackRequest) GetAppId() int32 {
+	if x != nil {
+		return x.AppId
+	}
+	return 0
+}
+
+type Feedback struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AppId         int32                  `protobuf:"varint,1,opt,name=app_id,json=appId,proto3" json:"app_id,omitempty"`
+	Token         string                 `protobuf:"bytes,2,opt,name=token,proto3" json:"token,omitempty"`
+	Reason        string                 `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
+	TimestampUnix int64                  `protobuf:"varint,4,opt,name=timestamp_unix,json=timestampUnix,proto3" json:"timestamp_unix,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Feedback) Reset() {
+	*x = Feedback{}
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Feedback) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Feedback) ProtoMessage() {}
+
+func (x *Feedback) ProtoReflect() protoreflect.Message {
+	mi := &file_apnspushpb_apnspush_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Feedback.ProtoReflect.Descriptor instead.
+func (*Feedback) Descriptor() ([]byte, []int) {
+	return file_apnspushpb_apnspush_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *Feedback) GetAppId() int32 {
+	if x != nil {
+		return x.AppId
+	}
+	return 0
+}
+
+func (x *Feedback) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *Feedback) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *Feedback) GetTimestampUnix() int64 {
+	if x != nil {
+		return x.TimestampUnix
+	}
+	return 0
+}
+
+var File_apnspushpb_apnspush_proto protoreflect.FileDescriptor
+
+const file_apnspushpb_apnspush_proto_rawDesc = "" +
+	"\n" +
+	"\x19apnspushpb/apnspush.proto\x12\x0eapnsservice.v1\"\xbe\x02\n" +
+	"\vPushOptions\x12\x1a\n" +
+	"\bpriority\x18\x01 \x01(\x05R\bpriority\x12'\n" +
+	"\x0fexpiration_unix\x18\x02 \x01(\x03R\x0eexpirationUnix\x12\x1f\n" +
+	"\vcollapse_id\x18\x03 \x01(\tR\n" +
+	"collapseId\x12\x1b\n" +
+	"\tpush_type\x18\x04 \x01(\tR\bpushType\x12%\n" +
+	"\x0ecorrelation_id\x18\x05 \x01(\tR\rcorrelationId\x12\x14\n" +
+	"\x05class\x18\x06 \x01(\tR\x05class\x12'\n" +
+	"\x0fidempotency_key\x18\a \x01(\tR\x0eidempotencyKey\x12\x17\n" +
+	"\aapns_id\x18\b \x01(\tR\x06apnsId\x12\x14\n" +
+	"\x05topic\x18\t \x01(\tR\x05topic\x12\x17\n" +
+	"\auser_id\x18\n" +
+	" \x01(\tR\x06userId\"\x96\x02\n" +
+	"\fNotification\x12\x14\n" +
+	"\x05token\x18\x01 \x01(\tR\x05token\x12\x14\n" +
+	"\x05alert\x18\x02 \x01(\tR\x05alert\x12\x19\n" +
+	"\x05badge\x18\x03 \x01(\x05H\x00R\x05badge\x88\x01\x01\x12\x14\n" +
+	"\x05sound\x18\x04 \x01(\tR\x05sound\x12\x1a\n" +
+	"\bcategory\x18\x05 \x01(\tR\bcategory\x12+\n" +
+	"\x11content_available\x18\x06 \x01(\bR\x10contentAvailable\x12\x1f\n" +
+	"\vcustom_json\x18\a \x01(\tR\n" +
+	"customJson\x125\n" +
+	"\aoptions\x18\b \x01(\v2\x1b.apnsservice.v1.PushOptionsR\aoptionsB\b\n" +
+	"\x06_badge\"f\n" +
+	"\vPushRequest\x12\x15\n" +
+	"\x06app_id\x18\x01 \x01(\x05R\x05appId\x12@\n" +
+	"\fnotification\x18\x02 \x01(\v2\x1c.apnsservice.v1.NotificationR\fnotification\"'\n" +
+	"\fPushResponse\x12\x17\n" +
+	"\aapns_id\x18\x01 \x01(\tR\x06apnsId\"l\n" +
+	"\x0fPushManyRequest\x12\x15\n" +
+	"\x06app_id\x18\x01 \x01(\x05R\x05appId\x12B\n" +
+	"\rnotifications\x18\x02 \x03(\v2\x1c.apnsservice.v1.NotificationR\rnotifications\";\n" +
+	"\tPushError\x12\x14\n" +
+	"\x05index\x18\x01 \x01(\x05R\x05index\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\"|\n" +
+	"\x10PushManyResponse\x12\x1a\n" +
+	"\baccepted\x18\x01 \x01(\x05R\baccepted\x121\n" +
+	"\x06errors\x18\x02 \x03(\v2\x19.apnsservice.v1.PushErrorR\x06errors\x12\x19\n" +
+	"\bapns_ids\x18\x03 \x03(\tR\aapnsIds\"\xf6\x01\n" +
+	"\x12RegisterAppRequest\x12\x15\n" +
+	"\x06app_id\x18\x01 \x01(\x05R\x05appId\x12\x1b\n" +
+	"\tstring_id\x18\x02 \x01(\tR\bstringId\x12\x15\n" +
+	"\x06is_dev\x18\x03 \x01(\bR\x05isDev\x12\x12\n" +
+	"\x04cert\x18\x04 \x01(\fR\x04cert\x12\x17\n" +
+	"\arsa_key\x18\x05 \x01(\fR\x06rsaKey\x12\x19\n" +
+	"\bauth_key\x18\x06 \x01(\fR\aauthKey\x12\x15\n" +
+	"\x06key_id\x18\a \x01(\tR\x05keyId\x12\x17\n" +
+	"\ateam_id\x18\b \x01(\tR\x06teamId\x12\x1d\n" +
+	"\n" +
+	"is_logging\x18\t \x01(\bR\tisLogging\"\x15\n" +
+	"\x13RegisterAppResponse\".\n" +
+	"\x15StreamFeedbackRequest\x12\x15\n" +
+	"\x06app_id\x18\x01 \x01(\x05R\x05appId\"v\n" +
+	"\bFeedback\x12\x15\n" +
+	"\x06app_id\x18\x01 \x01(\x05R\x05appId\x12\x14\n" +
+	"\x05token\x18\x02 \x01(\tR\x05token\x12\x16\n" +
+	"\x06reason\x18\x03 \x01(\tR\x06reason\x12%\n" +
+	"\x0etimestamp_unix\x18\x04 \x01(\x03R\rtimestampUnix2\xc9\x02\n" +
+	"\bApnsPush\x12A\n" +
+	"\x04Push\x12\x1b.apnsservice.v1.PushRequest\x1a\x1c.apnsservice.v1.PushResponse\x12M\n" +
+	"\bPushMany\x12\x1f.apnsservice.v1.PushManyRequest\x1a .apnsservice.v1.PushManyResponse\x12V\n" +
+	"\vRegisterApp\x12\".apnsservice.v1.RegisterAppRequest\x1a#.apnsservice.v1.RegisterAppResponse\x12S\n" +
+	"\x0eStreamFeedback\x12%.apnsservice.v1.StreamFeedbackRequest\x1a\x18.apnsservice.v1.Feedback0\x01B5Z3github.com/knousere/apnsservice/apnsgrpc/apnspushpbb\x06proto3"
+
+var (
+	file_apnspushpb_apnspush_proto_rawDescOnce sync.Once
+	file_apnspushpb_apnspush_proto_rawDescData []byte
+)
+
+func file_apnspushpb_apnspush_proto_rawDescGZIP() []byte {
+	file_apnspushpb_apnspush_proto_rawDescOnce.Do(func() {
+		file_apnspushpb_apnspush_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_apnspushpb_apnspush_proto_rawDesc), len(file_apnspushpb_apnspush_proto_rawDesc)))
+	})
+	return file_apnspushpb_apnspush_proto_rawDescData
+}
+
+var file_apnspushpb_apnspush_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_apnspushpb_apnspush_proto_goTypes = []any{
+	(*PushOptions)(nil),           // 0: apnsservice.v1.PushOptions
+	(*Notification)(nil),          // 1: apnsservice.v1.Notification
+	(*PushRequest)(nil),           // 2: apnsservice.v1.PushRequest
+	(*PushResponse)(nil),          // 3: apnsservice.v1.PushResponse
+	(*PushManyRequest)(nil),       // 4: apnsservice.v1.PushManyRequest
+	(*PushError)(nil),             // 5: apnsservice.v1.PushError
+	(*PushManyResponse)(nil),      // 6: apnsservice.v1.PushManyResponse
+	(*RegisterAppRequest)(nil),    // 7: apnsservice.v1.RegisterAppRequest
+	(*RegisterAppResponse)(nil),   // 8: apnsservice.v1.RegisterAppResponse
+	(*StreamFeedbackRequest)(nil), // 9: apnsservice.v1.StreamFeedbackRequest
+	(*Feedback)(nil),              // 10: apnsservice.v1.Feedback
+}
+var file_apnspushpb_apnspush_proto_depIdxs = []int32{
+	0,  // 0: apnsservice.v1.Notification.options:type_name -> apnsservice.v1.PushOptions
+	1,  // 1: apnsservice.v1.PushRequest.notification:type_name -> apnsservice.v1.Notification
+	1,  // 2: apnsservice.v1.PushManyRequest.notifications:type_name -> apnsservice.v1.Notification
+	5,  // 3: apnsservice.v1.PushManyResponse.errors:type_name -> apnsservice.v1.PushError
+	2,  // 4: apnsservice.v1.ApnsPush.Push:input_type -> apnsservice.v1.PushRequest
+	4,  // 5: apnsservice.v1.ApnsPush.PushMany:input_type -> apnsservice.v1.PushManyRequest
+	7,  // 6: apnsservice.v1.ApnsPush.RegisterApp:input_type -> apnsservice.v1.RegisterAppRequest
+	9,  // 7: apnsservice.v1.ApnsPush.StreamFeedback:input_type -> apnsservice.v1.StreamFeedbackRequest
+	3,  // 8: apnsservice.v1.ApnsPush.Push:output_type -> apnsservice.v1.PushResponse
+	6,  // 9: apnsservice.v1.ApnsPush.PushMany:output_type -> apnsservice.v1.PushManyResponse
+	8,  // 10: apnsservice.v1.ApnsPush.RegisterApp:output_type -> apnsservice.v1.RegisterAppResponse
+	10, // 11: apnsservice.v1.ApnsPush.StreamFeedback:output_type -> apnsservice.v1.Feedback
+	8,  // [8:12] is the sub-list for method output_type
+	4,  // [4:8] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_apnspushpb_apnspush_proto_init() }
+func file_apnspushpb_apnspush_proto_init() {
+	if File_apnspushpb_apnspush_proto != nil {
+		return
+	}
+	file_apnspushpb_apnspush_proto_msgTypes[1].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_apnspushpb_apnspush_proto_rawDesc), len(file_apnspushpb_apnspush_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   11,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_apnspushpb_apnspush_proto_goTypes,
+		DependencyIndexes: file_apnspushpb_apnspush_proto_depIdxs,
+		MessageInfos:      file_apnspushpb_apnspush_proto_msgTypes,
+	}.Build()
+	File_apnspushpb_apnspush_proto = out.File
+	file_apnspushpb_apnspush_proto_goTypes = nil
+	file_apnspushpb_apnspush_proto_depIdxs = nil
+}
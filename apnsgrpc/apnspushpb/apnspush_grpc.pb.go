@@ -0,0 +1,250 @@
+// This source code includes the gRPC front-end of apnsservice for services
+// written in other languages. Generate the Go code with go generate ./apnsgrpc.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: apnspushpb/apnspush.proto
+
+package apnspushpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ApnsPush_Push_FullMethodName           = "/apnsservice.v1.ApnsPush/Push"
+	ApnsPush_PushMany_FullMethodName       = "/apnsservice.v1.ApnsPush/PushMany"
+	ApnsPush_RegisterApp_FullMethodName    = "/apnsservice.v1.ApnsPush/RegisterApp"
+	ApnsPush_StreamFeedback_FullMethodName = "/apnsservice.v1.ApnsPush/StreamFeedback"
+)
+
+// ApnsPushClient is the client API for ApnsPush service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ApnsPushClient interface {
+	// Push pushes one notification. The RPC deadline bounds its delivery.
+	Push(ctx context.Context, in *PushRequest, opts ...grpc.CallOption) (*PushResponse, error)
+	// PushMany pushes a batch for one app and reports the failed entries.
+	PushMany(ctx context.Context, in *PushManyRequest, opts ...grpc.CallOption) (*PushManyResponse, error)
+	// RegisterApp launches a connection for a new app.
+	RegisterApp(ctx context.Context, in *RegisterAppRequest, opts ...grpc.CallOption) (*RegisterAppResponse, error)
+	// StreamFeedback streams tokens Apple reports as no longer valid.
+	StreamFeedback(ctx context.Context, in *StreamFeedbackRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Feedback], error)
+}
+
+type apnsPushClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewApnsPushClient(cc grpc.ClientConnInterface) ApnsPushClient {
+	return &apnsPushClient{cc}
+}
+
+func (c *apnsPushClient) Push(ctx context.Context, in *PushRequest, opts ...grpc.CallOption) (*PushResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PushResponse)
+	err := c.cc.Invoke(ctx, ApnsPush_Push_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *apnsPushClient) PushMany(ctx context.Context, in *PushManyRequest, opts ...grpc.CallOption) (*PushManyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PushManyResponse)
+	err := c.cc.Invoke(ctx, ApnsPush_PushMany_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *apnsPushClient) RegisterApp(ctx context.Context, in *RegisterAppRequest, opts ...grpc.CallOption) (*RegisterAppResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RegisterAppResponse)
+	err := c.cc.Invoke(ctx, ApnsPush_RegisterApp_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *apnsPushClient) StreamFeedback(ctx context.Context, in *StreamFeedbackRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Feedback], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ApnsPush_ServiceDesc.Streams[0], ApnsPush_StreamFeedback_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamFeedbackRequest, Feedback]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ApnsPush_StreamFeedbackClient = grpc.ServerStreamingClient[Feedback]
+
+// ApnsPushServer is the server API for ApnsPush service.
+// All implementations must embed UnimplementedApnsPushServer
+// for forward compatibility.
+type ApnsPushServer interface {
+	// Push pushes one notification. The RPC deadline bounds its delivery.
+	Push(context.Context, *PushRequest) (*PushResponse, error)
+	// PushMany pushes a batch for one app and reports the failed entries.
+	PushMany(context.Context, *PushManyRequest) (*PushManyResponse, error)
+	// RegisterApp launches a connection for a new app.
+	RegisterApp(context.Context, *RegisterAppRequest) (*RegisterAppResponse, error)
+	// StreamFeedback streams tokens Apple reports as no longer valid.
+	StreamFeedback(*StreamFeedbackRequest, grpc.ServerStreamingServer[Feedback]) error
+	mustEmbedUnimplementedApnsPushServer()
+}
+
+// UnimplementedApnsPushServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedApnsPushServer struct{}
+
+func (UnimplementedApnsPushServer) Push(context.Context, *PushRequest) (*PushResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Push not implemented")
+}
+func (UnimplementedApnsPushServer) PushMany(context.Context, *PushManyRequest) (*PushManyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PushMany not implemented")
+}
+func (UnimplementedApnsPushServer) RegisterApp(context.Context, *RegisterAppRequest) (*RegisterAppResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterApp not implemented")
+}
+func (UnimplementedApnsPushServer) StreamFeedback(*StreamFeedbackRequest, grpc.ServerStreamingServer[Feedback]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamFeedback not implemented")
+}
+func (UnimplementedApnsPushServer) mustEmbedUnimplementedApnsPushServer() {}
+func (UnimplementedApnsPushServer) testEmbeddedByValue()                  {}
+
+// UnsafeApnsPushServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ApnsPushServer will
+// result in compilation errors.
+type UnsafeApnsPushServer interface {
+	mustEmbedUnimplementedApnsPushServer()
+}
+
+func RegisterApnsPushServer(s grpc.ServiceRegistrar, srv ApnsPushServer) {
+	// If the following call pancis, it indicates UnimplementedApnsPushServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ApnsPush_ServiceDesc, srv)
+}
+
+func _ApnsPush_Push_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PushRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ApnsPushServer).Push(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ApnsPush_Push_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ApnsPushServer).Push(ctx, req.(*PushRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ApnsPush_PushMany_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PushManyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ApnsPushServer).PushMany(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ApnsPush_PushMany_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ApnsPushServer).PushMany(ctx, req.(*PushManyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ApnsPush_RegisterApp_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterAppRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ApnsPushServer).RegisterApp(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ApnsPush_RegisterApp_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ApnsPushServer).RegisterApp(ctx, req.(*RegisterAppRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ApnsPush_StreamFeedback_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamFeedbackRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ApnsPushServer).StreamFeedback(m, &grpc.GenericServerStream[StreamFeedbackRequest, Feedback]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ApnsPush_StreamFeedbackServer = grpc.ServerStreamingServer[Feedback]
+
+// ApnsPush_ServiceDesc is the grpc.ServiceDesc for ApnsPush service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ApnsPush_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "apnsservice.v1.ApnsPush",
+	HandlerType: (*ApnsPushServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Push",
+			Handler:    _ApnsPush_Push_Handler,
+		},
+		{
+			MethodName: "PushMany",
+			Handler:    _ApnsPush_PushMany_Handler,
+		},
+		{
+			MethodName: "RegisterApp",
+			Handler:    _ApnsPush_RegisterApp_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamFeedback",
+			Handler:       _ApnsPush_StreamFeedback_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "apnspushpb/apnspush.proto",
+}
@@ -0,0 +1,198 @@
+// Package apnsgrpc is an optional gRPC front-end to apnsservice for services
+// written in other languages. It serves the ApnsPush service defined in
+// apnspushpb/apnspush.proto on top of the apnsservice connection registry.
+//
+// The generated Go code for the proto is committed. Regenerate it with
+// protoc-gen-go v1.36 and protoc-gen-go-grpc v1.5 after editing the proto:
+//
+//	go generate ./apnsgrpc
+package apnsgrpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative apnspushpb/apnspush.proto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/apnsservice"
+	"github.com/knousere/apnsservice/apnsgrpc/apnspushpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// feedbackBuffer is the feedback buffered for each StreamFeedback caller.
+const feedbackBuffer = 100
+
+// Server implements apnspushpb.ApnsPushServer.
+type Server struct {
+	apnspushpb.UnimplementedApnsPushServer
+}
+
+// Register serves the ApnsPush service on s.
+func Register(s grpc.ServiceRegistrar) {
+	apnspushpb.RegisterApnsPushServer(s, &Server{})
+}
+
+// Push pushes one notification. The RPC deadline bounds its delivery.
+func (s *Server) Push(ctx context.Context, req *apnspushpb.PushRequest) (*apnspushpb.PushResponse, error) {
+	payload, opts, err := toPayload(req.GetNotification())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := apnsservice.PushOneContext(ctx, int(req.GetAppId()), payload, opts); err != nil {
+		return nil, toStatus(err)
+	}
+	return &apnspushpb.PushResponse{ApnsId: opts.ApnsID}, nil
+}
+
+// PushMany pushes a batch for one app and reports the entries that failed.
+// Entries sharing a payload are serialized once.
+func (s *Server) PushMany(ctx context.Context, req *apnspushpb.PushManyRequest) (*apnspushpb.PushManyResponse, error) {
+	listNotifications := req.GetNotifications()
+	resp := &apnspushpb.PushManyResponse{}
+	listPushes := make([]apnsservice.BatchPush, 0, len(listNotifications))
+	listIndexes := make([]int, 0, len(listNotifications))
+	for i, notification := range listNotifications {
+		payload, opts, err := toPayload(notification)
+		if err != nil {
+			resp.Errors = append(resp.Errors, &apnspushpb.PushError{Index: int32(i), Message: err.Error()})
+			continue
+		}
+		listPushes = append(listPushes, apnsservice.BatchPush{Payload: payload, Options: opts})
+		listIndexes = append(listIndexes, i)
+	}
+
+	resp.ApnsIds = make([]string, len(listNotifications))
+	listApnsIDs, errs := apnsservice.PushMany(ctx, int(req.GetAppId()), listPushes)
+	if errs != nil && ctx.Err() != nil {
+		return nil, toStatus(ctx.Err())
+	}
+	for j, i := range listIndexes {
+		if errs != nil && errs[j] != nil {
+			resp.Errors = append(resp.Errors, &apnspushpb.PushError{Index: int32(i), Message: errs[j].Error()})
+			continue
+		}
+		resp.ApnsIds[i] = listApnsIDs[j]
+		resp.Accepted++
+	}
+	sort.Slice(resp.Errors, func(i, j int) bool {
+		return resp.Errors[i].Index < resp.Errors[j].Index
+	})
+	return resp, nil
+}
+
+// RegisterApp launches a connection for a new app.
+func (s *Server) RegisterApp(ctx context.Context, req *apnspushpb.RegisterAppRequest) (*apnspushpb.RegisterAppResponse, error) {
+	appCert := apnsservice.AppCert{
+		AppID:   int(req.GetAppId()),
+		Cert:    req.GetCert(),
+		RSAKey:  req.GetRsaKey(),
+		AuthKey: req.GetAuthKey(),
+		KeyID:   req.GetKeyId(),
+		TeamID:  req.GetTeamId(),
+	}
+	if req.GetIsDev() {
+		appCert.IsDev = 1
+	}
+	err := apnsservice.AddApp(int(req.GetAppId()), req.GetStringId(), appCert, req.GetIsLogging())
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &apnspushpb.RegisterAppResponse{}, nil
+}
+
+// StreamFeedback streams invalid tokens until the caller cancels.
+func (s *Server) StreamFeedback(req *apnspushpb.StreamFeedbackRequest, stream apnspushpb.ApnsPush_StreamFeedbackServer) error {
+	chanFeedback, unsubscribe := apnsservice.SubscribeFeedback(feedbackBuffer)
+	defer unsubscribe()
+
+	for {
+		select {
+		case feedback := <-chanFeedback:
+			if req.GetAppId() != 0 && int(req.GetAppId()) != feedback.AppID {
+				continue
+			}
+			err := stream.Send(&apnspushpb.Feedback{
+				AppId:         int32(feedback.AppID),
+				Token:         feedback.Token,
+				Reason:        feedback.Reason,
+				TimestampUnix: feedback.Timestamp.Unix(),
+			})
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// toPayload converts a proto notification to a payload and push options.
+func toPayload(notification *apnspushpb.Notification) (apns.Payload, apnsservice.PushOptions, error) {
+	if notification == nil {
+		return apns.Payload{}, apnsservice.PushOptions{}, errors.New("notification is required")
+	}
+	payload := apns.Payload{
+		Token:     notification.GetToken(),
+		AlertText: notification.GetAlert(),
+		Sound:     notification.GetSound(),
+		Category:  notification.GetCategory(),
+	}
+	if notification.Badge != nil {
+		if notification.GetBadge() < 0 {
+			return apns.Payload{}, apnsservice.PushOptions{}, fmt.Errorf("badge %d is negative", notification.GetBadge())
+		}
+		payload.Badge = apns.NewBadgeNumber(uint32(notification.GetBadge()))
+	}
+	if notification.GetContentAvailable() {
+		payload.ContentAvailable = 1
+	}
+	if strCustom := notification.GetCustomJson(); strCustom != "" {
+		if err := json.Unmarshal([]byte(strCustom), &payload.ExtraData); err != nil {
+			return apns.Payload{}, apnsservice.PushOptions{}, fmt.Errorf("custom_json: %s", err.Error())
+		}
+	}
+
+	optsProto := notification.GetOptions()
+	opts := apnsservice.PushOptions{
+		Priority:       int(optsProto.GetPriority()),
+		CollapseID:     optsProto.GetCollapseId(),
+		PushType:       optsProto.GetPushType(),
+		CorrelationID:  optsProto.GetCorrelationId(),
+		Class:          optsProto.GetClass(),
+		IdempotencyKey: optsProto.GetIdempotencyKey(),
+		ApnsID:         optsProto.GetApnsId(),
+		Topic:          optsProto.GetTopic(),
+		UserID:         optsProto.GetUserId(),
+	}
+	if opts.ApnsID == "" {
+		opts.ApnsID = apnsservice.NewApnsID()
+	}
+	if optsProto.GetExpirationUnix() != 0 {
+		opts.Expiration = time.Unix(optsProto.GetExpirationUnix(), 0)
+	}
+	return payload, opts, nil
+}
+
+// toStatus maps an apnsservice error to a gRPC status.
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, apnsservice.ErrAppNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, apnsservice.ErrNotActive), errors.Is(err, apnsservice.ErrQueueFull):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, apnsservice.ErrRateLimited):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, apnsservice.ErrDuplicate):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
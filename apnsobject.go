@@ -4,10 +4,19 @@ package apnsservice
 // No part of this is exposed outside the apnsservice package.
 
 import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	apns "github.com/joekarl/go-libapns"
@@ -15,7 +24,9 @@ import (
 	"github.com/knousere/web-service-commons/utils"
 )
 
-type statusAPNS int
+// statusAPNS is read and written atomically through getStatus and setStatus
+// because pushes read it while close and launch write it.
+type statusAPNS int32
 
 const (
 	apnsUnknown statusAPNS = iota
@@ -24,22 +35,115 @@ const (
 	apnsActive
 )
 
+// String names the status for logs and the admin handler.
+func (s statusAPNS) String() string {
+	switch s {
+	case apnsNoCerts:
+		return "no-certs"
+	case apnsCertsFound:
+		return "closed"
+	case apnsActive:
+		return "active"
+	}
+	return "unknown"
+}
+
+// These are the Apple Binary Protocol gateway ports.
+const (
+	pushPort     = "2195"
+	feedbackPort = "2196"
+)
+
 // connectionAPNS is a structure for managing an APNS connection.
 // It is internal to the apnsservice package.
 type connectionAPNS struct {
-	appID       int    // internal app identifier
-	stringID    string // external app identifier
-	fileLog     io.Writer
-	loggers     map[int]*log.Logger
-	cert        *AppCert
-	cfgAPNS     *apns.APNSConfig
-	cfgFeedback *apns.APNSFeedbackServiceConfig
-	chanDone    chan struct{}
-	chanDoneLog chan struct{}
-	chanSend    chan apns.Payload
-	chanLog     chan *logEntry
-	status      statusAPNS
-	isLogging   bool
+	appID        int    // internal app identifier
+	stringID     string // external app identifier
+	platform     Platform
+	fileLog      io.Writer
+	closerLog    io.Closer           // the log file launch opened, closed with the log listener
+	loggers      map[int]*log.Logger // socket 0 logs for the connection as a whole
+	cert         *AppCert
+	egress       *EgressProfile              // nil for the default network path
+	closeHook    func(*apns.ConnectionClose) // optional observer of close errors
+	options      ConnectionOptions
+	suppressor   *suppressor // nil when suppression is disabled
+	idempotency  *suppressor // keyed by PushOptions.IdempotencyKey
+	classes      *classStats
+	limiter      *rateLimiter   // nil when no rate limit is set
+	schema       *payloadSchema // nil when no payload schema is set
+	health       *healthState
+	breaker      *breaker // nil without a CircuitBreaker
+	pause        *pauseGate
+	queue        *queueCounters
+	cfgAPNS      *apns.APNSConfig
+	cfgFeedback  *apns.APNSFeedbackServiceConfig
+	clientHTTP2  *http.Client   // used instead of cfgAPNS by ProtocolHTTP2 connections
+	signer       *tokenSigner   // set for token-based authentication
+	fcm          *fcmClient     // set for PlatformAndroid connections
+	webPush      *webPushClient // set for PlatformWeb connections
+	urlHTTP2     string
+	chanDone     chan struct{}
+	chanDoneLog  chan struct{}
+	chanSend     chan *notification
+	chanHigh     chan *notification // the high-priority lane, drained before chanSend
+	backlog      *retryBacklog      // pushes to send again, drained before both lanes
+	chanReady    chan *notification // unbuffered; the lane listener hands workers the next push
+	chanLog      chan *logEntry
+	chanAudit    chan AuditRecord // nil without an AuditSink
+	wgWorkers    *sync.WaitGroup
+	closeOnce    *sync.Once // closes chanDone once when workers and callers race to close
+	pool         *socketPool
+	leases       *leaseTracker
+	status       statusAPNS
+	closedByUser int32 // 1 once a caller closed the connection on purpose; the provider sync leaves it closed
+	isLogging    bool
+	logLevel     int32 // a LogLevel, changed at runtime by SetLogLevel
+}
+
+// notification is a structure for passing a payload and its push options
+// through the send channel.
+type notification struct {
+	payload   apns.Payload
+	options   PushOptions
+	body      []byte    // the serialized payload once marshalled, possibly shared
+	lease     *Lease    // set when the notification came from a shared queue
+	deadline  time.Time // the service stops trying after this time; zero for no limit
+	enqueueBy time.Time // push fails with ErrQueueFull if the send channel is still full then
+
+	attempts     int // send attempts, for dead-letter records
+	firstAttempt time.Time
+	lastAttempt  time.Time
+}
+
+// isExpired reports whether the notification's deadline has passed.
+func (n *notification) isExpired() bool {
+	return !n.deadline.IsZero() && time.Now().After(n.deadline)
+}
+
+// applyTTL sets the deadline and, unless one is set, the apns-expiration of a
+// notification with a TTL. An earlier deadline is kept.
+func (n *notification) applyTTL() {
+	if n.options.TTL <= 0 {
+		return
+	}
+	deadline := time.Now().Add(n.options.TTL)
+	if n.deadline.IsZero() || deadline.Before(n.deadline) {
+		n.deadline = deadline
+	}
+	if n.options.Expiration.IsZero() || n.deadline.Before(n.options.Expiration) {
+		n.options.Expiration = n.deadline
+	}
+}
+
+// expire discards a notification whose deadline passed while it waited in
+// the send channel or in backoff, and counts it.
+func (a *connectionAPNS) expire(socketID int, n *notification) {
+	a.logLevelf(LogDebug, socketID, "Deadline passed, dropped %s\n", n.payload.Token)
+	a.classes.count(n.options.Class, classExpired)
+	a.health.recordExpired()
+	a.audit(n, AuditExpired, 0, "")
+	a.settle(n)
 }
 
 // logEntry is a structure for passing a formatted log message
@@ -51,114 +155,502 @@ type logEntry struct {
 
 // launch starts a pair of sockets for an apns object
 // if certs are present. The sockets toggle to minimize blocking.
-func (a *connectionAPNS) launch(isLogging bool) error {
-	utils.Trace.Printf("launch %d, %s, %d", a.appID, a.stringID, int(a.status))
-
-	var err error
+func (a *connectionAPNS) launch(isLogging bool) (err error) {
+	utils.Trace.Printf("launch %d, %s, %d", a.appID, a.stringID, int(a.getStatus()))
 
 	a.isLogging = isLogging
+	a.setLogLevel(a.options.LogLevel)
 
-	switch a.status {
+	switch a.getStatus() {
 	case apnsActive, apnsNoCerts:
 		return nil
 	}
 
-	a.cfgAPNS = &apns.APNSConfig{
-		CertificateBytes: a.cert.Cert,
-		KeyBytes:         a.cert.RSAKey,
-		GatewayHost:      pushURL,
+	if a.fcm == nil && a.webPush == nil && a.options.Mock == nil && !a.isEnqueueOnly() {
+		err = a.cert.check()
+		if err != nil {
+			utils.Warning.Println("Error checking apns cert ", a.stringID, err.Error())
+			return err
+		}
 	}
 
-	a.cfgFeedback = &apns.APNSFeedbackServiceConfig{
-		CertificateBytes: a.cert.Cert,
-		KeyBytes:         a.cert.RSAKey,
-		GatewayHost:      feedbackURL,
-	}
+	a.egress = lookupEgress(a.appID)
+	a.health = &healthState{}
+	a.breaker = newBreaker(a.options.CircuitBreaker)
+	a.pause = &pauseGate{}
+	a.queue = &queueCounters{}
 
-	strLogPath := fmt.Sprintf("logs/apns/%s.txt", a.stringID)
-	a.fileLog, err = os.OpenFile(strLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	var isSharedLog bool
+	a.fileLog, isSharedLog, err = a.openLog(isLogging)
 	if err != nil {
-		utils.Warning.Println("Error opening apns log ", strLogPath, err.Error())
+		utils.Warning.Println("Error opening apns log ", a.stringID, err.Error())
 		return err
 	}
-	feedbackLog := log.New(a.fileLog, "APN: ", log.Ldate|log.Ltime|log.Lshortfile)
+	defer func() {
+		if err != nil {
+			a.closeLog() // the log listener never started
+		}
+	}()
+	// a shared destination needs the app in every entry, as in "APN acme#2: "
+	strLogName, strSocketFormat := "APN", "APN%d: "
+	if isSharedLog {
+		strLogName, strSocketFormat = "APN "+a.stringID, "APN "+a.stringID+"#%d: "
+	}
 
-	err = a.getBadTokens(feedbackLog)
+	if a.cert.hasAuthKey() && a.options.Protocol != ProtocolHTTP2 {
+		return errors.New("token-based authentication requires ProtocolHTTP2")
+	}
+	if a.options.GatewayURL != "" && a.options.Protocol != ProtocolHTTP2 {
+		return errors.New("a gateway URL requires ProtocolHTTP2")
+	}
+	a.schema, err = compileSchema(a.options.PayloadSchema)
 	if err != nil {
-		utils.Warning.Println("Error checking apns feedback ", a.stringID, err.Error())
+		utils.Warning.Println("Error compiling payload schema ", a.stringID, err.Error())
 		return err
 	}
 
+	if a.isEnqueueOnly() {
+		// a producer holds no connection to Apple
+	} else if a.fcm != nil {
+		a.initFCM()
+	} else if a.webPush != nil {
+		a.initWebPush()
+	} else if a.options.Mock != nil {
+		a.options.Mock.attach(a)
+	} else if a.options.Protocol == ProtocolHTTP2 {
+		err = a.initHTTP2()
+		if err != nil {
+			utils.Warning.Println("Error configuring apns http2 ", a.stringID, err.Error())
+			return err
+		}
+	} else {
+		strPushURL, strFeedbackURL := gatewayURLs(a.cert)
+
+		a.cfgAPNS = &apns.APNSConfig{
+			CertificateBytes: a.cert.Cert,
+			KeyBytes:         a.cert.RSAKey,
+			GatewayHost:      strPushURL,
+		}
+
+		a.cfgFeedback = &apns.APNSFeedbackServiceConfig{
+			CertificateBytes: a.cert.Cert,
+			KeyBytes:         a.cert.RSAKey,
+			GatewayHost:      strFeedbackURL,
+		}
+		a.applyTimeouts()
+
+		feedbackLog := log.New(a.fileLog, strLogName+": ", log.Ldate|log.Ltime|log.Lshortfile)
+
+		if a.isFeedbackLeader() {
+			err = a.getBadTokens(feedbackLog)
+			if err != nil {
+				utils.Warning.Println("Error checking apns feedback ", a.stringID, err.Error())
+				return err
+			}
+		} else {
+			feedbackLog.Println("Feedback polled by another instance")
+		}
+	}
+
 	a.chanDone = make(chan struct{})
 	a.chanDoneLog = make(chan struct{})
-	a.chanSend = make(chan apns.Payload, 100)
+	a.chanSend = make(chan *notification, 100)
+	a.chanHigh = make(chan *notification, 100)
+	a.backlog = newRetryBacklog()
+	a.chanReady = make(chan *notification)
 	a.chanLog = make(chan *logEntry, 100)
+	a.wgWorkers = &sync.WaitGroup{}
+	a.closeOnce = &sync.Once{}
 
 	a.loggers = make(map[int]*log.Logger)
+	a.loggers[0] = log.New(a.fileLog, strLogName+": ", log.Ldate|log.Ltime|log.Lshortfile)
+
+	a.suppressor = newSuppressor(a.options.SuppressionWindow)
+	windowIdempotency := a.options.IdempotencyWindow
+	if windowIdempotency <= 0 {
+		windowIdempotency = defaultIdempotencyWindow
+	}
+	a.idempotency = newSuppressor(windowIdempotency)
+	a.classes = newClassStats()
+	a.limiter = newRateLimiter(a.options.RateLimit, a.options.ClassRateLimits)
 
-	for socketID := 1; socketID <= 2; socketID++ {
-		strPrefix := fmt.Sprintf("APN%d: ", socketID)
+	for socketID := 1; socketID <= maxSockets; socketID++ {
+		strPrefix := fmt.Sprintf(strSocketFormat, socketID)
 		a.loggers[socketID] = log.New(a.fileLog, strPrefix, log.Ldate|log.Ltime|log.Lshortfile)
 	}
 
-	for socketID := 1; socketID <= 2; socketID++ {
-		go a.launchSocket(socketID)
+	go a.logListener()
+	a.startAudit()
+
+	if !a.isEnqueueOnly() {
+		a.startWorkers()
 	}
 
-	a.status = apnsActive
+	// stop the log listener once every worker has shut down
+	go func() {
+		a.wgWorkers.Wait()
+		close(a.chanDoneLog)
+	}()
+
+	a.setStatus(apnsActive)
 	return nil
 }
 
+// startWorkers starts the lane listener, the socket workers, the pool policy
+// monitor and, in cooperative mode, the lease listener.
+func (a *connectionAPNS) startWorkers() {
+	a.wgWorkers.Add(1)
+	go a.laneListener()
+	a.pool = &socketPool{mapSockets: make(map[int]*socketState)}
+	intSockets := a.options.Sockets
+	if intSockets <= 0 {
+		intSockets = defaultSockets
+	}
+	for i := 0; i < intSockets; i++ {
+		a.addSocket()
+	}
+	if a.options.SocketPolicy != nil {
+		a.wgWorkers.Add(1)
+		go a.monitorSockets()
+	}
+	if a.options.SharedQueue != nil {
+		a.leases = &leaseTracker{mapLeases: make(map[string]*Lease)}
+		a.wgWorkers.Add(1)
+		go a.leaseListener()
+	}
+}
+
+// getStatus returns the connection status.
+func (a *connectionAPNS) getStatus() statusAPNS {
+	return statusAPNS(atomic.LoadInt32((*int32)(&a.status)))
+}
+
+// setStatus sets the connection status.
+func (a *connectionAPNS) setStatus(status statusAPNS) {
+	atomic.StoreInt32((*int32)(&a.status), int32(status))
+}
+
+// isActive reports whether the connection is launched and not closed.
+func (a *connectionAPNS) isActive() bool {
+	return a.getStatus() == apnsActive
+}
+
+// activeError returns nil for an active connection, ErrNotLaunched for one
+// registered without certs and ErrNotActive for one that was closed.
+func (a *connectionAPNS) activeError() error {
+	switch a.getStatus() {
+	case apnsActive:
+		if a.breaker.isOpen() {
+			return ErrDegraded
+		}
+		return nil
+	case apnsNoCerts:
+		return ErrNotLaunched
+	}
+	return ErrNotActive
+}
+
 // Close shuts down the apns connection by closing the done channel
 func (a *connectionAPNS) close() {
-	if a.status == apnsActive {
-		close(a.chanDone)
-		a.status = apnsCertsFound
+	if atomic.CompareAndSwapInt32((*int32)(&a.status), int32(apnsActive), int32(apnsCertsFound)) {
+		a.closeOnce.Do(func() { close(a.chanDone) })
+	}
+}
+
+// closeOnPurpose closes the connection for a caller that wants it down, so
+// the provider sync does not relaunch it.
+func (a *connectionAPNS) closeOnPurpose() {
+	atomic.StoreInt32(&a.closedByUser, 1)
+	a.close()
+}
+
+// isClosedOnPurpose reports whether a caller closed the connection on purpose.
+func (a *connectionAPNS) isClosedOnPurpose() bool {
+	return atomic.LoadInt32(&a.closedByUser) == 1
+}
+
+// prepare applies the connection's push type defaults and the priority Apple
+// requires for VoIP and background-only pushes, then checks the payload size
+// for HTTP/2 connections. go-libapns applies its own limit to binary connections.
+// The stored badge is injected and the middleware chain runs first, so their
+// changes are checked too, then tokens in the bad token cache are refused
+// and the custom data is validated. It returns the serialized payload of an HTTP/2 APNS
+// push, taken from cache when a fan-out has serialized the same body already.
+func (a *connectionAPNS) prepare(ctx context.Context, payload *apns.Payload, opts *PushOptions, cache *bodyCache) ([]byte, error) {
+	a.injectBadge(payload)
+	if err := a.intercept(ctx, payload, *opts); err != nil {
+		return nil, err
+	}
+	if err := validateClass(opts.Class, a.options.Classes); err != nil {
+		return nil, err
+	}
+	if err := a.checkBadToken(payload.Token); err != nil {
+		return nil, err
+	}
+	if err := a.validateCustomData(payload); err != nil {
+		return nil, err
+	}
+	switch a.platform {
+	case PlatformAndroid:
+		if payload.Token == "" {
+			return nil, fmt.Errorf("%w: token is empty", ErrInvalidToken)
+		}
+		return nil, nil // push types and the size limit are APNS rules
+	case PlatformWeb:
+		return nil, validateWebPush(payload)
+	}
+	if err := validateToken(payload.Token); err != nil {
+		return nil, err
+	}
+	if opts.PushType == "" && a.options.VoIP {
+		opts.PushType = PushTypeVoIP
+	}
+	if opts.PushType == "" && isLiveActivity(payload) {
+		opts.PushType = PushTypeLiveActivity
+	}
+	if opts.PushType == PushTypeLiveActivity && a.options.Protocol != ProtocolHTTP2 {
+		return nil, errors.New("live activity push requires ProtocolHTTP2")
+	}
+	if opts.Topic != "" && a.options.Protocol != ProtocolHTTP2 {
+		return nil, errors.New("a push topic requires ProtocolHTTP2")
+	}
+	if hasApsExtras(payload) && a.options.Protocol != ProtocolHTTP2 {
+		// the binary protocol would drop them, and a critical sound would leave no sound at all
+		return nil, errors.New("aps keys such as thread-id or a critical sound require ProtocolHTTP2")
+	}
+
+	switch {
+	case opts.PushType == PushTypeVoIP:
+		if opts.Priority == PriorityConserve {
+			return nil, errors.New("voip push requires priority 10")
+		}
+		opts.Priority = PriorityImmediate
+	case isBackgroundOnly(payload):
+		if opts.Priority == PriorityImmediate {
+			return nil, errors.New("background push requires priority 5")
+		}
+		opts.Priority = PriorityConserve
+		if opts.PushType == "" {
+			opts.PushType = PushTypeBackground
+		}
+	}
+
+	if a.options.Protocol == ProtocolHTTP2 {
+		limit := MaxPayloadSize
+		if opts.PushType == PushTypeVoIP {
+			limit = MaxVoIPPayloadSize
+		}
+		body, err := cache.marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		return body, checkPayloadSize(payload, body, limit)
+	}
+	return nil, nil
+}
+
+// pushOne pushes one notification into the send channel
+// unless it duplicates a recent notification.
+// Priority and expiration are copied onto the payload for the binary protocol.
+// A rate limit in drop mode returns ErrRateLimited.
+// body is the serialized payload from prepare, or nil.
+func (a *connectionAPNS) pushOne(payload *apns.Payload, opts *PushOptions, body []byte) error {
+	return a.push(newNotification(payload, opts, body))
+}
+
+// push is pushOne for a notification that already carries a deadline.
+// A repeated idempotency key returns ErrDuplicate and a send channel that
+// stays full past the deadline returns ErrQueueFull.
+// A notification that is not queued locally is recycled.
+func (a *connectionAPNS) push(n *notification) error {
+	if n.options.ApnsID == "" {
+		n.options.ApnsID = NewApnsID()
+	}
+	n.applyTTL()
+	strKey := n.options.IdempotencyKey
+	if strKey != "" && a.idempotency.isDuplicateKey(strKey) {
+		a.logLevelf(LogDebug, 0, "Duplicate idempotency key %s to device %s\n", strKey, n.payload.Token)
+		a.classes.count(n.options.Class, classSuppressed)
+		recycle(n)
+		return ErrDuplicate
+	}
+	if a.suppressor != nil && a.suppressor.isDuplicate(&n.payload) {
+		a.logLevelf(LogTrace, 0, "Suppressed duplicate to device %v %s\n", n.payload.ExtraData, n.payload.AlertText)
+		a.classes.count(n.options.Class, classSuppressed)
+		recycle(n)
+		return nil
+	}
+	if strReason := a.checkPreferences(n); strReason != "" {
+		a.mute(n, strReason)
+		a.forgetPush(n)
+		recycle(n)
+		return nil
+	}
+	if err := a.waitRateLimit(n); err != nil {
+		a.logLevelf(LogDebug, 0, "Rate limited %s %s\n", n.payload.Token, err.Error())
+		a.forgetPush(n)
+		recycle(n)
+		return err
+	}
+	a.classes.count(n.options.Class, classPushed)
+	n.payload.Priority = uint8(n.options.Priority)
+	if !n.options.Expiration.IsZero() {
+		n.payload.ExpirationTime = uint32(n.options.Expiration.Unix())
+	}
+	var err error
+	if a.options.SharedQueue != nil {
+		if err = a.activeError(); err == nil {
+			err = a.enqueueShared(n)
+		}
+	} else {
+		err = a.holdOrEnqueue(n)
+	}
+	if err != nil {
+		a.logLevelf(LogWarn, 0, "Not queued %s %s\n", n.payload.Token, err.Error())
+		if err == ErrQueueFull {
+			a.queue.add(&a.queue.full, 1)
+		}
+		a.forgetPush(n)
+		recycle(n)
+		return err
+	}
+	a.queue.add(&a.queue.enqueued, 1)
+	if a.options.SharedQueue != nil {
+		recycle(n) // the shared queue holds an encoded copy
 	}
+	return nil
 }
 
-// pushOne pushes one notification into the send channel.
-func (a *connectionAPNS) pushOne(payload apns.Payload) {
-	if a.status == apnsActive { // safety first
-		a.chanSend <- payload
+// forgetPush releases the idempotency key and the content fingerprint of a
+// push that is muted or returns an error without being queued, so only
+// accepted pushes stay recorded and the caller's retry is not suppressed as a
+// duplicate of it.
+func (a *connectionAPNS) forgetPush(n *notification) {
+	if n.options.IdempotencyKey != "" {
+		a.idempotency.forgetKey(n.options.IdempotencyKey)
+	}
+	if a.suppressor != nil {
+		a.suppressor.forgetPayload(&n.payload)
 	}
 }
 
-// logPrint pushes a log entry.
+// enqueue is requeue for a new notification. It returns ErrNotActive if the
+// connection closes and ErrQueueFull if the send channel stays full past the
+// notification's deadline or enqueueBy.
+func (a *connectionAPNS) enqueue(n *notification) error {
+	if !a.isActive() {
+		return ErrNotActive
+	}
+	chanLane := a.lane(n)
+	select {
+	case chanLane <- n:
+		a.queue.mark(len(chanLane))
+		return nil
+	default:
+	}
+	deadline := n.deadline
+	if !n.enqueueBy.IsZero() && (deadline.IsZero() || n.enqueueBy.Before(deadline)) {
+		deadline = n.enqueueBy
+	}
+	var chanDeadline <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		chanDeadline = timer.C
+	}
+	select {
+	case chanLane <- n:
+		a.queue.mark(len(chanLane))
+		return nil
+	case <-a.chanDone:
+		return ErrNotActive
+	case <-chanDeadline:
+		return ErrQueueFull
+	}
+}
+
+// requeue pushes a notification into the send channel without suppression.
+// It waits for room, so only goroutines other than the workers may call it.
+// It reports false if the connection closes first; n is then the caller's.
+func (a *connectionAPNS) requeue(n *notification) bool {
+	if !a.isActive() { // safety first
+		return false
+	}
+	chanLane := a.lane(n)
+	select {
+	case chanLane <- n:
+		a.queue.mark(len(chanLane))
+		return true
+	case <-a.chanDone:
+		return false
+	}
+}
+
+// retryTimedOut handles a notification a binary socket did not accept within
+// the backoff. The wait counts as an attempt. The notification goes to the
+// retry backlog for any socket to take, or to the dead-letter sink once its
+// retries run out, so a payload taken from the queue is never lost. An
+// expired one is discarded as usual.
+func (a *connectionAPNS) retryTimedOut(socketID int, n *notification) {
+	n.recordAttempt()
+	if n.isExpired() {
+		a.expire(socketID, n)
+		return
+	}
+	if a.options.RetryPolicy.isExhausted(n) {
+		a.deadLetter(socketID, n, ReasonSendTimeout, 0)
+		a.settle(n)
+		return
+	}
+	a.audit(n, AuditRetry, 0, ReasonSendTimeout)
+	a.logLevelf(LogDebug, socketID, "Send timed out, retrying %s\n", n.options.ApnsID)
+	a.retryLater(n)
+}
+
+// pushLog hands an entry to the log listener unless it has shut down.
+func (a *connectionAPNS) pushLog(entry *logEntry) {
+	select {
+	case a.chanLog <- entry:
+	case <-a.chanDoneLog:
+	}
+}
+
+// logPrint pushes an info log entry.
 func (a *connectionAPNS) logPrint(socketID int, args ...interface{}) {
-	if a.isLogging {
+	if a.logsAt(LogInfo) {
 		entry := logEntry{
 			socketID: socketID,
 		}
-		entry.message = fmt.Sprint(args...)
-		a.chanLog <- &entry
+		entry.message = "INFO: " + fmt.Sprint(args...)
+		a.pushLog(&entry)
 	}
 }
 
-// logPrintln pushes a log entry terminated with line break.
+// logPrintln pushes an info log entry terminated with line break.
 func (a *connectionAPNS) logPrintln(socketID int, args ...interface{}) {
-	if a.isLogging {
+	if a.logsAt(LogInfo) {
 		entry := logEntry{
 			socketID: socketID,
 		}
-		entry.message = fmt.Sprintln(args...)
-		a.chanLog <- &entry
+		entry.message = "INFO: " + fmt.Sprintln(args...)
+		a.pushLog(&entry)
 	}
 }
 
-// logPrintf pushes a log entry with string formatting.
+// logPrintf pushes an info log entry with string formatting.
 func (a *connectionAPNS) logPrintf(socketID int, format string, args ...interface{}) {
-	if a.isLogging {
+	if a.logsAt(LogInfo) {
 		entry := logEntry{
 			socketID: socketID,
 		}
-		entry.message = fmt.Sprintf(format, args...)
-		a.chanLog <- &entry
+		entry.message = "INFO: " + fmt.Sprintf(format, args...)
+		a.pushLog(&entry)
 	}
 }
 
 // logListener listens on a.chanLog for entries from a socket
 // and writes to the associated logger.
+// Entries still buffered at shutdown are flushed.
 func (a *connectionAPNS) logListener() {
 	bShutdown := false
 	for {
@@ -172,46 +664,91 @@ func (a *connectionAPNS) logListener() {
 			bShutdown = true
 		}
 	}
+	for {
+		select {
+		case entry := <-a.chanLog:
+			a.loggers[entry.socketID].Print(entry.message)
+		default:
+			a.closeLog()
+			return
+		}
+	}
 }
 
 // launchSocket launches a channel listener.
 // It pulls notifications from the send channel and pushes them through the apns socket
 // until the either the send channel is empty or Apple closes the socket.
 // The done channel shuts down this listener.
-func (a *connectionAPNS) launchSocket(socketID int) {
+func (a *connectionAPNS) launchSocket(socketID int, state *socketState) {
+	defer a.wgWorkers.Done()
 
 	bShutdown := false
 	bConnectionGood := false
 	var connLast *apns.APNSConnection
-	intQueueSize := int(32)
-	intQueueIndex := int(intQueueSize - 1)                           // index into queue
-	payloadQueue := make([]apns.Payload, intQueueSize, intQueueSize) // circular queue of recent payloads
-	exponentialBackoff := int(1)                                     // number of seconds between sending retries
-	const backoffLimit = 128
+	intQueueSize := a.options.PayloadCacheSize
+	if intQueueSize <= 0 {
+		intQueueSize = defaultPayloadCacheSize
+	}
+	intQueueIndex := int(intQueueSize - 1)                            // index into queue
+	payloadQueue := make([]*notification, intQueueSize, intQueueSize) // circular queue of recent payloads
+	intFailures := 0                                                  // consecutive transient failures, for backoff
+	intDialFailures := 0
+	policy := a.options.RetryPolicy
+	var timeConnected time.Time
+	var timerIdle *time.Timer // re-dials a socket idle for IdleReconnect
+	var chanIdle <-chan time.Time
+	if a.options.IdleReconnect > 0 {
+		timerIdle = time.NewTimer(a.options.IdleReconnect)
+		defer timerIdle.Stop()
+		chanIdle = timerIdle.C
+	}
 
 	for { // loop until shutdown is declared
 		if bShutdown {
 			a.logPrintln(socketID, "Breaking the for loop, shutdown")
 			break
 		}
+		if !a.parkOpen(socketID, state.chanStop) {
+			bShutdown = true
+			continue
+		}
 
 		a.logPrint(socketID, "Establishing connection")
-		connAPNS, err := apns.NewAPNSConnection(a.cfgAPNS)
+		timeDial := time.Now()
+		connAPNS, err := a.connect()
+		state.recordDial(time.Since(timeDial), err == nil)
 
 		if err == nil { // is connection good?
 			connLast = connAPNS
 			bConnectionGood = true
+			intDialFailures = 0
+			state.setFailures(intFailures)
+			timeConnected = time.Now()
+			resetTimer(timerIdle, a.options.IdleReconnect)
 			a.logPrintln(socketID, "Connection established")
+			a.event(socketID, EventConnected, "")
+		} else if policy.classify(Failure{Err: err}) == RetryFatal && a.breaker == nil {
+			bConnectionGood = false
+			a.fail(socketID, err.Error())
+			bShutdown = true
 		} else {
 			bConnectionGood = false
-			a.logPrintf(socketID, " Error: %s\n", err.Error())
+			a.logLevelf(LogWarn, socketID, " Error: %s\n", err.Error())
+			a.health.recordError(err.Error())
+			a.event(socketID, EventError, err.Error())
+			a.breakerFailure(socketID, err.Error())
+			state.setFailures(intDialFailures + 1)
 
 			select {
-			case <-time.After(time.Second * 5):
+			case <-time.After(policy.delay(intDialFailures)):
+				intDialFailures++
 				continue
 			case <-a.chanDone:
 				a.logPrintln(socketID, "Received done close")
 				bShutdown = true
+			case <-state.chanStop:
+				a.logPrintln(socketID, "Socket removed")
+				bShutdown = true
 			}
 		}
 
@@ -219,18 +756,38 @@ func (a *connectionAPNS) launchSocket(socketID int) {
 			if !bConnectionGood || bShutdown {
 				break
 			}
+			if !a.waitResumed(socketID, state.chanStop) {
+				connAPNS.Disconnect()
+				bShutdown = true
+				break
+			}
 
 			select { // either process a payload or handle the exception
-			case payload := <-a.chanSend:
-				a.logPrintf(socketID, "Push to device %v %s\n", payload.ExtraData, payload.AlertText)
+			case n := <-a.chanReady:
+				if n.isExpired() {
+					a.expire(socketID, n)
+					break
+				}
+				a.logLevelf(LogTrace, socketID, "Push %s to device %v %s\n", n.options.ApnsID, n.payload.ExtraData, n.payload.AlertText)
 
+				timeSend := time.Now()
 				select {
-				case <-time.After(time.Duration(exponentialBackoff) * time.Second):
+				case <-time.After(policy.delay(intFailures)):
+					a.retryTimedOut(socketID, n)
 					break
-				case connAPNS.SendChannel <- &payload: // send it and queue it
+				case connAPNS.SendChannel <- &n.payload: // send it and queue it
+					n.recordAttempt()
+					state.recordSend(time.Since(timeSend))
+					a.classes.count(n.options.Class, classSent)
+					a.audit(n, AuditSent, 0, "")
+					a.settle(n)
+					resetTimer(timerIdle, a.options.IdleReconnect)
 					intQueueIndex = (intQueueIndex + 1) % intQueueSize
-					payloadQueue[intQueueIndex] = payload
-					exponentialBackoff = 1
+					payloadQueue[intQueueIndex] = n
+					if intFailures != 0 {
+						intFailures = 0
+						state.setFailures(0)
+					}
 					break
 				}
 				break
@@ -240,12 +797,46 @@ func (a *connectionAPNS) launchSocket(socketID int) {
 				// 1. Apple is verifying the socket. (every 2 hours)
 				// 2. The connection was established with an incorrect cert. (EOF comes on every try.)
 				a.logPrintln(socketID, "Received error, closing connection")
-				if exponentialBackoff < backoffLimit {
-					exponentialBackoff = exponentialBackoff * 2
+				strClose := "connection closed by Apple"
+				if closeError.Error != nil {
+					strClose = closeError.Error.ErrorString
+				}
+				if a.isTransientClose(closeError) {
+					intFailures++
+					state.setFailures(intFailures)
+					if time.Since(timeConnected) < breakerStable {
+						a.breakerFailure(socketID, strClose)
+					}
+				}
+				if time.Since(timeConnected) >= breakerStable {
+					a.breaker.recordSuccess()
 				}
+				a.health.recordError(strClose)
+				a.event(socketID, EventDisconnected, strClose)
 				a.handleCloseError(closeError, socketID, &payloadQueue, intQueueIndex)
+				state.setConnected(false)
 				bConnectionGood = false
 				break
+			case <-chanIdle:
+				a.logPrintln(socketID, "Connection idle, re-dialing")
+				a.event(socketID, EventDisconnected, "idle")
+				connAPNS.Disconnect()
+				a.drainClose(connAPNS, socketID, &payloadQueue, intQueueIndex)
+				connLast = nil
+				state.setConnected(false)
+				bConnectionGood = false
+			case <-state.chanRedial:
+				a.logPrintln(socketID, "Re-dialing connection")
+				a.event(socketID, EventDisconnected, "redial")
+				connAPNS.Disconnect()
+				a.drainClose(connAPNS, socketID, &payloadQueue, intQueueIndex)
+				connLast = nil
+				state.setConnected(false)
+				bConnectionGood = false
+			case <-state.chanStop:
+				a.logPrintln(socketID, "Socket removed. Closing connection.")
+				connAPNS.Disconnect()
+				bShutdown = true
 			case <-a.chanDone:
 				a.logPrintln(socketID, "Done channel is closed. Closing connection.")
 				connAPNS.Disconnect()
@@ -255,59 +846,116 @@ func (a *connectionAPNS) launchSocket(socketID int) {
 	}
 
 	if connLast != nil {
-		select {
-		case <-time.After(time.Second * 5):
-			a.logPrint(socketID, ".")
-			break
-		case closeError := <-connLast.CloseChannel:
-			a.logPrintln(socketID, "Closing channel")
-			a.handleCloseError(closeError, socketID, &payloadQueue, intQueueIndex)
-		}
+		a.drainClose(connLast, socketID, &payloadQueue, intQueueIndex)
 	}
 	a.logPrintln(socketID, "Shutting down apns service")
-	if bShutdown {
-		close(a.chanDoneLog)
+}
+
+// drainClose waits briefly for the close error of a disconnected socket
+// so unsent payloads can be resent through another socket.
+func (a *connectionAPNS) drainClose(connAPNS *apns.APNSConnection, socketID int,
+	queue *[]*notification, intCurrentIdx int) {
+
+	select {
+	case <-time.After(time.Second * 5):
+		a.logLevelf(LogTrace, socketID, ".")
+	case closeError := <-connAPNS.CloseChannel:
+		a.logPrintln(socketID, "Closing channel")
+		a.handleCloseError(closeError, socketID, queue, intCurrentIdx)
 	}
 }
 
 // handleCloseError handles feedback after Apple closes the connection.
 func (a *connectionAPNS) handleCloseError(closeError *apns.ConnectionClose, socketID int,
-	queue *[]apns.Payload, intCurrentIdx int) {
+	queue *[]*notification, intCurrentIdx int) {
 
-	a.logPrintln(socketID, "CloseError: ", closeError.Error)
+	a.logLevelf(LogWarn, socketID, "CloseError: %v\n", closeError.Error)
+	if a.closeHook != nil {
+		a.closeHook(closeError)
+	}
 	intUnsentCount := closeError.UnsentPayloads.Len()
-	// do something here with unsent payloads
 	if intUnsentCount > 0 {
-		a.logPrintf(socketID, "List length %d, Overflow %v\n",
+		a.logLevelf(LogDebug, socketID, "List length %d, Overflow %v\n",
 			closeError.UnsentPayloads.Len(),
 			closeError.UnsentPayloadBufferOverflow)
 	}
 	if closeError.ErrorPayload != nil {
 		payload := closeError.ErrorPayload
-		a.logPrintf(socketID, "Payload %v %s %s\n%s\n",
+		a.logLevelf(LogTrace, socketID, "Payload %v %s %s\n%s\n",
 			payload.ExtraData,
 			payload.Category,
 			payload.AlertText,
 			payload.Token)
 	}
+	if isPayloadRejection(closeError) {
+		n := findQueued(*queue, closeError.ErrorPayload)
+		if n == nil {
+			n = &notification{payload: *closeError.ErrorPayload}
+		}
+		a.deadLetter(socketID, n, closeError.Error.ErrorString, int(closeError.Error.Status))
+	}
+
+	if a.options.UnsentHandler != nil && (intUnsentCount > 0 || closeError.ErrorPayload != nil) &&
+		a.options.UnsentHandler(newUnsentBatch(a, socketID, closeError)) {
+		a.logPrintf(socketID, "UnsentHandler took %d unsent payloads\n", intUnsentCount)
+		if closeError.UnsentPayloadBufferOverflow {
+			a.reportOverflow(socketID, intUnsentCount, cap(*queue), 0, true)
+		}
+		return
+	}
+
+	if intUnsentCount > 0 || closeError.UnsentPayloadBufferOverflow {
+		intQueueSize := cap(*queue)
+		intDropped := 0
+		if intUnsentCount > intQueueSize {
+			intDropped = intUnsentCount - intQueueSize
+		}
+		if intDropped > 0 || closeError.UnsentPayloadBufferOverflow {
+			a.reportOverflow(socketID, intUnsentCount, intQueueSize, intDropped, closeError.UnsentPayloadBufferOverflow)
+		}
+	}
 
 	if intUnsentCount > 0 {
 		intQueueSize := cap(*queue)
 		if intUnsentCount > intQueueSize {
-			// prevent circular queue underflow
+			// prevent circular queue underflow; the oldest unsent payloads cannot be resent
+			e := closeError.UnsentPayloads.Front()
+			for i := intQueueSize; i < intUnsentCount && e != nil; i++ {
+				if payload, ok := e.Value.(*apns.Payload); ok {
+					a.deadLetter(socketID, &notification{payload: *payload}, ReasonCacheOverflow, 0)
+				}
+				e = e.Next()
+			}
 			intUnsentCount = intQueueSize
 		}
 		for i := intUnsentCount; i > 0; i-- {
 			intIdx := (intCurrentIdx + intQueueSize - i + 1) % intQueueSize
-			payload := (*queue)[intIdx]
-			a.pushOne(payload)
+			n := (*queue)[intIdx]
+			if n == nil {
+				continue
+			}
+			if a.options.RetryPolicy.isExhausted(n) {
+				a.deadLetter(socketID, n, ReasonRetriesExhausted, 0)
+				continue
+			}
+			a.retryLater(n)
 		}
 	}
 }
 
+// isTransientClose reports whether a close error should grow the backoff.
+// A rejected payload says nothing about the health of the connection.
+func (a *connectionAPNS) isTransientClose(closeError *apns.ConnectionClose) bool {
+	if closeError.Error == nil {
+		return true
+	}
+	failure := Failure{Status: int(closeError.Error.Status), Reason: closeError.Error.ErrorString}
+	return a.options.RetryPolicy.classify(failure) == RetryTransient
+}
+
 // getBadTokens gets list of recent bad tokens from Apple.
 func (a *connectionAPNS) getBadTokens(apnLog *log.Logger) error {
-	listResponse, err := apns.ConnectToFeedbackService(a.cfgFeedback)
+	listResponse, err := a.connectFeedback()
 
 	if err == nil {
 		apnLog.Println("getBadTokens listResponse len", listResponse.Len())
@@ -317,6 +965,7 @@ func (a *connectionAPNS) getBadTokens(apnLog *log.Logger) error {
 				if ok == true {
 					ts := time.Unix(int64(feedback.Timestamp), 0)
 					apnLog.Println("TimeStamp and Token", ts, feedback.Token)
+					a.removeFeedbackToken(feedback.Token, ts)
 				}
 			}
 		}
@@ -325,3 +974,78 @@ func (a *connectionAPNS) getBadTokens(apnLog *log.Logger) error {
 	}
 	return err
 }
+
+// connect opens an apns connection, through the app's egress profile if one is assigned.
+func (a *connectionAPNS) connect() (*apns.APNSConnection, error) {
+	if !a.dialsItself() {
+		return apns.NewAPNSConnection(a.cfgAPNS)
+	}
+	conn, err := a.dialTLS(a.cfgAPNS.GatewayHost, pushPort)
+	if err != nil {
+		return nil, err
+	}
+	return apns.SocketAPNSConnection(conn, a.cfgAPNS), nil
+}
+
+// connectFeedback reads the feedback service, through the app's egress profile if one is assigned.
+func (a *connectionAPNS) connectFeedback() (*list.List, error) {
+	if !a.dialsItself() {
+		return apns.ConnectToFeedbackService(a.cfgFeedback)
+	}
+	conn, err := a.dialTLS(a.cfgFeedback.GatewayHost, feedbackPort)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return readFeedback(conn)
+}
+
+// dialTLS dials host, through the egress profile if one is assigned, and
+// completes a TLS handshake with the app cert.
+func (a *connectionAPNS) dialTLS(host string, port string) (net.Conn, error) {
+	x509Cert, err := tls.X509KeyPair(a.cert.Cert, a.cert.RSAKey)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialGateway(context.Background(), a.egress, a.options, net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	cfgTLS := &tls.Config{
+		Certificates: []tls.Certificate{x509Cert},
+		ServerName:   host,
+	}
+	a.egress.applyTLS(cfgTLS)
+	connTLS := tls.Client(conn, cfgTLS)
+	connTLS.SetDeadline(time.Now().Add(a.options.connectTimeout()))
+	if err = connTLS.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	connTLS.SetDeadline(time.Time{})
+	return connTLS, nil
+}
+
+// readFeedback decodes feedback tuples until Apple closes the socket.
+// Each tuple is a 4 byte timestamp, a 2 byte token length and the token.
+func readFeedback(conn net.Conn) (*list.List, error) {
+	listResponse := list.New()
+	header := make([]byte, 6)
+	for {
+		conn.SetReadDeadline(time.Now().Add(egressDialTimeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err == io.EOF {
+				return listResponse, nil
+			}
+			return listResponse, err
+		}
+		token := make([]byte, binary.BigEndian.Uint16(header[4:]))
+		if _, err := io.ReadFull(conn, token); err != nil {
+			return listResponse, err
+		}
+		listResponse.PushBack(&apns.FeedbackResponse{
+			Timestamp: binary.BigEndian.Uint32(header[:4]),
+			Token:     hex.EncodeToString(token),
+		})
+	}
+}
@@ -4,62 +4,235 @@ package apnsservice
 // to be called from main or any api handler that uses push notifications.
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	apns "github.com/joekarl/go-libapns"
 	"github.com/knousere/web-service-commons/utils"
 )
 
 // AppCert is a structure for passing RSA certificate associated with an App.
 // If IsDev is non-zero then the cert is only valid for sandbox connections.
+// For token-based authentication set AuthKey to the PEM encoded p8 key with
+// its KeyID and TeamID instead of Cert and RSAKey. Token-based authentication
+// requires ProtocolHTTP2.
 type AppCert struct {
-	AppID  int    `json:"appId"`
-	IsDev  int    `json:"isDev"`
-	Cert   []byte `json:"cert"`
-	RSAKey []byte `json:"rsaKey"`
+	AppID   int    `json:"appId"`
+	IsDev   int    `json:"isDev"`
+	Cert    []byte `json:"cert"`
+	RSAKey  []byte `json:"rsaKey"`
+	AuthKey []byte `json:"authKey,omitempty"`
+	KeyID   string `json:"keyId,omitempty"`
+	TeamID  string `json:"teamId,omitempty"`
 }
 
-// mapAPNS stores all available APNS channels keyed by appID.
-var mapAPNS map[int]*connectionAPNS
+// mapAPNS stores all available push channels keyed by appID and platform.
+// mutexAPNS guards mapAPNS so apps can be added and removed while the service is live.
+// registryGeneration counts changes to mapAPNS so stale reload plans can be detected.
+//
+// Concurrency guarantees: every exported function is safe to call from any
+// goroutine. Lookups take the read lock only long enough to fetch the
+// connection, and a connection is launched and closed outside the lock, so a
+// slow launch never blocks pushes to other apps. A push racing with the close
+// of its connection either is accepted before the close or fails with ErrNotActive.
+var (
+	mutexAPNS          sync.RWMutex
+	mapAPNS            map[appKey]*connectionAPNS
+	registryGeneration uint64
+)
 
 func init() {
-	mapAPNS = make(map[int]*connectionAPNS)
+	mapAPNS = make(map[appKey]*connectionAPNS)
+}
+
+// Platform names the push service of a connection.
+type Platform string
+
+// These are the supported platforms.
+const (
+	PlatformIOS     Platform = "ios"     // Apple Push Notification service
+	PlatformAndroid Platform = "android" // Firebase Cloud Messaging
+	PlatformWeb     Platform = "web"     // Web Push with VAPID
+)
+
+// listPlatforms lists every platform a connection may be registered under.
+var listPlatforms = []Platform{PlatformIOS, PlatformAndroid, PlatformWeb}
+
+// isKnownPlatform reports whether platform is in listPlatforms.
+func isKnownPlatform(platform Platform) bool {
+	for _, known := range listPlatforms {
+		if platform == known {
+			return true
+		}
+	}
+	return false
+}
+
+// appKey is the key of a connection in mapAPNS.
+type appKey struct {
+	appID    int
+	platform Platform
 }
 
-// These are Apple push notification URLs applied to all instances of connectionAPNS.
-var pushURL string
-var feedbackURL string
+// These are the Apple push notification hosts for each environment.
+const (
+	pushURLProduction     = "gateway.push.apple.com"
+	feedbackURLProduction = "feedback.push.apple.com"
+	pushURLSandbox        = "gateway.sandbox.push.apple.com"
+	feedbackURLSandbox    = "feedback.sandbox.push.apple.com"
+)
+
+// These are the registry lookup errors returned by the push functions.
+var (
+	ErrAppNotFound = errors.New("app is not registered")
+	ErrNotActive   = errors.New("app connection is not active")
+)
 
-// InitURLs initializes the APNS gateway URLs.
+// These errors classify launch and push failures for errors.Is.
+// ErrNotLaunched also matches ErrNotActive, and a *PayloadSizeError matches ErrPayloadTooLarge.
+var (
+	ErrNoCert          = errors.New("app has no certificate or auth key")
+	ErrCertExpired     = errors.New("app certificate has expired")
+	ErrNotLaunched     = fmt.Errorf("app connection was never launched: %w", ErrNotActive)
+	ErrQueueFull       = errors.New("send queue is full")
+	ErrPayloadTooLarge = errors.New("payload is too large")
+	ErrInvalidToken    = errors.New("invalid device token")
+)
+
+// isDevServer forces every connection to the sandbox gateway.
+var isDevServer bool
+
+// InitURLs declares whether this server is a development server.
+// A development server sends every app through the sandbox gateway.
+// Otherwise each connection chooses its gateway from AppCert.IsDev,
+// so sandbox and production connections can coexist in one process.
 // Run this once from main before launching any connections.
-// This server is either production or development.
 func InitURLs(isDev bool) {
-	if isDev {
-		pushURL = "gateway.sandbox.push.apple.com"
-		feedbackURL = "feedback.sandbox.push.apple.com"
-	} else {
-		pushURL = "gateway.push.apple.com"
-		feedbackURL = "feedback.push.apple.com"
+	isDevServer = isDev
+}
+
+// gatewayURLs returns the push and feedback hosts for an app cert.
+func gatewayURLs(appCert *AppCert) (string, string) {
+	if isDevServer || appCert.IsDev != 0 {
+		return pushURLSandbox, feedbackURLSandbox
 	}
+	return pushURLProduction, feedbackURLProduction
 }
 
 // LaunchConnection creates an initialized apns connection
 // and adds it to the map if push is enabled for this app.
-// Call this from main for each app.
+// Call this from main for each app. An existing connection for the app is replaced.
+//
+// Deprecated: use LaunchConnectionWithOptions, which takes typed options
+// instead of the isPushEnabled and AppCert.IsDev int flags.
 func LaunchConnection(appID int, appString string, isPushEnabled int, appCert AppCert, isLogging bool) error {
 	if isPushEnabled == 1 {
-		connectionAPNS := newConnection(appID, appString, &appCert)
-		err := connectionAPNS.launch(isLogging)
-		if err != nil {
-			utils.Warning.Println("connectionAPNS.launch()", appString, err.Error())
-			return err
+		return registerConnection(appID, appString, appCert, isLogging, true)
+	}
+
+	return nil
+}
+
+// AddApp launches a connection for an app while the service is live,
+// for example when an admin API onboards a new app.
+// It fails if the app already has an active connection.
+func AddApp(appID int, appString string, appCert AppCert, isLogging bool) error {
+	if connectionAPNS := getConnection(appID); connectionAPNS != nil && connectionAPNS.isActive() {
+		return fmt.Errorf("app %d is already registered", appID)
+	}
+	return registerConnection(appID, appString, appCert, isLogging, false)
+}
+
+// RemoveApp closes the connections for an app and removes them from the map
+// while the service is live. It removes the app on every platform: iOS,
+// Android and Web Push.
+func RemoveApp(appID int) error {
+	stopCertWatch(appID)
+
+	isRemoved := false
+	for _, platform := range listPlatforms {
+		if removeConnection(appKey{appID, platform}) {
+			isRemoved = true
 		}
+	}
+	if !isRemoved {
+		return fmt.Errorf("app %d: %w", appID, ErrAppNotFound)
+	}
+	return nil
+}
+
+// removeConnection closes the connection stored under key and removes it from
+// the map. It reports whether one was registered.
+func removeConnection(key appKey) bool {
+	mutexAPNS.Lock()
+	connectionAPNS := mapAPNS[key]
+	if connectionAPNS != nil {
+		delete(mapAPNS, key)
+		registryGeneration++
+	}
+	mutexAPNS.Unlock()
+
+	if connectionAPNS == nil {
+		return false
+	}
+	connectionAPNS.close()
+	go connectionAPNS.handOver()
+	utils.Info.Println(connectionAPNS.stringID, connectionAPNS.platform, " connection removed")
+	return true
+}
+
+// registerConnection launches a connection and stores it in the map.
+// The launch happens outside the lock so pushes to other apps are not blocked.
+// If isReplace is false and another caller registered the app first, the new connection is discarded.
+func registerConnection(appID int, appString string, appCert AppCert, isLogging bool, isReplace bool) error {
+	connectionAPNS := newConnection(appID, appString, &appCert)
+	return storeConnection(&connectionAPNS, isLogging, isReplace)
+}
+
+// storeConnection launches a new connection and stores it in the map under its appID and platform.
+func storeConnection(connectionAPNS *connectionAPNS, isLogging bool, isReplace bool) error {
+	err := connectionAPNS.launch(isLogging)
+	if err != nil {
+		utils.Warning.Println("connectionAPNS.launch()", connectionAPNS.stringID, err.Error())
+		return err
+	}
 
-		mapAPNS[appID] = &connectionAPNS
-		utils.Info.Println(appString, " connection status=", connectionAPNS.status)
+	key := appKey{connectionAPNS.appID, connectionAPNS.platform}
+	mutexAPNS.Lock()
+	existing := mapAPNS[key]
+	if !isReplace && existing != nil && existing.isActive() {
+		mutexAPNS.Unlock()
+		connectionAPNS.close()
+		return fmt.Errorf("app %d is already registered for %s", key.appID, key.platform)
 	}
+	mapAPNS[key] = connectionAPNS
+	registryGeneration++
+	mutexAPNS.Unlock()
 
+	if existing != nil {
+		existing.close()
+		go existing.handOver()
+	}
+	utils.Info.Println(connectionAPNS.stringID, connectionAPNS.platform, " connection status=", connectionAPNS.getStatus())
 	return nil
 }
 
+// getConnection returns the registered APNS connection for appID or nil.
+// It does not consult the AppConfigProvider; see resolveConnection.
+func getConnection(appID int) *connectionAPNS {
+	return getPlatformConnection(appID, PlatformIOS)
+}
+
+// getPlatformConnection returns the registered connection for appID on platform or nil.
+func getPlatformConnection(appID int, platform Platform) *connectionAPNS {
+	mutexAPNS.RLock()
+	defer mutexAPNS.RUnlock()
+	return mapAPNS[appKey{appID, platform}]
+}
+
 // newConnection returns a connectionAPNS instance
 func newConnection(appID int, stringID string, appCert *AppCert) connectionAPNS {
 	status := apnsNoCerts
@@ -69,32 +242,305 @@ func newConnection(appID int, stringID string, appCert *AppCert) connectionAPNS
 	return connectionAPNS{
 		appID:     appID,
 		stringID:  stringID,
+		platform:  PlatformIOS,
 		status:    status,
 		cert:      appCert,
 		isLogging: true,
+		options:   lookupOptions(appID),
+	}
+}
+
+// These are the apns-priority values.
+// PriorityConserve lets Apple deliver the notification when it saves device power.
+const (
+	PriorityImmediate = 10
+	PriorityConserve  = 5
+)
+
+// maxCollapseIDLength is Apple's limit for apns-collapse-id in bytes.
+const maxCollapseIDLength = 64
+
+// PushOptions holds the per-notification delivery options.
+// The zero value lets Apple apply its defaults.
+type PushOptions struct {
+	Priority   int           `json:"priority,omitempty"`   // PriorityImmediate, PriorityConserve or 0 for Apple's default
+	Expiration time.Time     `json:"expiration,omitempty"` // Apple stops retrying after this time; zero for Apple's default
+	TTL        time.Duration `json:"ttl,omitempty"`        // the service discards the payload once this has passed since the push
+	CollapseID string        `json:"collapseId,omitempty"` // replaces a displayed notification with the same id (HTTP/2 only)
+	PushType   string        `json:"pushType,omitempty"`   // apns-push-type header, e.g. PushTypeBackground (HTTP/2 only)
+	Topic      string        `json:"topic,omitempty"`      // apns-topic for this push, e.g. the watch app's bundle id (HTTP/2 only)
+
+	CorrelationID  string `json:"correlationId,omitempty"`  // caller's id, copied into dead-letter records
+	IdempotencyKey string `json:"idempotencyKey,omitempty"` // a repeat within IdempotencyWindow returns ErrDuplicate
+	Class          string `json:"class,omitempty"`          // notification class such as order_update, for stats and policy
+	ApnsID         string `json:"apnsId,omitempty"`         // apns-id, a UUID that traces the push; generated when empty
+	UserID         string `json:"userId,omitempty"`         // the user pushed to, for the PreferenceStore; PushToUser sets it
+	Expedited      bool   `json:"expedited,omitempty"`      // queue in the high-priority lane ahead of normal pushes
+}
+
+// UnmarshalJSON accepts TTL as a string such as "1h" or as nanoseconds.
+func (o *PushOptions) UnmarshalJSON(data []byte) error {
+	type plain PushOptions
+	return unmarshalDurations(data, (*plain)(o))
+}
+
+// These are the apns-push-type values.
+const (
+	PushTypeAlert        = "alert"
+	PushTypeBackground   = "background"
+	PushTypeVoIP         = "voip"
+	PushTypeLiveActivity = "liveactivity"
+)
+
+// validate checks the options against Apple's accepted values.
+func (o PushOptions) validate() error {
+	switch o.Priority {
+	case 0, PriorityConserve, PriorityImmediate:
+	default:
+		return fmt.Errorf("invalid priority %d", o.Priority)
+	}
+	if o.TTL < 0 {
+		return errors.New("ttl is negative")
+	}
+	if len(o.CollapseID) > maxCollapseIDLength {
+		return errors.New("collapse id exceeds 64 bytes")
+	}
+	if o.ApnsID != "" && !isApnsID(o.ApnsID) {
+		return errors.New("apns id is not a UUID")
+	}
+	return nil
+}
+
+// lookupActive returns the active connection for appID, launching it from
+// the AppConfigProvider if one is set and the app is not registered yet.
+func lookupActive(appID int) (*connectionAPNS, error) {
+	connectionAPNS := resolveConnection(appID)
+	if connectionAPNS == nil {
+		return nil, ErrAppNotFound
 	}
+	if err := connectionAPNS.activeError(); err != nil {
+		return nil, err
+	}
+	return connectionAPNS, nil
 }
 
 // PushOne pushes one notification for the specified app.
-func PushOne(appID int, payload apns.Payload) {
-	connectionAPNS := mapAPNS[appID]
-	if connectionAPNS != nil {
-		connectionAPNS.pushOne(payload)
+// It is safe to call concurrently with AddApp and RemoveApp.
+// An app not yet registered is launched from the AppConfigProvider if one is set.
+// It returns ErrAppNotFound or ErrNotActive if the app cannot push.
+// Errors are also logged, so callers that run it with go lose nothing.
+func PushOne(appID int, payload apns.Payload) error {
+	connectionAPNS, err := lookupActive(appID)
+	if err == nil {
+		opts := PushOptions{}
+		var body []byte
+		body, err = connectionAPNS.prepare(context.Background(), &payload, &opts, nil)
+		if err == nil {
+			err = connectionAPNS.pushOne(&payload, &opts, body)
+		}
+	}
+	if err != nil {
+		utils.Warning.Println("PushOne", appID, err.Error())
+	}
+	return err
+}
+
+// PushOneWithOptions pushes one notification for the specified app
+// with a priority, expiration, collapse id or push type.
+// It returns ErrAppNotFound or ErrNotActive if the app cannot push and
+// ErrRateLimited when the app's rate limit drops the push.
+// Background-only and VoIP pushes get the priority Apple requires for them.
+func PushOneWithOptions(appID int, payload apns.Payload, opts PushOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	connectionAPNS, err := lookupActive(appID)
+	if err != nil {
+		return err
+	}
+	body, err := connectionAPNS.prepare(context.Background(), &payload, &opts, nil)
+	if err != nil {
+		return err
+	}
+	return connectionAPNS.pushOne(&payload, &opts, body)
+}
+
+// PushOneWithID is PushOneWithOptions that returns the push's apns-id.
+// The id appears in the app log, the audit trail and dead-letter records.
+func PushOneWithID(appID int, payload apns.Payload, opts PushOptions) (string, error) {
+	if opts.ApnsID == "" {
+		opts.ApnsID = NewApnsID()
+	}
+	return opts.ApnsID, PushOneWithOptions(appID, payload, opts)
+}
+
+// PushOneContext pushes one notification for the specified app and bounds its
+// delivery by the context deadline. The deadline caps apns-expiration and the
+// service drops the payload instead of sending it after the deadline.
+// A context that is already done returns its error.
+func PushOneContext(ctx context.Context, appID int, payload apns.Payload, opts PushOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	connectionAPNS, err := lookupActive(appID)
+	if err != nil {
+		return err
+	}
+	return connectionAPNS.pushContext(ctx, &payload, &opts, nil)
+}
+
+// BatchPush is one entry of a PushMany batch.
+type BatchPush struct {
+	Payload apns.Payload
+	Options PushOptions
+}
+
+// PushMany pushes a batch for one app as PushOneContext would push each entry.
+// Entries whose payloads differ only by token share one serialized body, so a
+// fan-out of one payload to many devices is marshalled once. It returns the
+// apns-id of each accepted entry and the error of each failed one by index;
+// errs is nil when every entry was accepted.
+func PushMany(ctx context.Context, appID int, listPushes []BatchPush) (listApnsIDs []string, errs []error) {
+	listApnsIDs = make([]string, len(listPushes))
+	connectionAPNS, err := lookupActive(appID)
+	cache := &bodyCache{}
+	for i := range listPushes {
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			if errs == nil {
+				errs = make([]error, len(listPushes))
+			}
+			for ; i < len(listPushes); i++ {
+				errs[i] = err
+			}
+			break
+		}
+		opts := listPushes[i].Options
+		if opts.ApnsID == "" {
+			opts.ApnsID = NewApnsID()
+		}
+		payload := listPushes[i].Payload
+		if errPush := connectionAPNS.pushContext(ctx, &payload, &opts, cache); errPush != nil {
+			if errs == nil {
+				errs = make([]error, len(listPushes))
+			}
+			errs[i] = errPush
+			continue
+		}
+		listApnsIDs[i] = opts.ApnsID
+	}
+	return listApnsIDs, errs
+}
+
+// pushContext validates, prepares and pushes one notification bounded by the
+// context deadline. cache is shared by the entries of a fan-out or nil.
+func (a *connectionAPNS) pushContext(ctx context.Context, payload *apns.Payload, opts *PushOptions, cache *bodyCache) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline && (opts.Expiration.IsZero() || deadline.Before(opts.Expiration)) {
+		opts.Expiration = deadline
+	}
+	body, err := a.prepare(ctx, payload, opts, cache)
+	if err != nil {
+		return err
+	}
+	n := newNotification(payload, opts, body)
+	if hasDeadline {
+		n.deadline = deadline
+	}
+	return a.push(n)
+}
+
+// TryPushOne is PushOneWithOptions for request paths that must not stall.
+// It returns ErrQueueFull at once if the send channel is full and
+// ErrRateLimited if the rate limit would make it wait.
+func TryPushOne(appID int, payload apns.Payload, opts PushOptions) error {
+	return PushOneTimeout(appID, payload, opts, 0)
+}
+
+// PushOneTimeout is PushOneWithOptions that waits at most timeout for room
+// in the send channel, or for the rate limit, and then returns ErrQueueFull
+// or ErrRateLimited.
+func PushOneTimeout(appID int, payload apns.Payload, opts PushOptions, timeout time.Duration) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	connectionAPNS, err := lookupActive(appID)
+	if err != nil {
+		return err
+	}
+	body, err := connectionAPNS.prepare(context.Background(), &payload, &opts, nil)
+	if err != nil {
+		return err
 	}
+	n := newNotification(&payload, &opts, body)
+	n.enqueueBy = time.Now().Add(timeout)
+	return connectionAPNS.push(n)
 }
 
-// CloseConnection closes the apns connection for one app.
+// SendBackground pushes a silent content-available notification that wakes the
+// app for a background refresh. data is delivered as custom keys.
+func SendBackground(appID int, token string, data map[string]interface{}) error {
+	payload := apns.Payload{
+		Token:            token,
+		ContentAvailable: 1,
+		ExtraData:        data,
+	}
+	return PushOneWithOptions(appID, payload, PushOptions{})
+}
+
+// isBackgroundOnly reports whether payload only asks for a background refresh
+// and carries nothing the user would see or hear.
+func isBackgroundOnly(payload *apns.Payload) bool {
+	return payload.ContentAvailable == 1 &&
+		payload.AlertText == "" && payload.LocKey == "" &&
+		payload.Sound == "" && !payload.Badge.IsSet()
+}
+
+// SuppressedCount returns the number of duplicate notifications suppressed
+// for the specified app since its connection was launched, counting both
+// content duplicates and repeated idempotency keys.
+func SuppressedCount(appID int) int64 {
+	connectionAPNS := getConnection(appID)
+	if connectionAPNS == nil {
+		return 0
+	}
+	return connectionAPNS.suppressedCount()
+}
+
+// SocketStats returns the latency stats of each socket for the specified app.
+func SocketStats(appID int) []SocketStat {
+	connectionAPNS := getConnection(appID)
+	if connectionAPNS == nil || connectionAPNS.pool == nil {
+		return nil
+	}
+	return connectionAPNS.socketStats()
+}
+
+// CloseConnection closes the apns connection for one app. The
+// AppConfigProvider sync does not relaunch it; launch it again to reopen it.
 func CloseConnection(appID int) {
-	connectionAPNS := mapAPNS[appID]
+	connectionAPNS := getConnection(appID)
 	if connectionAPNS != nil {
-		connectionAPNS.close()
+		connectionAPNS.closeOnPurpose()
 	}
 }
 
-// CloseAllConnections closes all apns connections.
+// CloseAllConnections closes all connections on every platform.
 // This is called at main shutdown.
 func CloseAllConnections() {
+	mutexAPNS.RLock()
+	listConnections := make([]*connectionAPNS, 0, len(mapAPNS))
 	for _, connectionAPNS := range mapAPNS {
-		connectionAPNS.close()
+		listConnections = append(listConnections, connectionAPNS)
+	}
+	mutexAPNS.RUnlock()
+
+	for _, connectionAPNS := range listConnections {
+		connectionAPNS.closeOnPurpose()
 	}
 }
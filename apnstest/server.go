@@ -0,0 +1,309 @@
+// Package apnstest is an in-process fake of Apple's HTTP/2 provider API for
+// integration tests of services built on apnsservice. A Server accepts real
+// connections from apnsservice over TLS and HTTP/2, records every push and
+// can be scripted to reject tokens, fail or drop requests and report
+// uninstalled apps, so tests need no Apple credentials.
+//
+//	srv := apnstest.NewServer()
+//	defer srv.Close()
+//	err := srv.Launch(42, "acme", apnsservice.ConnectionOptions{Topic: "com.acme.app"})
+//	err = apnsservice.PushOne(42, payload)
+//	ok := srv.WaitForDelivered(1, time.Second)
+package apnstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knousere/apnsservice"
+)
+
+// These identify the throwaway auth key of AppCert.
+const (
+	KeyID  = "APNSTEST01"
+	TeamID = "APNSTEST02"
+)
+
+// maxPayloadSize is the limit Apple applies to a regular push.
+const maxPayloadSize = 4096
+
+// Request is one push received by a Server.
+type Request struct {
+	Token         string          `json:"token"`
+	ApnsID        string          `json:"apnsId"`
+	Topic         string          `json:"topic"`
+	PushType      string          `json:"pushType"`
+	Priority      string          `json:"priority"`
+	Expiration    string          `json:"expiration"`
+	CollapseID    string          `json:"collapseId"`
+	Authorization string          `json:"authorization"`
+	Body          json.RawMessage `json:"body"`
+	Status        int             `json:"status"` // the answer, 200 when delivered, 0 when dropped
+	Reason        string          `json:"reason,omitempty"`
+	Time          time.Time       `json:"time"`
+}
+
+// response is a scripted answer.
+type response struct {
+	status int
+	reason string
+	isDrop bool
+}
+
+// Server is a fake HTTP/2 provider API. It is safe for concurrent use.
+type Server struct {
+	server       *httptest.Server
+	mutex        sync.Mutex
+	chanRequest  chan struct{} // signalled after each recorded request
+	listRequests []Request
+	mapRejects   map[string]response
+	mapGone      map[string]time.Time
+	listNext     []response
+}
+
+// NewServer starts a Server on a local port.
+func NewServer() *Server {
+	s := &Server{
+		chanRequest: make(chan struct{}, 1),
+		mapRejects:  make(map[string]response),
+		mapGone:     make(map[string]time.Time),
+	}
+	s.server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+	s.server.EnableHTTP2 = true
+	s.server.StartTLS()
+	return s
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// URL is the base URL for ConnectionOptions.GatewayURL.
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+// RootCAs trusts the server's self-signed certificate.
+func (s *Server) RootCAs() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.server.Certificate())
+	return pool
+}
+
+// Options returns opts pointed at the server over HTTP/2.
+func (s *Server) Options(opts apnsservice.ConnectionOptions) apnsservice.ConnectionOptions {
+	opts.Protocol = apnsservice.ProtocolHTTP2
+	opts.GatewayURL = s.URL()
+	opts.GatewayRootCAs = s.RootCAs()
+	return opts
+}
+
+// AppCert returns credentials with a freshly generated auth key, which the
+// server accepts in place of Apple's.
+func AppCert(appID int) apnsservice.AppCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return apnsservice.AppCert{
+		AppID:   appID,
+		AuthKey: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		KeyID:   KeyID,
+		TeamID:  TeamID,
+	}
+}
+
+// Launch launches a connection for the app against the server with opts and
+// a generated auth key, replacing an existing one.
+func (s *Server) Launch(appID int, appString string, opts apnsservice.ConnectionOptions) error {
+	appCert := AppCert(appID)
+	cert := apnsservice.Credentials{AuthKey: appCert.AuthKey, KeyID: appCert.KeyID, TeamID: appCert.TeamID}
+	return apnsservice.LaunchConnectionWithOptions(appID, appString, cert, apnsservice.WithConnectionOptions(s.Options(opts)))
+}
+
+// Reject makes every push to token fail with status and reason,
+// for example 400 and "BadDeviceToken".
+func (s *Server) Reject(token string, status int, reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.mapRejects[token] = response{status: status, reason: reason}
+}
+
+// Unregister makes every push to token fail with 410 Unregistered, as when
+// the app was removed from the device, which apnsservice reports as feedback.
+func (s *Server) Unregister(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.mapGone[token] = time.Now()
+}
+
+// FailNext makes the next count pushes fail with status and reason,
+// for example 503 and "ServiceUnavailable" or 403 and "InvalidProviderToken".
+func (s *Server) FailNext(count int, status int, reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := 0; i < count; i++ {
+		s.listNext = append(s.listNext, response{status: status, reason: reason})
+	}
+}
+
+// DropNext makes the next count pushes reset their stream without an answer.
+func (s *Server) DropNext(count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := 0; i < count; i++ {
+		s.listNext = append(s.listNext, response{isDrop: true})
+	}
+}
+
+// DropConnections closes every client connection, as Apple does on a GOAWAY.
+func (s *Server) DropConnections() {
+	s.server.CloseClientConnections()
+}
+
+// Requests returns a copy of every push received.
+func (s *Server) Requests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Request(nil), s.listRequests...)
+}
+
+// Delivered returns the pushes answered with 200.
+func (s *Server) Delivered() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var listDelivered []Request
+	for _, request := range s.listRequests {
+		if request.Status == http.StatusOK {
+			listDelivered = append(listDelivered, request)
+		}
+	}
+	return listDelivered
+}
+
+// WaitForDelivered waits until count pushes were delivered or timeout passes.
+func (s *Server) WaitForDelivered(count int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		if len(s.Delivered()) >= count {
+			return true
+		}
+		select {
+		case <-s.chanRequest:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// Reset forgets recorded pushes and scripted answers.
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listRequests = nil
+	s.listNext = nil
+	s.mapRejects = make(map[string]response)
+	s.mapGone = make(map[string]time.Time)
+}
+
+// serve answers one push like the provider API.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(io.LimitReader(r.Body, maxPayloadSize+1))
+	request := Request{
+		Token:         strings.TrimPrefix(r.URL.Path, "/3/device/"),
+		ApnsID:        r.Header.Get("apns-id"),
+		Topic:         r.Header.Get("apns-topic"),
+		PushType:      r.Header.Get("apns-push-type"),
+		Priority:      r.Header.Get("apns-priority"),
+		Expiration:    r.Header.Get("apns-expiration"),
+		CollapseID:    r.Header.Get("apns-collapse-id"),
+		Authorization: r.Header.Get("Authorization"),
+		Body:          body,
+		Time:          time.Now(),
+	}
+	if request.ApnsID == "" {
+		request.ApnsID = apnsservice.NewApnsID()
+	}
+
+	answer, timestamp := s.answer(r, &request)
+	s.record(request)
+	if answer.isDrop {
+		panic(http.ErrAbortHandler) // resets the stream
+	}
+
+	w.Header().Set("apns-id", request.ApnsID)
+	if answer.status == http.StatusOK {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	reply := map[string]interface{}{"reason": answer.reason}
+	if !timestamp.IsZero() {
+		reply["timestamp"] = timestamp.UnixMilli()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(answer.status)
+	json.NewEncoder(w).Encode(reply)
+}
+
+// answer picks the response to a request and stores it on the request.
+// The timestamp is set for an unregistered token.
+func (s *Server) answer(r *http.Request, request *Request) (response, time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	answer := response{status: http.StatusOK}
+	var timestamp time.Time
+	switch {
+	case r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, "/3/device/"):
+		answer = response{status: http.StatusNotFound, reason: "BadPath"}
+	case len(s.listNext) > 0:
+		answer = s.listNext[0]
+		s.listNext = s.listNext[1:]
+	case !strings.HasPrefix(request.Authorization, "bearer "):
+		answer = response{status: http.StatusForbidden, reason: "MissingProviderToken"}
+	case request.Topic == "":
+		answer = response{status: http.StatusBadRequest, reason: "MissingTopic"}
+	case len(request.Body) > maxPayloadSize:
+		answer = response{status: http.StatusRequestEntityTooLarge, reason: "PayloadTooLarge"}
+	case !json.Valid(request.Body):
+		answer = response{status: http.StatusBadRequest, reason: "PayloadEmpty"}
+	default:
+		if rejected, ok := s.mapRejects[request.Token]; ok {
+			answer = rejected
+		} else if gone, ok := s.mapGone[request.Token]; ok {
+			answer = response{status: http.StatusGone, reason: "Unregistered"}
+			timestamp = gone
+		}
+	}
+	if !answer.isDrop {
+		request.Status = answer.status
+		request.Reason = answer.reason
+	}
+	return answer, timestamp
+}
+
+// record stores a request and wakes WaitForDelivered.
+func (s *Server) record(request Request) {
+	s.mutex.Lock()
+	s.listRequests = append(s.listRequests, request)
+	s.mutex.Unlock()
+	select {
+	case s.chanRequest <- struct{}{}:
+	default:
+	}
+}
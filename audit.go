@@ -0,0 +1,249 @@
+package apnsservice
+
+// This source code includes the audit trail. With an AuditSink set, every
+// push attempt is recorded with the app, a hash of the device token, Apple's
+// apns-id, the time and the outcome, so support can prove when and whether a
+// user was notified. Records are written by a per-connection goroutine so a
+// slow sink never delays sending. SQLAuditStore is a built-in sink that also
+// answers History queries.
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// These are the outcomes of an audited push attempt.
+// AuditSent means a binary socket accepted the payload; only HTTP/2 reports AuditDelivered.
+const (
+	AuditDelivered = "delivered"
+	AuditSent      = "sent"
+	AuditRetry     = "retry"
+	AuditRejected  = "rejected"
+	AuditExpired   = "expired"
+)
+
+// auditBuffer is the number of records a connection holds for its sink before dropping.
+const auditBuffer = 1024
+
+// AuditRecord is one push attempt.
+type AuditRecord struct {
+	AppID         int       `json:"appId"`
+	Platform      Platform  `json:"platform"`
+	TokenHash     string    `json:"tokenHash"` // sha256 hex of the device token
+	ApnsID        string    `json:"apnsId,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+	Outcome       string    `json:"outcome"`
+	Status        int       `json:"status,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	Attempt       int       `json:"attempt"`
+	CorrelationID string    `json:"correlationId,omitempty"`
+	Class         string    `json:"class,omitempty"`
+}
+
+// AuditSink records push attempts. It is called from one goroutine per connection.
+type AuditSink interface {
+	RecordAttempt(record AuditRecord) error
+}
+
+// AuditHistory is implemented by sinks that can answer History queries.
+type AuditHistory interface {
+	History(appID int, tokenHash string, since time.Time) ([]AuditRecord, error)
+}
+
+// HashToken returns the token hash stored in audit records.
+func HashToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+// History returns the audited attempts to push to token for the specified
+// app since a time, oldest first. The app's AuditSink must implement AuditHistory.
+func History(appID int, token string, since time.Time) ([]AuditRecord, error) {
+	sink := lookupOptions(appID).AuditSink
+	if sink == nil {
+		return nil, fmt.Errorf("app %d has no audit sink", appID)
+	}
+	history, ok := sink.(AuditHistory)
+	if !ok {
+		return nil, errors.New("audit sink does not support History")
+	}
+	return history.History(appID, HashToken(token), since)
+}
+
+// startAudit starts the writer of a connection with an AuditSink.
+func (a *connectionAPNS) startAudit() {
+	if a.options.AuditSink == nil {
+		return
+	}
+	a.chanAudit = make(chan AuditRecord, auditBuffer)
+	go a.auditWriter()
+}
+
+// audit queues the record of one attempt for the connection's sink.
+// A full buffer drops the record rather than delay sending.
+// Every outcome also feeds the connection's QueueStat counters.
+func (a *connectionAPNS) audit(n *notification, strOutcome string, intStatus int, strReason string) {
+	a.queue.countOutcome(strOutcome)
+	if a.chanAudit == nil {
+		return
+	}
+	record := AuditRecord{
+		AppID:         a.appID,
+		Platform:      a.platform,
+		TokenHash:     HashToken(n.payload.Token),
+		ApnsID:        n.options.ApnsID,
+		Timestamp:     time.Now(),
+		Outcome:       strOutcome,
+		Status:        intStatus,
+		Reason:        strReason,
+		Attempt:       n.attempts,
+		CorrelationID: n.options.CorrelationID,
+		Class:         n.options.Class,
+	}
+	select {
+	case a.chanAudit <- record:
+	default:
+		a.logLevelf(LogWarn, 0, "Audit buffer full, dropped record for %s\n", record.TokenHash)
+	}
+}
+
+// auditWriter hands queued records to the sink until the connection closes,
+// then writes what is left.
+func (a *connectionAPNS) auditWriter() {
+	sink := a.options.AuditSink
+	write := func(record AuditRecord) {
+		if err := sink.RecordAttempt(record); err != nil {
+			a.logLevelf(LogWarn, 0, "AuditSink %s\n", err.Error())
+		}
+	}
+	for {
+		select {
+		case record := <-a.chanAudit:
+			write(record)
+		case <-a.chanDone:
+			for {
+				select {
+				case record := <-a.chanAudit:
+					write(record)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// These are the dialects SQLAuditStore supports.
+const (
+	DialectPostgres = "postgres"
+	DialectMySQL    = "mysql"
+	DialectSQLite   = "sqlite"
+)
+
+// auditTable is the table SQLAuditStore writes.
+const auditTable = "apns_audit"
+
+// SQLAuditStore is an AuditSink and AuditHistory backed by a database/sql
+// connection. The caller opens the database with the driver of its choice.
+type SQLAuditStore struct {
+	db        *sql.DB
+	strInsert string
+	strQuery  string
+}
+
+// NewSQLAuditStore creates the audit table and its index if they do not
+// exist and returns a store writing to it. dialect is DialectPostgres,
+// DialectMySQL or DialectSQLite and selects the placeholder style and schema.
+func NewSQLAuditStore(db *sql.DB, dialect string) (*SQLAuditStore, error) {
+	strTimestamp := "TIMESTAMP"
+	switch dialect {
+	case DialectPostgres:
+		strTimestamp = "TIMESTAMPTZ"
+	case DialectMySQL:
+		strTimestamp = "DATETIME(6)"
+	case DialectSQLite:
+	default:
+		return nil, fmt.Errorf("unknown sql dialect %q", dialect)
+	}
+	listStatements := []string{
+		"CREATE TABLE IF NOT EXISTS " + auditTable + ` (
+			app_id INTEGER NOT NULL,
+			platform VARCHAR(16) NOT NULL,
+			token_hash CHAR(64) NOT NULL,
+			apns_id VARCHAR(64) NOT NULL,
+			ts ` + strTimestamp + ` NOT NULL,
+			outcome VARCHAR(16) NOT NULL,
+			status INTEGER NOT NULL,
+			reason VARCHAR(128) NOT NULL,
+			attempt INTEGER NOT NULL,
+			correlation_id VARCHAR(128) NOT NULL,
+			class VARCHAR(64) NOT NULL)`,
+	}
+	// MySQL has no CREATE INDEX IF NOT EXISTS, so its index is left to the DBA
+	if dialect != DialectMySQL {
+		listStatements = append(listStatements,
+			"CREATE INDEX IF NOT EXISTS "+auditTable+"_token ON "+auditTable+" (app_id, token_hash, ts)")
+	}
+	for _, strStatement := range listStatements {
+		if _, err := db.Exec(strStatement); err != nil {
+			return nil, err
+		}
+	}
+
+	placeholders := func(count int) []string {
+		list := make([]string, count)
+		for i := range list {
+			list[i] = "?"
+			if dialect == DialectPostgres {
+				list[i] = fmt.Sprintf("$%d", i+1)
+			}
+		}
+		return list
+	}
+	const strColumns = "app_id, platform, token_hash, apns_id, ts, outcome, status, reason, attempt, correlation_id, class"
+	listQuery := placeholders(3)
+	return &SQLAuditStore{
+		db: db,
+		strInsert: "INSERT INTO " + auditTable + " (" + strColumns + ") VALUES (" +
+			strings.Join(placeholders(11), ", ") + ")",
+		strQuery: "SELECT " + strColumns + " FROM " + auditTable +
+			" WHERE app_id = " + listQuery[0] + " AND token_hash = " + listQuery[1] + " AND ts >= " + listQuery[2] +
+			" ORDER BY ts",
+	}, nil
+}
+
+// RecordAttempt inserts one record.
+func (s *SQLAuditStore) RecordAttempt(record AuditRecord) error {
+	_, err := s.db.Exec(s.strInsert,
+		record.AppID, string(record.Platform), record.TokenHash, record.ApnsID, record.Timestamp.UTC(),
+		record.Outcome, record.Status, record.Reason, record.Attempt, record.CorrelationID, record.Class)
+	return err
+}
+
+// History returns the records for a token hash since a time, oldest first.
+func (s *SQLAuditStore) History(appID int, tokenHash string, since time.Time) ([]AuditRecord, error) {
+	rows, err := s.db.Query(s.strQuery, appID, tokenHash, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var listRecords []AuditRecord
+	for rows.Next() {
+		var record AuditRecord
+		var strPlatform string
+		err := rows.Scan(&record.AppID, &strPlatform, &record.TokenHash, &record.ApnsID, &record.Timestamp,
+			&record.Outcome, &record.Status, &record.Reason, &record.Attempt, &record.CorrelationID, &record.Class)
+		if err != nil {
+			return nil, err
+		}
+		record.Platform = Platform(strPlatform)
+		listRecords = append(listRecords, record)
+	}
+	return listRecords, rows.Err()
+}
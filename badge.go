@@ -0,0 +1,111 @@
+package apnsservice
+
+// This source code includes the badge manager. An app whose options name a
+// BadgeStore keeps one badge count per device: callers increment or reset it
+// and every outgoing alert without a badge of its own carries the current
+// count, so no caller has to compute it.
+
+import (
+	"errors"
+	"sync"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// ErrNoBadgeStore is returned by the badge functions for an app without a BadgeStore.
+var ErrNoBadgeStore = errors.New("app has no badge store")
+
+// BadgeStore keeps the badge count of each device token.
+// Its methods must be safe for concurrent use.
+type BadgeStore interface {
+	// IncrementBadge adds delta to the token's count and returns the new count.
+	IncrementBadge(appID int, token string, delta int) (int, error)
+	// ResetBadge sets the token's count to zero.
+	ResetBadge(appID int, token string) error
+	// Badge returns the token's count, zero for an unknown token.
+	Badge(appID int, token string) (int, error)
+}
+
+// IncrementBadge adds one to the badge count of token and returns the new count.
+func IncrementBadge(appID int, token string) (int, error) {
+	store := lookupOptions(appID).BadgeStore
+	if store == nil {
+		return 0, ErrNoBadgeStore
+	}
+	intBadge, err := store.IncrementBadge(appID, token, 1)
+	if err != nil {
+		utils.Warning.Println("BadgeStore.IncrementBadge", appID, err.Error())
+	}
+	return intBadge, err
+}
+
+// ResetBadge sets the badge count of token to zero, for example when the
+// user opens the app. The next alert clears the badge on the device.
+func ResetBadge(appID int, token string) error {
+	store := lookupOptions(appID).BadgeStore
+	if store == nil {
+		return ErrNoBadgeStore
+	}
+	err := store.ResetBadge(appID, token)
+	if err != nil {
+		utils.Warning.Println("BadgeStore.ResetBadge", appID, err.Error())
+	}
+	return err
+}
+
+// injectBadge sets the stored badge count on an alert that has no badge.
+// Silent pushes and Web Push are left alone. A store error is logged and the
+// push goes out without a badge.
+func (a *connectionAPNS) injectBadge(payload *apns.Payload) {
+	store := a.options.BadgeStore
+	if store == nil || a.platform == PlatformWeb || payload.Badge.IsSet() || isBackgroundOnly(payload) {
+		return
+	}
+	intBadge, err := store.Badge(a.appID, payload.Token)
+	if err != nil {
+		a.logLevelf(LogWarn, 0, "BadgeStore %s %s\n", payload.Token, err.Error())
+		return
+	}
+	payload.Badge = apns.NewBadgeNumber(uint32(intBadge))
+}
+
+// memoryBadgeStore is an in-process BadgeStore.
+type memoryBadgeStore struct {
+	mutex     sync.Mutex
+	mapBadges map[int]map[string]int
+}
+
+// NewMemoryBadgeStore returns a BadgeStore held in process memory.
+// Counts are lost on restart; production services need a shared store.
+func NewMemoryBadgeStore() BadgeStore {
+	return &memoryBadgeStore{mapBadges: make(map[int]map[string]int)}
+}
+
+func (s *memoryBadgeStore) IncrementBadge(appID int, token string, delta int) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mapApp := s.mapBadges[appID]
+	if mapApp == nil {
+		mapApp = make(map[string]int)
+		s.mapBadges[appID] = mapApp
+	}
+	mapApp[token] += delta
+	if mapApp[token] < 0 {
+		mapApp[token] = 0
+	}
+	return mapApp[token], nil
+}
+
+func (s *memoryBadgeStore) ResetBadge(appID int, token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.mapBadges[appID], token)
+	return nil
+}
+
+func (s *memoryBadgeStore) Badge(appID int, token string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.mapBadges[appID][token], nil
+}
@@ -0,0 +1,128 @@
+package apnsservice
+
+// This source code includes the bad token cache. Tokens the feedback service
+// reports and tokens Apple rejects as invalid are remembered per app with the
+// time Apple gave, and further pushes to them are refused before they are
+// enqueued. The cache saves the traffic to dead devices between the caller's
+// own database cleanups. It keeps the most recent tokens of each app up to
+// ConnectionOptions.BadTokenCacheSize.
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultBadTokenCacheSize is the number of bad tokens remembered per app by default.
+const defaultBadTokenCacheSize = 10000
+
+// ErrKnownBadToken refuses a push to a token Apple already reported as invalid.
+// It also matches ErrInvalidToken.
+var ErrKnownBadToken = fmt.Errorf("token was reported invalid: %w", ErrInvalidToken)
+
+// badTokenCache is the bad tokens of one app, oldest report first.
+type badTokenCache struct {
+	listOrder *list.List               // of Feedback
+	mapTokens map[string]*list.Element // keyed by token
+}
+
+// mapBadTokens stores the bad token caches keyed by appID. The caches outlive
+// relaunches of their connection.
+var (
+	mutexBadTokens sync.RWMutex
+	mapBadTokens   = make(map[int]*badTokenCache)
+)
+
+// IsTokenBad reports whether Apple reported token of the specified app as invalid.
+func IsTokenBad(appID int, token string) bool {
+	mutexBadTokens.RLock()
+	defer mutexBadTokens.RUnlock()
+	cache := mapBadTokens[appID]
+	if cache == nil {
+		return false
+	}
+	_, ok := cache.mapTokens[token]
+	return ok
+}
+
+// BadTokens returns the cached bad tokens of the specified app reported at or
+// after since, oldest first. A zero since returns all of them.
+func BadTokens(appID int, since time.Time) []Feedback {
+	mutexBadTokens.RLock()
+	defer mutexBadTokens.RUnlock()
+	cache := mapBadTokens[appID]
+	if cache == nil {
+		return nil
+	}
+	var listFeedback []Feedback
+	for e := cache.listOrder.Front(); e != nil; e = e.Next() {
+		feedback := e.Value.(Feedback)
+		if !feedback.Timestamp.Before(since) {
+			listFeedback = append(listFeedback, feedback)
+		}
+	}
+	// feedback timestamps are Apple's and need not arrive in order
+	sort.SliceStable(listFeedback, func(i, j int) bool {
+		return listFeedback[i].Timestamp.Before(listFeedback[j].Timestamp)
+	})
+	return listFeedback
+}
+
+// ForgetBadToken removes token from the specified app's bad token cache, for
+// example when a device registers it again after reinstalling the app.
+func ForgetBadToken(appID int, token string) {
+	mutexBadTokens.Lock()
+	defer mutexBadTokens.Unlock()
+	cache := mapBadTokens[appID]
+	if cache == nil {
+		return
+	}
+	if e, ok := cache.mapTokens[token]; ok {
+		cache.listOrder.Remove(e)
+		delete(cache.mapTokens, token)
+	}
+}
+
+// badTokenCacheSize returns the number of bad tokens the connection remembers.
+func (a *connectionAPNS) badTokenCacheSize() int {
+	if a.options.BadTokenCacheSize == 0 {
+		return defaultBadTokenCacheSize
+	}
+	return a.options.BadTokenCacheSize
+}
+
+// rememberBadToken caches a token Apple reported as invalid, evicting the
+// oldest reports beyond the cache size. A negative size disables the cache.
+func (a *connectionAPNS) rememberBadToken(feedback Feedback) {
+	intSize := a.badTokenCacheSize()
+	if intSize < 0 || feedback.Token == "" {
+		return
+	}
+	mutexBadTokens.Lock()
+	defer mutexBadTokens.Unlock()
+	cache := mapBadTokens[a.appID]
+	if cache == nil {
+		cache = &badTokenCache{listOrder: list.New(), mapTokens: make(map[string]*list.Element)}
+		mapBadTokens[a.appID] = cache
+	}
+	if e, ok := cache.mapTokens[feedback.Token]; ok {
+		cache.listOrder.Remove(e)
+	}
+	cache.mapTokens[feedback.Token] = cache.listOrder.PushBack(feedback)
+	for cache.listOrder.Len() > intSize {
+		e := cache.listOrder.Front()
+		cache.listOrder.Remove(e)
+		delete(cache.mapTokens, e.Value.(Feedback).Token)
+	}
+}
+
+// checkBadToken returns ErrKnownBadToken for a push to a cached bad token.
+func (a *connectionAPNS) checkBadToken(strToken string) error {
+	if a.badTokenCacheSize() < 0 || !IsTokenBad(a.appID, strToken) {
+		return nil
+	}
+	a.logLevelf(LogDebug, 0, "Known bad token %s\n", strToken)
+	return ErrKnownBadToken
+}
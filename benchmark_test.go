@@ -0,0 +1,123 @@
+package apnsservice
+
+// This source code includes benchmarks of the hot paths: enqueue, payload
+// serialization, fan-out to many tokens and the resend after a close error.
+//
+//	go test -run '^$' -bench . -benchmem
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// benchPayload is a typical alert with custom data.
+var benchPayload = apns.Payload{
+	Token:     strings.Repeat("ab", 32),
+	AlertText: "Your order has shipped",
+	Sound:     "default",
+	Badge:     apns.NewBadgeNumber(3),
+	ExtraData: map[string]interface{}{"orderId": 1234, "screen": "orders"},
+}
+
+// benchAppID is the app the benchmarks register, clear of real app ids.
+const benchAppID = 1 << 30
+
+// newBenchConnection launches a connection for benchAppID through a
+// MockTransport, so enqueue cost is measured along the real path without a
+// socket. The transport forgets its recorded pushes as the run goes, so a
+// long run stays bounded. The app is removed when the benchmark ends.
+func newBenchConnection(b *testing.B) *connectionAPNS {
+	b.Helper()
+	transport := NewMockTransport()
+	SetConnectionOptions(benchAppID, ConnectionOptions{})
+	connectionAPNS := newConnection(benchAppID, "bench", &AppCert{AppID: benchAppID})
+	connectionAPNS.options.Mock = transport
+	if err := storeConnection(&connectionAPNS, false, true); err != nil {
+		b.Fatal(err)
+	}
+	chanStop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				transport.Reset()
+			case <-chanStop:
+				return
+			}
+		}
+	}()
+	b.Cleanup(func() {
+		close(chanStop)
+		RemoveApp(benchAppID)
+	})
+	return &connectionAPNS
+}
+
+func BenchmarkEnqueue(b *testing.B) {
+	a := newBenchConnection(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.pushOne(&benchPayload, &PushOptions{}, nil)
+	}
+}
+
+func BenchmarkMarshalPayload(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		marshalPayload(&benchPayload)
+	}
+}
+
+func BenchmarkEncodeNotification(b *testing.B) {
+	n := &notification{payload: benchPayload}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encodeNotification(n)
+	}
+}
+
+func BenchmarkFanOut100(b *testing.B) {
+	a := newBenchConnection(b)
+	listTokens := make([]string, 100)
+	for i := range listTokens {
+		listTokens[i] = fmt.Sprintf("%064x", i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, token := range listTokens {
+			payload := benchPayload
+			payload.Token = token
+			a.pushOne(&payload, &PushOptions{}, nil)
+		}
+	}
+}
+
+func BenchmarkCloseErrorResend(b *testing.B) {
+	a := newBenchConnection(b)
+	queue := make([]*notification, 32)
+	for i := range queue {
+		queue[i] = &notification{payload: benchPayload}
+	}
+	unsent := list.New()
+	for i := 0; i < 16; i++ {
+		unsent.PushBack(&queue[i].payload)
+	}
+	closeError := &apns.ConnectionClose{
+		Error:          &apns.AppleError{Status: binaryStatusShutdown},
+		UnsentPayloads: unsent,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.handleCloseError(closeError, 1, &queue, 15)
+	}
+}
@@ -0,0 +1,179 @@
+package apnsservice
+
+// This source code includes the circuit breaker of a connection. After
+// CircuitBreaker.Threshold consecutive connection failures the connection is
+// parked in StateDegraded: its workers stop dialing and pushes are refused
+// until Reset is called or the cool-down passes and one more attempt is made.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// ErrDegraded is returned for a push to a connection parked by its circuit breaker.
+// It also matches ErrNotActive.
+var ErrDegraded = fmt.Errorf("app connection is degraded: %w", ErrNotActive)
+
+// defaultBreakerCoolDown is used when CoolDown is not set.
+const defaultBreakerCoolDown = 30 * time.Minute
+
+// breakerStable is how long a binary socket must stay connected for its close
+// not to count as a failure. Apple closes healthy sockets every few hours.
+const breakerStable = time.Minute
+
+// CircuitBreaker parks a connection that keeps failing, for example with a
+// wrong cert. Threshold is the number of consecutive dial, network or fatal
+// failures that opens it, 0 to disable. CoolDown is how long it stays open
+// before one more attempt, 30 minutes by default.
+// With a breaker a fatal failure no longer closes the connection.
+type CircuitBreaker struct {
+	Threshold int           `json:"threshold"`
+	CoolDown  time.Duration `json:"coolDown"`
+}
+
+// UnmarshalJSON accepts the cool-down as a string such as "10m" or as nanoseconds.
+func (c *CircuitBreaker) UnmarshalJSON(data []byte) error {
+	type plain CircuitBreaker
+	return unmarshalDurations(data, (*plain)(c))
+}
+
+// breaker is the circuit breaker state shared by the workers of a connection.
+type breaker struct {
+	mutex     sync.Mutex
+	config    CircuitBreaker
+	failures  int
+	openUntil time.Time     // zero while closed
+	chanReset chan struct{} // closed by reset to wake parked workers
+}
+
+// newBreaker returns a breaker for config or nil if Threshold is not positive.
+func newBreaker(config CircuitBreaker) *breaker {
+	if config.Threshold <= 0 {
+		return nil
+	}
+	if config.CoolDown <= 0 {
+		config.CoolDown = defaultBreakerCoolDown
+	}
+	return &breaker{config: config, chanReset: make(chan struct{})}
+}
+
+// recordSuccess clears the consecutive failures. A nil breaker records nothing.
+func (b *breaker) recordSuccess() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+}
+
+// recordFailure counts a failure and reports whether it opened the breaker.
+// A failure after the cool-down opens it again at once.
+func (b *breaker) recordFailure() bool {
+	if b == nil {
+		return false
+	}
+	now := time.Now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.failures < b.config.Threshold || b.openUntil.After(now) {
+		return false
+	}
+	b.openUntil = now.Add(b.config.CoolDown)
+	return true
+}
+
+// isOpen reports whether the breaker parks the connection.
+func (b *breaker) isOpen() bool {
+	return b.openedUntil().After(time.Now())
+}
+
+// openedUntil returns the end of the cool-down, zero if the breaker never opened.
+func (b *breaker) openedUntil() time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.openUntil
+}
+
+// wait blocks while the breaker is open. It returns false if chanDone or
+// chanStop closed first.
+func (b *breaker) wait(chanDone <-chan struct{}, chanStop <-chan struct{}) bool {
+	for b.isOpen() {
+		b.mutex.Lock()
+		until := b.openUntil
+		chanReset := b.chanReset
+		b.mutex.Unlock()
+
+		select {
+		case <-time.After(time.Until(until)):
+		case <-chanReset:
+		case <-chanDone:
+			return false
+		case <-chanStop:
+			return false
+		}
+	}
+	return true
+}
+
+// reset closes the breaker and wakes parked workers.
+func (b *breaker) reset() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	close(b.chanReset)
+	b.chanReset = make(chan struct{})
+}
+
+// breakerFailure counts a connection failure against the circuit breaker
+// and reports when it opens.
+func (a *connectionAPNS) breakerFailure(socketID int, strReason string) {
+	if !a.breaker.recordFailure() {
+		return
+	}
+	a.logLevelf(LogWarn, socketID, "Circuit breaker open until %s: %s\n", a.breaker.openedUntil().Format(time.RFC3339), strReason)
+	utils.Warning.Println("apns connection degraded", a.stringID, strReason)
+	a.event(socketID, EventError, "circuit breaker open: "+strReason)
+}
+
+// parkOpen blocks the worker while the circuit breaker is open.
+// It returns false if the connection or socket shut down meanwhile.
+func (a *connectionAPNS) parkOpen(socketID int, chanStop <-chan struct{}) bool {
+	if !a.breaker.isOpen() {
+		return true
+	}
+	a.logPrintln(socketID, "Circuit breaker open, waiting")
+	if !a.breaker.wait(a.chanDone, chanStop) {
+		return false
+	}
+	a.logPrintln(socketID, "Circuit breaker closed, retrying")
+	return true
+}
+
+// Reset closes the circuit breaker of the app's connection so its workers
+// dial again without waiting for the cool-down.
+func Reset(appID int) error {
+	connectionAPNS := getConnection(appID)
+	if connectionAPNS == nil {
+		return ErrAppNotFound
+	}
+	connectionAPNS.resetBreaker()
+	return nil
+}
+
+// resetBreaker closes the circuit breaker of one connection of any platform.
+func (a *connectionAPNS) resetBreaker() {
+	a.breaker.reset()
+	utils.Info.Println(a.stringID, a.platform, " circuit breaker reset")
+}
@@ -0,0 +1,277 @@
+package apnsservice
+
+// This source code includes topic subscriptions and broadcasts. Device
+// tokens subscribe to named topics of an app, and Broadcast fans a payload
+// out to every subscriber of a topic in the background, paced by its own
+// rate and reporting progress as it goes. Subscriptions are held in memory
+// unless a SubscriptionStore is set. Tokens reported invalid are unsubscribed.
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// defaultBroadcastRate paces a broadcast that sets no rate, in pushes per second.
+const defaultBroadcastRate = 500
+
+// SubscriptionStore persists topic subscriptions so they survive a restart.
+type SubscriptionStore interface {
+	// Subscribe adds token to topic. Subscribing twice is not an error.
+	Subscribe(appID int, topic string, token string) error
+	// Unsubscribe removes token from topic.
+	Unsubscribe(appID int, topic string, token string) error
+	// RemoveToken removes token from every topic of the app.
+	RemoveToken(appID int, token string) error
+	// Subscribers returns the tokens subscribed to topic.
+	Subscribers(appID int, topic string) ([]string, error)
+}
+
+// BroadcastOptions tune a broadcast. A zero Rate paces it at defaultBroadcastRate.
+// The app's own rate limit applies as well.
+type BroadcastOptions struct {
+	Rate    RateLimit
+	Options PushOptions
+}
+
+// BroadcastProgress reports how far a broadcast has got.
+type BroadcastProgress struct {
+	AppID     int       `json:"appId"`
+	Topic     string    `json:"topic"`
+	Total     int       `json:"total"`
+	Sent      int       `json:"sent"`   // accepted into the send queue
+	Failed    int       `json:"failed"` // rejected before the queue, e.g. by the app's rate limit
+	Done      bool      `json:"done"`
+	Cancelled bool      `json:"cancelled,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished,omitempty"`
+}
+
+// BroadcastJob is a running broadcast.
+type BroadcastJob struct {
+	mutex      sync.Mutex
+	progress   BroadcastProgress
+	chanDone   chan struct{}
+	chanCancel chan struct{}
+	cancelOnce sync.Once
+}
+
+// subscriptionStore is the store used by Subscribe and Broadcast.
+var (
+	mutexSubscriptions sync.RWMutex
+	subscriptionStore  SubscriptionStore = newMemorySubscriptionStore()
+)
+
+// SetSubscriptionStore replaces the in-memory subscription store, for
+// example with one backed by the business database. Call it from main before
+// any Subscribe.
+func SetSubscriptionStore(store SubscriptionStore) {
+	mutexSubscriptions.Lock()
+	defer mutexSubscriptions.Unlock()
+	subscriptionStore = store
+}
+
+// currentSubscriptionStore returns the store in use.
+func currentSubscriptionStore() SubscriptionStore {
+	mutexSubscriptions.RLock()
+	defer mutexSubscriptions.RUnlock()
+	return subscriptionStore
+}
+
+// Subscribe adds a device token of an app to a topic.
+func Subscribe(appID int, token string, topic string) error {
+	if token == "" || topic == "" {
+		return errors.New("token and topic are required")
+	}
+	return currentSubscriptionStore().Subscribe(appID, topic, token)
+}
+
+// Unsubscribe removes a device token of an app from a topic.
+func Unsubscribe(appID int, token string, topic string) error {
+	return currentSubscriptionStore().Unsubscribe(appID, topic, token)
+}
+
+// removeSubscriptions unsubscribes an invalid token from every topic.
+func removeSubscriptions(appID int, strToken string) {
+	if err := currentSubscriptionStore().RemoveToken(appID, strToken); err != nil {
+		utils.Warning.Println("SubscriptionStore.RemoveToken", appID, err.Error())
+	}
+}
+
+// Broadcast pushes payload to every token subscribed to topic, in the
+// background at the default rate. The payload's token is ignored.
+func Broadcast(appID int, topic string, payload apns.Payload) (*BroadcastJob, error) {
+	return BroadcastWithOptions(appID, topic, payload, BroadcastOptions{})
+}
+
+// BroadcastWithOptions pushes payload to every token subscribed to topic
+// with a rate and push options. It fails at once if the app cannot push or
+// the subscribers cannot be read.
+func BroadcastWithOptions(appID int, topic string, payload apns.Payload, opts BroadcastOptions) (*BroadcastJob, error) {
+	if err := opts.Options.validate(); err != nil {
+		return nil, err
+	}
+	connectionAPNS, err := lookupActive(appID)
+	if err != nil {
+		return nil, err
+	}
+	listTokens, err := currentSubscriptionStore().Subscribers(appID, topic)
+	if err != nil {
+		utils.Warning.Println("SubscriptionStore.Subscribers", appID, topic, err.Error())
+		return nil, err
+	}
+
+	rate := opts.Rate
+	if rate.PerSecond <= 0 {
+		rate = RateLimit{PerSecond: defaultBroadcastRate}
+	}
+	job := &BroadcastJob{
+		progress:   BroadcastProgress{AppID: appID, Topic: topic, Total: len(listTokens), Started: time.Now()},
+		chanDone:   make(chan struct{}),
+		chanCancel: make(chan struct{}),
+	}
+	go job.run(connectionAPNS, listTokens, payload, opts.Options, newTokenBucket(rate))
+	return job, nil
+}
+
+// run pushes to each token, waiting on bucket between pushes.
+// It stops early if the job is cancelled or the connection stops accepting pushes.
+func (j *BroadcastJob) run(connectionAPNS *connectionAPNS, listTokens []string, payload apns.Payload,
+	opts PushOptions, bucket *tokenBucket) {
+
+	defer func() {
+		j.mutex.Lock()
+		j.progress.Done = true
+		j.progress.Finished = time.Now()
+		j.mutex.Unlock()
+		close(j.chanDone)
+	}()
+
+	cache := &bodyCache{}
+	for _, strToken := range listTokens {
+		for ok, wait := bucket.take(); !ok; ok, wait = bucket.take() {
+			select {
+			case <-time.After(wait):
+			case <-j.chanCancel:
+				j.setCancelled()
+				return
+			}
+		}
+		select {
+		case <-j.chanCancel:
+			j.setCancelled()
+			return
+		default:
+		}
+
+		if !connectionAPNS.isActive() {
+			j.mutex.Lock()
+			j.progress.LastError = ErrNotActive.Error()
+			j.mutex.Unlock()
+			utils.Warning.Println("Broadcast", connectionAPNS.stringID, j.progress.Topic, ErrNotActive.Error())
+			return
+		}
+
+		payloadToken := payload
+		payloadToken.Token = strToken
+		optsToken := opts
+		body, err := connectionAPNS.prepare(context.Background(), &payloadToken, &optsToken, cache)
+		if err == nil {
+			err = connectionAPNS.pushOne(&payloadToken, &optsToken, body)
+		}
+
+		j.mutex.Lock()
+		if err == nil {
+			j.progress.Sent++
+		} else {
+			j.progress.Failed++
+			j.progress.LastError = err.Error()
+		}
+		j.mutex.Unlock()
+	}
+}
+
+// setCancelled records that the job was cancelled.
+func (j *BroadcastJob) setCancelled() {
+	j.mutex.Lock()
+	j.progress.Cancelled = true
+	j.mutex.Unlock()
+}
+
+// Progress returns a snapshot of the broadcast's progress.
+func (j *BroadcastJob) Progress() BroadcastProgress {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.progress
+}
+
+// Wait blocks until the broadcast finishes and returns its final progress.
+func (j *BroadcastJob) Wait() BroadcastProgress {
+	<-j.chanDone
+	return j.Progress()
+}
+
+// Cancel stops the broadcast before its remaining tokens are pushed.
+func (j *BroadcastJob) Cancel() {
+	j.cancelOnce.Do(func() { close(j.chanCancel) })
+}
+
+// memorySubscriptionStore is the default in-process SubscriptionStore.
+// It is keyed by appID, then topic, then token.
+type memorySubscriptionStore struct {
+	mutex     sync.Mutex
+	mapTopics map[int]map[string]map[string]struct{}
+}
+
+// newMemorySubscriptionStore returns an empty in-process store.
+func newMemorySubscriptionStore() *memorySubscriptionStore {
+	return &memorySubscriptionStore{mapTopics: make(map[int]map[string]map[string]struct{})}
+}
+
+func (s *memorySubscriptionStore) Subscribe(appID int, topic string, token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mapApp := s.mapTopics[appID]
+	if mapApp == nil {
+		mapApp = make(map[string]map[string]struct{})
+		s.mapTopics[appID] = mapApp
+	}
+	if mapApp[topic] == nil {
+		mapApp[topic] = make(map[string]struct{})
+	}
+	mapApp[topic][token] = struct{}{}
+	return nil
+}
+
+func (s *memorySubscriptionStore) Unsubscribe(appID int, topic string, token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.mapTopics[appID][topic], token)
+	return nil
+}
+
+func (s *memorySubscriptionStore) RemoveToken(appID int, token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, mapTokens := range s.mapTopics[appID] {
+		delete(mapTokens, token)
+	}
+	return nil
+}
+
+func (s *memorySubscriptionStore) Subscribers(appID int, topic string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	listTokens := make([]string, 0, len(s.mapTopics[appID][topic]))
+	for token := range s.mapTopics[appID][topic] {
+		listTokens = append(listTokens, token)
+	}
+	sort.Strings(listTokens)
+	return listTokens, nil
+}
@@ -0,0 +1,457 @@
+package apnsservice
+
+// This source code includes the campaign engine. A campaign renders a
+// template for every target a TokenIterator yields and pushes it in the
+// background with a set concurrency and rate. Unlike a broadcast, its
+// targets are read as it goes, so a campaign can cover a user base too large
+// to list up front, and it can be paused and resumed. Campaigns are held in
+// memory and looked up by id.
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// ErrCampaignNotFound is returned for an unknown campaign id.
+var ErrCampaignNotFound = errors.New("campaign not found")
+
+// These are the states of a campaign.
+const (
+	CampaignRunning   = "running"
+	CampaignPaused    = "paused"
+	CampaignDone      = "done"
+	CampaignCancelled = "cancelled"
+	CampaignFailed    = "failed" // the app stopped accepting pushes or the iterator failed
+)
+
+// CampaignTarget is one recipient of a campaign.
+type CampaignTarget struct {
+	Token  string
+	UserID string // optional, checked against the app's PreferenceStore
+	Locale string // optional, overrides CampaignOptions.Locale
+}
+
+// TokenIterator yields the targets of a campaign. Next returns false once
+// the targets are exhausted or reading them failed, and Err then reports the
+// failure. An iterator that also has a Len() int method lets the campaign
+// report how many targets remain. Iterators are read from one goroutine.
+type TokenIterator interface {
+	Next() (CampaignTarget, bool)
+	Err() error
+}
+
+// CampaignOptions describe what a campaign pushes and how fast.
+// Template names a registered template rendered with Vars in the target's
+// locale into the alert of Payload, which supplies the sound, badge and
+// custom data. Payload is pushed as is when Template is empty.
+// Concurrency is 1 and Rate is defaultBroadcastRate by default. The app's
+// own rate limit applies as well.
+type CampaignOptions struct {
+	Template    string                 `json:"template"`
+	Vars        map[string]interface{} `json:"vars"`
+	Locale      string                 `json:"locale"`
+	Payload     apns.Payload           `json:"-"`
+	Options     PushOptions            `json:"options"`
+	Concurrency int                    `json:"concurrency"`
+	Rate        RateLimit              `json:"rate"`
+}
+
+// CampaignProgress reports how far a campaign has got.
+type CampaignProgress struct {
+	ID        string    `json:"id"`
+	AppID     int       `json:"appId"`
+	State     string    `json:"state"`
+	Total     int       `json:"total"`     // -1 when the iterator cannot tell
+	Sent      int       `json:"sent"`      // accepted into the send queue
+	Failed    int       `json:"failed"`    // rejected before the queue or not rendered
+	Remaining int       `json:"remaining"` // -1 when the iterator cannot tell
+	LastError string    `json:"lastError,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished,omitempty"`
+}
+
+// Campaign is a started campaign.
+type Campaign struct {
+	mutex      sync.Mutex
+	progress   CampaignProgress
+	options    CampaignOptions
+	chanResume chan struct{} // closed while the campaign runs
+	chanCancel chan struct{}
+	chanDone   chan struct{}
+	cancelOnce sync.Once
+}
+
+// mapCampaigns stores campaigns keyed by id until ForgetCampaign.
+var (
+	mutexCampaigns sync.Mutex
+	mapCampaigns   = make(map[string]*Campaign)
+)
+
+// StartCampaign creates a campaign for the targets of tokens and starts it.
+// It fails at once if the app cannot push or the template is not registered.
+func StartCampaign(appID int, tokens TokenIterator, opts CampaignOptions) (*Campaign, error) {
+	if err := opts.Options.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := lookupActive(appID); err != nil {
+		return nil, err
+	}
+	if opts.Template != "" {
+		mutexTemplates.RLock()
+		_, ok := mapTemplates[opts.Template]
+		mutexTemplates.RUnlock()
+		if !ok {
+			return nil, ErrTemplateNotFound
+		}
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.Rate.PerSecond <= 0 {
+		opts.Rate = RateLimit{PerSecond: defaultBroadcastRate}
+	}
+
+	c := &Campaign{
+		progress: CampaignProgress{
+			ID:        NewApnsID(),
+			AppID:     appID,
+			State:     CampaignRunning,
+			Total:     -1,
+			Remaining: -1,
+			Started:   time.Now(),
+		},
+		options:    opts,
+		chanResume: make(chan struct{}),
+		chanCancel: make(chan struct{}),
+		chanDone:   make(chan struct{}),
+	}
+	close(c.chanResume)
+	if counter, ok := tokens.(interface{ Len() int }); ok {
+		c.progress.Total = counter.Len()
+		c.progress.Remaining = c.progress.Total
+	}
+
+	mutexCampaigns.Lock()
+	mapCampaigns[c.progress.ID] = c
+	mutexCampaigns.Unlock()
+
+	go c.run(tokens, newTokenBucket(opts.Rate))
+	return c, nil
+}
+
+// CampaignStatus returns the progress of the campaign with id.
+// The second result is false if there is no such campaign.
+func CampaignStatus(id string) (CampaignProgress, bool) {
+	c := lookupCampaign(id)
+	if c == nil {
+		return CampaignProgress{}, false
+	}
+	return c.Progress(), true
+}
+
+// PauseCampaign pauses the campaign with id.
+func PauseCampaign(id string) error {
+	c := lookupCampaign(id)
+	if c == nil {
+		return ErrCampaignNotFound
+	}
+	c.Pause()
+	return nil
+}
+
+// ResumeCampaign resumes the paused campaign with id.
+func ResumeCampaign(id string) error {
+	c := lookupCampaign(id)
+	if c == nil {
+		return ErrCampaignNotFound
+	}
+	c.Resume()
+	return nil
+}
+
+// CancelCampaign cancels the campaign with id.
+func CancelCampaign(id string) error {
+	c := lookupCampaign(id)
+	if c == nil {
+		return ErrCampaignNotFound
+	}
+	c.Cancel()
+	return nil
+}
+
+// ForgetCampaign cancels the campaign with id and drops it from the registry.
+func ForgetCampaign(id string) {
+	mutexCampaigns.Lock()
+	c := mapCampaigns[id]
+	delete(mapCampaigns, id)
+	mutexCampaigns.Unlock()
+	if c != nil {
+		c.Cancel()
+	}
+}
+
+// lookupCampaign returns the campaign with id or nil.
+func lookupCampaign(id string) *Campaign {
+	mutexCampaigns.Lock()
+	defer mutexCampaigns.Unlock()
+	return mapCampaigns[id]
+}
+
+// ID returns the campaign id.
+func (c *Campaign) ID() string {
+	return c.progress.ID // set once before the campaign starts
+}
+
+// Progress returns a snapshot of the campaign's progress.
+func (c *Campaign) Progress() CampaignProgress {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.progress
+}
+
+// Wait blocks until the campaign finishes and returns its final progress.
+func (c *Campaign) Wait() CampaignProgress {
+	<-c.chanDone
+	return c.Progress()
+}
+
+// Pause stops the campaign after the pushes in flight. It does nothing
+// unless the campaign is running.
+func (c *Campaign) Pause() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.progress.State != CampaignRunning {
+		return
+	}
+	c.progress.State = CampaignPaused
+	c.chanResume = make(chan struct{})
+}
+
+// Resume continues a paused campaign.
+func (c *Campaign) Resume() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.progress.State != CampaignPaused {
+		return
+	}
+	c.progress.State = CampaignRunning
+	close(c.chanResume)
+}
+
+// Cancel stops the campaign before its remaining targets are pushed.
+func (c *Campaign) Cancel() {
+	c.stop(CampaignCancelled, "")
+}
+
+// stop ends the campaign in state unless it already ended.
+func (c *Campaign) stop(strState string, strError string) {
+	c.cancelOnce.Do(func() {
+		c.mutex.Lock()
+		c.progress.State = strState
+		if strError != "" {
+			c.progress.LastError = strError
+		}
+		c.mutex.Unlock()
+		close(c.chanCancel)
+	})
+}
+
+// waitRunning blocks while the campaign is paused.
+// It returns false once the campaign is cancelled or has failed.
+func (c *Campaign) waitRunning() bool {
+	c.mutex.Lock()
+	chanResume := c.chanResume
+	c.mutex.Unlock()
+	select {
+	case <-c.chanCancel:
+		return false
+	default:
+	}
+	select {
+	case <-chanResume:
+		return true
+	case <-c.chanCancel:
+		return false
+	}
+}
+
+// run feeds the targets of tokens to the campaign's workers and finishes
+// the campaign once they are done.
+func (c *Campaign) run(tokens TokenIterator, bucket *tokenBucket) {
+	chanTargets := make(chan CampaignTarget)
+	wg := sync.WaitGroup{}
+	for i := 0; i < c.options.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.work(chanTargets, bucket)
+		}()
+	}
+
+feed:
+	for {
+		target, ok := tokens.Next()
+		if !ok {
+			break
+		}
+		select {
+		case chanTargets <- target:
+		case <-c.chanCancel:
+			break feed
+		}
+	}
+	close(chanTargets)
+	wg.Wait()
+
+	if err := tokens.Err(); err != nil {
+		utils.Warning.Println("Campaign", c.progress.ID, err.Error())
+		c.stop(CampaignFailed, err.Error())
+	}
+	c.stop(CampaignDone, "")
+	c.mutex.Lock()
+	c.progress.Finished = time.Now()
+	c.mutex.Unlock()
+	close(c.chanDone)
+}
+
+// work pushes targets until they run out or the campaign stops.
+func (c *Campaign) work(chanTargets <-chan CampaignTarget, bucket *tokenBucket) {
+	cache := &bodyCache{}
+	for target := range chanTargets {
+		if !c.waitRunning() || !c.waitRate(bucket) {
+			return
+		}
+		connectionAPNS, err := lookupActive(c.progress.AppID)
+		if err != nil {
+			utils.Warning.Println("Campaign", c.progress.ID, err.Error())
+			c.stop(CampaignFailed, err.Error())
+			return
+		}
+		err = c.push(connectionAPNS, target, cache)
+
+		c.mutex.Lock()
+		if err == nil {
+			c.progress.Sent++
+		} else {
+			c.progress.Failed++
+			c.progress.LastError = err.Error()
+		}
+		if c.progress.Remaining > 0 {
+			c.progress.Remaining--
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// waitRate waits on bucket for the next push.
+// It returns false once the campaign is cancelled or has failed.
+func (c *Campaign) waitRate(bucket *tokenBucket) bool {
+	for ok, wait := bucket.take(); !ok; ok, wait = bucket.take() {
+		select {
+		case <-time.After(wait):
+		case <-c.chanCancel:
+			return false
+		}
+	}
+	return true
+}
+
+// push renders the campaign's payload for target and pushes it.
+func (c *Campaign) push(connectionAPNS *connectionAPNS, target CampaignTarget, cache *bodyCache) error {
+	payload := c.options.Payload
+	payload.Token = target.Token
+	if c.options.Template != "" {
+		strLocale := target.Locale
+		if strLocale == "" {
+			strLocale = c.options.Locale
+		}
+		rendered, err := RenderTemplate(target.Token, c.options.Template, c.options.Vars, strLocale)
+		if err != nil {
+			return err
+		}
+		payload.AlertText = rendered.AlertText
+		payload.LocKey = rendered.LocKey
+		payload.LocArgs = rendered.LocArgs
+	}
+	opts := c.options.Options
+	opts.UserID = target.UserID
+	body, err := connectionAPNS.prepare(context.Background(), &payload, &opts, cache)
+	if err != nil {
+		return err
+	}
+	return connectionAPNS.pushOne(&payload, &opts, body)
+}
+
+// sliceTokens is a TokenIterator over a list of tokens.
+type sliceTokens struct {
+	listTokens []string
+	index      int
+}
+
+// SliceTokens returns a TokenIterator over listTokens.
+func SliceTokens(listTokens []string) TokenIterator {
+	return &sliceTokens{listTokens: listTokens}
+}
+
+func (s *sliceTokens) Next() (CampaignTarget, bool) {
+	if s.index >= len(s.listTokens) {
+		return CampaignTarget{}, false
+	}
+	s.index++
+	return CampaignTarget{Token: s.listTokens[s.index-1]}, true
+}
+
+func (s *sliceTokens) Err() error {
+	return nil
+}
+
+func (s *sliceTokens) Len() int {
+	return len(s.listTokens)
+}
+
+// userTokens is a TokenIterator that resolves users through a TokenStore.
+type userTokens struct {
+	appID       int
+	store       TokenStore
+	listUserIDs []string
+	listPending []string
+	strUserID   string
+	err         error
+}
+
+// UserTokens returns a TokenIterator over the tokens the app's TokenStore
+// holds for each of listUserIDs. The users are looked up as the campaign
+// reaches them, and each target carries its UserID.
+func UserTokens(appID int, listUserIDs []string) (TokenIterator, error) {
+	connectionAPNS := getConnection(appID)
+	if connectionAPNS == nil {
+		return nil, ErrAppNotFound
+	}
+	if connectionAPNS.options.TokenStore == nil {
+		return nil, errors.New("app has no token store")
+	}
+	return &userTokens{appID: appID, store: connectionAPNS.options.TokenStore, listUserIDs: listUserIDs}, nil
+}
+
+func (u *userTokens) Next() (CampaignTarget, bool) {
+	for len(u.listPending) == 0 {
+		if u.err != nil || len(u.listUserIDs) == 0 {
+			return CampaignTarget{}, false
+		}
+		u.strUserID = u.listUserIDs[0]
+		u.listUserIDs = u.listUserIDs[1:]
+		u.listPending, u.err = u.store.LookupTokens(u.appID, u.strUserID)
+	}
+	strToken := u.listPending[0]
+	u.listPending = u.listPending[1:]
+	return CampaignTarget{Token: strToken, UserID: u.strUserID}, true
+}
+
+func (u *userTokens) Err() error {
+	return u.err
+}
@@ -0,0 +1,77 @@
+package apnsservice
+
+// This source code includes certificate inspection. InspectCert reports the
+// topic and validity of an Apple push certificate so operators can catch an
+// expiring or mismatched cert before Apple rejects it.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// oidUID is the subject attribute Apple stores the bundle id in.
+var oidUID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// CertInfo describes an Apple push certificate.
+type CertInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Topic     string    `json:"topic"` // the bundle id the cert pushes to
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	IsSandbox bool      `json:"isSandbox"` // a development cert that only works with the sandbox
+}
+
+// InspectCert parses the certificate of an AppCert. If RSAKey is set it
+// must match the certificate. Token-based AppCerts have no certificate.
+func InspectCert(appCert AppCert) (CertInfo, error) {
+	var info CertInfo
+	block, _ := pem.Decode(appCert.Cert)
+	if block == nil {
+		return info, fmt.Errorf("app %d: %w", appCert.AppID, ErrNoCert)
+	}
+	if len(appCert.RSAKey) > 0 {
+		if _, err := tls.X509KeyPair(appCert.Cert, appCert.RSAKey); err != nil {
+			return info, err
+		}
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return info, err
+	}
+	info.Subject = leaf.Subject.String()
+	info.Issuer = leaf.Issuer.String()
+	info.NotBefore = leaf.NotBefore
+	info.NotAfter = leaf.NotAfter
+	info.IsSandbox = strings.HasPrefix(leaf.Subject.CommonName, "Apple Development")
+	for _, name := range leaf.Subject.Names {
+		if name.Type.Equal(oidUID) {
+			info.Topic = fmt.Sprint(name.Value)
+		}
+	}
+	return info, nil
+}
+
+// check returns ErrNoCert if the cert carries no credentials and
+// ErrCertExpired if its certificate is past NotAfter.
+func (c *AppCert) check() error {
+	if c.hasAuthKey() {
+		return nil
+	}
+	if len(c.Cert) == 0 || len(c.RSAKey) == 0 {
+		return fmt.Errorf("app %d: %w", c.AppID, ErrNoCert)
+	}
+	info, err := InspectCert(*c)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(info.NotAfter) {
+		return fmt.Errorf("app %d: %w on %s", c.AppID, ErrCertExpired, info.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package apnsservice
+
+// This source code includes certificate providers. A CertProvider fetches an
+// app's credentials from where they are kept, so secrets never pass through
+// main. LaunchWithCertProvider re-fetches them on an interval and relaunches
+// the connection when they rotate. Files and environment variables are built
+// in here; Vault and AWS Secrets Manager are in secretstores.go.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// CertProvider fetches the credentials of an app.
+type CertProvider interface {
+	FetchCert(ctx context.Context, appID int) (AppCert, error)
+}
+
+// certFetchTimeout bounds one fetch from a provider.
+const certFetchTimeout = 30 * time.Second
+
+// FileCertProvider reads PEM files. Set CertPath and KeyPath for a
+// certificate, or AuthKeyPath with KeyID and TeamID for token-based authentication.
+type FileCertProvider struct {
+	CertPath    string
+	KeyPath     string
+	AuthKeyPath string
+	KeyID       string
+	TeamID      string
+	IsDev       bool
+}
+
+// FetchCert reads the files.
+func (p FileCertProvider) FetchCert(ctx context.Context, appID int) (AppCert, error) {
+	appCert := AppCert{AppID: appID, KeyID: p.KeyID, TeamID: p.TeamID}
+	if p.IsDev {
+		appCert.IsDev = 1
+	}
+	for _, file := range []struct {
+		strPath string
+		data    *[]byte
+	}{
+		{p.CertPath, &appCert.Cert},
+		{p.KeyPath, &appCert.RSAKey},
+		{p.AuthKeyPath, &appCert.AuthKey},
+	} {
+		if file.strPath == "" {
+			continue
+		}
+		data, err := os.ReadFile(file.strPath)
+		if err != nil {
+			return AppCert{}, err
+		}
+		*file.data = data
+	}
+	return appCert, nil
+}
+
+// EnvCertProvider reads credentials from environment variables named by its
+// fields. Values may be PEM text or base64 encoded PEM.
+type EnvCertProvider struct {
+	CertVar    string
+	KeyVar     string
+	AuthKeyVar string
+	KeyIDVar   string
+	TeamIDVar  string
+	IsDev      bool
+}
+
+// FetchCert reads the variables.
+func (p EnvCertProvider) FetchCert(ctx context.Context, appID int) (AppCert, error) {
+	secret := certSecret{
+		Cert:    os.Getenv(p.CertVar),
+		RSAKey:  os.Getenv(p.KeyVar),
+		AuthKey: os.Getenv(p.AuthKeyVar),
+		KeyID:   os.Getenv(p.KeyIDVar),
+		TeamID:  os.Getenv(p.TeamIDVar),
+		IsDev:   p.IsDev,
+	}
+	if secret.Cert == "" && secret.AuthKey == "" {
+		return AppCert{}, fmt.Errorf("neither %s nor %s is set", p.CertVar, p.AuthKeyVar)
+	}
+	return secret.appCert(appID)
+}
+
+// certSecret is the JSON document a secret store holds for an app.
+// Key material is PEM text or base64 encoded PEM.
+type certSecret struct {
+	Cert    string `json:"cert"`
+	RSAKey  string `json:"rsaKey"`
+	AuthKey string `json:"authKey"`
+	KeyID   string `json:"keyId"`
+	TeamID  string `json:"teamId"`
+	IsDev   bool   `json:"isDev"`
+}
+
+// parseCertSecret decodes a certSecret document.
+func parseCertSecret(data []byte, appID int) (AppCert, error) {
+	var secret certSecret
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return AppCert{}, fmt.Errorf("secret is not a cert document: %s", err.Error())
+	}
+	return secret.appCert(appID)
+}
+
+// appCert converts the secret to an AppCert.
+func (s certSecret) appCert(appID int) (AppCert, error) {
+	appCert := AppCert{AppID: appID, KeyID: s.KeyID, TeamID: s.TeamID}
+	if s.IsDev {
+		appCert.IsDev = 1
+	}
+	var err error
+	if appCert.Cert, err = decodePEM(s.Cert); err != nil {
+		return AppCert{}, fmt.Errorf("cert: %s", err.Error())
+	}
+	if appCert.RSAKey, err = decodePEM(s.RSAKey); err != nil {
+		return AppCert{}, fmt.Errorf("rsaKey: %s", err.Error())
+	}
+	if appCert.AuthKey, err = decodePEM(s.AuthKey); err != nil {
+		return AppCert{}, fmt.Errorf("authKey: %s", err.Error())
+	}
+	return appCert, nil
+}
+
+// decodePEM returns PEM text as is and decodes base64 encoded PEM.
+func decodePEM(strValue string) ([]byte, error) {
+	strValue = strings.TrimSpace(strValue)
+	if strValue == "" || strings.HasPrefix(strValue, "-----BEGIN") {
+		return []byte(strValue), nil
+	}
+	return base64.StdEncoding.DecodeString(strValue)
+}
+
+// mapCertWatches stores the stop channel of each app's rotation watch keyed by appID.
+var (
+	mutexCertWatches sync.Mutex
+	mapCertWatches   = make(map[int]chan struct{})
+)
+
+// LaunchWithCertProvider fetches an app's credentials from provider and
+// launches its connection, replacing an existing one. When refresh is
+// positive the credentials are re-fetched on that interval and the connection
+// is relaunched if they changed. RemoveApp stops the re-fetch.
+func LaunchWithCertProvider(appID int, appString string, provider CertProvider, isLogging bool, refresh time.Duration) error {
+	appCert, err := fetchCert(provider, appID)
+	if err != nil {
+		utils.Warning.Println("CertProvider.FetchCert", appString, err.Error())
+		return err
+	}
+	if err := registerConnection(appID, appString, appCert, isLogging, true); err != nil {
+		return err
+	}
+
+	stopCertWatch(appID)
+	if refresh > 0 {
+		chanStop := make(chan struct{})
+		mutexCertWatches.Lock()
+		mapCertWatches[appID] = chanStop
+		mutexCertWatches.Unlock()
+		go watchCert(appID, appString, provider, isLogging, refresh, certFingerprint(&appCert), chanStop)
+	}
+	return nil
+}
+
+// fetchCert fetches credentials with the fetch timeout.
+func fetchCert(provider CertProvider, appID int) (AppCert, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), certFetchTimeout)
+	defer cancel()
+	return provider.FetchCert(ctx, appID)
+}
+
+// watchCert re-fetches credentials every refresh and relaunches the app when they rotate.
+// A failed fetch keeps the running connection and is retried on the next tick.
+// Pushes still queued on the old connection move to the new one, and its log
+// file is closed once its workers stop.
+func watchCert(appID int, appString string, provider CertProvider, isLogging bool,
+	refresh time.Duration, strPrint string, chanStop chan struct{}) {
+
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			appCert, err := fetchCert(provider, appID)
+			if err != nil {
+				utils.Warning.Println("CertProvider.FetchCert", appString, err.Error())
+				continue
+			}
+			strNewPrint := certFingerprint(&appCert)
+			if strNewPrint == strPrint {
+				continue
+			}
+			if err := registerConnection(appID, appString, appCert, isLogging, true); err != nil {
+				utils.Warning.Println("relaunch after cert rotation", appString, err.Error())
+				continue
+			}
+			utils.Info.Println(appString, " relaunched after cert rotation", strPrint, "->", strNewPrint)
+			strPrint = strNewPrint
+		case <-chanStop:
+			return
+		}
+	}
+}
+
+// stopCertWatch stops the rotation watch of an app if it has one.
+func stopCertWatch(appID int) {
+	mutexCertWatches.Lock()
+	defer mutexCertWatches.Unlock()
+	if chanStop, ok := mapCertWatches[appID]; ok {
+		close(chanStop)
+		delete(mapCertWatches, appID)
+	}
+}
@@ -0,0 +1,79 @@
+package apnsservice
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// rotatingProvider returns a new certificate on every fetch up to intLast.
+type rotatingProvider struct {
+	mutex    sync.Mutex
+	intFetch int
+	intLast  int
+}
+
+func (p *rotatingProvider) FetchCert(ctx context.Context, appID int) (AppCert, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.intFetch < p.intLast {
+		p.intFetch++
+	}
+	return AppCert{AppID: appID, Cert: []byte(fmt.Sprint("cert ", p.intFetch)), RSAKey: []byte("key")}, nil
+}
+
+func TestCertRotationHandsOverAndClosesLog(t *testing.T) {
+	const appID = 9401
+	transport := NewMockTransport()
+	SetConnectionOptions(appID, ConnectionOptions{
+		Mock:    transport,
+		LogFile: filepath.Join(t.TempDir(), "rotate.log"),
+	})
+	if err := LaunchWithCertProvider(appID, "rotate", &rotatingProvider{intLast: 1}, true, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+	first := getConnection(appID)
+	if first.closerLog == nil {
+		t.Fatal("log file not opened")
+	}
+
+	if err := Pause(appID); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := PushOne(appID, apns.Payload{Token: testToken(i), AlertText: "held"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a watch that ticks at once stands in for the hourly one
+	chanStop := make(chan struct{})
+	defer close(chanStop)
+	go watchCert(appID, "rotate", &rotatingProvider{intFetch: 1, intLast: 2}, true, 10*time.Millisecond,
+		certFingerprint(first.cert), chanStop)
+
+	if !transport.WaitForSent(3, 2*time.Second) {
+		t.Fatalf("sent %d of 3 held pushes after the rotation", len(transport.Sent()))
+	}
+	if getConnection(appID) == first {
+		t.Fatal("connection was not relaunched")
+	}
+	fileLog := first.closerLog.(*os.File)
+	timeLimit := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := fileLog.Stat(); err != nil {
+			return // closed
+		}
+		if time.Now().After(timeLimit) {
+			t.Fatal("old log file left open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,314 @@
+// Command apnsctl is an operations tool for debugging pushes without writing
+// a throwaway program.
+//
+//	apnsctl send     -cert cert.pem -key key.pem -token TOKEN -alert "hello"
+//	apnsctl send     -p8 AuthKey.p8 -key-id KEYID -team-id TEAMID -topic com.example.app -token TOKEN -payload body.json
+//	apnsctl feedback -cert cert.pem -key key.pem
+//	apnsctl cert     -cert cert.pem [-key key.pem]
+//	apnsctl validate [-voip] body.json
+//
+// Add -dev to use the sandbox. The service writes its connection log under logs/apns.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/apnsservice"
+)
+
+// ctlAppID is the app id the tool registers its one connection under.
+const ctlAppID = 1
+
+// credentials holds the flags that name an app's Apple credentials.
+type credentials struct {
+	strCert   *string
+	strKey    *string
+	strP8     *string
+	strKeyID  *string
+	strTeamID *string
+	isDev     *bool
+}
+
+// auditChannel is an AuditSink that hands records to the waiting command.
+type auditChannel chan apnsservice.AuditRecord
+
+// RecordAttempt passes the record on unless nobody is listening.
+func (c auditChannel) RecordAttempt(record apnsservice.AuditRecord) error {
+	select {
+	case c <- record:
+	default:
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "send":
+		err = runSend(os.Args[2:])
+	case "feedback":
+		err = runFeedback(os.Args[2:])
+	case "cert":
+		err = runCert(os.Args[2:])
+	case "validate":
+		err = runValidate(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "apnsctl:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// usage prints the commands and exits.
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: apnsctl send|feedback|cert|validate [flags]")
+	os.Exit(2)
+}
+
+// addCredentials declares the credential flags on flags.
+func addCredentials(flags *flag.FlagSet) credentials {
+	return credentials{
+		strCert:   flags.String("cert", "", "PEM push certificate"),
+		strKey:    flags.String("key", "", "PEM private key of the certificate"),
+		strP8:     flags.String("p8", "", "p8 auth key for token-based authentication"),
+		strKeyID:  flags.String("key-id", "", "key id of the p8 auth key"),
+		strTeamID: flags.String("team-id", "", "team id of the p8 auth key"),
+		isDev:     flags.Bool("dev", false, "use the sandbox"),
+	}
+}
+
+// appCert reads the credential files into an AppCert.
+func (c credentials) appCert() (apnsservice.AppCert, error) {
+	appCert := apnsservice.AppCert{AppID: ctlAppID, KeyID: *c.strKeyID, TeamID: *c.strTeamID}
+	if *c.isDev {
+		appCert.IsDev = 1
+	}
+	var err error
+	if *c.strP8 != "" {
+		appCert.AuthKey, err = os.ReadFile(*c.strP8)
+		return appCert, err
+	}
+	if *c.strCert == "" || *c.strKey == "" {
+		return appCert, errors.New("-cert and -key, or -p8, are required")
+	}
+	if appCert.Cert, err = os.ReadFile(*c.strCert); err != nil {
+		return appCert, err
+	}
+	appCert.RSAKey, err = os.ReadFile(*c.strKey)
+	return appCert, err
+}
+
+// launch connects the tool's app with opts.
+func launch(appCert apnsservice.AppCert, opts apnsservice.ConnectionOptions) error {
+	apnsservice.InitURLs(false)
+	listOptions := []apnsservice.Option{apnsservice.WithConnectionOptions(opts)}
+	if appCert.IsDev != 0 {
+		listOptions = append(listOptions, apnsservice.WithSandbox())
+	}
+	cert := apnsservice.Credentials{
+		Cert:    appCert.Cert,
+		RSAKey:  appCert.RSAKey,
+		AuthKey: appCert.AuthKey,
+		KeyID:   appCert.KeyID,
+		TeamID:  appCert.TeamID,
+	}
+	return apnsservice.LaunchConnectionWithOptions(ctlAppID, "apnsctl", cert, listOptions...)
+}
+
+// runSend pushes one notification and reports Apple's answer.
+func runSend(listArgs []string) error {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	creds := addCredentials(flags)
+	strToken := flags.String("token", "", "device token")
+	strTopic := flags.String("topic", "", "bundle id, required with -p8")
+	strAlert := flags.String("alert", "", "alert text")
+	strPayload := flags.String("payload", "", "JSON payload file, instead of -alert")
+	strPushType := flags.String("push-type", "", "apns-push-type")
+	isVoIP := flags.Bool("voip", false, "send a VoIP push")
+	isBinary := flags.Bool("binary", false, "use the legacy binary protocol")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long to wait for Apple's answer")
+	flags.Parse(listArgs)
+
+	if *strToken == "" {
+		return errors.New("-token is required")
+	}
+	appCert, err := creds.appCert()
+	if err != nil {
+		return err
+	}
+	limit := apnsservice.MaxPayloadSize
+	if *isVoIP {
+		limit = apnsservice.MaxVoIPPayloadSize
+	}
+	payload := apns.Payload{Token: *strToken, AlertText: *strAlert}
+	if *strPayload != "" {
+		data, err := os.ReadFile(*strPayload)
+		if err != nil {
+			return err
+		}
+		if payload, err = apnsservice.ParsePayload(*strToken, data, limit); err != nil {
+			return err
+		}
+	}
+
+	chanAudit := make(auditChannel, 16)
+	opts := apnsservice.ConnectionOptions{
+		Protocol:    apnsservice.ProtocolHTTP2,
+		Topic:       *strTopic,
+		VoIP:        *isVoIP,
+		RetryPolicy: apnsservice.RetryPolicy{MaxAttempts: 3},
+		AuditSink:   chanAudit,
+	}
+	if *isBinary {
+		opts.Protocol = apnsservice.ProtocolBinary
+	}
+	if err := launch(appCert, opts); err != nil {
+		return err
+	}
+	defer apnsservice.CloseAllConnections()
+
+	if err := apnsservice.PushOneWithOptions(ctlAppID, payload, apnsservice.PushOptions{PushType: *strPushType}); err != nil {
+		return err
+	}
+
+	// the binary protocol only reports rejections, so a sent record is
+	// followed by a short wait for one
+	timer := time.NewTimer(*timeout)
+	defer timer.Stop()
+	var recordSent *apnsservice.AuditRecord
+	for {
+		select {
+		case record := <-chanAudit:
+			printJSON(record)
+			switch record.Outcome {
+			case apnsservice.AuditDelivered:
+				return nil
+			case apnsservice.AuditSent:
+				recordSent = &record
+				timer.Reset(2 * time.Second)
+			case apnsservice.AuditRejected, apnsservice.AuditExpired:
+				return fmt.Errorf("push %s: %d %s", record.Outcome, record.Status, record.Reason)
+			}
+		case <-timer.C:
+			if recordSent != nil {
+				return nil
+			}
+			return fmt.Errorf("no answer from Apple within %s", timeout.String())
+		}
+	}
+}
+
+// runFeedback prints the tokens the binary feedback service reports as uninstalled.
+func runFeedback(listArgs []string) error {
+	flags := flag.NewFlagSet("feedback", flag.ExitOnError)
+	creds := addCredentials(flags)
+	flags.Parse(listArgs)
+
+	appCert, err := creds.appCert()
+	if err != nil {
+		return err
+	}
+	chanFeedback, unsubscribe := apnsservice.SubscribeFeedback(10000)
+	defer unsubscribe()
+	// launch reads the feedback service before it opens the push sockets
+	if err := launch(appCert, apnsservice.ConnectionOptions{Protocol: apnsservice.ProtocolBinary}); err != nil {
+		return err
+	}
+	defer apnsservice.CloseAllConnections()
+
+	intCount := 0
+	for {
+		select {
+		case feedback := <-chanFeedback:
+			printJSON(feedback)
+			intCount++
+		default:
+			fmt.Fprintf(os.Stderr, "%d tokens reported\n", intCount)
+			return nil
+		}
+	}
+}
+
+// runCert prints the topic and validity of a push certificate.
+func runCert(listArgs []string) error {
+	flags := flag.NewFlagSet("cert", flag.ExitOnError)
+	strCert := flags.String("cert", "", "PEM push certificate")
+	strKey := flags.String("key", "", "optional PEM private key, checked against the certificate")
+	flags.Parse(listArgs)
+
+	if *strCert == "" {
+		return errors.New("-cert is required")
+	}
+	var appCert apnsservice.AppCert
+	var err error
+	if appCert.Cert, err = os.ReadFile(*strCert); err != nil {
+		return err
+	}
+	if *strKey != "" {
+		if appCert.RSAKey, err = os.ReadFile(*strKey); err != nil {
+			return err
+		}
+	}
+	info, err := apnsservice.InspectCert(appCert)
+	if err != nil {
+		return err
+	}
+	printJSON(info)
+	remaining := time.Until(info.NotAfter)
+	if remaining <= 0 {
+		return fmt.Errorf("%w on %s", apnsservice.ErrCertExpired, info.NotAfter.Format(time.RFC3339))
+	}
+	fmt.Fprintf(os.Stderr, "expires in %d days\n", int(remaining.Hours()/24))
+	return nil
+}
+
+// runValidate checks a JSON payload file, or stdin for "-", against Apple's limit.
+func runValidate(listArgs []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	isVoIP := flags.Bool("voip", false, "apply the VoIP size limit")
+	flags.Parse(listArgs)
+
+	if flags.NArg() != 1 {
+		return errors.New("one payload file is required")
+	}
+	var data []byte
+	var err error
+	if flags.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	limit := apnsservice.MaxPayloadSize
+	if *isVoIP {
+		limit = apnsservice.MaxVoIPPayloadSize
+	}
+	if _, err := apnsservice.ParsePayload("", data, limit); err != nil {
+		var sizeErr *apnsservice.PayloadSizeError
+		if errors.As(err, &sizeErr) {
+			printJSON(sizeErr)
+		}
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "payload is valid, %d bytes of %d\n", len(data), limit)
+	return nil
+}
+
+// printJSON writes value to stdout as one line of JSON.
+func printJSON(value interface{}) {
+	json.NewEncoder(os.Stdout).Encode(value)
+}
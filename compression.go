@@ -0,0 +1,131 @@
+package apnsservice
+
+// This source code includes pluggable compression for the records this service
+// writes to disk: write-ahead logs, spill files and exports. Each record names
+// the codec that wrote it, so files stay readable after the codec is changed.
+// gzip is built in; snappy, zstd and others plug in through the Compressor interface.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compressor compresses and decompresses one record.
+// Name identifies the codec in every record it writes and must be stable.
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// CompressionNone is the name of the pass-through codec.
+const CompressionNone = "none"
+
+// CompressionGzip is the name of the built-in gzip codec.
+const CompressionGzip = "gzip"
+
+// mapCompressors stores registered codecs keyed by name.
+// compressorActive is the codec used for records written from now on.
+var (
+	mutexCompressors sync.RWMutex
+	mapCompressors   = map[string]Compressor{
+		CompressionNone: noneCompressor{},
+		CompressionGzip: gzipCompressor{},
+	}
+	compressorActive Compressor = noneCompressor{}
+)
+
+// RegisterCompressor makes a codec available for writing and reading records.
+func RegisterCompressor(c Compressor) error {
+	strName := c.Name()
+	if strName == "" || len(strName) > 255 {
+		return errors.New("compressor name must be 1 to 255 bytes")
+	}
+	mutexCompressors.Lock()
+	defer mutexCompressors.Unlock()
+	mapCompressors[strName] = c
+	return nil
+}
+
+// SetCompressor selects the registered codec used for records written from now on.
+// Records already on disk keep their codec and remain readable.
+func SetCompressor(name string) error {
+	mutexCompressors.Lock()
+	defer mutexCompressors.Unlock()
+	c, ok := mapCompressors[name]
+	if !ok {
+		return fmt.Errorf("compressor %s is not registered", name)
+	}
+	compressorActive = c
+	return nil
+}
+
+// compressRecord encodes data with the active codec behind a header naming it.
+func compressRecord(data []byte) ([]byte, error) {
+	mutexCompressors.RLock()
+	c := compressorActive
+	mutexCompressors.RUnlock()
+
+	body, err := c.Compress(data)
+	if err != nil {
+		return nil, err
+	}
+	strName := c.Name()
+	record := make([]byte, 0, 1+len(strName)+len(body))
+	record = append(record, byte(len(strName)))
+	record = append(record, strName...)
+	return append(record, body...), nil
+}
+
+// decompressRecord decodes a record written by compressRecord with any registered codec.
+func decompressRecord(record []byte) ([]byte, error) {
+	if len(record) == 0 || len(record) < 1+int(record[0]) {
+		return nil, errors.New("compressed record is truncated")
+	}
+	strName := string(record[1 : 1+record[0]])
+
+	mutexCompressors.RLock()
+	c, ok := mapCompressors[strName]
+	mutexCompressors.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("record written with unregistered compressor %s", strName)
+	}
+	return c.Decompress(record[1+record[0]:])
+}
+
+// noneCompressor stores records as is.
+type noneCompressor struct{}
+
+func (noneCompressor) Name() string                           { return CompressionNone }
+func (noneCompressor) Compress(data []byte) ([]byte, error)   { return data, nil }
+func (noneCompressor) Decompress(data []byte) ([]byte, error) { return data, nil }
+
+// gzipCompressor compresses records with compress/gzip.
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return CompressionGzip }
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
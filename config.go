@@ -0,0 +1,224 @@
+package apnsservice
+
+// This source code includes loading the app fleet from a JSON or YAML file.
+// The file declares the gateway environment and each app's credentials by
+// path, options, socket count, logging and rate limits. LaunchFromConfig
+// brings the whole fleet up in one call and reports errors per app.
+//
+//	environment: production
+//	apps:
+//	  - appId: 42
+//	    stringId: acme
+//	    certFile: certs/acme.pem
+//	    keyFile: certs/acme.key
+//	    isLogging: true
+//	    options:
+//	      sockets: 4
+//	      rateLimit: {perSecond: 500, burst: 1000}
+//	  - appId: 43
+//	    stringId: globex
+//	    sandbox: true
+//	    authKeyFile: keys/AuthKey_ABC123.p8
+//	    keyId: ABC123
+//	    teamId: TEAM123456
+//	    options: {protocol: http2, topic: com.globex.app}
+//
+// Field names are the JSON names of Config, AppConfig and ConnectionOptions
+// in both formats. Durations are strings such as "30s" or "1m30s", or
+// numbers of nanoseconds.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/knousere/web-service-commons/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// These are the values of Config.Environment.
+const (
+	EnvironmentProduction = "production"
+	EnvironmentSandbox    = "sandbox"
+)
+
+// AppError reports a configuration or launch error of one app.
+type AppError struct {
+	AppID    int
+	StringID string
+	Err      error
+}
+
+func (e *AppError) Error() string {
+	return fmt.Sprintf("app %d %s: %s", e.AppID, e.StringID, e.Err.Error())
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// LoadConfig reads a JSON or YAML config file, chosen by the .yaml or .yml
+// extension, and loads the cert and key files it names. Relative paths are
+// resolved from the config file's directory. Every invalid app is reported
+// as an *AppError in the joined error.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		utils.Warning.Println("LoadConfig", path, err.Error())
+		return nil, err
+	}
+
+	strExt := strings.ToLower(filepath.Ext(path))
+	if strExt == ".yaml" || strExt == ".yml" {
+		// decode YAML generically and re-encode it so one set of JSON tags serves both formats
+		var document interface{}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		if data, err = json.Marshal(document); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	switch config.Environment {
+	case "", EnvironmentProduction, EnvironmentSandbox:
+	default:
+		return nil, fmt.Errorf("%s: unknown environment %q", path, config.Environment)
+	}
+
+	strDir := filepath.Dir(path)
+	var listErrors []error
+	for i := range config.Apps {
+		appConfig := &config.Apps[i]
+		err := appConfig.loadFiles(strDir)
+		if err == nil {
+			err = appConfig.validate()
+		}
+		if err != nil {
+			listErrors = append(listErrors, &AppError{AppID: appConfig.AppID, StringID: appConfig.StringID, Err: err})
+		}
+	}
+	if len(listErrors) > 0 {
+		return config, errors.Join(listErrors...)
+	}
+	return config, nil
+}
+
+// LaunchFromConfig sets the gateway environment and launches every app in
+// config, replacing existing connections. An app that fails validation or
+// launch does not stop the others; each is reported as an *AppError.
+func LaunchFromConfig(config *Config) error {
+	if config.Environment != "" {
+		InitURLs(config.Environment == EnvironmentSandbox)
+	}
+
+	var listErrors []error
+	mapSeen := make(map[int]bool)
+	for i := range config.Apps {
+		appConfig := &config.Apps[i]
+		err := appConfig.validate()
+		if err == nil && mapSeen[appConfig.AppID] {
+			err = errors.New("app is declared more than once")
+		}
+		mapSeen[appConfig.AppID] = true
+		if err == nil {
+			SetConnectionOptions(appConfig.AppID, appConfig.options())
+			err = registerConnection(appConfig.AppID, appConfig.StringID, appConfig.Cert, appConfig.IsLogging, true)
+		}
+		if err != nil {
+			listErrors = append(listErrors, &AppError{AppID: appConfig.AppID, StringID: appConfig.StringID, Err: err})
+		}
+	}
+	utils.Info.Println("launched", len(config.Apps)-len(listErrors), "of", len(config.Apps), "apps from config")
+	return errors.Join(listErrors...)
+}
+
+// loadFiles reads the cert and key files named by the app into its AppCert.
+func (c *AppConfig) loadFiles(strDir string) error {
+	c.Cert.AppID = c.AppID
+	if c.Sandbox {
+		c.Cert.IsDev = 1
+	}
+	for _, file := range []struct {
+		strPath string
+		data    *[]byte
+	}{
+		{c.CertFile, &c.Cert.Cert},
+		{c.KeyFile, &c.Cert.RSAKey},
+		{c.AuthKeyFile, &c.Cert.AuthKey},
+	} {
+		if file.strPath == "" {
+			continue
+		}
+		strPath := file.strPath
+		if !filepath.IsAbs(strPath) {
+			strPath = filepath.Join(strDir, strPath)
+		}
+		data, err := os.ReadFile(strPath)
+		if err != nil {
+			return err
+		}
+		*file.data = data
+	}
+	if c.KeyID != "" {
+		c.Cert.KeyID = c.KeyID
+	}
+	if c.TeamID != "" {
+		c.Cert.TeamID = c.TeamID
+	}
+	return nil
+}
+
+// options returns the app's options over those set from code, which keep the
+// fields a config file cannot hold, such as SharedQueue or DeadLetterSink.
+func (c *AppConfig) options() ConnectionOptions {
+	return mergeOptions(lookupOptions(c.AppID), c.Options)
+}
+
+// validate checks one app's declaration.
+func (c *AppConfig) validate() error {
+	var listProblems []string
+	if c.AppID <= 0 {
+		listProblems = append(listProblems, "appId must be positive")
+	}
+	if c.StringID == "" {
+		listProblems = append(listProblems, "stringId is required")
+	}
+	opts := c.options()
+	switch {
+	case opts.Mock != nil:
+	case opts.EnqueueOnly && opts.SharedQueue != nil:
+		// a producer opens no connection to Apple
+	case c.Cert.hasAuthKey():
+		if c.Cert.KeyID == "" || c.Cert.TeamID == "" {
+			listProblems = append(listProblems, "auth key requires keyId and teamId")
+		}
+		if c.Options.Protocol != ProtocolHTTP2 {
+			listProblems = append(listProblems, "auth key requires protocol http2")
+		}
+	case len(c.Cert.Cert) == 0 || len(c.Cert.RSAKey) == 0:
+		listProblems = append(listProblems, "no cert: set certFile and keyFile or authKeyFile")
+	}
+	if c.Options.Sockets < 0 || c.Options.Sockets > maxSockets {
+		listProblems = append(listProblems, fmt.Sprintf("sockets must be 1 to %d", maxSockets))
+	}
+	if c.Options.RateLimit.PerSecond < 0 || c.Options.RateLimit.Burst < 0 {
+		listProblems = append(listProblems, "rate limit must not be negative")
+	}
+	for _, strClass := range c.Options.Classes {
+		if err := validateClass(strClass, nil); err != nil {
+			listProblems = append(listProblems, err.Error())
+		}
+	}
+	if len(listProblems) > 0 {
+		return errors.New(strings.Join(listProblems, ", "))
+	}
+	return nil
+}
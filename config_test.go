@@ -0,0 +1,65 @@
+package apnsservice
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigDurations(t *testing.T) {
+	strPath := filepath.Join(t.TempDir(), "apns.json")
+	data := []byte(`{"apps": [{"appId": 9601, "stringId": "durations", "options": {
+		"enqueueOnly": true,
+		"leaseTtl": "45s",
+		"idempotencyWindow": 600000000000,
+		"retryPolicy": {"baseDelay": "250ms", "maxDelay": "1m"},
+		"circuitBreaker": {"threshold": 3, "coolDown": "10m"}
+	}}]}`)
+	if err := os.WriteFile(strPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetConnectionOptions(9601, ConnectionOptions{SharedQueue: NewMemoryQueue()})
+	defer SetConnectionOptions(9601, ConnectionOptions{})
+
+	config, err := LoadConfig(strPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := config.Apps[0].Options
+	if opts.LeaseTTL != 45*time.Second || opts.IdempotencyWindow != 10*time.Minute ||
+		opts.RetryPolicy.BaseDelay != 250*time.Millisecond || opts.RetryPolicy.MaxDelay != time.Minute ||
+		opts.CircuitBreaker.CoolDown != 10*time.Minute {
+		t.Fatalf("durations decoded as %+v", opts)
+	}
+}
+
+func TestLoadConfigBadDuration(t *testing.T) {
+	strPath := filepath.Join(t.TempDir(), "apns.json")
+	data := []byte(`{"apps": [{"appId": 9602, "stringId": "bad", "options": {"leaseTtl": "soon"}}]}`)
+	if err := os.WriteFile(strPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(strPath); err == nil {
+		t.Fatal("invalid duration accepted")
+	}
+}
+
+func TestLaunchFromConfigKeepsCodeSetOptions(t *testing.T) {
+	const appID = 9603
+	sink := &deadLetters{}
+	SetConnectionOptions(appID, ConnectionOptions{SharedQueue: NewMemoryQueue(), DeadLetterSink: sink})
+	config := &Config{Apps: []AppConfig{{
+		AppID:    appID,
+		StringID: "producer",
+		Options:  ConnectionOptions{EnqueueOnly: true, Sockets: 2},
+	}}}
+	if err := LaunchFromConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+	a := getConnection(appID)
+	if !a.isEnqueueOnly() || a.options.DeadLetterSink == nil || a.options.Sockets != 2 {
+		t.Fatalf("launched with options %+v", a.options)
+	}
+}
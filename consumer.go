@@ -0,0 +1,343 @@
+package apnsservice
+
+// This source code includes message bus ingestion. A consumer reads push jobs
+// from Kafka or NATS JetStream through a small adapter over the caller's
+// client, routes each job to its app's connection and commits the message
+// only once the push is enqueued. Jobs that cannot be decoded or are rejected
+// for good are dead-lettered and committed so they do not block the stream.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// These are the consumer defaults.
+// maxConsumerRetryDelay caps the backoff between retries of one job.
+const (
+	defaultConsumerRetryDelay      = time.Second
+	defaultConsumerMaxRedeliveries = 10
+	maxConsumerRetryDelay          = time.Minute
+)
+
+// PushJob is the JSON message schema of a push job on the bus.
+// Payload is the JSON body Apple receives; without it the job is built from
+// Alert, Badge, Sound and Data. Platform defaults to PlatformIOS.
+type PushJob struct {
+	AppID    int                    `json:"appId"`
+	Platform Platform               `json:"platform,omitempty"`
+	Token    string                 `json:"token"`
+	Payload  json.RawMessage        `json:"payload,omitempty"`
+	Alert    string                 `json:"alert,omitempty"`
+	Badge    *int                   `json:"badge,omitempty"`
+	Sound    string                 `json:"sound,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+	Options  PushOptions            `json:"options"`
+}
+
+// BusMessage is one message read from a bus. ID identifies the message, for
+// example topic/partition/offset on Kafka, and is the default idempotency key
+// of its job. Raw carries the client's own message for the adapter's commit.
+type BusMessage struct {
+	ID      string
+	Topic   string
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+	Raw     interface{}
+}
+
+// KafkaReader adapts a Kafka consumer group client, such as a kafka-go Reader
+// with a GroupID, to the consumer.
+type KafkaReader interface {
+	// FetchMessage blocks for the next message without committing it.
+	FetchMessage(ctx context.Context) (BusMessage, error)
+	// CommitMessage commits the offset of msg.
+	CommitMessage(ctx context.Context, msg BusMessage) error
+}
+
+// NATSSubscription adapts a NATS JetStream subscription with explicit acks to the consumer.
+type NATSSubscription interface {
+	// NextMsg blocks for the next message.
+	NextMsg(ctx context.Context) (BusMessage, error)
+	// Ack acknowledges msg so it is not redelivered.
+	Ack(msg BusMessage) error
+	// Nak asks the server to redeliver msg later.
+	Nak(msg BusMessage) error
+}
+
+// ConsumerOptions tune a consumer.
+type ConsumerOptions struct {
+	// DeadLetter receives jobs that cannot be decoded or are rejected for
+	// good, for example to publish them to a dead-letter topic. If it returns
+	// an error the message is not committed and is dead-lettered again.
+	// When nil such jobs are logged and committed.
+	DeadLetter func(msg BusMessage, err error) error
+
+	// RetryDelay is the wait before a job the app could not take, for example
+	// on ErrQueueFull, is tried again. It doubles with each retry of the same
+	// job, up to one minute. The default is one second.
+	RetryDelay time.Duration
+
+	// MaxRedeliveries is how many times a job the app could not take is
+	// retried before it is dead-lettered. The default is 10.
+	MaxRedeliveries int
+}
+
+// ConsumerStats counts the jobs a consumer has handled.
+type ConsumerStats struct {
+	Consumed     int64  `json:"consumed"`
+	Pushed       int64  `json:"pushed"`
+	DeadLettered int64  `json:"deadLettered"`
+	Retried      int64  `json:"retried"` // pushes refused for now, such as on ErrQueueFull
+	LastError    string `json:"lastError,omitempty"`
+}
+
+// Consumer is a running bus consumer.
+type Consumer struct {
+	mutex      sync.Mutex
+	stats      ConsumerStats
+	cancel     context.CancelFunc
+	chanDone   chan struct{}
+	mapRetries map[string]int // retries by message ID, used by the run loop only
+}
+
+// busSource is the part of a bus the consumer loop uses.
+type busSource interface {
+	next(ctx context.Context) (BusMessage, error)
+	commit(ctx context.Context, msg BusMessage) error
+	// redeliver hands msg back to the bus for a retry after the consumer's
+	// backoff. It returns false if the bus cannot, and the consumer retries
+	// msg in place.
+	redeliver(msg BusMessage) bool
+}
+
+// kafkaSource commits Kafka offsets in order, so a job is retried in place.
+type kafkaSource struct {
+	reader KafkaReader
+}
+
+// next fetches the next message.
+func (s kafkaSource) next(ctx context.Context) (BusMessage, error) {
+	return s.reader.FetchMessage(ctx)
+}
+
+// commit commits the offset of msg.
+func (s kafkaSource) commit(ctx context.Context, msg BusMessage) error {
+	return s.reader.CommitMessage(ctx, msg)
+}
+
+// redeliver is not possible without skipping past the offset.
+func (s kafkaSource) redeliver(msg BusMessage) bool {
+	return false
+}
+
+// natsSource acks JetStream messages one by one, so a job is naked for redelivery.
+type natsSource struct {
+	subscription NATSSubscription
+}
+
+// next waits for the next message.
+func (s natsSource) next(ctx context.Context) (BusMessage, error) {
+	return s.subscription.NextMsg(ctx)
+}
+
+// commit acks msg.
+func (s natsSource) commit(ctx context.Context, msg BusMessage) error {
+	return s.subscription.Ack(msg)
+}
+
+// redeliver naks msg.
+func (s natsSource) redeliver(msg BusMessage) bool {
+	return s.subscription.Nak(msg) == nil
+}
+
+// StartKafkaConsumer consumes push jobs from reader in the background.
+// Offsets are committed in order, after each job is enqueued or dead-lettered.
+func StartKafkaConsumer(reader KafkaReader, opts ConsumerOptions) (*Consumer, error) {
+	if reader == nil {
+		return nil, errors.New("kafka reader is required")
+	}
+	return startConsumer(kafkaSource{reader: reader}, opts), nil
+}
+
+// StartNATSConsumer consumes push jobs from subscription in the background.
+// Each message is acked after its job is enqueued or dead-lettered, and
+// naked when the app cannot take it yet.
+func StartNATSConsumer(subscription NATSSubscription, opts ConsumerOptions) (*Consumer, error) {
+	if subscription == nil {
+		return nil, errors.New("nats subscription is required")
+	}
+	return startConsumer(natsSource{subscription: subscription}, opts), nil
+}
+
+// startConsumer runs the consumer loop over source.
+func startConsumer(source busSource, opts ConsumerOptions) *Consumer {
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = defaultConsumerRetryDelay
+	}
+	if opts.MaxRedeliveries <= 0 {
+		opts.MaxRedeliveries = defaultConsumerMaxRedeliveries
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Consumer{cancel: cancel, chanDone: make(chan struct{}), mapRetries: make(map[string]int)}
+	go c.run(ctx, source, opts)
+	return c
+}
+
+// Stats returns a snapshot of the consumer's counters.
+func (c *Consumer) Stats() ConsumerStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
+
+// Stop ends the consumer and waits for the job in hand to be settled or abandoned.
+// An abandoned job is not committed, so the bus delivers it again.
+func (c *Consumer) Stop() {
+	c.cancel()
+	<-c.chanDone
+}
+
+// run reads and handles messages until the consumer is stopped.
+func (c *Consumer) run(ctx context.Context, source busSource, opts ConsumerOptions) {
+	defer close(c.chanDone)
+	for {
+		msg, err := source.next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.recordError(err)
+			utils.Warning.Println("Consumer fetch", err.Error())
+			if !sleepContext(ctx, opts.RetryDelay) {
+				return
+			}
+			continue
+		}
+		c.update(func(stats *ConsumerStats) { stats.Consumed++ })
+		for !c.handle(ctx, source, msg, opts) {
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle pushes the job of msg and settles msg. It returns false when msg
+// must be retried in place. A job the app could not take is retried after a
+// growing delay, and dead-lettered after opts.MaxRedeliveries retries.
+func (c *Consumer) handle(ctx context.Context, source busSource, msg BusMessage, opts ConsumerOptions) bool {
+	err := pushBusMessage(msg)
+	if isRetryablePush(err) {
+		intRetries := c.mapRetries[msg.ID]
+		if intRetries < opts.MaxRedeliveries {
+			c.mapRetries[msg.ID] = intRetries + 1
+			c.update(func(stats *ConsumerStats) { stats.Retried++ })
+			c.recordError(err)
+			policy := RetryPolicy{BaseDelay: opts.RetryDelay, MaxDelay: maxConsumerRetryDelay}
+			if !sleepContext(ctx, policy.delay(intRetries)) {
+				return false
+			}
+			return source.redeliver(msg)
+		}
+		err = fmt.Errorf("gave up after %d retries: %w", intRetries, err)
+	}
+	switch {
+	case err == nil, errors.Is(err, ErrDuplicate):
+		c.update(func(stats *ConsumerStats) { stats.Pushed++ })
+	default:
+		c.recordError(err)
+		if opts.DeadLetter == nil {
+			utils.Warning.Println("Consumer dropped job", msg.ID, err.Error())
+		} else if errDead := opts.DeadLetter(msg, err); errDead != nil {
+			utils.Warning.Println("Consumer dead letter", msg.ID, errDead.Error())
+			sleepContext(ctx, opts.RetryDelay)
+			return false
+		}
+		c.update(func(stats *ConsumerStats) { stats.DeadLettered++ })
+	}
+	delete(c.mapRetries, msg.ID)
+	if err := source.commit(ctx, msg); err != nil {
+		// the bus will deliver the job again; its idempotency key catches the repeat
+		c.recordError(err)
+		utils.Warning.Println("Consumer commit", msg.ID, err.Error())
+	}
+	return true
+}
+
+// update changes the stats under the lock.
+func (c *Consumer) update(change func(stats *ConsumerStats)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	change(&c.stats)
+}
+
+// recordError remembers the most recent error.
+func (c *Consumer) recordError(err error) {
+	c.update(func(stats *ConsumerStats) { stats.LastError = err.Error() })
+}
+
+// isRetryablePush reports whether a push was refused only for now. A job for
+// an app that was never launched is refused for good, though ErrNotLaunched
+// matches ErrNotActive.
+func isRetryablePush(err error) bool {
+	if errors.Is(err, ErrNotLaunched) {
+		return false
+	}
+	return errors.Is(err, ErrQueueFull) || errors.Is(err, ErrNotActive) || errors.Is(err, ErrRateLimited)
+}
+
+// sleepContext waits for d and reports false if ctx ended first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// pushBusMessage decodes the job of msg and pushes it to its app.
+func pushBusMessage(msg BusMessage) error {
+	var job PushJob
+	if err := json.Unmarshal(msg.Value, &job); err != nil {
+		return fmt.Errorf("invalid push job: %s", err.Error())
+	}
+	payload := apns.Payload{
+		Token:     job.Token,
+		AlertText: job.Alert,
+		Sound:     job.Sound,
+		ExtraData: job.Data,
+	}
+	if job.Badge != nil {
+		if *job.Badge < 0 {
+			return fmt.Errorf("invalid push job: badge %d is negative", *job.Badge)
+		}
+		payload.Badge = apns.NewBadgeNumber(uint32(*job.Badge))
+	}
+	if len(job.Payload) > 0 {
+		var err error
+		// prepare applies the exact limit of the push type
+		if payload, err = ParsePayload(job.Token, job.Payload, MaxVoIPPayloadSize); err != nil {
+			return err
+		}
+	}
+	platform := job.Platform
+	if platform == "" {
+		platform = PlatformIOS
+	}
+	opts := job.Options
+	if opts.IdempotencyKey == "" {
+		opts.IdempotencyKey = msg.ID
+	}
+	return PushWithOptions(job.AppID, platform, payload, opts)
+}
@@ -0,0 +1,121 @@
+package apnsservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsRetryablePush(t *testing.T) {
+	for _, test := range []struct {
+		err         error
+		isRetryable bool
+	}{
+		{ErrQueueFull, true},
+		{ErrNotActive, true},
+		{ErrRateLimited, true},
+		{fmt.Errorf("push: %w", ErrQueueFull), true},
+		{ErrNotLaunched, false},
+		{fmt.Errorf("push: %w", ErrNotLaunched), false},
+		{ErrInvalidToken, false},
+	} {
+		if got := isRetryablePush(test.err); got != test.isRetryable {
+			t.Errorf("isRetryablePush(%v) = %v, want %v", test.err, got, test.isRetryable)
+		}
+	}
+}
+
+// stubNATS hands out one message and records how it was settled.
+type stubNATS struct {
+	msg      BusMessage
+	chanNext chan BusMessage
+	mutex    sync.Mutex
+	intNaks  int
+	intAcks  int
+}
+
+func (s *stubNATS) NextMsg(ctx context.Context) (BusMessage, error) {
+	select {
+	case msg := <-s.chanNext:
+		return msg, nil
+	case <-ctx.Done():
+		return BusMessage{}, ctx.Err()
+	}
+}
+
+func (s *stubNATS) Ack(msg BusMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.intAcks++
+	return nil
+}
+
+func (s *stubNATS) Nak(msg BusMessage) error {
+	s.mutex.Lock()
+	s.intNaks++
+	s.mutex.Unlock()
+	s.chanNext <- msg
+	return nil
+}
+
+func TestConsumerDeadLettersAfterMaxRedeliveries(t *testing.T) {
+	const appID = 9501
+	if err := LaunchConnectionWithTransport(appID, "closed", NewMockTransport(), false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+	CloseConnection(appID)
+
+	value, _ := json.Marshal(PushJob{AppID: appID, Token: strings.Repeat("ab", 32), Alert: "hi"})
+	nats := &stubNATS{chanNext: make(chan BusMessage, 1)}
+	nats.chanNext <- BusMessage{ID: "job-1", Value: value}
+	chanDead := make(chan error, 1)
+	consumer, err := StartNATSConsumer(nats, ConsumerOptions{
+		RetryDelay:      time.Millisecond,
+		MaxRedeliveries: 3,
+		DeadLetter: func(msg BusMessage, err error) error {
+			chanDead <- err
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Stop()
+
+	select {
+	case err := <-chanDead:
+		if !errors.Is(err, ErrNotActive) {
+			t.Errorf("dead letter error = %v, want ErrNotActive", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not dead-lettered")
+	}
+	time.Sleep(20 * time.Millisecond)
+	nats.mutex.Lock()
+	defer nats.mutex.Unlock()
+	if nats.intNaks != 3 || nats.intAcks != 1 {
+		t.Errorf("naks = %d, acks = %d, want 3 and 1", nats.intNaks, nats.intAcks)
+	}
+	if stats := consumer.Stats(); stats.Retried != 3 || stats.DeadLettered != 1 {
+		t.Errorf("stats = %+v, want 3 retried and 1 dead-lettered", stats)
+	}
+}
+
+func TestPushJobDurationStrings(t *testing.T) {
+	var job PushJob
+	if err := json.Unmarshal([]byte(`{"appId": 1, "options": {"ttl": "90s", "class": "news"}}`), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Options.TTL != 90*time.Second || job.Options.Class != "news" {
+		t.Errorf("options = %+v, want a 90s ttl and class news", job.Options)
+	}
+	if err := json.Unmarshal([]byte(`{"options": {"ttl": 5000000000}}`), &job); err != nil || job.Options.TTL != 5*time.Second {
+		t.Errorf("nanosecond ttl = %v, %v", job.Options.TTL, err)
+	}
+}
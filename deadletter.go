@@ -0,0 +1,208 @@
+package apnsservice
+
+// This source code includes dead-letter records. A dead-letter record is the
+// structured account of a payload the service gave up on. Its JSON form is a
+// documented schema so downstream tooling can be built against it:
+//
+//	{
+//	  "appId":         42,                      internal app identifier
+//	  "stringId":      "acme",                  external app identifier
+//	  "token":         "a1b2...",               device token
+//	  "apnsId":        "123e4567-e89b-...",     apns-id of the push
+//	  "reasonCode":    "BadDeviceToken",        Apple's reason or a Reason constant of this package
+//	  "status":        400,                     HTTP status or binary protocol status code
+//	  "attempts":      1,                       send attempts made
+//	  "firstAttempt":  "2024-01-02T15:04:05Z",  RFC 3339 time of the first attempt
+//	  "lastAttempt":   "2024-01-02T15:04:05Z",  RFC 3339 time of the last attempt
+//	  "correlationId": "req-7f3a",              PushOptions.CorrelationID, omitted when empty
+//	  "class":         "order_update",          PushOptions.Class, omitted when empty
+//	  "payloadHash":   "9f86d0...",             sha256 hex of the serialized payload
+//	  "payload":       {"aps": {...}}           payload snapshot, only with DeadLetterPayloads
+//	}
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// DeadLetter is the record of a payload the service gave up on.
+type DeadLetter struct {
+	AppID         int             `json:"appId"`
+	StringID      string          `json:"stringId"`
+	Token         string          `json:"token"`
+	ApnsID        string          `json:"apnsId"`
+	ReasonCode    string          `json:"reasonCode"`
+	Status        int             `json:"status"`
+	Attempts      int             `json:"attempts"`
+	FirstAttempt  time.Time       `json:"firstAttempt"`
+	LastAttempt   time.Time       `json:"lastAttempt"`
+	CorrelationID string          `json:"correlationId,omitempty"`
+	Class         string          `json:"class,omitempty"`
+	PayloadHash   string          `json:"payloadHash"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+}
+
+// These are the dead-letter reasons of payloads the service dropped itself.
+// Rejections by Apple carry Apple's reason instead.
+const (
+	ReasonCacheOverflow = "CacheOverflow" // unsent after a close error but older than the resend cache
+	ReasonSendTimeout   = "SendTimeout"   // the socket did not accept the payload within the backoff and it could not be requeued
+	ReasonRequeueFailed = "RequeueFailed" // a held or handed-over push found its new connection closed or full
+	ReasonAppRemoved    = "AppRemoved"    // still queued when RemoveApp closed the connection
+)
+
+// DeadLetterSink receives the records of payloads the service gave up on.
+// It is called from connection workers, so it must be safe for concurrent
+// use and should return quickly.
+type DeadLetterSink interface {
+	DeadLetter(record *DeadLetter)
+}
+
+// DeadLetterFunc adapts a function to a DeadLetterSink.
+type DeadLetterFunc func(record *DeadLetter)
+
+// DeadLetter calls f(record).
+func (f DeadLetterFunc) DeadLetter(record *DeadLetter) {
+	f(record)
+}
+
+// DeadLetterQueue is an in-memory DeadLetterSink holding the most recent records.
+// When full, the oldest record is discarded.
+type DeadLetterQueue struct {
+	mutex       sync.Mutex
+	listRecords []*DeadLetter
+	capacity    int
+	dropped     int64
+}
+
+// NewDeadLetterQueue returns a queue holding up to capacity records.
+func NewDeadLetterQueue(capacity int) *DeadLetterQueue {
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	return &DeadLetterQueue{capacity: capacity}
+}
+
+// DeadLetter appends a record, discarding the oldest one when the queue is full.
+func (q *DeadLetterQueue) DeadLetter(record *DeadLetter) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.listRecords) >= q.capacity {
+		q.listRecords = q.listRecords[1:]
+		q.dropped++
+	}
+	q.listRecords = append(q.listRecords, record)
+}
+
+// Len returns the number of records held.
+func (q *DeadLetterQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.listRecords)
+}
+
+// Dropped returns the number of records discarded because the queue was full.
+func (q *DeadLetterQueue) Dropped() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.dropped
+}
+
+// Drain removes and returns every record held, oldest first.
+func (q *DeadLetterQueue) Drain() []*DeadLetter {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	listRecords := q.listRecords
+	q.listRecords = nil
+	return listRecords
+}
+
+// These binary protocol status codes are not caused by the payload itself.
+const (
+	binaryStatusProcessing = 1
+	binaryStatusShutdown   = 10
+	binaryStatusUnknown    = 255
+)
+
+// recordAttempt counts one send attempt of a notification.
+func (n *notification) recordAttempt() {
+	now := time.Now()
+	if n.attempts == 0 {
+		n.firstAttempt = now
+	}
+	n.attempts++
+	n.lastAttempt = now
+}
+
+// newDeadLetter builds the record of a notification rejected with reason and status.
+func (a *connectionAPNS) newDeadLetter(n *notification, strReason string, intStatus int) *DeadLetter {
+	deadLetter := &DeadLetter{
+		AppID:         a.appID,
+		StringID:      a.stringID,
+		Token:         n.payload.Token,
+		ApnsID:        n.options.ApnsID,
+		ReasonCode:    strReason,
+		Status:        intStatus,
+		Attempts:      n.attempts,
+		FirstAttempt:  n.firstAttempt,
+		LastAttempt:   n.lastAttempt,
+		CorrelationID: n.options.CorrelationID,
+		Class:         n.options.Class,
+	}
+	body, err := n.marshal()
+	if err == nil {
+		digest := sha256.Sum256(body)
+		deadLetter.PayloadHash = hex.EncodeToString(digest[:])
+		if a.options.DeadLetterPayloads {
+			deadLetter.Payload = body
+		}
+	}
+	return deadLetter
+}
+
+// deadLetter records a notification the service gave up on in the app log
+// and hands it to the app's DeadLetterSink.
+func (a *connectionAPNS) deadLetter(socketID int, n *notification, strReason string, intStatus int) {
+	a.classes.count(n.options.Class, classRejected)
+	a.audit(n, AuditRejected, intStatus, strReason)
+	a.updateTokenStore(socketID, n.payload.Token, strReason, intStatus)
+	a.publishEvent(ConnectionEvent{Type: EventRejected, SocketID: socketID, Reason: strReason,
+		Status: intStatus, Token: n.payload.Token, ApnsID: n.options.ApnsID})
+	deadLetter := a.newDeadLetter(n, strReason, intStatus)
+	if a.options.DeadLetterSink != nil {
+		a.options.DeadLetterSink.DeadLetter(deadLetter)
+	}
+	record, err := json.Marshal(deadLetter)
+	if err != nil {
+		a.logLevelf(LogError, socketID, "DeadLetter %s %s\n", n.payload.Token, err.Error())
+		return
+	}
+	a.logLevelf(LogWarn, socketID, "DeadLetter %s\n", record)
+}
+
+// findQueued returns the cached notification holding payload or nil.
+func findQueued(queue []*notification, payload *apns.Payload) *notification {
+	for _, n := range queue {
+		if n != nil && &n.payload == payload {
+			return n
+		}
+	}
+	return nil
+}
+
+// isPayloadRejection reports whether a binary close error blames its error payload.
+func isPayloadRejection(closeError *apns.ConnectionClose) bool {
+	if closeError.Error == nil || closeError.ErrorPayload == nil {
+		return false
+	}
+	switch closeError.Error.Status {
+	case 0, binaryStatusProcessing, binaryStatusShutdown, binaryStatusUnknown:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,386 @@
+package apnsservice
+
+// This source code includes named egress profiles. An egress profile pins the
+// network path an app uses to reach Apple: the source interface or address or
+// a custom dialer, an optional proxy, an optional DNS server and the TLS
+// versions and cipher suites allowed. Profiles are registered from main and
+// assigned to apps before their connections are launched.
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EgressProfile describes one network path to the APNS gateway.
+// Interface and SourceIP are mutually exclusive ways to choose the local address.
+// Interface uses its IPv4 address, or its IPv6 address when it has none, and
+// the gateway and proxy are dialed over the family of the local address.
+// DialContext replaces the dialer for the first hop, to the proxy or to Apple,
+// and excludes Interface, SourceIP and DNSServer.
+// ProxyURL is either http://[user:pass@]host:port or socks5://[user:pass@]host:port.
+// A SOCKS5 user name or password is at most 255 bytes.
+// DNSServer is the host:port of the resolver used for gateway or proxy lookups.
+// TLSMinVersion is "1.2" or "1.3". CipherSuites are Go cipher suite names such
+// as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 and only restrict TLS 1.2. Suites
+// Go lists as insecure are rejected.
+type EgressProfile struct {
+	Name          string                                                                      `json:"name"`
+	Interface     string                                                                      `json:"interface"`
+	SourceIP      string                                                                      `json:"sourceIp"`
+	DialContext   func(ctx context.Context, network string, address string) (net.Conn, error) `json:"-"`
+	ProxyURL      string                                                                      `json:"proxyUrl"`
+	DNSServer     string                                                                      `json:"dnsServer"`
+	TLSMinVersion string                                                                      `json:"tlsMinVersion"`
+	CipherSuites  []string                                                                    `json:"cipherSuites"`
+
+	tlsMinVersion    uint16
+	listCipherSuites []uint16
+}
+
+const egressDialTimeout = 10 * time.Second
+
+// mapEgress stores registered egress profiles keyed by name.
+// mapEgressApps stores the profile name assigned to each appID.
+var (
+	mutexEgress   sync.RWMutex
+	mapEgress     = make(map[string]*EgressProfile)
+	mapEgressApps = make(map[int]string)
+)
+
+// RegisterEgressProfile validates and registers a named egress profile.
+// Registering an existing name replaces it for connections launched afterwards.
+func RegisterEgressProfile(profile EgressProfile) error {
+	if profile.Name == "" {
+		return errors.New("egress profile name is required")
+	}
+	if profile.Interface != "" && profile.SourceIP != "" {
+		return fmt.Errorf("egress profile %s: interface and sourceIp are mutually exclusive", profile.Name)
+	}
+	if profile.SourceIP != "" && net.ParseIP(profile.SourceIP) == nil {
+		return fmt.Errorf("egress profile %s: invalid sourceIp %q", profile.Name, profile.SourceIP)
+	}
+	if profile.ProxyURL != "" {
+		urlProxy, err := url.Parse(profile.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("egress profile %s: %s", profile.Name, err.Error())
+		}
+		switch urlProxy.Scheme {
+		case "http":
+		case "socks5":
+			strPassword, _ := urlProxy.User.Password()
+			if len(urlProxy.User.Username()) > 255 || len(strPassword) > 255 {
+				return fmt.Errorf("egress profile %s: socks5 username or password longer than 255 bytes", profile.Name)
+			}
+		default:
+			return fmt.Errorf("egress profile %s: unsupported proxy scheme %q", profile.Name, urlProxy.Scheme)
+		}
+	}
+	if profile.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(profile.DNSServer); err != nil {
+			return fmt.Errorf("egress profile %s: invalid dnsServer %q", profile.Name, profile.DNSServer)
+		}
+	}
+	if profile.DialContext != nil && (profile.Interface != "" || profile.SourceIP != "" || profile.DNSServer != "") {
+		return fmt.Errorf("egress profile %s: dialContext excludes interface, sourceIp and dnsServer", profile.Name)
+	}
+	switch profile.TLSMinVersion {
+	case "":
+		profile.tlsMinVersion = 0
+	case "1.2":
+		profile.tlsMinVersion = tls.VersionTLS12
+	case "1.3":
+		profile.tlsMinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("egress profile %s: unsupported tlsMinVersion %q", profile.Name, profile.TLSMinVersion)
+	}
+	profile.listCipherSuites = nil
+	for _, strSuite := range profile.CipherSuites {
+		id, ok := cipherSuiteID(strSuite)
+		if !ok {
+			return fmt.Errorf("egress profile %s: unknown cipher suite %q", profile.Name, strSuite)
+		}
+		profile.listCipherSuites = append(profile.listCipherSuites, id)
+	}
+
+	mutexEgress.Lock()
+	defer mutexEgress.Unlock()
+	mapEgress[profile.Name] = &profile
+	return nil
+}
+
+// AssignEgressProfile routes an app through a registered egress profile.
+// An empty name restores the default network path.
+// The assignment takes effect the next time the app's connection is launched.
+func AssignEgressProfile(appID int, name string) error {
+	mutexEgress.Lock()
+	defer mutexEgress.Unlock()
+	if name == "" {
+		delete(mapEgressApps, appID)
+		return nil
+	}
+	if _, ok := mapEgress[name]; !ok {
+		return fmt.Errorf("egress profile %s is not registered", name)
+	}
+	mapEgressApps[appID] = name
+	return nil
+}
+
+// lookupEgress returns the profile assigned to appID or nil for the default path.
+func lookupEgress(appID int) *EgressProfile {
+	mutexEgress.RLock()
+	defer mutexEgress.RUnlock()
+	name, ok := mapEgressApps[appID]
+	if !ok {
+		return nil
+	}
+	return mapEgress[name]
+}
+
+// dialer builds a net.Dialer bound to the profile's source address and resolver.
+// It also returns the network to dial, tcp4 or tcp6 when a source address is
+// bound, so the gateway is reached over the family of that address.
+func (p *EgressProfile) dialer() (*net.Dialer, string, error) {
+	d := &net.Dialer{}
+	strNetwork := "tcp"
+
+	ipSource := net.ParseIP(p.SourceIP)
+	if p.Interface != "" {
+		iface, err := net.InterfaceByName(p.Interface)
+		if err != nil {
+			return nil, "", err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, "", err
+		}
+		if ipSource = interfaceSourceIP(addrs); ipSource == nil {
+			return nil, "", fmt.Errorf("interface %s has no usable IPv4 or IPv6 address", p.Interface)
+		}
+	}
+	if ipSource != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ipSource}
+		strNetwork = "tcp6"
+		if ipSource.To4() != nil {
+			strNetwork = "tcp4"
+		}
+	}
+
+	if p.DNSServer != "" {
+		strServer := p.DNSServer
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{Timeout: egressDialTimeout}).DialContext(ctx, network, strServer)
+			},
+		}
+	}
+	return d, strNetwork, nil
+}
+
+// interfaceSourceIP picks the source address among an interface's addresses.
+// IPv4 is preferred; IPv6 link-local addresses are skipped as they need a zone.
+func interfaceSourceIP(addrs []net.Addr) net.IP {
+	var ipV6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP
+		}
+		if ipV6 == nil && !ipNet.IP.IsLinkLocalUnicast() {
+			ipV6 = ipNet.IP
+		}
+	}
+	return ipV6
+}
+
+// cipherSuiteID returns the id of a cipher suite Go implements and considers
+// secure. tls.InsecureCipherSuites are refused.
+func cipherSuiteID(strName string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == strName {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// applyTLS restricts cfgTLS to the profile's TLS versions and cipher suites.
+// A nil profile leaves the Go defaults.
+func (p *EgressProfile) applyTLS(cfgTLS *tls.Config) {
+	if p == nil {
+		return
+	}
+	cfgTLS.MinVersion = p.tlsMinVersion
+	cfgTLS.CipherSuites = p.listCipherSuites
+}
+
+// dialFirstHop opens a TCP connection to address with the profile's DialContext or dialer.
+func (p *EgressProfile) dialFirstHop(ctx context.Context, address string, keepAlive time.Duration) (net.Conn, error) {
+	if p.DialContext != nil {
+		return p.DialContext(ctx, "tcp", address)
+	}
+	d, strNetwork, err := p.dialer()
+	if err != nil {
+		return nil, err
+	}
+	d.KeepAlive = keepAlive
+	return d.DialContext(ctx, strNetwork, address)
+}
+
+// dial opens a TCP connection to address through the profile's network path.
+// ctx bounds the dial; the proxy handshake has its own deadline.
+func (p *EgressProfile) dial(ctx context.Context, address string, keepAlive time.Duration) (net.Conn, error) {
+	if p.ProxyURL == "" {
+		return p.dialFirstHop(ctx, address, keepAlive)
+	}
+
+	urlProxy, err := url.Parse(p.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.dialFirstHop(ctx, urlProxy.Host, keepAlive)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(egressDialTimeout))
+	if urlProxy.Scheme == "socks5" {
+		err = socks5Connect(conn, urlProxy.User, address)
+	} else {
+		err = httpConnect(conn, urlProxy.User, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// httpConnect asks an HTTP proxy to tunnel conn to address.
+func httpConnect(conn net.Conn, user *url.Userinfo, address string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		strPassword, _ := user.Password()
+		strAuth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + strPassword))
+		req.Header.Set("Proxy-Authorization", "Basic "+strAuth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy CONNECT %s: %s", address, resp.Status)
+	}
+	return nil
+}
+
+// socks5Connect performs a SOCKS5 handshake on conn for address.
+// Username/password authentication is offered when user is set.
+func socks5Connect(conn net.Conn, user *url.Userinfo, address string) error {
+	strHost, strPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(strPort)
+	if err != nil {
+		return err
+	}
+	if len(strHost) > 255 {
+		return errors.New("socks5: host name too long")
+	}
+	var strUser, strPassword string
+	if user != nil {
+		strUser = user.Username()
+		strPassword, _ = user.Password()
+		if len(strUser) > 255 || len(strPassword) > 255 {
+			return errors.New("socks5: username or password longer than 255 bytes")
+		}
+	}
+
+	greeting := []byte{5, 1, 0}
+	if user != nil {
+		greeting = []byte{5, 2, 0, 2}
+	}
+	if _, err = conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	switch reply[1] {
+	case 0:
+	case 2:
+		if user == nil {
+			return errors.New("socks5: proxy requires authentication")
+		}
+		auth := []byte{1, byte(len(strUser))}
+		auth = append(auth, strUser...)
+		auth = append(auth, byte(len(strPassword)))
+		auth = append(auth, strPassword...)
+		if _, err = conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("socks5: authentication rejected")
+		}
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+
+	request := []byte{5, 1, 0, 3, byte(len(strHost))}
+	request = append(request, strHost...)
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("socks5: connect %s failed with code %d", address, header[1])
+	}
+	// discard the bound address
+	intSkip := 0
+	switch header[3] {
+	case 1:
+		intSkip = net.IPv4len + 2
+	case 4:
+		intSkip = net.IPv6len + 2
+	case 3:
+		if _, err = io.ReadFull(conn, header[:1]); err != nil {
+			return err
+		}
+		intSkip = int(header[0]) + 2
+	}
+	_, err = io.ReadFull(conn, make([]byte, intSkip))
+	return err
+}
@@ -0,0 +1,67 @@
+package apnsservice
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSocks5RejectsLongCredentials(t *testing.T) {
+	strLong := strings.Repeat("x", 256)
+	for _, user := range []*url.Userinfo{
+		url.User(strLong),
+		url.UserPassword("user", strLong),
+	} {
+		// the pipe has no reader, so the handshake must fail before writing
+		conn, _ := net.Pipe()
+		err := socks5Connect(conn, user, "api.push.apple.com:443")
+		conn.Close()
+		if err == nil || !strings.Contains(err.Error(), "255 bytes") {
+			t.Errorf("socks5Connect with %d byte credentials: %v", len(strLong), err)
+		}
+	}
+
+	err := RegisterEgressProfile(EgressProfile{Name: "long", ProxyURL: "socks5://user:" + strLong + "@proxy:1080"})
+	if err == nil {
+		t.Error("profile with a 256 byte password registered")
+	}
+}
+
+func TestEgressRejectsInsecureCipherSuites(t *testing.T) {
+	for _, suite := range tls.InsecureCipherSuites() {
+		err := RegisterEgressProfile(EgressProfile{Name: "insecure", CipherSuites: []string{suite.Name}})
+		if err == nil {
+			t.Errorf("profile with insecure suite %s registered", suite.Name)
+		}
+	}
+	if err := RegisterEgressProfile(EgressProfile{Name: "secure", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterfaceSourceIP(t *testing.T) {
+	ipNet := func(strCIDR string) net.Addr {
+		ip, network, _ := net.ParseCIDR(strCIDR)
+		network.IP = ip
+		return network
+	}
+	for _, test := range []struct {
+		addrs   []net.Addr
+		strWant string
+	}{
+		{[]net.Addr{ipNet("fe80::1/64"), ipNet("2001:db8::5/64"), ipNet("192.0.2.7/24")}, "192.0.2.7"},
+		{[]net.Addr{ipNet("fe80::1/64"), ipNet("2001:db8::5/64")}, "2001:db8::5"},
+		{[]net.Addr{ipNet("fe80::1/64")}, "<nil>"},
+	} {
+		if got := interfaceSourceIP(test.addrs).String(); got != test.strWant {
+			t.Errorf("interfaceSourceIP(%v) = %s, want %s", test.addrs, got, test.strWant)
+		}
+	}
+
+	profile := EgressProfile{SourceIP: "::1"}
+	if _, strNetwork, err := profile.dialer(); err != nil || strNetwork != "tcp6" {
+		t.Errorf("IPv6 source dials %q, %v, want tcp6", strNetwork, err)
+	}
+}
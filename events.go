@@ -0,0 +1,101 @@
+package apnsservice
+
+// This source code includes connection events. Subscribers to an app's events
+// hear when its sockets connect and disconnect, when a connection error
+// occurs, when Apple rejects a payload and when a token is reported invalid,
+// so monitoring and application code can react as it happens.
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType names a ConnectionEvent.
+type EventType string
+
+// These are the connection event types.
+// EventError carries dial, network and fatal errors and the opening of the circuit breaker.
+const (
+	EventConnected    EventType = "connected"
+	EventDisconnected EventType = "disconnected"
+	EventError        EventType = "error"
+	EventRejected     EventType = "payload-rejected"
+	EventFeedback     EventType = "feedback-received"
+)
+
+// ConnectionEvent is one event of an app connection.
+// Token, ApnsID and Status are set for rejections and feedback.
+type ConnectionEvent struct {
+	AppID    int       `json:"appId"`
+	StringID string    `json:"stringId"`
+	Platform Platform  `json:"platform"`
+	Type     EventType `json:"type"`
+	SocketID int       `json:"socketId,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Token    string    `json:"token,omitempty"`
+	ApnsID   string    `json:"apnsId,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// eventSubscriber is one Events channel.
+type eventSubscriber struct {
+	appID     int
+	chanEvent chan ConnectionEvent
+}
+
+// mapEventSubscribers stores the subscribers keyed by subscription id.
+var (
+	mutexEvents         sync.Mutex
+	mapEventSubscribers = make(map[int]eventSubscriber)
+	nextEventID         int
+)
+
+// Events returns a channel receiving the events of an app's connections on
+// every platform, across relaunches, and a func that ends the subscription
+// and closes the channel. Events are dropped for a subscriber whose buffer is full.
+func Events(appID int, intBuffer int) (<-chan ConnectionEvent, func()) {
+	chanEvent := make(chan ConnectionEvent, intBuffer)
+
+	mutexEvents.Lock()
+	nextEventID++
+	subscriptionID := nextEventID
+	mapEventSubscribers[subscriptionID] = eventSubscriber{appID: appID, chanEvent: chanEvent}
+	mutexEvents.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			mutexEvents.Lock()
+			delete(mapEventSubscribers, subscriptionID)
+			mutexEvents.Unlock()
+			close(chanEvent)
+		})
+	}
+	return chanEvent, unsubscribe
+}
+
+// publishEvent hands an event to the app's subscribers without blocking.
+func (a *connectionAPNS) publishEvent(event ConnectionEvent) {
+	event.AppID = a.appID
+	event.StringID = a.stringID
+	event.Platform = a.platform
+	event.Time = time.Now()
+
+	mutexEvents.Lock()
+	defer mutexEvents.Unlock()
+	for _, subscriber := range mapEventSubscribers {
+		if subscriber.appID != a.appID {
+			continue
+		}
+		select {
+		case subscriber.chanEvent <- event:
+		default:
+		}
+	}
+}
+
+// event publishes an event without payload details.
+func (a *connectionAPNS) event(socketID int, eventType EventType, strReason string) {
+	a.publishEvent(ConnectionEvent{Type: eventType, SocketID: socketID, Reason: strReason})
+}
@@ -0,0 +1,317 @@
+package apnsservice
+
+// This source code includes the Firebase Cloud Messaging transport. An FCM
+// connection is a connectionAPNS registered under PlatformAndroid, so it
+// shares the send queue, logging, retry policy, rate limits, dead letters and
+// class stats of an APNS connection. Its workers post each payload to the
+// FCM HTTP v1 API, authenticated by an OAuth token signed with the app's
+// service account key.
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// These are the FCM endpoints and OAuth scope.
+const (
+	fcmURL        = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+	fcmTokenURL   = "https://oauth2.googleapis.com/token"
+	fcmScope      = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmGrantType  = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	fcmTokenEarly = 5 * time.Minute // an access token is refreshed this long before it expires
+)
+
+// serviceAccount holds the fields of a Google service account key file.
+type serviceAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// fcmClient posts messages for one Firebase project.
+type fcmClient struct {
+	strURL      string
+	client      *http.Client
+	mutex       sync.Mutex
+	key         *rsa.PrivateKey
+	strEmail    string
+	strTokenURL string
+	strToken    string
+	timeExpiry  time.Time
+}
+
+// LaunchFCM creates an FCM connection for an app from its service account
+// key file and adds it to the map under PlatformAndroid. The connection uses
+// the app's ConnectionOptions and logs to logs/fcm. An existing FCM
+// connection for the app is replaced.
+func LaunchFCM(appID int, appString string, serviceAccountJSON []byte, isLogging bool) error {
+	client, err := newFCMClient(serviceAccountJSON)
+	if err != nil {
+		utils.Warning.Println("LaunchFCM", appString, err.Error())
+		return err
+	}
+	connectionAPNS := newConnection(appID, appString, &AppCert{AppID: appID})
+	connectionAPNS.platform = PlatformAndroid
+	connectionAPNS.options.Mock = nil
+	connectionAPNS.fcm = client
+	return storeConnection(&connectionAPNS, isLogging, true)
+}
+
+// newFCMClient parses a service account key file.
+func newFCMClient(serviceAccountJSON []byte) (*fcmClient, error) {
+	var account serviceAccount
+	if err := json.Unmarshal(serviceAccountJSON, &account); err != nil {
+		return nil, fmt.Errorf("service account: %s", err.Error())
+	}
+	if account.ProjectID == "" || account.ClientEmail == "" {
+		return nil, errors.New("service account requires project_id and client_email")
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("service account private key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account private key is not an RSA key")
+	}
+	strTokenURL := account.TokenURI
+	if strTokenURL == "" {
+		strTokenURL = fcmTokenURL
+	}
+	return &fcmClient{
+		strURL:      fmt.Sprintf(fcmURL, account.ProjectID),
+		client:      newRequestClient(nil, ConnectionOptions{}),
+		key:         key,
+		strEmail:    account.ClientEmail,
+		strTokenURL: strTokenURL,
+	}, nil
+}
+
+// initFCM routes the FCM client through the app's egress profile if it has one.
+func (a *connectionAPNS) initFCM() {
+	a.fcm.client = newRequestClient(a.egress, a.options)
+}
+
+// accessToken returns a current OAuth access token, exchanging a newly signed
+// assertion when the cached token is due.
+func (c *fcmClient) accessToken() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if c.strToken != "" && now.Before(c.timeExpiry.Add(-fcmTokenEarly)) {
+		return c.strToken, nil
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   c.strEmail,
+		"scope": fcmScope,
+		"aud":   c.strTokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	strSigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(strSigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	strAssertion := strSigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	resp, err := c.client.PostForm(c.strTokenURL, url.Values{
+		"grant_type": {fcmGrantType},
+		"assertion":  {strAssertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	if resp.StatusCode != http.StatusOK || reply.AccessToken == "" {
+		return "", fmt.Errorf("fcm token exchange failed: %d %s", resp.StatusCode, reply.Error)
+	}
+	c.strToken = reply.AccessToken
+	c.timeExpiry = now.Add(time.Duration(reply.ExpiresIn) * time.Second)
+	return c.strToken, nil
+}
+
+// sendFCM posts one notification and returns the FCM status code and error code.
+func (a *connectionAPNS) sendFCM(n *notification) (int, string, error) {
+	body, err := json.Marshal(map[string]interface{}{"message": fcmMessage(&n.payload, &n.options)})
+	if err != nil {
+		return 0, "", err
+	}
+	strToken, err := a.fcm.accessToken()
+	if err != nil {
+		return 0, "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.fcm.strURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+strToken)
+
+	resp, err := a.fcm.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return resp.StatusCode, "", nil
+	}
+
+	var reply struct {
+		Error struct {
+			Status  string `json:"status"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	strReason := reply.Error.Status
+	for _, detail := range reply.Error.Details {
+		if detail.ErrorCode != "" {
+			strReason = detail.ErrorCode
+			break
+		}
+	}
+	return resp.StatusCode, strReason, nil
+}
+
+// fcmMessage converts a payload and its options to an FCM v1 message.
+// The alert becomes the notification body and custom keys become data,
+// which FCM requires to be strings.
+func fcmMessage(payload *apns.Payload, opts *PushOptions) map[string]interface{} {
+	message := map[string]interface{}{"token": payload.Token}
+	android := map[string]interface{}{}
+	notification := map[string]interface{}{}
+
+	if payload.AlertText != "" {
+		message["notification"] = map[string]interface{}{"body": payload.AlertText}
+	}
+	if len(payload.ExtraData) > 0 {
+		mapData := make(map[string]string, len(payload.ExtraData))
+		for strKey, value := range payload.ExtraData {
+			if strValue, ok := value.(string); ok {
+				mapData[strKey] = strValue
+				continue
+			}
+			data, _ := json.Marshal(value)
+			mapData[strKey] = string(data)
+		}
+		message["data"] = mapData
+	}
+	if payload.Sound != "" {
+		notification["sound"] = payload.Sound
+	}
+	if payload.Badge.IsSet() {
+		notification["notification_count"] = payload.Badge.Number()
+	}
+	if payload.Category != "" {
+		notification["click_action"] = payload.Category
+	}
+
+	switch opts.Priority {
+	case PriorityImmediate:
+		android["priority"] = "HIGH"
+	case PriorityConserve:
+		android["priority"] = "NORMAL"
+	}
+	if !opts.Expiration.IsZero() {
+		ttl := time.Until(opts.Expiration)
+		if ttl < 0 {
+			ttl = 0
+		}
+		android["ttl"] = fmt.Sprintf("%ds", int64(ttl/time.Second))
+	}
+	if opts.CollapseID != "" {
+		android["collapse_key"] = opts.CollapseID
+	}
+	if len(notification) > 0 {
+		android["notification"] = notification
+	}
+	if len(android) > 0 {
+		message["android"] = android
+	}
+	return message
+}
+
+// lookupPlatform returns the active connection for appID on platform.
+// APNS apps not yet registered are launched from the AppConfigProvider.
+func lookupPlatform(appID int, platform Platform) (*connectionAPNS, error) {
+	switch platform {
+	case PlatformIOS:
+		return lookupActive(appID)
+	case PlatformAndroid, PlatformWeb:
+	default:
+		return nil, fmt.Errorf("unknown platform %q", string(platform))
+	}
+	connectionAPNS := getPlatformConnection(appID, platform)
+	if connectionAPNS == nil {
+		return nil, ErrAppNotFound
+	}
+	if err := connectionAPNS.activeError(); err != nil {
+		return nil, err
+	}
+	return connectionAPNS, nil
+}
+
+// Push pushes one notification for the specified app to APNS, FCM or Web Push.
+// The payload is built the same way for every platform.
+// It returns ErrAppNotFound or ErrNotActive if the app cannot push on platform.
+// Errors are also logged, so callers that run it with go lose nothing.
+func Push(appID int, platform Platform, payload apns.Payload) error {
+	err := PushWithOptions(appID, platform, payload, PushOptions{})
+	if err != nil {
+		utils.Warning.Println("Push", appID, platform, err.Error())
+	}
+	return err
+}
+
+// PushWithOptions pushes one notification for the specified app to APNS, FCM
+// or Web Push with delivery options. Priority, expiration and collapse id map
+// to their equivalents on PlatformAndroid and PlatformWeb.
+func PushWithOptions(appID int, platform Platform, payload apns.Payload, opts PushOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	connectionAPNS, err := lookupPlatform(appID, platform)
+	if err != nil {
+		return err
+	}
+	body, err := connectionAPNS.prepare(context.Background(), &payload, &opts, nil)
+	if err != nil {
+		return err
+	}
+	return connectionAPNS.pushOne(&payload, &opts, body)
+}
@@ -0,0 +1,64 @@
+package apnsservice
+
+// This source code includes feedback subscriptions. Tokens the feedback
+// service reports and tokens Apple rejects as invalid are published to every
+// subscriber, so callers outside the package can clean up their records.
+
+import (
+	"sync"
+	"time"
+)
+
+// ReasonFeedback is the Feedback reason of a token reported by the feedback service.
+const ReasonFeedback = "Feedback"
+
+// Feedback reports a device token Apple says is no longer valid.
+type Feedback struct {
+	AppID     int       `json:"appId"`
+	Token     string    `json:"token"`
+	Reason    string    `json:"reason"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// mapFeedbackSubscribers stores the subscriber channels keyed by subscription id.
+var (
+	mutexFeedback          sync.Mutex
+	mapFeedbackSubscribers = make(map[int]chan Feedback)
+	nextFeedbackID         int
+)
+
+// SubscribeFeedback returns a channel receiving every invalid token of every app
+// and a func that ends the subscription and closes the channel.
+// Feedback is dropped for a subscriber whose buffer is full.
+func SubscribeFeedback(intBuffer int) (<-chan Feedback, func()) {
+	chanFeedback := make(chan Feedback, intBuffer)
+
+	mutexFeedback.Lock()
+	nextFeedbackID++
+	subscriptionID := nextFeedbackID
+	mapFeedbackSubscribers[subscriptionID] = chanFeedback
+	mutexFeedback.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			mutexFeedback.Lock()
+			delete(mapFeedbackSubscribers, subscriptionID)
+			mutexFeedback.Unlock()
+			close(chanFeedback)
+		})
+	}
+	return chanFeedback, unsubscribe
+}
+
+// publishFeedback hands feedback to every subscriber without blocking.
+func publishFeedback(feedback Feedback) {
+	mutexFeedback.Lock()
+	defer mutexFeedback.Unlock()
+	for _, chanFeedback := range mapFeedbackSubscribers {
+		select {
+		case chanFeedback <- feedback:
+		default:
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package apnsservice
+
+// This source code includes feedback leader election. Replicas that run the
+// same app each poll the feedback service when they launch and would report
+// the same bad tokens to the TokenStore and to subscribers several times.
+// An app whose options name a FeedbackLock polls only in the replica that
+// takes the lock; every replica still sends pushes.
+
+import (
+	"time"
+
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// defaultFeedbackLockTTL is used when FeedbackLockTTL is not set.
+const defaultFeedbackLockTTL = time.Hour
+
+// FeedbackLock elects the replica that polls the feedback service for an app.
+// TryLock takes the lock for owner until ttl elapses and reports whether it
+// did; it must not wait for a lock another owner holds. RedisQueue
+// implements it for replicas that share a Redis server.
+type FeedbackLock interface {
+	TryLock(appID int, owner string, ttl time.Duration) (bool, error)
+}
+
+// isFeedbackLeader reports whether this replica should poll the feedback
+// service. Without a FeedbackLock every replica polls. A lock that fails
+// polls anyway, since a repeated report is harmless and a missed one is not.
+func (a *connectionAPNS) isFeedbackLeader() bool {
+	if a.options.FeedbackLock == nil {
+		return true
+	}
+	ttl := a.options.FeedbackLockTTL
+	if ttl <= 0 {
+		ttl = defaultFeedbackLockTTL
+	}
+	strOwner := a.options.InstanceID
+	if strOwner == "" {
+		strOwner = defaultInstanceID()
+	}
+	isLeader, err := a.options.FeedbackLock.TryLock(a.appID, strOwner, ttl)
+	if err != nil {
+		utils.Warning.Println("FeedbackLock", a.stringID, err.Error())
+		return true
+	}
+	return isLeader
+}
@@ -0,0 +1,84 @@
+package apnsservice
+
+// This source code includes the hand-over of a replaced connection. A
+// relaunch, whether by reload, cert rotation or the admin handler, closes the
+// old connection after PushOne already accepted pushes that are still queued
+// in its lanes or held by its pause gate. Once the old workers stop, those
+// pushes move to the app's current connection in order, so a relaunch loses
+// none of them. Pushes waiting to be retried go first. A removed app has no successor and its pushes are dead-lettered.
+
+import (
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// handOver moves the pushes left in a closed connection's retry backlog,
+// lanes and pause gate to the app's current connection, or dead-letters them if the app was
+// removed. It waits for the closed connection's workers first, so call it in
+// its own goroutine.
+func (a *connectionAPNS) handOver() {
+	if a.wgWorkers == nil {
+		return // never launched
+	}
+	a.wgWorkers.Wait()
+
+	next := getPlatformConnection(a.appID, a.platform)
+	if next == a {
+		next = nil
+	}
+	intMoved, intDropped := 0, 0
+	move := func(n *notification) {
+		if a.moveTo(next, n) {
+			intMoved++
+		} else {
+			intDropped++
+		}
+	}
+	for _, n := range a.backlog.takeAll() {
+		move(n)
+	}
+	for _, chanLane := range []chan *notification{a.chanHigh, a.chanSend} {
+		for isDrained := false; !isDrained; {
+			select {
+			case n := <-chanLane:
+				move(n)
+			default:
+				isDrained = true
+			}
+		}
+	}
+	for _, n := range a.pause.takeHeld() {
+		move(n)
+	}
+	if intMoved > 0 || intDropped > 0 {
+		utils.Info.Println(a.stringID, a.platform, "handed over", intMoved, "queued pushes, dead-lettered", intDropped)
+	}
+}
+
+// moveTo queues one notification of a closed connection on next and reports
+// whether it did. A leased notification is left for the shared queue to
+// redeliver once its lease expires.
+func (a *connectionAPNS) moveTo(next *connectionAPNS, n *notification) bool {
+	if n.lease != nil {
+		a.release(n)
+		recycle(n)
+		return true
+	}
+	strReason := ReasonAppRemoved
+	if next != nil {
+		var err error
+		if next.options.SharedQueue != nil {
+			err = next.enqueueShared(n)
+			if err == nil {
+				recycle(n) // the shared queue holds an encoded copy
+				return true
+			}
+		} else if err = next.holdOrEnqueue(n); err == nil {
+			return true
+		}
+		a.logLevelf(LogWarn, 0, "Hand-over of %s failed %s\n", n.options.ApnsID, err.Error())
+		strReason = ReasonRequeueFailed
+	}
+	a.deadLetter(0, n, strReason, 0)
+	recycle(n)
+	return false
+}
@@ -0,0 +1,210 @@
+package apnsservice
+
+// This source code includes connection status and the health check. Status
+// reports where a connection stands and why, and Healthy aggregates every
+// connection for a /healthz endpoint.
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnectionState summarizes a connection for callers.
+type ConnectionState string
+
+// These are the states a connection can be in.
+// StateRetrying means no socket is connected or every socket is backing off.
+// StateFailed means the connection was closed by a fatal error such as a bad cert.
+// StateDegraded means the circuit breaker parked the connection after repeated failures.
+const (
+	StateNoCerts  ConnectionState = "no-certs"
+	StateActive   ConnectionState = "active"
+	StateRetrying ConnectionState = "retrying"
+	StateClosed   ConnectionState = "closed"
+	StateFailed   ConnectionState = "failed"
+	StateDegraded ConnectionState = "degraded"
+)
+
+// ConnectionStatus reports the state of one app connection.
+type ConnectionStatus struct {
+	AppID         int             `json:"appId"`
+	StringID      string          `json:"stringId"`
+	Platform      Platform        `json:"platform"`
+	State         ConnectionState `json:"state"`
+	LastConnect   time.Time       `json:"lastConnect"` // most recent connect of any socket
+	LastError     string          `json:"lastError,omitempty"`
+	LastErrorTime time.Time       `json:"lastErrorTime,omitempty"`
+	QueueDepth    int             `json:"queueDepth"`
+	QueueCap      int             `json:"queueCap"`
+	BackoffLevel  int             `json:"backoffLevel"` // fewest consecutive transient failures of any socket
+	Backoff       time.Duration   `json:"backoff"`      // the wait at BackoffLevel, before jitter
+	Sockets       int             `json:"sockets"`
+	Connected     int             `json:"connected"`
+	CacheOverflow int64           `json:"cacheOverflow"`           // unsent payloads lost to resend cache overflow
+	Expired       int64           `json:"expired"`                 // payloads discarded after their deadline or TTL
+	DegradedUntil time.Time       `json:"degradedUntil,omitempty"` // end of the circuit breaker cool-down
+	Paused        bool            `json:"paused"`
+	Held          int             `json:"held"` // pushes held while paused, not yet in the queue
+}
+
+// healthState holds the last error of a connection.
+type healthState struct {
+	mutex         sync.Mutex
+	lastError     string
+	lastErrorTime time.Time
+	isFailed      bool
+	overflows     int64 // unsent payloads the resend cache could not hold
+	expired       int64 // payloads discarded after their deadline or TTL
+}
+
+// recordExpired counts a payload discarded after its deadline.
+func (h *healthState) recordExpired() {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.expired++
+}
+
+// recordError remembers the most recent error. A nil healthState records nothing.
+func (h *healthState) recordError(strError string) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastError = strError
+	h.lastErrorTime = time.Now()
+}
+
+// recordFatal remembers the error that closed the connection.
+func (h *healthState) recordFatal(strError string) {
+	if h == nil {
+		return
+	}
+	h.recordError(strError)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.isFailed = true
+}
+
+// Status returns the status of the specified app's connection.
+// The second result is false if the app is not registered.
+func Status(appID int) (ConnectionStatus, bool) {
+	connectionAPNS := getConnection(appID)
+	if connectionAPNS == nil {
+		return ConnectionStatus{}, false
+	}
+	return connectionAPNS.connectionStatus(), true
+}
+
+// Statuses returns the status of every registered connection ordered by appID and platform.
+func Statuses() []ConnectionStatus {
+	mutexAPNS.RLock()
+	listConnections := make([]*connectionAPNS, 0, len(mapAPNS))
+	for _, connectionAPNS := range mapAPNS {
+		listConnections = append(listConnections, connectionAPNS)
+	}
+	mutexAPNS.RUnlock()
+
+	listStatus := make([]ConnectionStatus, 0, len(listConnections))
+	for _, connectionAPNS := range listConnections {
+		listStatus = append(listStatus, connectionAPNS.connectionStatus())
+	}
+	sort.Slice(listStatus, func(i, j int) bool {
+		if listStatus[i].AppID != listStatus[j].AppID {
+			return listStatus[i].AppID < listStatus[j].AppID
+		}
+		return listStatus[i].Platform < listStatus[j].Platform
+	})
+	return listStatus
+}
+
+// Healthy reports whether no connection has failed or degraded and every
+// active connection has a connected socket. Closed connections are ignored.
+func Healthy() bool {
+	for _, status := range Statuses() {
+		if status.State == StateFailed || status.State == StateDegraded ||
+			(status.State == StateRetrying && status.Connected == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// HealthHandler returns an http.Handler for a /healthz endpoint. It answers
+// 200 when Healthy and 503 otherwise, with the statuses as JSON.
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		intStatus := http.StatusOK
+		if !Healthy() {
+			intStatus = http.StatusServiceUnavailable
+		}
+		writeJSON(w, intStatus, Statuses())
+	})
+}
+
+// connectionStatus builds the status of the connection.
+func (a *connectionAPNS) connectionStatus() ConnectionStatus {
+	status := ConnectionStatus{
+		AppID:    a.appID,
+		StringID: a.stringID,
+		Platform: a.platform,
+		Paused:   a.pause.isPausedNow(),
+		Held:     a.pause.heldCount(),
+	}
+	status.QueueDepth, status.QueueCap = a.queueDepth()
+	isFailed := false
+	if a.health != nil {
+		a.health.mutex.Lock()
+		status.LastError = a.health.lastError
+		status.LastErrorTime = a.health.lastErrorTime
+		isFailed = a.health.isFailed
+		status.CacheOverflow = a.health.overflows
+		status.Expired = a.health.expired
+		a.health.mutex.Unlock()
+	}
+	if a.pool != nil {
+		for i, stat := range a.socketStats() {
+			status.Sockets++
+			if stat.Connected {
+				status.Connected++
+			}
+			if stat.LastConnect.After(status.LastConnect) {
+				status.LastConnect = stat.LastConnect
+			}
+			// one socket that is not backing off keeps the connection delivering
+			if i == 0 || stat.Failures < status.BackoffLevel {
+				status.BackoffLevel = stat.Failures
+			}
+		}
+	}
+	if status.BackoffLevel > 0 {
+		policy := a.options.RetryPolicy
+		policy.Jitter = 0
+		status.Backoff = policy.delay(status.BackoffLevel)
+	}
+
+	statusConnection := a.getStatus()
+	switch {
+	case statusConnection == apnsNoCerts:
+		status.State = StateNoCerts
+	case statusConnection != apnsActive && isFailed:
+		status.State = StateFailed
+	case statusConnection != apnsActive:
+		status.State = StateClosed
+	case a.isEnqueueOnly():
+		status.State = StateActive // a producer holds no sockets
+	case a.breaker.isOpen():
+		status.State = StateDegraded
+		status.DegradedUntil = a.breaker.openedUntil()
+	case status.Connected == 0 || status.BackoffLevel > 0:
+		status.State = StateRetrying
+	default:
+		status.State = StateActive
+	}
+	return status
+}
@@ -0,0 +1,350 @@
+package apnsservice
+
+// This source code includes the HTTP/2 provider API transport. A connection
+// launched with ProtocolHTTP2 runs a pair of workers that post each payload
+// as its own request, so per-notification headers such as apns-collapse-id
+// reach Apple and every rejection is reported for exactly one payload.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// These are the HTTP/2 provider API hosts for each environment.
+const (
+	http2URLProduction = "https://api.push.apple.com"
+	http2URLSandbox    = "https://api.sandbox.push.apple.com"
+)
+
+// These suffixes are appended to the bundle id to form the apns-topic of a push type.
+const (
+	voipTopicSuffix         = ".voip"
+	liveActivityTopicSuffix = ".push-type.liveactivity"
+)
+
+// http2Timeout bounds one request to the provider API.
+const http2Timeout = 30 * time.Second
+
+// initHTTP2 builds the HTTP/2 client for the app credentials and gateway environment.
+// An auth key selects token-based authentication, otherwise the cert authenticates the TLS session.
+func (a *connectionAPNS) initHTTP2() error {
+	cfgTLS := &tls.Config{}
+	if a.cert.hasAuthKey() {
+		signer, err := newTokenSigner(a.cert)
+		if err != nil {
+			return err
+		}
+		a.signer = signer
+	} else {
+		x509Cert, err := tls.X509KeyPair(a.cert.Cert, a.cert.RSAKey)
+		if err != nil {
+			return err
+		}
+		cfgTLS.Certificates = []tls.Certificate{x509Cert}
+	}
+
+	a.urlHTTP2 = http2URLProduction
+	if isDevServer || a.cert.IsDev != 0 {
+		a.urlHTTP2 = http2URLSandbox
+	}
+	if a.options.GatewayURL != "" {
+		a.urlHTTP2 = strings.TrimSuffix(a.options.GatewayURL, "/")
+		cfgTLS.RootCAs = a.options.GatewayRootCAs
+	}
+
+	a.egress.applyTLS(cfgTLS)
+
+	a.clientHTTP2 = newTransportClient(cfgTLS, a.egress, a.options)
+	return nil
+}
+
+// newRequestClient returns an HTTP client for a request-per-notification
+// service such as FCM, dialing through egress if it is not nil.
+func newRequestClient(egress *EgressProfile, options ConnectionOptions) *http.Client {
+	cfgTLS := &tls.Config{}
+	egress.applyTLS(cfgTLS)
+	return newTransportClient(cfgTLS, egress, options)
+}
+
+// newTransportClient returns an HTTP/2 capable client that dials with the
+// options' timeouts and keepalive and closes connections idle for IdleReconnect.
+func newTransportClient(cfgTLS *tls.Config, egress *EgressProfile, options ConnectionOptions) *http.Client {
+	transport := &http.Transport{
+		TLSClientConfig:     cfgTLS,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: options.connectTimeout(),
+		IdleConnTimeout:     options.IdleReconnect,
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return dialGateway(ctx, egress, options, address)
+		},
+	}
+	return &http.Client{Transport: transport, Timeout: http2Timeout}
+}
+
+// launchWorkerHTTP2 launches a channel listener for an HTTP/2 connection.
+// It pulls notifications from the send channel and posts them to Apple,
+// or hands them to the MockTransport of a mock connection.
+// Failures are classified by the connection's RetryPolicy: transient ones are
+// retried by the same worker after a backoff, permanent ones are dead-lettered and fatal ones close
+// the connection. Notifications are recycled once delivered, expired or
+// dead-lettered. The done channel shuts down this listener.
+func (a *connectionAPNS) launchWorkerHTTP2(socketID int, state *socketState) {
+	defer a.wgWorkers.Done()
+
+	intFailures := 0 // consecutive transient failures, for backoff
+	policy := a.options.RetryPolicy
+	a.event(socketID, EventConnected, "")
+
+	// a push in backoff stays with this worker, which sends it again itself;
+	// one still held when the worker stops goes to the retry backlog, which
+	// the other workers or the hand-over to a relaunched connection drain
+	var nRetry *notification
+	defer func() {
+		if nRetry != nil {
+			a.retryLater(nRetry)
+		}
+	}()
+
+	for {
+		if !a.parkOpen(socketID, state.chanStop) || !a.waitResumed(socketID, state.chanStop) {
+			return
+		}
+		n := nRetry
+		nRetry = nil
+		if n == nil {
+			select {
+			case n = <-a.chanReady:
+			case <-state.chanRedial:
+				// requests share one client, so a re-dial drops its idle connections
+				a.logPrintln(socketID, "Re-dialing connection")
+				if a.clientHTTP2 != nil {
+					a.clientHTTP2.CloseIdleConnections()
+				}
+				state.recordDial(0, true)
+				continue
+			case <-state.chanStop:
+				a.logPrintln(socketID, "Socket removed. Shutting down.")
+				return
+			case <-a.chanDone:
+				a.logPrintln(socketID, "Done channel is closed. Shutting down apns service")
+				return
+			}
+		}
+		if n.isExpired() {
+			a.expire(socketID, n)
+			recycle(n)
+			continue
+		}
+		a.logLevelf(LogTrace, socketID, "Push %s to device %v %s\n", n.options.ApnsID, n.payload.ExtraData, n.payload.AlertText)
+
+		timeSend := time.Now()
+		n.recordAttempt()
+		intStatus, strReason, err := a.sendRequest(n)
+		state.recordSend(time.Since(timeSend))
+		if state.setConnected(err == nil) {
+			if err == nil {
+				a.event(socketID, EventConnected, "")
+			} else {
+				a.event(socketID, EventDisconnected, err.Error())
+			}
+		}
+		if err == nil && intStatus == http.StatusOK {
+			a.breaker.recordSuccess()
+			if intFailures != 0 {
+				intFailures = 0
+				state.setFailures(0)
+			}
+			a.classes.count(n.options.Class, classSent)
+			a.audit(n, AuditDelivered, intStatus, "")
+			a.settle(n)
+			recycle(n)
+			continue
+		}
+		failure := Failure{Err: err, Status: intStatus, Reason: strReason}
+		switch policy.classify(failure) {
+		case RetryTransient:
+			if err != nil {
+				a.logLevelf(LogWarn, socketID, "Error: %s %s\n", n.options.ApnsID, err.Error())
+				a.health.recordError(err.Error())
+				a.event(socketID, EventError, err.Error())
+				a.breakerFailure(socketID, err.Error())
+				a.audit(n, AuditRetry, 0, err.Error())
+			} else {
+				a.logLevelf(LogWarn, socketID, "Retrying %s after %d %s\n", n.options.ApnsID, intStatus, strReason)
+				a.audit(n, AuditRetry, intStatus, strReason)
+				a.health.recordError(fmt.Sprintf("%d %s", intStatus, strReason))
+			}
+			select {
+			case <-time.After(policy.delay(intFailures)):
+			case <-a.chanDone:
+				nRetry = n
+				return
+			}
+			intFailures++
+			state.setFailures(intFailures)
+			if policy.isExhausted(n) {
+				a.deadLetter(socketID, n, ReasonRetriesExhausted, intStatus)
+				a.settle(n)
+				recycle(n)
+				break
+			}
+			if n.isExpired() {
+				a.expire(socketID, n) // the TTL ran out during backoff
+				recycle(n)
+				break
+			}
+			nRetry = n
+		case RetryPermanent:
+			a.deadLetter(socketID, n, strReason, intStatus)
+			a.settle(n)
+			recycle(n)
+		case RetryFatal:
+			if err != nil {
+				strReason = err.Error()
+			}
+			a.deadLetter(socketID, n, strReason, intStatus)
+			a.settle(n)
+			recycle(n)
+			if a.breaker != nil {
+				a.health.recordError(strReason)
+				a.breakerFailure(socketID, strReason)
+				break
+			}
+			a.fail(socketID, strReason)
+			return
+		}
+	}
+}
+
+// NewApnsID returns a random UUID for PushOptions.ApnsID.
+func NewApnsID() string {
+	var uuid [16]byte
+	rand.Read(uuid[:])
+	uuid[6] = uuid[6]&0x0f | 0x40 // version 4
+	uuid[8] = uuid[8]&0x3f | 0x80 // RFC 4122 variant
+	strHex := hex.EncodeToString(uuid[:])
+	return strHex[0:8] + "-" + strHex[8:12] + "-" + strHex[12:16] + "-" + strHex[16:20] + "-" + strHex[20:]
+}
+
+// isApnsID reports whether strID has the 8-4-4-4-12 hex form Apple requires.
+func isApnsID(strID string) bool {
+	if len(strID) != 36 {
+		return false
+	}
+	for i, c := range strID {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// topic returns the apns-topic for a notification: its own topic, or else
+// the connection's. VoIP and Live Activity pushes use the bundle id with
+// their push type suffix.
+func (a *connectionAPNS) topic(n *notification) string {
+	strTopic := n.options.Topic
+	if strTopic == "" {
+		strTopic = a.options.Topic
+	}
+	strSuffix := ""
+	switch n.options.PushType {
+	case PushTypeVoIP:
+		strSuffix = voipTopicSuffix
+	case PushTypeLiveActivity:
+		strSuffix = liveActivityTopicSuffix
+	}
+	if strTopic != "" && !strings.HasSuffix(strTopic, strSuffix) {
+		strTopic += strSuffix
+	}
+	return strTopic
+}
+
+// sendRequest sends one notification through the mock transport if the
+// connection has one, posts it to FCM or a Web Push service for those
+// platforms and otherwise posts it to Apple.
+func (a *connectionAPNS) sendRequest(n *notification) (int, string, error) {
+	switch {
+	case a.fcm != nil:
+		return a.sendFCM(n)
+	case a.webPush != nil:
+		return a.sendWebPush(n)
+	}
+	if a.options.Mock != nil {
+		return a.options.Mock.deliver(a, n)
+	}
+	return a.sendHTTP2(n)
+}
+
+// sendHTTP2 posts one notification and returns Apple's status code and reason.
+func (a *connectionAPNS) sendHTTP2(n *notification) (int, string, error) {
+	body, err := n.marshal()
+	if err != nil {
+		return 0, "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.urlHTTP2+"/3/device/"+n.payload.Token, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.signer != nil {
+		strToken, err := a.signer.bearer()
+		if err != nil {
+			return 0, "", err
+		}
+		req.Header.Set("Authorization", "bearer "+strToken)
+	}
+	if n.options.ApnsID != "" {
+		req.Header.Set("apns-id", n.options.ApnsID)
+	}
+	if n.options.Priority != 0 {
+		req.Header.Set("apns-priority", strconv.Itoa(n.options.Priority))
+	}
+	if !n.options.Expiration.IsZero() {
+		req.Header.Set("apns-expiration", strconv.FormatInt(n.options.Expiration.Unix(), 10))
+	}
+	if n.options.CollapseID != "" {
+		req.Header.Set("apns-collapse-id", n.options.CollapseID)
+	}
+	if n.options.PushType != "" {
+		req.Header.Set("apns-push-type", n.options.PushType)
+	}
+	if strTopic := a.topic(n); strTopic != "" {
+		req.Header.Set("apns-topic", strTopic)
+	}
+
+	resp, err := a.clientHTTP2.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if strID := resp.Header.Get("apns-id"); strID != "" {
+		n.options.ApnsID = strID
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.StatusCode, "", nil
+	}
+
+	var reply struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	return resp.StatusCode, reply.Reason, nil
+}
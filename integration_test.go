@@ -0,0 +1,117 @@
+//go:build integration
+
+package apnsservice
+
+// This source code includes an opt-in end-to-end suite that runs against
+// Apple's sandbox gateway. It is only compiled with the integration build tag
+// and is driven by these environment variables:
+//
+//	APNS_SANDBOX_CERT  path to the PEM encoded sandbox push certificate
+//	APNS_SANDBOX_KEY   path to the PEM encoded RSA key for the certificate
+//	APNS_SANDBOX_TOKEN hex device token of a test device running a sandbox build
+//	APNS_SANDBOX_APP   optional app string used for the log file name
+//
+//	go test -tags integration -run TestSandboxSuite -v
+
+import (
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// sandboxWait bounds how long each step waits for Apple to react.
+const sandboxWait = 30 * time.Second
+
+// invalidSandboxToken is well formed but not issued to any device.
+var invalidSandboxToken = strings.Repeat("ab", 32)
+
+// testWriter writes feedback output to the test log.
+type testWriter struct {
+	t *testing.T
+}
+
+func (w testWriter) Write(data []byte) (int, error) {
+	w.t.Log(strings.TrimRight(string(data), "\n"))
+	return len(data), nil
+}
+
+// TestSandboxSuite exercises launch, send, rejection handling and feedback
+// against the Apple sandbox. It is skipped without APNS_SANDBOX_CERT.
+func TestSandboxSuite(t *testing.T) {
+	if os.Getenv("APNS_SANDBOX_CERT") == "" {
+		t.Skip("APNS_SANDBOX_CERT is not set")
+	}
+	cert, err := os.ReadFile(os.Getenv("APNS_SANDBOX_CERT"))
+	if err != nil {
+		t.Fatalf("APNS_SANDBOX_CERT: %s", err.Error())
+	}
+	key, err := os.ReadFile(os.Getenv("APNS_SANDBOX_KEY"))
+	if err != nil {
+		t.Fatalf("APNS_SANDBOX_KEY: %s", err.Error())
+	}
+	token := os.Getenv("APNS_SANDBOX_TOKEN")
+	if token == "" {
+		t.Fatal("APNS_SANDBOX_TOKEN is not set")
+	}
+	appString := os.Getenv("APNS_SANDBOX_APP")
+	if appString == "" {
+		appString = "sandbox"
+	}
+
+	appCert := AppCert{IsDev: 1, Cert: cert, RSAKey: key}
+	a := newConnection(0, appString, &appCert)
+	chanClose := make(chan *apns.ConnectionClose, 10)
+	a.closeHook = func(closeError *apns.ConnectionClose) {
+		// the hook runs on a worker, which must not wait for the suite
+		select {
+		case chanClose <- closeError:
+		default:
+		}
+	}
+
+	t.Log("launch: connecting to sandbox")
+	if err = a.launch(true); err != nil {
+		t.Fatalf("launch: %s", err.Error())
+	}
+	defer a.close()
+	if !a.isActive() {
+		t.Fatalf("launch: status %d, want %d", a.getStatus(), apnsActive)
+	}
+
+	t.Log("send: pushing to test device")
+	a.pushOne(&apns.Payload{Token: token, AlertText: "apnsservice sandbox suite: send"}, &PushOptions{}, nil)
+	select {
+	case closeError := <-chanClose:
+		t.Fatalf("send: connection closed with %v", closeError.Error)
+	case <-time.After(sandboxWait / 3):
+	}
+
+	t.Log("rejection: pushing to an invalid token")
+	a.pushOne(&apns.Payload{Token: invalidSandboxToken, AlertText: "apnsservice sandbox suite: reject"}, &PushOptions{}, nil)
+	select {
+	case closeError := <-chanClose:
+		if closeError.Error == nil {
+			t.Fatal("rejection: connection closed without an apple error")
+		}
+		t.Log("rejection: apple status", closeError.Error.Status, closeError.Error.ErrorString)
+	case <-time.After(sandboxWait):
+		t.Fatal("rejection: no close error from apple")
+	}
+
+	t.Log("recovery: pushing to test device after reconnect")
+	a.pushOne(&apns.Payload{Token: token, AlertText: "apnsservice sandbox suite: recovery"}, &PushOptions{}, nil)
+	select {
+	case closeError := <-chanClose:
+		t.Fatalf("recovery: connection closed with %v", closeError.Error)
+	case <-time.After(sandboxWait / 3):
+	}
+
+	t.Log("feedback: polling", a.cfgFeedback.GatewayHost)
+	if err = a.getBadTokens(log.New(testWriter{t}, "feedback: ", 0)); err != nil {
+		t.Fatalf("feedback: %s", err.Error())
+	}
+}
@@ -0,0 +1,141 @@
+package apnsservice
+
+// This source code includes the expedited lane. Each connection queues
+// pushes in two channels: the send channel for normal traffic and a
+// high-priority lane for time-critical pushes such as one-time codes and
+// call invites. A lane listener hands the socket workers the next push,
+// taking the high-priority lane first, so a bulk campaign filling the send
+// channel does not delay them. Pushes a binary socket has to resend wait in
+// a retry backlog the listener serves before both lanes, so a worker never
+// waits on a full lane and a retried push is never dropped.
+
+import (
+	"sync"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// retryBacklog holds pushes waiting to be sent again, oldest first.
+type retryBacklog struct {
+	mutex       sync.Mutex
+	listPending []*notification
+	chanAdded   chan struct{} // signals the lane listener; holds at most one signal
+}
+
+// newRetryBacklog returns an empty backlog.
+func newRetryBacklog() *retryBacklog {
+	return &retryBacklog{chanAdded: make(chan struct{}, 1)}
+}
+
+// add appends n and wakes the lane listener.
+func (b *retryBacklog) add(n *notification) {
+	b.mutex.Lock()
+	b.listPending = append(b.listPending, n)
+	b.mutex.Unlock()
+	select {
+	case b.chanAdded <- struct{}{}:
+	default:
+	}
+}
+
+// putBack returns n to the front of the backlog.
+func (b *retryBacklog) putBack(n *notification) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.listPending = append([]*notification{n}, b.listPending...)
+}
+
+// take removes and returns the oldest push, or nil if there is none.
+func (b *retryBacklog) take() *notification {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.listPending) == 0 {
+		return nil
+	}
+	n := b.listPending[0]
+	b.listPending[0] = nil
+	b.listPending = b.listPending[1:]
+	return n
+}
+
+// takeAll removes and returns every push in the backlog. It is nil-safe.
+func (b *retryBacklog) takeAll() []*notification {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	listPending := b.listPending
+	b.listPending = nil
+	return listPending
+}
+
+// len returns the number of pushes in the backlog. It is nil-safe.
+func (b *retryBacklog) len() int {
+	if b == nil {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.listPending)
+}
+
+// retryLater queues a push a worker has to send again. The lane listener
+// hands it to a worker before anything in the lanes. It never blocks, and
+// if the connection closes first the hand-over moves it on.
+func (a *connectionAPNS) retryLater(n *notification) {
+	a.backlog.add(n)
+}
+
+// PushOnePriority is PushOneWithOptions through the high-priority lane.
+// The push overtakes every normal push still queued for the app. It does
+// not change the apns-priority Apple sees; set opts.Priority for that.
+func PushOnePriority(appID int, payload apns.Payload, opts PushOptions) error {
+	opts.Expedited = true
+	return PushOneWithOptions(appID, payload, opts)
+}
+
+// lane returns the channel a notification is queued in.
+func (a *connectionAPNS) lane(n *notification) chan *notification {
+	if n.options.Expedited {
+		return a.chanHigh
+	}
+	return a.chanSend
+}
+
+// queueDepth returns the notifications waiting in both lanes and their capacity.
+func (a *connectionAPNS) queueDepth() (int, int) {
+	return len(a.chanSend) + len(a.chanHigh), cap(a.chanSend) + cap(a.chanHigh)
+}
+
+// laneListener moves notifications from the retry backlog and the lanes to
+// the socket workers, draining the backlog first and the high-priority lane
+// before the send channel. The done channel shuts down this listener.
+func (a *connectionAPNS) laneListener() {
+	defer a.wgWorkers.Done()
+
+	for {
+		n := a.backlog.take()
+		if n == nil {
+			select {
+			case n = <-a.chanHigh:
+			default:
+				select {
+				case n = <-a.chanHigh:
+				case n = <-a.chanSend:
+				case <-a.backlog.chanAdded:
+					continue
+				case <-a.chanDone:
+					return
+				}
+			}
+		}
+		select {
+		case a.chanReady <- n:
+		case <-a.chanDone:
+			// keep n first in line for the hand-over; producers may have filled its lane
+			a.backlog.putBack(n)
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package apnsservice
+
+// This source code includes the typed launch API. LaunchConnectionWithOptions
+// takes the credentials without environment flags and configures the
+// connection with functional options, replacing the int flags of
+// LaunchConnection and AppCert.IsDev.
+
+import (
+	"io"
+)
+
+// Credentials authenticate an app with Apple: a certificate and its RSA key,
+// or a p8 auth key with its key id and team id for token-based authentication.
+type Credentials struct {
+	Cert    []byte
+	RSAKey  []byte
+	AuthKey []byte
+	KeyID   string
+	TeamID  string
+}
+
+// launchConfig collects the options of one launch.
+type launchConfig struct {
+	isSandbox bool
+	isLogging bool
+	options   ConnectionOptions
+}
+
+// Option configures a connection launched by LaunchConnectionWithOptions.
+type Option func(*launchConfig)
+
+// WithSandbox connects to Apple's sandbox gateway instead of production.
+func WithSandbox() Option {
+	return func(c *launchConfig) {
+		c.isSandbox = true
+	}
+}
+
+// WithLogging writes the connection log to w, or to the app's file under
+// logs/ when w is nil.
+func WithLogging(w io.Writer) Option {
+	return func(c *launchConfig) {
+		c.isLogging = true
+		c.options.LogWriter = w
+	}
+}
+
+// WithSockets sets the number of sockets launched.
+func WithSockets(n int) Option {
+	return func(c *launchConfig) {
+		c.options.Sockets = n
+	}
+}
+
+// WithProtocol selects the provider API.
+func WithProtocol(protocol Protocol) Option {
+	return func(c *launchConfig) {
+		c.options.Protocol = protocol
+	}
+}
+
+// WithTopic sets the app's bundle id, sent as apns-topic on HTTP/2 connections.
+func WithTopic(strTopic string) Option {
+	return func(c *launchConfig) {
+		c.options.Topic = strTopic
+	}
+}
+
+// WithConnectionOptions replaces every connection option with opts.
+// Options given after it still apply on top.
+func WithConnectionOptions(opts ConnectionOptions) Option {
+	return func(c *launchConfig) {
+		c.options = opts
+	}
+}
+
+// LaunchConnectionWithOptions launches the app's connection, replacing an
+// existing one. Connection options already set for the app are the starting
+// point for opts, and the result is stored as the app's options.
+func LaunchConnectionWithOptions(appID int, stringID string, cert Credentials, opts ...Option) error {
+	config := launchConfig{options: lookupOptions(appID)}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	appCert := AppCert{
+		AppID:   appID,
+		Cert:    cert.Cert,
+		RSAKey:  cert.RSAKey,
+		AuthKey: cert.AuthKey,
+		KeyID:   cert.KeyID,
+		TeamID:  cert.TeamID,
+	}
+	if config.isSandbox {
+		appCert.IsDev = 1
+	}
+	SetConnectionOptions(appID, config.options)
+	return registerConnection(appID, stringID, appCert, config.isLogging, true)
+}
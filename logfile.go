@@ -0,0 +1,131 @@
+package apnsservice
+
+// This source code includes choosing where a connection logs. By default each
+// app logs to its own file under logs/, one directory per platform. The
+// directory and the file path can be set per app or for the whole process,
+// and containers with read-only filesystems can log to stdout or stderr, or
+// to any io.Writer, instead of files.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// These are the values of ConnectionOptions.LogOutput.
+const (
+	LogOutputFile   = "file"
+	LogOutputStdout = "stdout"
+	LogOutputStderr = "stderr"
+)
+
+// defaultLogDirectory is the log directory, relative to the working directory.
+const defaultLogDirectory = "logs"
+
+// strLogDirectory and writerLogOutput are the process-wide log settings.
+var (
+	mutexLogSettings sync.RWMutex
+	strLogDirectory  = defaultLogDirectory
+	writerLogOutput  io.Writer
+)
+
+// SetLogDirectory sets the directory under which connections without their
+// own LogDirectory or LogFile write their logs, "logs" by default. Each
+// platform logs to its own subdirectory, created when needed.
+// Connections launched earlier keep their files.
+func SetLogDirectory(strDir string) {
+	if strDir == "" {
+		strDir = defaultLogDirectory
+	}
+	mutexLogSettings.Lock()
+	defer mutexLogSettings.Unlock()
+	strLogDirectory = strDir
+}
+
+// SetLogOutput sends the logs of every connection that has no LogWriter or
+// LogOutput of its own to w, for example os.Stdout, instead of files.
+// Entries are prefixed with the app's string id, and w must be safe for
+// concurrent use by the connections. A nil w restores files.
+// Connections launched earlier keep their destination.
+func SetLogOutput(w io.Writer) {
+	mutexLogSettings.Lock()
+	defer mutexLogSettings.Unlock()
+	writerLogOutput = w
+}
+
+// logPath returns the log file of the connection.
+func (a *connectionAPNS) logPath() string {
+	if a.options.LogFile != "" {
+		return a.options.LogFile
+	}
+	strDir := a.options.LogDirectory
+	if strDir == "" {
+		mutexLogSettings.RLock()
+		strDir = strLogDirectory
+		mutexLogSettings.RUnlock()
+	}
+	strPlatformDir := "apns"
+	switch a.platform {
+	case PlatformAndroid:
+		strPlatformDir = "fcm"
+	case PlatformWeb:
+		strPlatformDir = "webpush"
+	}
+	return filepath.Join(strDir, strPlatformDir, a.stringID+".txt")
+}
+
+// openLog returns the destination of the connection log and whether other
+// connections may share it. A connection that does not log gets no file. A
+// LogWriter wins over LogOutput, LogOutput over the process-wide output, and
+// any of them over the log file.
+func (a *connectionAPNS) openLog(isLogging bool) (io.Writer, bool, error) {
+	if !isLogging {
+		return io.Discard, false, nil
+	}
+	if a.options.LogWriter != nil {
+		return a.options.LogWriter, false, nil
+	}
+	switch a.options.LogOutput {
+	case LogOutputStdout:
+		return os.Stdout, true, nil
+	case LogOutputStderr:
+		return os.Stderr, true, nil
+	case "":
+		mutexLogSettings.RLock()
+		w := writerLogOutput
+		mutexLogSettings.RUnlock()
+		if w != nil {
+			return w, true, nil
+		}
+	case LogOutputFile:
+	default:
+		return nil, false, fmt.Errorf("unknown log output %q", a.options.LogOutput)
+	}
+
+	strLogPath := a.logPath()
+	if err := os.MkdirAll(filepath.Dir(strLogPath), 0755); err != nil {
+		return nil, false, err
+	}
+	fileLog, err := os.OpenFile(strLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, false, err
+	}
+	a.closerLog = fileLog
+	return fileLog, false, nil
+}
+
+// closeLog closes the log file the connection opened. Writers supplied by
+// the caller, such as LogWriter or SetLogOutput, are left open. The log
+// listener calls it once the workers stop, and launch calls it on failure.
+func (a *connectionAPNS) closeLog() {
+	if a.closerLog == nil {
+		return
+	}
+	if err := a.closerLog.Close(); err != nil {
+		utils.Warning.Println("Error closing apns log ", a.stringID, err.Error())
+	}
+}
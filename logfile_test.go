@@ -0,0 +1,43 @@
+package apnsservice
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogFileNotCreatedWithoutLogging(t *testing.T) {
+	const appID = 9501
+	strDir := t.TempDir()
+	SetConnectionOptions(appID, ConnectionOptions{LogDirectory: strDir, LogOutput: LogOutputFile})
+	if err := LaunchConnectionWithTransport(appID, "quiet", NewMockTransport(), false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+	if getConnection(appID).closerLog != nil {
+		t.Fatal("log file opened for a connection that does not log")
+	}
+	if _, err := os.Stat(filepath.Join(strDir, "apns")); !os.IsNotExist(err) {
+		t.Fatalf("log directory created: %v", err)
+	}
+}
+
+func TestFailedLaunchClosesLogFile(t *testing.T) {
+	const appID = 9502
+	SetConnectionOptions(appID, ConnectionOptions{
+		LogFile:       filepath.Join(t.TempDir(), "failed.log"),
+		PayloadSchema: json.RawMessage(`{"type": 1}`),
+	})
+	a := newConnection(appID, "failed", &AppCert{AppID: appID})
+	a.options.Mock = NewMockTransport()
+	if err := a.launch(true); err == nil {
+		t.Fatal("launch with an invalid schema succeeded")
+	}
+	if a.closerLog == nil {
+		t.Fatal("log file not opened")
+	}
+	if _, err := a.closerLog.(*os.File).Stat(); err == nil {
+		t.Fatal("log file left open after the launch failed")
+	}
+}
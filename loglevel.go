@@ -0,0 +1,120 @@
+package apnsservice
+
+// This source code includes connection log levels. Each logging connection
+// writes its entries at or below its level and drops the rest, so one
+// misbehaving app can be switched to debug at runtime while the others stay
+// quiet. Each entry is tagged with its level.
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the verbosity of a connection log. The zero value means LogInfo.
+type LogLevel int32
+
+// These are the log levels from the quietest.
+// LogDebug adds the progress of each push and LogTrace adds payload contents.
+const (
+	LogError LogLevel = iota + 1
+	LogWarn
+	LogInfo
+	LogDebug
+	LogTrace
+)
+
+// listLogLevels names the levels in order, starting with LogError.
+var listLogLevels = []string{"error", "warn", "info", "debug", "trace"}
+
+// String returns the name of the level.
+func (l LogLevel) String() string {
+	if l < LogError || l > LogTrace {
+		return listLogLevels[LogInfo-1]
+	}
+	return listLogLevels[l-1]
+}
+
+// ParseLogLevel returns the level named by strLevel, such as "debug".
+func ParseLogLevel(strLevel string) (LogLevel, error) {
+	for i, strName := range listLogLevels {
+		if strings.EqualFold(strings.TrimSpace(strLevel), strName) {
+			return LogLevel(i + 1), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", strLevel)
+}
+
+// MarshalText writes the level by name, so configs read "debug" rather than 4.
+func (l LogLevel) MarshalText() ([]byte, error) {
+	if l == 0 {
+		return []byte{}, nil
+	}
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText reads a level by name. An empty name means the default.
+func (l *LogLevel) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*l = 0
+		return nil
+	}
+	level, err := ParseLogLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// SetLogLevel changes the log level of the specified app's running
+// connection. It lasts until the connection is relaunched; set
+// ConnectionOptions.LogLevel to keep it.
+func SetLogLevel(appID int, level LogLevel) error {
+	if err := checkLogLevel(level); err != nil {
+		return err
+	}
+	connectionAPNS := getConnection(appID)
+	if connectionAPNS == nil {
+		return ErrAppNotFound
+	}
+	connectionAPNS.setLogLevel(level)
+	return nil
+}
+
+// checkLogLevel rejects a level outside LogError to LogTrace.
+func checkLogLevel(level LogLevel) error {
+	if level < LogError || level > LogTrace {
+		return fmt.Errorf("invalid log level %d", level)
+	}
+	return nil
+}
+
+// setLogLevel sets the level, the connection default for zero.
+func (a *connectionAPNS) setLogLevel(level LogLevel) {
+	if level == 0 {
+		level = LogInfo
+	}
+	atomic.StoreInt32(&a.logLevel, int32(level))
+}
+
+// getLogLevel returns the level of the connection.
+func (a *connectionAPNS) getLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&a.logLevel))
+}
+
+// logsAt reports whether a logging connection writes entries of level.
+func (a *connectionAPNS) logsAt(level LogLevel) bool {
+	return a.isLogging && level <= a.getLogLevel()
+}
+
+// logLevelf pushes a log entry of level with string formatting.
+func (a *connectionAPNS) logLevelf(level LogLevel, socketID int, format string, args ...interface{}) {
+	if a.logsAt(level) {
+		entry := logEntry{
+			socketID: socketID,
+		}
+		entry.message = strings.ToUpper(level.String()) + ": " + fmt.Sprintf(format, args...)
+		a.pushLog(&entry)
+	}
+}
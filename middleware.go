@@ -0,0 +1,78 @@
+package apnsservice
+
+// This source code includes the payload middleware chain. Middleware runs on
+// every push before it is validated and enqueued, so callers can compute
+// badges, scrub PII, tag experiments or sign payloads without forking the
+// send path. Global middleware runs first, then the app's own.
+
+import (
+	"context"
+	"sync"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// Middleware rewrites or rejects a payload before it is enqueued. It returns
+// the payload to continue with, which may be the one it was given after
+// editing it in place, or nil to keep it. An error rejects the push.
+// Middleware is called from the pushing goroutine and must be safe for concurrent use.
+type Middleware func(ctx context.Context, payload *apns.Payload) (*apns.Payload, error)
+
+// PushInfo describes the push a middleware runs for.
+type PushInfo struct {
+	AppID    int
+	StringID string
+	Platform Platform
+	Options  PushOptions
+}
+
+// pushInfoKey is the context key of the PushInfo.
+type pushInfoKey struct{}
+
+// PushInfoFromContext returns the PushInfo of the push a middleware runs for.
+func PushInfoFromContext(ctx context.Context) (PushInfo, bool) {
+	info, ok := ctx.Value(pushInfoKey{}).(PushInfo)
+	return info, ok
+}
+
+var (
+	mutexMiddleware sync.RWMutex
+	listMiddleware  []Middleware
+)
+
+// UseMiddleware appends middleware run on the pushes of every app.
+func UseMiddleware(middleware ...Middleware) {
+	mutexMiddleware.Lock()
+	defer mutexMiddleware.Unlock()
+	listMiddleware = append(listMiddleware, middleware...)
+}
+
+// intercept runs the global and the app's middleware on payload in order.
+func (a *connectionAPNS) intercept(ctx context.Context, payload *apns.Payload, opts PushOptions) error {
+	mutexMiddleware.RLock()
+	listChain := listMiddleware
+	mutexMiddleware.RUnlock()
+	if len(listChain) == 0 && len(a.options.Middleware) == 0 {
+		return nil
+	}
+
+	ctx = context.WithValue(ctx, pushInfoKey{}, PushInfo{
+		AppID:    a.appID,
+		StringID: a.stringID,
+		Platform: a.platform,
+		Options:  opts,
+	})
+	for _, listLayer := range [][]Middleware{listChain, a.options.Middleware} {
+		for _, middleware := range listLayer {
+			payloadNext, err := middleware(ctx, payload)
+			if err != nil {
+				a.logLevelf(LogDebug, 0, "Middleware rejected %s %s\n", payload.Token, err.Error())
+				return err
+			}
+			if payloadNext != nil && payloadNext != payload {
+				*payload = *payloadNext
+			}
+		}
+	}
+	return nil
+}
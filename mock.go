@@ -0,0 +1,180 @@
+package apnsservice
+
+// This source code includes the mock transport. A connection launched with a
+// MockTransport needs no certificate and never dials Apple: each push is
+// recorded in memory and answered like the HTTP/2 provider API, with
+// rejections, transient failures and feedback injected by the test.
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// MockPush is one push attempt recorded by a MockTransport.
+type MockPush struct {
+	AppID   int             `json:"appId"`
+	Token   string          `json:"token"`
+	Payload apns.Payload    `json:"-"`
+	Body    json.RawMessage `json:"body"` // the payload as Apple would receive it
+	Options PushOptions     `json:"options"`
+	Status  int             `json:"status"` // the simulated response, 200 when accepted
+	Reason  string          `json:"reason,omitempty"`
+	Time    time.Time       `json:"time"`
+}
+
+// mockResponse is a simulated answer to a push.
+type mockResponse struct {
+	status int
+	reason string
+}
+
+// MockTransport records pushes in memory instead of sending them to Apple.
+// It is safe for concurrent use.
+type MockTransport struct {
+	mutex        sync.Mutex
+	conn         *connectionAPNS
+	listPushes   []MockPush
+	mapRejects   map[string]mockResponse
+	listFailures []mockResponse
+	listFeedback []Feedback
+}
+
+// NewMockTransport returns an empty mock transport.
+func NewMockTransport() *MockTransport {
+	return &MockTransport{mapRejects: make(map[string]mockResponse)}
+}
+
+// LaunchConnectionWithTransport launches a connection for an app that pushes
+// through transport instead of Apple. No certificate is needed, and without
+// logging no log file is opened, so it runs in CI. An existing connection for
+// the app is replaced. The app's other ConnectionOptions still apply; set
+// Protocol to ProtocolHTTP2 to get the HTTP/2 payload checks. The transport
+// belongs to this connection only and is not stored with the app's options,
+// so a later launch of the app talks to Apple again.
+func LaunchConnectionWithTransport(appID int, appString string, transport *MockTransport, isLogging bool) error {
+	connectionAPNS := newConnection(appID, appString, &AppCert{AppID: appID})
+	connectionAPNS.options.Mock = transport
+	return storeConnection(&connectionAPNS, isLogging, true)
+}
+
+// Reject makes every push to token fail with an HTTP or binary status and
+// Apple's reason, for example 410 and "Unregistered".
+func (m *MockTransport) Reject(token string, status int, reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.mapRejects[token] = mockResponse{status: status, reason: reason}
+}
+
+// FailNext makes the next count pushes fail with status and reason, for
+// example 503 or binary status 10 to simulate Apple closing the connection.
+func (m *MockTransport) FailNext(count int, status int, reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := 0; i < count; i++ {
+		m.listFailures = append(m.listFailures, mockResponse{status: status, reason: reason})
+	}
+}
+
+// SendFeedback reports token as invalid the way the feedback service does.
+// Before launch the feedback is held and reported when the connection launches.
+func (m *MockTransport) SendFeedback(token string) {
+	m.mutex.Lock()
+	conn := m.conn
+	if conn == nil {
+		m.listFeedback = append(m.listFeedback, Feedback{Token: token, Timestamp: time.Now()})
+	}
+	m.mutex.Unlock()
+	if conn != nil {
+		conn.removeFeedbackToken(token, time.Now())
+	}
+}
+
+// Pushes returns every recorded push attempt, oldest first.
+func (m *MockTransport) Pushes() []MockPush {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]MockPush(nil), m.listPushes...)
+}
+
+// Sent returns the recorded pushes that were accepted, oldest first.
+func (m *MockTransport) Sent() []MockPush {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var listSent []MockPush
+	for _, push := range m.listPushes {
+		if push.Status == http.StatusOK {
+			listSent = append(listSent, push)
+		}
+	}
+	return listSent
+}
+
+// WaitForSent waits until at least count pushes were accepted or timeout passes.
+// It reports whether the count was reached.
+func (m *MockTransport) WaitForSent(count int, timeout time.Duration) bool {
+	timeLimit := time.Now().Add(timeout)
+	for {
+		if len(m.Sent()) >= count {
+			return true
+		}
+		if time.Now().After(timeLimit) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Reset forgets recorded pushes and injected responses.
+func (m *MockTransport) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listPushes = nil
+	m.mapRejects = make(map[string]mockResponse)
+	m.listFailures = nil
+	m.listFeedback = nil
+}
+
+// attach binds the transport to a launched connection and reports held feedback.
+func (m *MockTransport) attach(a *connectionAPNS) {
+	m.mutex.Lock()
+	m.conn = a
+	listFeedback := m.listFeedback
+	m.listFeedback = nil
+	m.mutex.Unlock()
+	for _, feedback := range listFeedback {
+		a.removeFeedbackToken(feedback.Token, feedback.Timestamp)
+	}
+}
+
+// deliver records one push and returns the simulated status and reason.
+func (m *MockTransport) deliver(a *connectionAPNS, n *notification) (int, string, error) {
+	body, err := n.marshal()
+	if err != nil {
+		return 0, "", err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	response := mockResponse{status: http.StatusOK}
+	if len(m.listFailures) > 0 {
+		response = m.listFailures[0]
+		m.listFailures = m.listFailures[1:]
+	} else if reject, ok := m.mapRejects[n.payload.Token]; ok {
+		response = reject
+	}
+	m.listPushes = append(m.listPushes, MockPush{
+		AppID:   a.appID,
+		Token:   n.payload.Token,
+		Payload: n.payload,
+		Body:    body,
+		Options: n.options,
+		Status:  response.status,
+		Reason:  response.reason,
+		Time:    time.Now(),
+	})
+	return response.status, response.reason, nil
+}
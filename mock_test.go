@@ -0,0 +1,35 @@
+package apnsservice
+
+import (
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+func TestMockTransportStaysWithItsConnection(t *testing.T) {
+	const appID = 9801
+	SetConnectionOptions(appID, ConnectionOptions{Sockets: 1})
+	transport := NewMockTransport()
+	if err := LaunchConnectionWithTransport(appID, "mocked", transport, false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+	if err := PushOne(appID, apns.Payload{Token: testToken(1), AlertText: "mocked"}); err != nil {
+		t.Fatal(err)
+	}
+	if !transport.WaitForSent(1, time.Second) {
+		t.Fatal("mock connection sent nothing")
+	}
+	if opts := lookupOptions(appID); opts.Mock != nil || opts.Sockets != 1 {
+		t.Fatalf("stored options %+v, want the app's own without the mock", opts)
+	}
+
+	// a real launch without a cert must fail instead of landing on the mock
+	if err := LaunchConnectionWithOptions(appID, "real", Credentials{}); err == nil {
+		t.Fatal("real launch without a cert succeeded through the mock")
+	}
+	if got := len(transport.Pushes()); got != 1 {
+		t.Fatalf("mock recorded %d pushes, want 1", got)
+	}
+}
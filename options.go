@@ -0,0 +1,275 @@
+package apnsservice
+
+// This source code includes optional per-app connection settings.
+// Options are set from main or an admin API and are read when the
+// app's connection is launched.
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol selects the provider API a connection speaks to Apple.
+type Protocol int
+
+// These are the supported provider APIs.
+// ProtocolBinary is the legacy Apple Binary Protocol served by go-libapns.
+// ProtocolHTTP2 is the HTTP/2 provider API, which also carries collapse-id
+// and the aps keys apns.Payload has no field for.
+const (
+	ProtocolBinary Protocol = iota
+	ProtocolHTTP2
+)
+
+// UnmarshalJSON accepts a protocol number or its name, "binary" or "http2",
+// so config files can name the protocol.
+func (p *Protocol) UnmarshalJSON(data []byte) error {
+	var strName string
+	if err := json.Unmarshal(data, &strName); err != nil {
+		var intProtocol int
+		if err := json.Unmarshal(data, &intProtocol); err != nil {
+			return err
+		}
+		*p = Protocol(intProtocol)
+		return nil
+	}
+	switch strName {
+	case "binary":
+		*p = ProtocolBinary
+	case "http2":
+		*p = ProtocolHTTP2
+	default:
+		return fmt.Errorf("unknown protocol %q", strName)
+	}
+	return nil
+}
+
+// unmarshalDurations decodes data into v, a pointer to a struct without its
+// own UnmarshalJSON, and accepts a time.ParseDuration string such as "30s"
+// as well as nanoseconds for each time.Duration field.
+func unmarshalDurations(data []byte, v interface{}) error {
+	var mapFields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &mapFields); err != nil || mapFields == nil {
+		return json.Unmarshal(data, v)
+	}
+	typeStruct := reflect.TypeOf(v).Elem()
+	for i := 0; i < typeStruct.NumField(); i++ {
+		field := typeStruct.Field(i)
+		if field.Type != reflect.TypeOf(time.Duration(0)) {
+			continue
+		}
+		strName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if strName == "" {
+			strName = field.Name
+		}
+		for strKey, raw := range mapFields {
+			var strDuration string
+			if !strings.EqualFold(strKey, strName) || json.Unmarshal(raw, &strDuration) != nil {
+				continue
+			}
+			duration, err := time.ParseDuration(strDuration)
+			if err != nil {
+				return fmt.Errorf("%s: %s", strKey, err.Error())
+			}
+			mapFields[strKey] = json.RawMessage(strconv.FormatInt(int64(duration), 10))
+		}
+	}
+	data, err := json.Marshal(mapFields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ConnectionOptions holds optional settings for one app connection.
+// The zero value keeps the default behavior.
+type ConnectionOptions struct {
+	// Protocol selects the provider API. The default is ProtocolBinary.
+	Protocol Protocol `json:"protocol"`
+
+	// Topic is the app's bundle id, sent as apns-topic on HTTP/2 connections.
+	// Cert-based connections may leave it empty to use the cert's topic.
+	// PushOptions.Topic overrides it per push, so one universal cert or auth
+	// key can serve the app, its watch app and its complications.
+	Topic string `json:"topic"`
+
+	// VoIP makes every push a PushKit VoIP push: push type voip, priority 10,
+	// the .voip topic suffix and the 5KB payload limit.
+	VoIP bool `json:"voip"`
+
+	// Classes optionally declares the app's notification taxonomy.
+	// When set, a push whose PushOptions.Class is not listed is rejected.
+	Classes []string `json:"classes"`
+
+	// TokenStore optionally receives invalid and failed tokens and
+	// resolves users to tokens for PushToUser.
+	TokenStore TokenStore `json:"-"`
+
+	// BadgeStore optionally keeps a badge count per device, set on every
+	// alert that has no badge. See IncrementBadge and ResetBadge.
+	BadgeStore BadgeStore `json:"-"`
+
+	// PreferenceStore optionally holds users' opt-outs, quiet hours and daily
+	// caps, checked before each push is enqueued. MuteHandler optionally hears
+	// about each push they drop.
+	PreferenceStore PreferenceStore `json:"-"`
+	MuteHandler     MuteHandler     `json:"-"`
+
+	// RetryPolicy controls backoff, attempts per payload and which failures
+	// are retried. The zero value keeps the one to 128 second backoff.
+	RetryPolicy RetryPolicy `json:"retryPolicy"`
+
+	// RateLimit caps the rate pushes enter the send channel.
+	// ClassRateLimits adds a limit per notification class on top of it.
+	RateLimit       RateLimit            `json:"rateLimit"`
+	ClassRateLimits map[string]RateLimit `json:"classRateLimits"`
+
+	// Mock replaces Apple with an in-memory transport for tests. Prefer
+	// LaunchConnectionWithTransport, which sets it on one connection only.
+	Mock *MockTransport `json:"-"`
+
+	// DeadLetterSink optionally receives every dead-letter record,
+	// for example a DeadLetterQueue.
+	DeadLetterSink DeadLetterSink `json:"-"`
+
+	// AuditSink optionally records every push attempt, for example an
+	// SQLAuditStore. See History.
+	AuditSink AuditSink `json:"-"`
+
+	// PayloadCacheSize is the number of recent payloads each binary socket
+	// keeps for replay after Apple closes the connection, 32 by default.
+	// OverflowHandler optionally hears about unsent payloads the cache could not hold.
+	PayloadCacheSize int             `json:"payloadCacheSize"`
+	OverflowHandler  OverflowHandler `json:"-"`
+
+	// UnsentHandler optionally receives the full list of payloads left unsent
+	// when Apple closes a binary connection, and may take them over.
+	UnsentHandler UnsentHandler `json:"-"`
+
+	// DeadLetterPayloads includes a payload snapshot in dead-letter records.
+	// By default records carry only a hash of the payload.
+	DeadLetterPayloads bool `json:"deadLetterPayloads"`
+
+	// SuppressionWindow suppresses a push whose token and content, badge and
+	// sound included, match a push sent within the window. Zero disables suppression.
+	SuppressionWindow time.Duration `json:"suppressionWindow"`
+
+	// IdempotencyWindow is how long a PushOptions.IdempotencyKey is remembered,
+	// 10 minutes by default. Keys are remembered per process.
+	IdempotencyWindow time.Duration `json:"idempotencyWindow"`
+
+	// Sockets is the number of sockets launched, 2 by default and at most 8.
+	Sockets int `json:"sockets"`
+
+	// SocketPolicy optionally grows, shrinks or re-dials the socket pool from
+	// observed latency. It runs every PolicyInterval, 30 seconds by default.
+	SocketPolicy   SocketPolicy  `json:"-"`
+	PolicyInterval time.Duration `json:"policyInterval"`
+
+	// SharedQueue enables cooperative mode: pushes are enqueued to the backend
+	// and every process configured with the same backend leases from it.
+	// InstanceID names this process as a lease owner, hostname:pid by default.
+	// LeaseTTL is how long an unrenewed lease is held, 30 seconds by default.
+	// EnqueueOnly makes this process a producer: it enqueues to SharedQueue
+	// but opens no connection to Apple and leases nothing, so only the worker
+	// processes hold connections. A producer needs no cert.
+	SharedQueue SharedQueue   `json:"-"`
+	InstanceID  string        `json:"instanceId"`
+	LeaseTTL    time.Duration `json:"leaseTtl"`
+	EnqueueOnly bool          `json:"enqueueOnly"`
+
+	// FeedbackLock elects one replica to poll the feedback service when
+	// several run this app. The winner holds it for FeedbackLockTTL, one hour
+	// by default, and InstanceID names it.
+	FeedbackLock    FeedbackLock  `json:"-"`
+	FeedbackLockTTL time.Duration `json:"feedbackLockTtl"`
+
+	// ConnectTimeout bounds the dial and TLS handshake of each socket, 10 seconds by default.
+	// KeepAlive is the TCP keepalive period, 30 seconds by default; negative disables it.
+	// IdleReconnect re-dials a socket that has sent nothing for that long, before
+	// Apple or a middlebox silently drops it. Zero never re-dials an idle socket.
+	// FlushInterval is how long a binary socket buffers payloads into one frame,
+	// 10 milliseconds by default.
+	ConnectTimeout time.Duration `json:"connectTimeout"`
+	KeepAlive      time.Duration `json:"keepAlive"`
+	IdleReconnect  time.Duration `json:"idleReconnect"`
+	FlushInterval  time.Duration `json:"flushInterval"`
+
+	// CircuitBreaker optionally parks the connection after repeated failures
+	// instead of retrying forever. See Reset.
+	CircuitBreaker CircuitBreaker `json:"circuitBreaker"`
+
+	// PauseBuffer is the number of pushes held while the connection is paused,
+	// 10000 by default. Further pushes are refused with ErrQueueFull.
+	PauseBuffer int `json:"pauseBuffer"`
+
+	// Middleware runs on each of the app's pushes after the global middleware.
+	// See UseMiddleware.
+	Middleware []Middleware `json:"-"`
+
+	// PayloadSchema optionally is a JSON Schema the custom data of each push
+	// must satisfy, and PayloadValidator a callback it must pass. Pushes that
+	// fail either are refused with an error matching ErrInvalidPayload.
+	PayloadSchema    json.RawMessage  `json:"payloadSchema,omitempty"`
+	PayloadValidator PayloadValidator `json:"-"`
+
+	// BadTokenCacheSize is the number of tokens Apple reported as invalid that
+	// the app remembers and refuses pushes to, 10000 by default. A negative
+	// size disables the cache. See IsTokenBad.
+	BadTokenCacheSize int `json:"badTokenCacheSize"`
+
+	// GatewayURL replaces Apple's HTTP/2 provider API, for example with an
+	// apnstest.Server. GatewayRootCAs is then trusted instead of the system roots.
+	GatewayURL     string         `json:"gatewayUrl"`
+	GatewayRootCAs *x509.CertPool `json:"-"`
+
+	// LogWriter receives the connection log of a logging connection instead
+	// of the app's file under logs/, for example os.Stdout or a *syslog.Writer
+	// for a remote syslog. See WithLogging.
+	// LogLevel is the verbosity of the connection log, LogInfo by default.
+	// SetLogLevel changes it while the connection runs.
+	LogWriter io.Writer `json:"-"`
+	LogLevel  LogLevel  `json:"logLevel"`
+
+	// LogOutput is LogOutputStdout or LogOutputStderr to log there instead of
+	// to a file, or LogOutputFile to log to a file despite SetLogOutput.
+	// LogDirectory replaces the directory set by SetLogDirectory, and LogFile
+	// is the full path of the log file, replacing both. See SetLogOutput.
+	LogOutput    string `json:"logOutput,omitempty"`
+	LogDirectory string `json:"logDirectory,omitempty"`
+	LogFile      string `json:"logFile,omitempty"`
+}
+
+// UnmarshalJSON accepts durations as strings such as "30s" or as nanoseconds.
+func (o *ConnectionOptions) UnmarshalJSON(data []byte) error {
+	type plain ConnectionOptions
+	return unmarshalDurations(data, (*plain)(o))
+}
+
+// mapOptions stores connection options keyed by appID.
+var (
+	mutexOptions sync.RWMutex
+	mapOptions   = make(map[int]ConnectionOptions)
+)
+
+// SetConnectionOptions stores the options for an app.
+// They take effect the next time the app's connection is launched.
+func SetConnectionOptions(appID int, opts ConnectionOptions) {
+	mutexOptions.Lock()
+	defer mutexOptions.Unlock()
+	mapOptions[appID] = opts
+}
+
+// lookupOptions returns the options stored for appID or the zero value.
+func lookupOptions(appID int) ConnectionOptions {
+	mutexOptions.RLock()
+	defer mutexOptions.RUnlock()
+	return mapOptions[appID]
+}
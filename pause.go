@@ -0,0 +1,226 @@
+package apnsservice
+
+// This source code includes pausing a connection. A paused connection keeps
+// its credentials and sockets but its workers stop draining the send queue.
+// New pushes are held in memory, or persisted by the SharedQueue in
+// cooperative mode, and Resume flushes them in the order they arrived.
+
+import (
+	"sync"
+
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// defaultPauseBuffer is used when PauseBuffer is not set.
+const defaultPauseBuffer = 10000
+
+// pauseGate holds a connection's pushes while it is paused.
+type pauseGate struct {
+	mutex      sync.Mutex
+	isPaused   bool
+	isHolding  bool          // pushes go to listHeld until the flush catches up
+	isFlushing bool          // a flush goroutine is running
+	chanResume chan struct{} // closed by resume to wake paused workers
+	listHeld   []*notification
+}
+
+// isPausedNow reports whether the workers are paused. A nil gate is never paused.
+func (g *pauseGate) isPausedNow() bool {
+	if g == nil {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.isPaused
+}
+
+// heldCount returns the number of pushes waiting for a flush.
+func (g *pauseGate) heldCount() int {
+	if g == nil {
+		return 0
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.listHeld)
+}
+
+// hold keeps n while the connection is paused or flushing and reports whether it did.
+// It returns ErrQueueFull once intLimit pushes are held.
+func (g *pauseGate) hold(n *notification, intLimit int) (bool, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if !g.isHolding {
+		return false, nil
+	}
+	if len(g.listHeld) >= intLimit {
+		return true, ErrQueueFull
+	}
+	g.listHeld = append(g.listHeld, n)
+	return true, nil
+}
+
+// takeHeld returns every held push and stops holding, for the hand-over of a
+// closed connection. A nil gate holds nothing.
+func (g *pauseGate) takeHeld() []*notification {
+	if g == nil {
+		return nil
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	listHeld := g.listHeld
+	g.listHeld = nil
+	g.isHolding = false
+	return listHeld
+}
+
+// pause stops the workers and holds new pushes. It reports false if already paused.
+func (g *pauseGate) pause() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.isPaused {
+		return false
+	}
+	g.isPaused = true
+	g.isHolding = true
+	g.chanResume = make(chan struct{})
+	return true
+}
+
+// resume wakes the workers. It reports whether the caller should start a flush.
+func (g *pauseGate) resume() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if !g.isPaused {
+		return false
+	}
+	g.isPaused = false
+	close(g.chanResume)
+	if g.isFlushing {
+		return false
+	}
+	g.isFlushing = true
+	return true
+}
+
+// next returns the oldest held push, or nil when the flush is over because
+// the list is empty or the connection was paused again.
+func (g *pauseGate) next() *notification {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.isPaused || len(g.listHeld) == 0 {
+		if !g.isPaused {
+			g.isHolding = false
+		}
+		g.isFlushing = false
+		return nil
+	}
+	n := g.listHeld[0]
+	g.listHeld[0] = nil
+	g.listHeld = g.listHeld[1:]
+	return n
+}
+
+// wait blocks while the gate is paused. It returns false if chanDone or
+// chanStop closed first.
+func (g *pauseGate) wait(chanDone <-chan struct{}, chanStop <-chan struct{}) bool {
+	g.mutex.Lock()
+	isPaused := g.isPaused
+	chanResume := g.chanResume
+	g.mutex.Unlock()
+	if !isPaused {
+		return true
+	}
+	select {
+	case <-chanResume:
+		return true
+	case <-chanDone:
+		return false
+	case <-chanStop:
+		return false
+	}
+}
+
+// holdOrEnqueue holds n while the connection is paused and otherwise enqueues it.
+func (a *connectionAPNS) holdOrEnqueue(n *notification) error {
+	if !a.isActive() {
+		return ErrNotActive
+	}
+	intLimit := a.options.PauseBuffer
+	if intLimit <= 0 {
+		intLimit = defaultPauseBuffer
+	}
+	if isHeld, err := a.pause.hold(n, intLimit); isHeld {
+		return err
+	}
+	return a.enqueue(n)
+}
+
+// flushHeld moves held pushes into the send channel in order.
+func (a *connectionAPNS) flushHeld() {
+	intFlushed := 0
+	for n := a.pause.next(); n != nil; n = a.pause.next() {
+		if !a.requeue(n) {
+			a.deadLetter(0, n, ReasonRequeueFailed, 0)
+			recycle(n)
+			continue
+		}
+		intFlushed++
+	}
+	a.logPrintf(0, "Flushed %d held pushes\n", intFlushed)
+}
+
+// waitResumed blocks the worker while the connection is paused.
+// It returns false if the connection or socket shut down meanwhile.
+func (a *connectionAPNS) waitResumed(socketID int, chanStop <-chan struct{}) bool {
+	if !a.pause.isPausedNow() {
+		return true
+	}
+	a.logPrintln(socketID, "Paused")
+	if !a.pause.wait(a.chanDone, chanStop) {
+		return false
+	}
+	a.logPrintln(socketID, "Resumed")
+	return true
+}
+
+// Pause stops the app's workers from draining its send queue. The connection
+// and its credentials stay up; new pushes are held until Resume.
+func Pause(appID int) error {
+	connectionAPNS := getConnection(appID)
+	if connectionAPNS == nil {
+		return ErrAppNotFound
+	}
+	return connectionAPNS.pauseConnection()
+}
+
+// pauseConnection pauses one connection of any platform.
+func (a *connectionAPNS) pauseConnection() error {
+	if !a.isActive() {
+		return ErrNotActive
+	}
+	if a.pause.pause() {
+		utils.Info.Println(a.stringID, a.platform, " connection paused")
+	}
+	return nil
+}
+
+// Resume restarts the app's workers and flushes the pushes held while paused.
+func Resume(appID int) error {
+	connectionAPNS := getConnection(appID)
+	if connectionAPNS == nil {
+		return ErrAppNotFound
+	}
+	connectionAPNS.resumeConnection()
+	return nil
+}
+
+// resumeConnection resumes one connection of any platform.
+func (a *connectionAPNS) resumeConnection() {
+	if !a.pause.isPausedNow() {
+		return
+	}
+	if a.pause.resume() {
+		go a.flushHeld()
+	}
+	utils.Info.Println(a.stringID, a.platform, " connection resumed")
+}
@@ -0,0 +1,465 @@
+package apnsservice
+
+// This source code includes a fluent builder for push payloads. The builder
+// serializes the aps dictionary the same way it will be delivered and rejects
+// payloads that exceed Apple's size limit before they are enqueued.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// These are Apple's payload size limits in bytes.
+const (
+	MaxPayloadSize     = 4096
+	MaxVoIPPayloadSize = 5120
+)
+
+// apsKey is the reserved ExtraData entry holding aps keys that apns.Payload
+// has no field for, such as thread-id. It is merged into the aps dictionary
+// when the payload is serialized. go-libapns builds aps from its own fields,
+// so these keys are only delivered by ProtocolHTTP2 connections and a binary
+// connection rejects a push that carries them.
+const apsKey = "aps"
+
+// These are the Live Activity events a push can carry.
+const (
+	LiveActivityUpdate = "update"
+	LiveActivityEnd    = "end"
+)
+
+// These are the interruption levels of a notification.
+// InterruptionCritical requires Apple's critical alerts entitlement.
+const (
+	InterruptionPassive       = "passive"
+	InterruptionActive        = "active"
+	InterruptionTimeSensitive = "time-sensitive"
+	InterruptionCritical      = "critical"
+)
+
+// These custom keys carry a rich media attachment for a notification service
+// extension, which downloads MediaURLKey and attaches it before display.
+const (
+	MediaURLKey  = "media-url"
+	MediaTypeKey = "media-type"
+)
+
+// These are the attachment media types a notification service extension can display.
+const (
+	MediaImage = "image"
+	MediaGIF   = "gif"
+	MediaVideo = "video"
+	MediaAudio = "audio"
+)
+
+// PayloadBuilder assembles an apns.Payload one field at a time.
+// Errors are collected and reported by Build.
+type PayloadBuilder struct {
+	payload apns.Payload
+	aps     map[string]interface{}
+	limit   int
+	errs    []string
+}
+
+// FieldSize is the serialized size of one payload field.
+type FieldSize struct {
+	Field string `json:"field"`
+	Size  int    `json:"size"`
+}
+
+// PayloadSizeError reports a payload over Apple's limit.
+// Fields lists the contributing fields, largest first.
+type PayloadSizeError struct {
+	Size   int         `json:"size"`
+	Limit  int         `json:"limit"`
+	Fields []FieldSize `json:"fields"`
+}
+
+// Is matches ErrPayloadTooLarge.
+func (e *PayloadSizeError) Is(target error) bool {
+	return target == ErrPayloadTooLarge
+}
+
+func (e *PayloadSizeError) Error() string {
+	listFields := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		listFields = append(listFields, fmt.Sprintf("%s %d bytes", field.Field, field.Size))
+	}
+	return fmt.Sprintf("payload is %d bytes, limit is %d: %s", e.Size, e.Limit, strings.Join(listFields, ", "))
+}
+
+// NewPayloadBuilder starts a payload for a device token.
+func NewPayloadBuilder(token string) *PayloadBuilder {
+	return &PayloadBuilder{
+		payload: apns.Payload{Token: token},
+		aps:     make(map[string]interface{}),
+		limit:   MaxPayloadSize,
+	}
+}
+
+// Alert sets the alert text.
+func (b *PayloadBuilder) Alert(text string) *PayloadBuilder {
+	b.payload.AlertText = text
+	return b
+}
+
+// Badge sets the badge number. Zero clears the badge on the device.
+func (b *PayloadBuilder) Badge(number int) *PayloadBuilder {
+	if number < 0 {
+		b.errs = append(b.errs, fmt.Sprintf("badge %d is negative", number))
+		return b
+	}
+	b.payload.Badge = apns.NewBadgeNumber(uint32(number))
+	return b
+}
+
+// Sound sets the name of the sound file to play. It replaces any CriticalSound.
+func (b *PayloadBuilder) Sound(name string) *PayloadBuilder {
+	b.payload.Sound = name
+	delete(b.aps, "sound")
+	return b
+}
+
+// CriticalSound plays a critical alert sound that ignores the mute switch and
+// Do Not Disturb. volume ranges from 0 to 1. It replaces any Sound.
+// Critical alerts require Apple's critical alerts entitlement and, like the
+// other aps keys apns.Payload has no field for, ProtocolHTTP2.
+func (b *PayloadBuilder) CriticalSound(name string, volume float64) *PayloadBuilder {
+	if volume < 0 || volume > 1 {
+		b.errs = append(b.errs, fmt.Sprintf("critical sound volume %v is outside 0 to 1", volume))
+		return b
+	}
+	b.payload.Sound = ""
+	b.aps["sound"] = map[string]interface{}{
+		"critical": 1,
+		"name":     name,
+		"volume":   volume,
+	}
+	return b
+}
+
+// InterruptionLevel sets how strongly the notification interrupts the user.
+func (b *PayloadBuilder) InterruptionLevel(level string) *PayloadBuilder {
+	switch level {
+	case InterruptionPassive, InterruptionActive, InterruptionTimeSensitive, InterruptionCritical:
+	default:
+		b.errs = append(b.errs, fmt.Sprintf("unknown interruption level %q", level))
+		return b
+	}
+	b.aps["interruption-level"] = level
+	return b
+}
+
+// Category sets the notification category for actionable notifications.
+func (b *PayloadBuilder) Category(category string) *PayloadBuilder {
+	b.payload.Category = category
+	return b
+}
+
+// ThreadID groups notifications in notification center.
+func (b *PayloadBuilder) ThreadID(threadID string) *PayloadBuilder {
+	b.aps["thread-id"] = threadID
+	return b
+}
+
+// ContentAvailable marks the payload as a background refresh.
+// Without an alert, sound or badge it is a silent push and must be sent
+// with PriorityConserve, which PushOneWithOptions applies by default.
+func (b *PayloadBuilder) ContentAvailable() *PayloadBuilder {
+	b.payload.ContentAvailable = 1
+	return b
+}
+
+// LiveActivity makes the payload a Live Activity update or end event carrying
+// the new content state, stamped with the current time.
+// Push it through a ProtocolHTTP2 connection whose Topic is the app's bundle id.
+func (b *PayloadBuilder) LiveActivity(event string, contentState map[string]interface{}) *PayloadBuilder {
+	switch event {
+	case LiveActivityUpdate, LiveActivityEnd:
+	default:
+		b.errs = append(b.errs, fmt.Sprintf("unknown live activity event %q", event))
+		return b
+	}
+	b.aps["event"] = event
+	b.aps["content-state"] = contentState
+	b.aps["timestamp"] = time.Now().Unix()
+	return b
+}
+
+// DismissalDate sets when an ended Live Activity leaves the lock screen.
+func (b *PayloadBuilder) DismissalDate(t time.Time) *PayloadBuilder {
+	b.aps["dismissal-date"] = t.Unix()
+	return b
+}
+
+// StaleDate sets when a Live Activity is considered out of date.
+func (b *PayloadBuilder) StaleDate(t time.Time) *PayloadBuilder {
+	b.aps["stale-date"] = t.Unix()
+	return b
+}
+
+// MutableContent lets the app's notification service extension modify the
+// notification before it is displayed. It requires an alert.
+func (b *PayloadBuilder) MutableContent() *PayloadBuilder {
+	b.aps["mutable-content"] = 1
+	return b
+}
+
+// Attachment sets mutable-content and adds an https media URL and its media
+// type under MediaURLKey and MediaTypeKey for the service extension to attach.
+func (b *PayloadBuilder) Attachment(mediaURL string, mediaType string) *PayloadBuilder {
+	switch mediaType {
+	case MediaImage, MediaGIF, MediaVideo, MediaAudio:
+	default:
+		b.errs = append(b.errs, fmt.Sprintf("unknown media type %q", mediaType))
+		return b
+	}
+	parsedURL, err := url.Parse(mediaURL)
+	if err != nil || parsedURL.Scheme != "https" || parsedURL.Host == "" {
+		b.errs = append(b.errs, fmt.Sprintf("media url %q is not an https url", mediaURL))
+		return b
+	}
+	b.MutableContent()
+	b.Custom(MediaURLKey, mediaURL)
+	return b.Custom(MediaTypeKey, mediaType)
+}
+
+// Custom adds a custom key outside the aps dictionary.
+func (b *PayloadBuilder) Custom(key string, value interface{}) *PayloadBuilder {
+	if key == apsKey {
+		b.errs = append(b.errs, "custom key aps is reserved")
+		return b
+	}
+	if b.payload.ExtraData == nil {
+		b.payload.ExtraData = make(map[string]interface{})
+	}
+	b.payload.ExtraData[key] = value
+	return b
+}
+
+// VoIP applies the larger VoIP payload limit.
+// Push the result with PushType PushTypeVoIP or through a VoIP connection.
+func (b *PayloadBuilder) VoIP() *PayloadBuilder {
+	b.limit = MaxVoIPPayloadSize
+	return b
+}
+
+// Build validates the payload and returns it ready for PushOne.
+// Oversized payloads return a *PayloadSizeError.
+func (b *PayloadBuilder) Build() (apns.Payload, error) {
+	if _, ok := b.aps["dismissal-date"]; ok && b.aps["event"] != LiveActivityEnd {
+		b.errs = append(b.errs, "dismissal-date requires the end event")
+	}
+	if _, ok := b.aps["mutable-content"]; ok && b.payload.AlertText == "" && b.payload.LocKey == "" {
+		b.errs = append(b.errs, "mutable-content requires an alert")
+	}
+	if len(b.errs) > 0 {
+		return apns.Payload{}, fmt.Errorf("invalid payload: %s", strings.Join(b.errs, ", "))
+	}
+	payload := b.payload
+	if len(b.aps) > 0 {
+		extra := make(map[string]interface{}, len(payload.ExtraData)+1)
+		for key, value := range payload.ExtraData {
+			extra[key] = value
+		}
+		aps := make(map[string]interface{}, len(b.aps))
+		for key, value := range b.aps {
+			aps[key] = value
+		}
+		extra[apsKey] = aps
+		payload.ExtraData = extra
+	}
+	if err := validatePayloadSize(&payload, b.limit); err != nil {
+		return apns.Payload{}, err
+	}
+	return payload, nil
+}
+
+// ParsePayload reads the JSON body Apple receives into an apns.Payload for
+// token and checks it against limit. Alert, badge, sound, content-available
+// and category fill their fields. Other aps keys are kept as PayloadBuilder
+// keeps them, so only ProtocolHTTP2 connections deliver them. A negative badge
+// is rejected.
+func ParsePayload(token string, data []byte, limit int) (apns.Payload, error) {
+	var extra map[string]interface{}
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return apns.Payload{}, fmt.Errorf("invalid payload: %s", err.Error())
+	}
+	aps, ok := extra[apsKey].(map[string]interface{})
+	if !ok {
+		return apns.Payload{}, errors.New("invalid payload: aps dictionary is required")
+	}
+	delete(extra, apsKey)
+
+	payload := apns.Payload{Token: token}
+	apsExtra := make(map[string]interface{})
+	for key, value := range aps {
+		switch typed := value.(type) {
+		case string:
+			switch key {
+			case "alert":
+				payload.AlertText = typed
+				continue
+			case "sound":
+				payload.Sound = typed
+				continue
+			case "category":
+				payload.Category = typed
+				continue
+			}
+		case float64:
+			switch key {
+			case "badge":
+				if typed < 0 {
+					return apns.Payload{}, fmt.Errorf("invalid payload: badge %v is negative", typed)
+				}
+				payload.Badge = apns.NewBadgeNumber(uint32(typed))
+				continue
+			case "content-available":
+				payload.ContentAvailable = int(typed)
+				continue
+			}
+		}
+		apsExtra[key] = value
+	}
+	if len(apsExtra) > 0 {
+		extra[apsKey] = apsExtra
+	}
+	if len(extra) > 0 {
+		payload.ExtraData = extra
+	}
+	if err := validatePayloadSize(&payload, limit); err != nil {
+		return apns.Payload{}, err
+	}
+	return payload, nil
+}
+
+// hasApsExtras reports whether payload carries aps keys that only
+// ProtocolHTTP2 connections deliver.
+func hasApsExtras(payload *apns.Payload) bool {
+	aps, ok := payload.ExtraData[apsKey].(map[string]interface{})
+	return ok && len(aps) > 0
+}
+
+// isLiveActivity reports whether payload carries a Live Activity event.
+func isLiveActivity(payload *apns.Payload) bool {
+	aps, ok := payload.ExtraData[apsKey].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, isEvent := aps["event"]
+	_, isContentState := aps["content-state"]
+	return isEvent && isContentState
+}
+
+// validateToken returns ErrInvalidToken unless strToken is a hex APNS device token.
+func validateToken(strToken string) error {
+	if strToken == "" {
+		return fmt.Errorf("%w: token is empty", ErrInvalidToken)
+	}
+	if len(strToken)%2 != 0 {
+		return fmt.Errorf("%w: odd length %d", ErrInvalidToken, len(strToken))
+	}
+	if _, err := hex.DecodeString(strToken); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidToken, err.Error())
+	}
+	return nil
+}
+
+// validatePayloadSize serializes payload and reports the fields of an oversized one.
+func validatePayloadSize(payload *apns.Payload, limit int) error {
+	body, err := marshalPayload(payload)
+	if err != nil {
+		return err
+	}
+	return checkPayloadSize(payload, body, limit)
+}
+
+// checkPayloadSize is validatePayloadSize for a payload already serialized as body.
+func checkPayloadSize(payload *apns.Payload, body []byte, limit int) error {
+	if len(body) <= limit {
+		return nil
+	}
+
+	sizeError := &PayloadSizeError{Size: len(body), Limit: limit}
+	aps, extra := payloadDictionaries(payload)
+	for key, value := range aps {
+		fieldJSON, _ := json.Marshal(value)
+		sizeError.Fields = append(sizeError.Fields, FieldSize{Field: "aps." + key, Size: len(key) + len(fieldJSON) + 4})
+	}
+	for key, value := range extra {
+		fieldJSON, _ := json.Marshal(value)
+		sizeError.Fields = append(sizeError.Fields, FieldSize{Field: key, Size: len(key) + len(fieldJSON) + 4})
+	}
+	sort.Slice(sizeError.Fields, func(i, j int) bool {
+		return sizeError.Fields[i].Size > sizeError.Fields[j].Size
+	})
+	return sizeError
+}
+
+// marshalPayload serializes payload as Apple receives it.
+func marshalPayload(payload *apns.Payload) ([]byte, error) {
+	aps, extra := payloadDictionaries(payload)
+	extra[apsKey] = aps
+	return json.Marshal(extra)
+}
+
+// payloadDictionaries splits payload into the aps dictionary and the custom keys.
+func payloadDictionaries(payload *apns.Payload) (map[string]interface{}, map[string]interface{}) {
+	aps := make(map[string]interface{})
+	if payload.LocKey != "" || payload.ActionLocKey != "" || payload.LaunchImage != "" || len(payload.LocArgs) > 0 {
+		alert := make(map[string]interface{})
+		if payload.AlertText != "" {
+			alert["body"] = payload.AlertText
+		}
+		if payload.LocKey != "" {
+			alert["loc-key"] = payload.LocKey
+		}
+		if len(payload.LocArgs) > 0 {
+			alert["loc-args"] = payload.LocArgs
+		}
+		if payload.ActionLocKey != "" {
+			alert["action-loc-key"] = payload.ActionLocKey
+		}
+		if payload.LaunchImage != "" {
+			alert["launch-image"] = payload.LaunchImage
+		}
+		aps["alert"] = alert
+	} else if payload.AlertText != "" {
+		aps["alert"] = payload.AlertText
+	}
+	if payload.Badge.IsSet() {
+		aps["badge"] = payload.Badge.Number()
+	}
+	if payload.Sound != "" {
+		aps["sound"] = payload.Sound
+	}
+	if payload.ContentAvailable != 0 {
+		aps["content-available"] = payload.ContentAvailable
+	}
+	if payload.Category != "" {
+		aps["category"] = payload.Category
+	}
+
+	extra := make(map[string]interface{}, len(payload.ExtraData))
+	for key, value := range payload.ExtraData {
+		if key == apsKey {
+			if apsExtra, ok := value.(map[string]interface{}); ok {
+				for apsExtraKey, apsExtraValue := range apsExtra {
+					aps[apsExtraKey] = apsExtraValue
+				}
+			}
+			continue
+		}
+		extra[key] = value
+	}
+	return aps, extra
+}
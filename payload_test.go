@@ -0,0 +1,50 @@
+package apnsservice
+
+import (
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+func TestParsePayloadRejectsNegativeBadge(t *testing.T) {
+	if _, err := ParsePayload(testToken(1), []byte(`{"aps": {"badge": -1}}`), MaxPayloadSize); err == nil {
+		t.Fatal("negative badge was accepted")
+	}
+	payload, err := ParsePayload(testToken(1), []byte(`{"aps": {"badge": 0}}`), MaxPayloadSize)
+	if err != nil || !payload.Badge.IsSet() || payload.Badge.Number() != 0 {
+		t.Fatalf("badge 0 = %v, %v, want a set badge of 0", payload.Badge, err)
+	}
+}
+
+func TestBinaryConnectionRejectsApsExtras(t *testing.T) {
+	const appID = 9802
+	transport := NewMockTransport()
+	if err := LaunchConnectionWithTransport(appID, "binary", transport, false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+
+	for name, builder := range map[string]*PayloadBuilder{
+		"thread-id":      NewPayloadBuilder(testToken(1)).Alert("hi").ThreadID("t1"),
+		"critical sound": NewPayloadBuilder(testToken(1)).Alert("hi").Sound("ping").CriticalSound("alarm", 1),
+		"interruption":   NewPayloadBuilder(testToken(1)).Alert("hi").InterruptionLevel(InterruptionTimeSensitive),
+	} {
+		payload, err := builder.Build()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if err := PushOne(appID, payload); err == nil {
+			t.Errorf("%s push was accepted by a binary connection", name)
+		}
+	}
+	if err := PushOne(appID, apns.Payload{Token: testToken(1), AlertText: "plain", Sound: "ping"}); err != nil {
+		t.Fatal(err)
+	}
+	if !transport.WaitForSent(1, time.Second) {
+		t.Fatal("plain push was not sent")
+	}
+	if got := len(transport.Pushes()); got != 1 {
+		t.Fatalf("mock recorded %d pushes, want only the plain one", got)
+	}
+}
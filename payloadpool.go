@@ -0,0 +1,95 @@
+package apnsservice
+
+// This source code includes the allocation savers of the hot path. Notifications
+// come from a sync.Pool and return to it once an HTTP/2 worker is done with
+// them, and each notification carries its serialized body so it is marshalled
+// once however often it is retried. A fan-out shares a bodyCache so pushes of
+// one payload to many tokens share one body.
+
+import (
+	"reflect"
+	"sync"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// poolNotifications recycles notifications between pushes.
+var poolNotifications = sync.Pool{
+	New: func() interface{} { return new(notification) },
+}
+
+// newNotification returns a pooled notification holding a copy of payload and
+// opts. body is the payload's serialized form or nil to marshal it when sent.
+func newNotification(payload *apns.Payload, opts *PushOptions, body []byte) *notification {
+	n := poolNotifications.Get().(*notification)
+	n.payload = *payload
+	n.options = *opts
+	n.body = body
+	return n
+}
+
+// recycle returns a notification nobody holds any more to the pool.
+// Binary sockets keep sent notifications in their resend cache, so only
+// pushes that never reached the send channel and HTTP/2 workers recycle.
+func recycle(n *notification) {
+	*n = notification{}
+	poolNotifications.Put(n)
+}
+
+// marshal returns the serialized payload, marshalling it on first use.
+// Bodies may be shared between notifications and are never written to.
+func (n *notification) marshal() ([]byte, error) {
+	if n.body != nil {
+		return n.body, nil
+	}
+	body, err := marshalPayload(&n.payload)
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+	return body, nil
+}
+
+// bodyCache serializes the payloads of one fan-out. A payload whose content
+// matches the previous one, token aside, reuses its body. Custom data matches
+// when it is the same map, so middleware that varies it per token must
+// replace the map rather than write to it. A nil bodyCache caches nothing.
+type bodyCache struct {
+	payload apns.Payload
+	body    []byte
+}
+
+// marshal returns the serialized payload, reusing the previous body when the content matches.
+func (c *bodyCache) marshal(payload *apns.Payload) ([]byte, error) {
+	if c == nil {
+		return marshalPayload(payload)
+	}
+	if c.body != nil && sameBody(&c.payload, payload) {
+		return c.body, nil
+	}
+	body, err := marshalPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	c.payload = *payload
+	c.body = body
+	return body, nil
+}
+
+// sameBody reports whether two payloads serialize alike. The token, priority
+// and expiration travel outside the HTTP/2 body and are not compared.
+func sameBody(p1 *apns.Payload, p2 *apns.Payload) bool {
+	if p1.AlertText != p2.AlertText || p1.ActionLocKey != p2.ActionLocKey ||
+		p1.LocKey != p2.LocKey || p1.LaunchImage != p2.LaunchImage ||
+		p1.Badge != p2.Badge || p1.Sound != p2.Sound ||
+		p1.ContentAvailable != p2.ContentAvailable || p1.Category != p2.Category ||
+		len(p1.LocArgs) != len(p2.LocArgs) || len(p1.ExtraData) != len(p2.ExtraData) {
+		return false
+	}
+	for i := range p1.LocArgs {
+		if p1.LocArgs[i] != p2.LocArgs[i] {
+			return false
+		}
+	}
+	return reflect.ValueOf(p1.ExtraData).Pointer() == reflect.ValueOf(p2.ExtraData).Pointer()
+}
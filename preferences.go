@@ -0,0 +1,209 @@
+package apnsservice
+
+// This source code includes user notification preferences. An app whose
+// options name a PreferenceStore consults it before enqueuing each push:
+// classes the user opted out of, quiet hours in the user's time zone and a
+// daily cap. A push that breaks a preference is dropped, counted as muted
+// in the class stats and reported to the app's MuteHandler.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// These are the reasons a push is muted.
+const (
+	ReasonOptOut     = "OptOut"
+	ReasonQuietHours = "QuietHours"
+	ReasonDailyCap   = "DailyCap"
+)
+
+// Preferences are one user's notification preferences.
+// QuietStart and QuietEnd are "15:04" times in TimeZone; a window such as
+// 22:00 to 07:00 spans midnight. TimeZone is an IANA name, UTC by default.
+type Preferences struct {
+	OptOut     []string `json:"optOut"` // notification classes the user does not want
+	QuietStart string   `json:"quietStart"`
+	QuietEnd   string   `json:"quietEnd"`
+	TimeZone   string   `json:"timeZone"`
+	DailyCap   int      `json:"dailyCap"` // pushes per local day, 0 for no cap
+}
+
+// PreferenceStore holds users' notification preferences.
+// Its methods are called from pushing goroutines and must be safe for concurrent use.
+type PreferenceStore interface {
+	// Preferences returns the user's preferences, nil when the user has none.
+	Preferences(appID int, userID string) (*Preferences, error)
+	// CountPush counts a push to the user on a local day such as
+	// 2006-01-02 and returns the day's count including it.
+	CountPush(appID int, userID string, strDay string) (int, error)
+}
+
+// MutedPush describes a push dropped by the user's preferences.
+type MutedPush struct {
+	AppID  int    `json:"appId"`
+	UserID string `json:"userId"`
+	Token  string `json:"token"`
+	Class  string `json:"class"`
+	ApnsID string `json:"apnsId"`
+	Reason string `json:"reason"`
+}
+
+// MuteHandler hears about each push dropped by the user's preferences.
+type MuteHandler func(muted MutedPush)
+
+// checkPreferences returns the reason the push must be dropped, or "" to send it.
+// Pushes without a UserID are checked against the preferences of their token.
+// A store error is logged and the push is sent.
+func (a *connectionAPNS) checkPreferences(n *notification) string {
+	store := a.options.PreferenceStore
+	if store == nil {
+		return ""
+	}
+	strUser := n.options.UserID
+	if strUser == "" {
+		strUser = n.payload.Token
+	}
+	prefs, err := store.Preferences(a.appID, strUser)
+	if err != nil {
+		a.logLevelf(LogWarn, 0, "PreferenceStore %s %s\n", strUser, err.Error())
+		return ""
+	}
+	if prefs == nil {
+		return ""
+	}
+	for _, strClass := range prefs.OptOut {
+		if strClass == n.options.Class {
+			return ReasonOptOut
+		}
+	}
+
+	location, err := time.LoadLocation(prefs.TimeZone)
+	if err != nil {
+		a.logLevelf(LogWarn, 0, "PreferenceStore %s time zone %s\n", strUser, err.Error())
+		location = time.UTC
+	}
+	now := time.Now().In(location)
+	isQuiet, err := prefs.isQuiet(now)
+	if err != nil {
+		a.logLevelf(LogWarn, 0, "PreferenceStore %s quiet hours %s\n", strUser, err.Error())
+	} else if isQuiet {
+		return ReasonQuietHours
+	}
+	if prefs.DailyCap > 0 {
+		intCount, err := store.CountPush(a.appID, strUser, now.Format("2006-01-02"))
+		if err != nil {
+			a.logLevelf(LogWarn, 0, "PreferenceStore %s %s\n", strUser, err.Error())
+		} else if intCount > prefs.DailyCap {
+			return ReasonDailyCap
+		}
+	}
+	return ""
+}
+
+// isQuiet reports whether local falls within the quiet hours.
+func (p *Preferences) isQuiet(local time.Time) (bool, error) {
+	if p.QuietStart == "" || p.QuietEnd == "" {
+		return false, nil
+	}
+	start, err := time.Parse("15:04", p.QuietStart)
+	if err != nil {
+		return false, fmt.Errorf("invalid quietStart %q", p.QuietStart)
+	}
+	end, err := time.Parse("15:04", p.QuietEnd)
+	if err != nil {
+		return false, fmt.Errorf("invalid quietEnd %q", p.QuietEnd)
+	}
+	intNow := local.Hour()*60 + local.Minute()
+	intStart := start.Hour()*60 + start.Minute()
+	intEnd := end.Hour()*60 + end.Minute()
+	if intStart <= intEnd {
+		return intNow >= intStart && intNow < intEnd, nil
+	}
+	return intNow >= intStart || intNow < intEnd, nil
+}
+
+// mute drops a push that breaks the user's preferences.
+func (a *connectionAPNS) mute(n *notification, strReason string) {
+	a.logLevelf(LogDebug, 0, "Muted %s to device %s: %s\n", n.options.ApnsID, n.payload.Token, strReason)
+	a.classes.count(n.options.Class, classMuted)
+	if a.options.MuteHandler == nil {
+		return
+	}
+	a.options.MuteHandler(MutedPush{
+		AppID:  a.appID,
+		UserID: n.options.UserID,
+		Token:  n.payload.Token,
+		Class:  n.options.Class,
+		ApnsID: n.options.ApnsID,
+		Reason: strReason,
+	})
+}
+
+// MemoryPreferenceStore is a PreferenceStore held in process memory.
+// Daily counts are kept for the current and previous day only.
+type MemoryPreferenceStore struct {
+	mutex     sync.Mutex
+	mapPrefs  map[int]map[string]Preferences
+	mapCounts map[string]int // appID/userID/day
+}
+
+// NewMemoryPreferenceStore returns an empty MemoryPreferenceStore.
+func NewMemoryPreferenceStore() *MemoryPreferenceStore {
+	return &MemoryPreferenceStore{
+		mapPrefs:  make(map[int]map[string]Preferences),
+		mapCounts: make(map[string]int),
+	}
+}
+
+// SetPreferences replaces the user's preferences.
+func (s *MemoryPreferenceStore) SetPreferences(appID int, userID string, prefs Preferences) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.mapPrefs[appID] == nil {
+		s.mapPrefs[appID] = make(map[string]Preferences)
+	}
+	s.mapPrefs[appID][userID] = prefs
+}
+
+// Preferences implements PreferenceStore.
+func (s *MemoryPreferenceStore) Preferences(appID int, userID string) (*Preferences, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	prefs, ok := s.mapPrefs[appID][userID]
+	if !ok {
+		return nil, nil
+	}
+	return &prefs, nil
+}
+
+// CountPush implements PreferenceStore.
+func (s *MemoryPreferenceStore) CountPush(appID int, userID string, strDay string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.mapCounts) > 100000 {
+		s.sweep(strDay)
+	}
+	strKey := fmt.Sprintf("%d/%s/%s", appID, userID, strDay)
+	s.mapCounts[strKey]++
+	return s.mapCounts[strKey], nil
+}
+
+// sweep forgets the counts of days other than strDay and the day before.
+func (s *MemoryPreferenceStore) sweep(strDay string) {
+	day, err := time.Parse("2006-01-02", strDay)
+	if err != nil {
+		utils.Warning.Println("MemoryPreferenceStore invalid day", strDay)
+		return
+	}
+	strPrev := day.AddDate(0, 0, -1).Format("2006-01-02")
+	for strKey := range s.mapCounts {
+		strKeyDay := strKey[len(strKey)-len(strDay):]
+		if strKeyDay != strDay && strKeyDay != strPrev {
+			delete(s.mapCounts, strKey)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package apnsservice
+
+// This source code includes discovery of apps from an external store such as
+// the business database. A push to an app with no connection consults the
+// AppConfigProvider through a read-through cache and launches the app, and a
+// periodic sync launches newly onboarded apps, so no deploy is needed.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// AppConfigProvider looks up app configuration in an external store.
+type AppConfigProvider interface {
+	// LookupApp returns the configuration of one app, or nil if the store has no such app.
+	LookupApp(appID int) (*AppConfig, error)
+	// ListApps returns every app that should have a connection.
+	ListApps() ([]AppConfig, error)
+}
+
+// defaultProviderTTL is how long a provider answer is cached when no TTL is given.
+const defaultProviderTTL = 5 * time.Minute
+
+// providerEntry is one cached provider answer. A nil app caches a miss.
+type providerEntry struct {
+	app     *AppConfig
+	fetched time.Time
+}
+
+// providerCache holds the registered provider and its cached answers.
+// mutexLoad serializes launches so concurrent pushes launch an app once.
+type providerCache struct {
+	mutex      sync.Mutex
+	mutexLoad  sync.Mutex
+	provider   AppConfigProvider
+	ttl        time.Duration
+	mapEntries map[int]*providerEntry
+	chanStop   chan struct{}
+}
+
+var appProvider = &providerCache{mapEntries: make(map[int]*providerEntry)}
+
+// SetAppConfigProvider registers the store apps are discovered from.
+// Answers are cached for ttl, five minutes if ttl is not positive, and
+// every ttl the provider's app list is synced to launch new apps.
+// A nil provider stops discovery. Connections already launched are kept.
+func SetAppConfigProvider(provider AppConfigProvider, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = defaultProviderTTL
+	}
+	appProvider.mutex.Lock()
+	defer appProvider.mutex.Unlock()
+	if appProvider.chanStop != nil {
+		close(appProvider.chanStop)
+		appProvider.chanStop = nil
+	}
+	appProvider.provider = provider
+	appProvider.ttl = ttl
+	appProvider.mapEntries = make(map[int]*providerEntry)
+	if provider != nil {
+		appProvider.chanStop = make(chan struct{})
+		go appProvider.syncListener(appProvider.chanStop, ttl)
+	}
+}
+
+// SyncApps launches every app the provider lists that has no active connection.
+// Apps launched by other means are never closed, and apps closed with
+// CloseConnection or the admin handler stay closed.
+func SyncApps() error {
+	appProvider.mutex.Lock()
+	provider := appProvider.provider
+	appProvider.mutex.Unlock()
+	if provider == nil {
+		return nil
+	}
+
+	listApps, err := provider.ListApps()
+	if err != nil {
+		utils.Warning.Println("AppConfigProvider.ListApps", err.Error())
+		return err
+	}
+	for i := range listApps {
+		appProvider.store(listApps[i].AppID, &listApps[i])
+		appProvider.launch(&listApps[i])
+	}
+	return nil
+}
+
+// resolveConnection returns the connection for appID, launching it from the
+// provider if the app is not registered yet. It returns nil for unknown apps.
+func resolveConnection(appID int) *connectionAPNS {
+	if connectionAPNS := getConnection(appID); connectionAPNS != nil {
+		return connectionAPNS
+	}
+	appConfig := appProvider.lookup(appID)
+	if appConfig == nil {
+		return nil
+	}
+	appProvider.launch(appConfig)
+	return getConnection(appID)
+}
+
+// syncListener runs SyncApps every ttl until stopped.
+func (c *providerCache) syncListener(chanStop chan struct{}, ttl time.Duration) {
+	ticker := time.NewTicker(ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			SyncApps()
+		case <-chanStop:
+			return
+		}
+	}
+}
+
+// lookup returns the cached configuration of appID, asking the provider
+// when there is no answer younger than the TTL.
+func (c *providerCache) lookup(appID int) *AppConfig {
+	c.mutex.Lock()
+	provider := c.provider
+	entry, ok := c.mapEntries[appID]
+	isFresh := ok && time.Since(entry.fetched) < c.ttl
+	c.mutex.Unlock()
+	if provider == nil {
+		return nil
+	}
+	if isFresh {
+		return entry.app
+	}
+
+	appConfig, err := provider.LookupApp(appID)
+	if err != nil {
+		// a failing store is retried on the next push rather than cached as a miss
+		utils.Warning.Println("AppConfigProvider.LookupApp", appID, err.Error())
+		return nil
+	}
+	c.store(appID, appConfig)
+	return appConfig
+}
+
+// store caches one provider answer.
+func (c *providerCache) store(appID int, appConfig *AppConfig) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.mapEntries[appID] = &providerEntry{app: appConfig, fetched: time.Now()}
+}
+
+// launch registers a connection for a discovered app unless it is already
+// active or a caller closed it on purpose. The provider's options go over
+// those set from code, as in LaunchFromConfig.
+func (c *providerCache) launch(appConfig *AppConfig) {
+	c.mutexLoad.Lock()
+	defer c.mutexLoad.Unlock()
+	if connectionAPNS := getConnection(appConfig.AppID); connectionAPNS != nil &&
+		(connectionAPNS.isActive() || connectionAPNS.isClosedOnPurpose()) {
+		return
+	}
+	SetConnectionOptions(appConfig.AppID, appConfig.options())
+	err := registerConnection(appConfig.AppID, appConfig.StringID, appConfig.Cert, appConfig.IsLogging, false)
+	if err != nil {
+		// cache a miss so pushes do not retry a failing launch until the TTL expires
+		utils.Warning.Println("launch discovered app", appConfig.AppID, err.Error())
+		c.store(appConfig.AppID, nil)
+		return
+	}
+	utils.Info.Println(appConfig.StringID, " discovered from app config provider")
+}
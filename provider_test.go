@@ -0,0 +1,55 @@
+package apnsservice
+
+import (
+	"testing"
+)
+
+// listProvider serves a fixed app list.
+type listProvider struct {
+	listApps []AppConfig
+}
+
+func (p *listProvider) LookupApp(appID int) (*AppConfig, error) {
+	for i := range p.listApps {
+		if p.listApps[i].AppID == appID {
+			return &p.listApps[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (p *listProvider) ListApps() ([]AppConfig, error) {
+	return p.listApps, nil
+}
+
+func TestSyncAppsKeepsOptionsAndClosedApps(t *testing.T) {
+	const appID = 9901
+	SetConnectionOptions(appID, ConnectionOptions{DeadLetterSink: &deadLetters{}})
+	provider := &listProvider{listApps: []AppConfig{{
+		AppID:    appID,
+		StringID: "discovered",
+		Options:  ConnectionOptions{Mock: NewMockTransport(), Sockets: 2},
+	}}}
+	SetAppConfigProvider(provider, 0)
+	defer SetAppConfigProvider(nil, 0)
+	defer RemoveApp(appID)
+
+	if err := SyncApps(); err != nil {
+		t.Fatal(err)
+	}
+	first := getConnection(appID)
+	if first == nil || !first.isActive() {
+		t.Fatal("listed app not launched")
+	}
+	if first.options.DeadLetterSink == nil || first.options.Sockets != 2 {
+		t.Fatalf("launched with options %+v", first.options)
+	}
+
+	CloseConnection(appID)
+	if err := SyncApps(); err != nil {
+		t.Fatal(err)
+	}
+	if a := getConnection(appID); a != first || a.isActive() {
+		t.Fatal("sync relaunched an app closed on purpose")
+	}
+}
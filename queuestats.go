@@ -0,0 +1,94 @@
+package apnsservice
+
+// This source code includes send queue introspection. QueueStats reports how
+// full a connection's send channel is and how many payloads went through it,
+// so callers can shed load or alert before the channel saturates.
+
+import (
+	"sync/atomic"
+)
+
+// QueueStat reports the send channel of one app connection.
+// The counters start at zero when the connection is launched.
+type QueueStat struct {
+	AppID     int   `json:"appId"`
+	Depth     int   `json:"depth"`     // payloads waiting in the send channel and the high-priority lane
+	Cap       int   `json:"cap"`       // capacity of both
+	Expedited int   `json:"expedited"` // payloads of Depth waiting in the high-priority lane
+	HighWater int64 `json:"highWater"` // deepest the send channel has been
+	Enqueued  int64 `json:"enqueued"`  // pushes accepted, including into a shared queue
+	Sent      int64 `json:"sent"`      // payloads delivered or written to a binary socket
+	Dropped   int64 `json:"dropped"`   // accepted payloads rejected, expired or lost to cache overflow
+	Full      int64 `json:"full"`      // pushes refused with ErrQueueFull
+}
+
+// queueCounters holds the QueueStat counters of a connection.
+// A nil queueCounters counts nothing.
+type queueCounters struct {
+	highWater int64
+	enqueued  int64
+	sent      int64
+	dropped   int64
+	full      int64
+}
+
+// mark raises the high-water mark to intDepth.
+func (q *queueCounters) mark(intDepth int) {
+	if q == nil {
+		return
+	}
+	for {
+		current := atomic.LoadInt64(&q.highWater)
+		if int64(intDepth) <= current || atomic.CompareAndSwapInt64(&q.highWater, current, int64(intDepth)) {
+			return
+		}
+	}
+}
+
+// add adds delta to one counter.
+func (q *queueCounters) add(counter *int64, delta int) {
+	if q == nil {
+		return
+	}
+	atomic.AddInt64(counter, int64(delta))
+}
+
+// countOutcome counts the final outcomes of an audit record.
+func (q *queueCounters) countOutcome(strOutcome string) {
+	if q == nil {
+		return
+	}
+	switch strOutcome {
+	case AuditDelivered, AuditSent:
+		q.add(&q.sent, 1)
+	case AuditRejected, AuditExpired:
+		q.add(&q.dropped, 1)
+	}
+}
+
+// QueueStats returns the send queue stats of the specified app's connection.
+// The second result is false if the app is not registered.
+func QueueStats(appID int) (QueueStat, bool) {
+	connectionAPNS := getConnection(appID)
+	if connectionAPNS == nil {
+		return QueueStat{}, false
+	}
+	return connectionAPNS.queueStats(), true
+}
+
+// queueStats builds the send queue stats of the connection.
+func (a *connectionAPNS) queueStats() QueueStat {
+	stats := QueueStat{
+		AppID:     a.appID,
+		Expedited: len(a.chanHigh),
+	}
+	stats.Depth, stats.Cap = a.queueDepth()
+	if q := a.queue; q != nil {
+		stats.HighWater = atomic.LoadInt64(&q.highWater)
+		stats.Enqueued = atomic.LoadInt64(&q.enqueued)
+		stats.Sent = atomic.LoadInt64(&q.sent)
+		stats.Dropped = atomic.LoadInt64(&q.dropped)
+		stats.Full = atomic.LoadInt64(&q.full)
+	}
+	return stats
+}
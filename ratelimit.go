@@ -0,0 +1,122 @@
+package apnsservice
+
+// This source code includes per-connection rate limiting. A token bucket is
+// applied before the send channel so one noisy app cannot starve the others
+// sharing the process. Limits may also be set per notification class.
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned for a push dropped by a RateLimit in drop mode,
+// or by a blocking RateLimit whose wait would pass the push deadline.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimit is a token bucket allowing PerSecond notifications with bursts of Burst.
+// By default a push over the limit waits for a token; with Drop it fails with ErrRateLimited.
+// A zero PerSecond disables the limit.
+type RateLimit struct {
+	PerSecond float64 `json:"perSecond"`
+	Burst     int     `json:"burst"` // at least 1; defaults to one second of PerSecond
+	Drop      bool    `json:"drop"`
+}
+
+// tokenBucket is the state of one RateLimit.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	limit  RateLimit
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket for limit or nil if limit is disabled.
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if limit.PerSecond <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = limit.PerSecond
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &tokenBucket{limit: limit, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take removes a token if one is available and otherwise returns how long
+// until one will be.
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.PerSecond
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.limit.PerSecond * float64(time.Second))
+}
+
+// rateLimiter holds the connection bucket and the per-class buckets.
+type rateLimiter struct {
+	bucket     *tokenBucket
+	mapClasses map[string]*tokenBucket
+}
+
+// newRateLimiter returns the limiter for the options or nil if no limit is set.
+func newRateLimiter(limit RateLimit, mapClassLimits map[string]RateLimit) *rateLimiter {
+	limiter := &rateLimiter{bucket: newTokenBucket(limit), mapClasses: make(map[string]*tokenBucket)}
+	for strClass, classLimit := range mapClassLimits {
+		if bucket := newTokenBucket(classLimit); bucket != nil {
+			limiter.mapClasses[strClass] = bucket
+		}
+	}
+	if limiter.bucket == nil && len(limiter.mapClasses) == 0 {
+		return nil
+	}
+	return limiter
+}
+
+// waitRateLimit takes a token from the class bucket, then the connection bucket.
+// It blocks unless the bucket drops, and gives up at the notification
+// deadline or when the connection closes.
+func (a *connectionAPNS) waitRateLimit(n *notification) error {
+	if a.limiter == nil {
+		return nil
+	}
+	if err := a.waitBucket(a.limiter.mapClasses[n.options.Class], n); err != nil {
+		return err
+	}
+	return a.waitBucket(a.limiter.bucket, n)
+}
+
+// waitBucket takes one token from bucket for n.
+func (a *connectionAPNS) waitBucket(bucket *tokenBucket, n *notification) error {
+	if bucket == nil {
+		return nil
+	}
+	for {
+		ok, wait := bucket.take()
+		if ok {
+			return nil
+		}
+		after := time.Now().Add(wait)
+		if bucket.limit.Drop || (!n.deadline.IsZero() && after.After(n.deadline)) ||
+			(!n.enqueueBy.IsZero() && after.After(n.enqueueBy)) {
+			return ErrRateLimited
+		}
+		select {
+		case <-time.After(wait):
+		case <-a.chanDone:
+			return errors.New("connection closed")
+		}
+	}
+}
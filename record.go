@@ -0,0 +1,96 @@
+package apnsservice
+
+// This source code includes the serialized form of a notification. It is used
+// wherever a notification leaves process memory, such as a shared queue.
+// apns.Payload keeps its badge in unexported fields, so it is copied into a
+// record with an explicit badge before encoding.
+
+import (
+	"encoding/json"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// notificationRecord mirrors apns.Payload and PushOptions with JSON tags.
+type notificationRecord struct {
+	Token            string                 `json:"token"`
+	AlertText        string                 `json:"alertText,omitempty"`
+	ActionLocKey     string                 `json:"actionLocKey,omitempty"`
+	LocKey           string                 `json:"locKey,omitempty"`
+	LocArgs          []string               `json:"locArgs,omitempty"`
+	LaunchImage      string                 `json:"launchImage,omitempty"`
+	Badge            *uint32                `json:"badge,omitempty"`
+	Sound            string                 `json:"sound,omitempty"`
+	ContentAvailable int                    `json:"contentAvailable,omitempty"`
+	Category         string                 `json:"category,omitempty"`
+	ExtraData        map[string]interface{} `json:"extraData,omitempty"`
+	ExpirationTime   uint32                 `json:"expirationTime,omitempty"`
+	Priority         uint8                  `json:"priority,omitempty"`
+	Options          PushOptions            `json:"options"`
+	Deadline         time.Time              `json:"deadline,omitempty"`
+}
+
+// encodeNotification serializes and compresses a notification.
+func encodeNotification(n *notification) ([]byte, error) {
+	p := &n.payload
+	record := notificationRecord{
+		Token:            p.Token,
+		AlertText:        p.AlertText,
+		ActionLocKey:     p.ActionLocKey,
+		LocKey:           p.LocKey,
+		LocArgs:          p.LocArgs,
+		LaunchImage:      p.LaunchImage,
+		Sound:            p.Sound,
+		ContentAvailable: p.ContentAvailable,
+		Category:         p.Category,
+		ExtraData:        p.ExtraData,
+		ExpirationTime:   p.ExpirationTime,
+		Priority:         p.Priority,
+		Options:          n.options,
+		Deadline:         n.deadline,
+	}
+	if p.Badge.IsSet() {
+		intBadge := p.Badge.Number()
+		record.Badge = &intBadge
+	}
+	data, err := json.Marshal(&record)
+	if err != nil {
+		return nil, err
+	}
+	return compressRecord(data)
+}
+
+// decodeNotification reverses encodeNotification.
+func decodeNotification(data []byte) (*notification, error) {
+	data, err := decompressRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	var record notificationRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	n := &notification{
+		payload: apns.Payload{
+			Token:            record.Token,
+			AlertText:        record.AlertText,
+			ActionLocKey:     record.ActionLocKey,
+			LocKey:           record.LocKey,
+			LocArgs:          record.LocArgs,
+			LaunchImage:      record.LaunchImage,
+			Sound:            record.Sound,
+			ContentAvailable: record.ContentAvailable,
+			Category:         record.Category,
+			ExtraData:        record.ExtraData,
+			ExpirationTime:   record.ExpirationTime,
+			Priority:         record.Priority,
+		},
+		options:  record.Options,
+		deadline: record.Deadline,
+	}
+	if record.Badge != nil {
+		n.payload.Badge = apns.NewBadgeNumber(*record.Badge)
+	}
+	return n, nil
+}
@@ -0,0 +1,325 @@
+package apnsservice
+
+// This source code includes a SharedQueue held in Redis, so API replicas on
+// different hosts can enqueue for an app while a designated set of worker
+// processes holds its connection and drains the queue. Each operation is one
+// Lua script, so leasing is atomic across processes. Lease expiry is measured
+// by the Redis clock, which requires Redis 5 or later.
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// These are the RedisQueue defaults.
+const (
+	defaultRedisPrefix  = "apnsservice"
+	defaultRedisTimeout = 5 * time.Second
+)
+
+// RedisOptions locate the Redis server of a RedisQueue.
+type RedisOptions struct {
+	Addr     string        `json:"addr"` // host:port
+	Username string        `json:"username"`
+	Password string        `json:"-"`
+	DB       int           `json:"db"`
+	TLS      *tls.Config   `json:"-"`       // optional, for managed Redis that requires TLS
+	Prefix   string        `json:"prefix"`  // key prefix, "apnsservice" by default
+	Timeout  time.Duration `json:"timeout"` // dial and command timeout, 5 seconds by default
+}
+
+// RedisQueue is a SharedQueue held in Redis. An app's records live in a
+// list of ready ids, a hash of records and a sorted set of lease expiries,
+// under one hash tag so the keys share a Redis Cluster slot.
+// It holds one connection and redials after an error.
+type RedisQueue struct {
+	options RedisOptions
+	mutex   sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+// redisError is an error reply from Redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// These are the Lua scripts of the queue operations.
+const (
+	// KEYS seq, ready, records; ARGV record
+	redisScriptEnqueue = `
+local id = redis.call('INCR', KEYS[1])
+redis.call('HSET', KEYS[3], id, ARGV[1])
+redis.call('RPUSH', KEYS[2], id)
+return id`
+
+	// KEYS ready, records, leases, owners; ARGV owner, ttl in ms.
+	// An expired lease is taken before a ready record.
+	redisScriptLease = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local id = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', now, 'LIMIT', 0, 1)[1]
+if not id then
+  id = redis.call('LPOP', KEYS[1])
+  if not id then return false end
+end
+local record = redis.call('HGET', KEYS[2], id)
+if not record then
+  redis.call('ZREM', KEYS[3], id)
+  redis.call('HDEL', KEYS[4], id)
+  return false
+end
+local expires = now + tonumber(ARGV[2])
+redis.call('ZADD', KEYS[3], expires, id)
+redis.call('HSET', KEYS[4], id, ARGV[1])
+return {id, record, tostring(expires)}`
+
+	// KEYS leases, owners; ARGV id, owner, ttl in ms
+	redisScriptRenew = `
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then return -1 end
+local t = redis.call('TIME')
+local expires = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000) + tonumber(ARGV[3])
+redis.call('ZADD', KEYS[1], expires, ARGV[1])
+return expires`
+
+	// KEYS records, leases, owners; ARGV id, owner
+	redisScriptAck = `
+if redis.call('HGET', KEYS[3], ARGV[1]) ~= ARGV[2] then return 0 end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return 1`
+)
+
+// NewRedisQueue connects to Redis and returns a SharedQueue held there.
+func NewRedisQueue(opts RedisOptions) (*RedisQueue, error) {
+	if opts.Addr == "" {
+		return nil, errors.New("redis addr is required")
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = defaultRedisPrefix
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultRedisTimeout
+	}
+	q := &RedisQueue{options: opts}
+	if _, err := q.do("PING"); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Close closes the connection to Redis.
+func (q *RedisQueue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.conn == nil {
+		return nil
+	}
+	err := q.conn.Close()
+	q.conn = nil
+	return err
+}
+
+// key returns the key of one structure of an app's queue.
+func (q *RedisQueue) key(appID int, strName string) string {
+	return fmt.Sprintf("%s:{%d}:%s", q.options.Prefix, appID, strName)
+}
+
+func (q *RedisQueue) Enqueue(appID int, record []byte) error {
+	_, err := q.do("EVAL", redisScriptEnqueue, "3",
+		q.key(appID, "seq"), q.key(appID, "ready"), q.key(appID, "records"), string(record))
+	return err
+}
+
+func (q *RedisQueue) Lease(appID int, owner string, ttl time.Duration) (*Lease, error) {
+	reply, err := q.do("EVAL", redisScriptLease, "4",
+		q.key(appID, "ready"), q.key(appID, "records"), q.key(appID, "leases"), q.key(appID, "owners"),
+		owner, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	listReply, ok := reply.([]interface{})
+	if !ok || len(listReply) != 3 {
+		return nil, fmt.Errorf("redis: unexpected lease reply %v", reply)
+	}
+	strID, _ := listReply[0].(string)
+	strRecord, _ := listReply[1].(string)
+	strExpires, _ := listReply[2].(string)
+	intExpires, err := strconv.ParseInt(strExpires, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &Lease{
+		ID:      strID,
+		AppID:   appID,
+		Owner:   owner,
+		Record:  []byte(strRecord),
+		Expires: time.UnixMilli(intExpires),
+	}, nil
+}
+
+func (q *RedisQueue) Renew(lease *Lease, ttl time.Duration) error {
+	reply, err := q.do("EVAL", redisScriptRenew, "2",
+		q.key(lease.AppID, "leases"), q.key(lease.AppID, "owners"),
+		lease.ID, lease.Owner, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return err
+	}
+	intExpires, _ := reply.(int64)
+	if intExpires < 0 {
+		return ErrLeaseLost
+	}
+	lease.Expires = time.UnixMilli(intExpires)
+	return nil
+}
+
+func (q *RedisQueue) Ack(lease *Lease) error {
+	reply, err := q.do("EVAL", redisScriptAck, "3",
+		q.key(lease.AppID, "records"), q.key(lease.AppID, "leases"), q.key(lease.AppID, "owners"),
+		lease.ID, lease.Owner)
+	if err != nil {
+		return err
+	}
+	if intAcked, _ := reply.(int64); intAcked != 1 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// TryLock implements FeedbackLock with a Redis key that expires after ttl.
+func (q *RedisQueue) TryLock(appID int, owner string, ttl time.Duration) (bool, error) {
+	reply, err := q.do("SET", q.key(appID, "feedback"), owner, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// do sends one command and reads its reply, dialing first if needed.
+// A network or protocol error drops the connection so the next command redials.
+func (q *RedisQueue) do(listArgs ...string) (interface{}, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.conn == nil {
+		if err := q.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := q.roundTrip(listArgs)
+	if _, isReply := err.(redisError); err != nil && !isReply {
+		q.conn.Close()
+		q.conn = nil
+	}
+	return reply, err
+}
+
+// dial connects, authenticates and selects the database.
+func (q *RedisQueue) dial() error {
+	dialer := &net.Dialer{Timeout: q.options.Timeout}
+	var conn net.Conn
+	var err error
+	if q.options.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", q.options.Addr, q.options.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", q.options.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	q.conn = conn
+	q.reader = bufio.NewReader(conn)
+
+	var listSetup [][]string
+	if q.options.Password != "" {
+		if q.options.Username != "" {
+			listSetup = append(listSetup, []string{"AUTH", q.options.Username, q.options.Password})
+		} else {
+			listSetup = append(listSetup, []string{"AUTH", q.options.Password})
+		}
+	}
+	if q.options.DB != 0 {
+		listSetup = append(listSetup, []string{"SELECT", strconv.Itoa(q.options.DB)})
+	}
+	for _, listArgs := range listSetup {
+		if _, err := q.roundTrip(listArgs); err != nil {
+			conn.Close()
+			q.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// roundTrip writes a command as a RESP array of bulk strings and reads the reply.
+func (q *RedisQueue) roundTrip(listArgs []string) (interface{}, error) {
+	q.conn.SetDeadline(time.Now().Add(q.options.Timeout))
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(listArgs)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, strArg := range listArgs {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(strArg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, strArg...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := q.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return readRESP(q.reader)
+}
+
+// readRESP reads one reply. Bulk and simple strings are returned as string,
+// integers as int64, arrays as []interface{} and nil replies as nil.
+func readRESP(reader *bufio.Reader) (interface{}, error) {
+	strLine, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(strLine) < 3 || strLine[len(strLine)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", strLine)
+	}
+	strValue := strLine[1 : len(strLine)-2]
+	switch strLine[0] {
+	case '+':
+		return strValue, nil
+	case '-':
+		return nil, redisError(strValue)
+	case ':':
+		return strconv.ParseInt(strValue, 10, 64)
+	case '$':
+		intLen, err := strconv.Atoi(strValue)
+		if err != nil || intLen < 0 {
+			return nil, err
+		}
+		data := make([]byte, intLen+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:intLen]), nil
+	case '*':
+		intLen, err := strconv.Atoi(strValue)
+		if err != nil || intLen < 0 {
+			return nil, err
+		}
+		listValues := make([]interface{}, intLen)
+		for i := range listValues {
+			if listValues[i], err = readRESP(reader); err != nil {
+				return nil, err
+			}
+		}
+		return listValues, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", strLine[0])
+}
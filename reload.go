@@ -0,0 +1,268 @@
+package apnsservice
+
+// This source code includes reloading the app fleet from a declared configuration.
+// A reload is planned first so operators can preview exactly what it will do
+// to live connections, then applied as a separate confirm step.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// Config declares the desired set of apps for the service.
+// Environment is applied by LaunchFromConfig; reloads leave it unchanged.
+type Config struct {
+	Environment string      `json:"environment,omitempty"` // EnvironmentProduction or EnvironmentSandbox
+	Apps        []AppConfig `json:"apps"`
+}
+
+// AppConfig declares one app connection.
+// The file fields are read into Cert by LoadConfig.
+type AppConfig struct {
+	AppID     int               `json:"appId"`
+	StringID  string            `json:"stringId"`
+	Cert      AppCert           `json:"cert"`
+	IsLogging bool              `json:"isLogging"`
+	Options   ConnectionOptions `json:"options"`
+
+	Sandbox     bool   `json:"sandbox,omitempty"` // sets Cert.IsDev when loaded
+	CertFile    string `json:"certFile,omitempty"`
+	KeyFile     string `json:"keyFile,omitempty"`
+	AuthKeyFile string `json:"authKeyFile,omitempty"`
+	KeyID       string `json:"keyId,omitempty"`
+	TeamID      string `json:"teamId,omitempty"`
+}
+
+// ReloadAction names what a reload will do to one app.
+type ReloadAction string
+
+// These are the reload actions reported in a ReloadPlan.
+const (
+	ReloadAdd          ReloadAction = "add"
+	ReloadRemove       ReloadAction = "remove"
+	ReloadCertChange   ReloadAction = "cert"
+	ReloadOptionChange ReloadAction = "options"
+)
+
+// ReloadChange describes one change to one app.
+type ReloadChange struct {
+	AppID    int          `json:"appId"`
+	StringID string       `json:"stringId"`
+	Action   ReloadAction `json:"action"`
+	Detail   string       `json:"detail"`
+}
+
+// ReloadPlan is the dry-run diff between the live registry and a Config.
+// Pass it to ApplyReload to commit it.
+type ReloadPlan struct {
+	Changes    []ReloadChange `json:"changes"`
+	config     Config
+	generation uint64
+}
+
+// ErrStalePlan is returned by ApplyReload when apps were added, removed or
+// relaunched after the plan was computed.
+var ErrStalePlan = errors.New("reload plan is stale, plan again")
+
+// IsEmpty reports whether applying the plan would change nothing.
+func (p *ReloadPlan) IsEmpty() bool {
+	return len(p.Changes) == 0
+}
+
+// String formats the plan one change per line for operators.
+func (p *ReloadPlan) String() string {
+	if p.IsEmpty() {
+		return "no changes"
+	}
+	var sb strings.Builder
+	for _, change := range p.Changes {
+		fmt.Fprintf(&sb, "%-7s %d %s: %s\n", change.Action, change.AppID, change.StringID, change.Detail)
+	}
+	return sb.String()
+}
+
+// PlanReload validates config and returns the changes a reload would make
+// without touching any live connection.
+func PlanReload(config Config) (*ReloadPlan, error) {
+	mapWanted := make(map[int]*AppConfig)
+	for i := range config.Apps {
+		appConfig := &config.Apps[i]
+		if _, ok := mapWanted[appConfig.AppID]; ok {
+			return nil, fmt.Errorf("app %d is declared more than once", appConfig.AppID)
+		}
+		if err := appConfig.validate(); err != nil {
+			return nil, &AppError{AppID: appConfig.AppID, StringID: appConfig.StringID, Err: err}
+		}
+		mapWanted[appConfig.AppID] = appConfig
+	}
+
+	plan := &ReloadPlan{config: config}
+
+	mutexAPNS.RLock()
+	plan.generation = registryGeneration
+	for key, connectionAPNS := range mapAPNS {
+		if key.platform != PlatformIOS {
+			continue // the config file declares APNS apps only
+		}
+		appID := key.appID
+		appConfig, ok := mapWanted[appID]
+		if !ok {
+			plan.Changes = append(plan.Changes, ReloadChange{
+				AppID:    appID,
+				StringID: connectionAPNS.stringID,
+				Action:   ReloadRemove,
+				Detail:   "close connection",
+			})
+			continue
+		}
+		if strDetail := certDiff(connectionAPNS.cert, &appConfig.Cert); strDetail != "" {
+			plan.Changes = append(plan.Changes, ReloadChange{
+				AppID:    appID,
+				StringID: appConfig.StringID,
+				Action:   ReloadCertChange,
+				Detail:   strDetail,
+			})
+		}
+		if strDetail := optionsDiff(connectionAPNS, appConfig); strDetail != "" {
+			plan.Changes = append(plan.Changes, ReloadChange{
+				AppID:    appID,
+				StringID: appConfig.StringID,
+				Action:   ReloadOptionChange,
+				Detail:   strDetail,
+			})
+		}
+	}
+	for appID, appConfig := range mapWanted {
+		if _, ok := mapAPNS[appKey{appID, PlatformIOS}]; !ok {
+			plan.Changes = append(plan.Changes, ReloadChange{
+				AppID:    appID,
+				StringID: appConfig.StringID,
+				Action:   ReloadAdd,
+				Detail:   "launch connection",
+			})
+		}
+	}
+	mutexAPNS.RUnlock()
+
+	sort.Slice(plan.Changes, func(i, j int) bool {
+		if plan.Changes[i].AppID != plan.Changes[j].AppID {
+			return plan.Changes[i].AppID < plan.Changes[j].AppID
+		}
+		return plan.Changes[i].Action < plan.Changes[j].Action
+	})
+	return plan, nil
+}
+
+// ApplyReload commits a plan returned by PlanReload.
+// Removed apps are closed, added apps are launched and changed apps are
+// relaunched. Options set in code, such as stores, sinks and callbacks, are
+// kept, and pushes still queued on a relaunched app move to its new connection.
+// It fails with ErrStalePlan if the registry changed since the plan was computed.
+// Per-app launch failures are joined into the returned error.
+func ApplyReload(plan *ReloadPlan) error {
+	mutexAPNS.RLock()
+	generation := registryGeneration
+	mutexAPNS.RUnlock()
+	if generation != plan.generation {
+		return ErrStalePlan
+	}
+
+	mapConfig := make(map[int]*AppConfig)
+	for i := range plan.config.Apps {
+		mapConfig[plan.config.Apps[i].AppID] = &plan.config.Apps[i]
+	}
+
+	var listErrors []error
+	mapDone := make(map[int]bool)
+	for _, change := range plan.Changes {
+		if mapDone[change.AppID] {
+			continue
+		}
+		mapDone[change.AppID] = true
+
+		if change.Action == ReloadRemove {
+			// the config declares APNS apps only, so FCM and Web Push stay up
+			stopCertWatch(change.AppID)
+			if !removeConnection(appKey{change.AppID, PlatformIOS}) {
+				listErrors = append(listErrors, fmt.Errorf("app %d: %w", change.AppID, ErrAppNotFound))
+			}
+			continue
+		}
+		appConfig := mapConfig[change.AppID]
+		SetConnectionOptions(appConfig.AppID, mergeOptions(lookupOptions(appConfig.AppID), appConfig.Options))
+		err := registerConnection(appConfig.AppID, appConfig.StringID, appConfig.Cert, appConfig.IsLogging, true)
+		if err != nil {
+			listErrors = append(listErrors, fmt.Errorf("app %d %s: %w", appConfig.AppID, appConfig.StringID, err))
+		}
+	}
+	utils.Info.Println("reload applied", len(plan.Changes), "changes,", len(listErrors), "errors")
+	return errors.Join(listErrors...)
+}
+
+// Reload plans and immediately applies config.
+func Reload(config Config) error {
+	plan, err := PlanReload(config)
+	if err != nil {
+		return err
+	}
+	return ApplyReload(plan)
+}
+
+// certDiff describes the difference between two certs or returns "".
+func certDiff(oldCert *AppCert, newCert *AppCert) string {
+	var listDetail []string
+	if oldCert.IsDev != newCert.IsDev {
+		listDetail = append(listDetail, fmt.Sprintf("isDev %d -> %d", oldCert.IsDev, newCert.IsDev))
+	}
+	oldPrint, newPrint := certFingerprint(oldCert), certFingerprint(newCert)
+	if oldPrint != newPrint {
+		listDetail = append(listDetail, fmt.Sprintf("fingerprint %s -> %s", oldPrint, newPrint))
+	}
+	return strings.Join(listDetail, ", ")
+}
+
+// certFingerprint returns a short hash of the cert and key so secrets are never displayed.
+func certFingerprint(appCert *AppCert) string {
+	h := sha256.New()
+	h.Write(appCert.Cert)
+	h.Write(appCert.RSAKey)
+	h.Write(appCert.AuthKey)
+	h.Write([]byte(appCert.KeyID + appCert.TeamID))
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// optionsDiff names the settings that differ between a live connection and its config or returns "".
+func optionsDiff(a *connectionAPNS, appConfig *AppConfig) string {
+	var listDetail []string
+	if a.stringID != appConfig.StringID {
+		listDetail = append(listDetail, fmt.Sprintf("stringId %s -> %s", a.stringID, appConfig.StringID))
+	}
+	if a.isLogging != appConfig.IsLogging {
+		listDetail = append(listDetail, fmt.Sprintf("isLogging %v -> %v", a.isLogging, appConfig.IsLogging))
+	}
+	// a config can only express the JSON fields; the others are set in code
+	// and survive the reload, see mergeOptions
+	oldValue := reflect.ValueOf(a.options)
+	newValue := reflect.ValueOf(appConfig.Options)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if field.Tag.Get("json") == "-" {
+			continue
+		}
+		oldJSON, errOld := json.Marshal(oldValue.Field(i).Interface())
+		newJSON, errNew := json.Marshal(newValue.Field(i).Interface())
+		if errOld != nil || errNew != nil || !bytes.Equal(oldJSON, newJSON) {
+			listDetail = append(listDetail, fmt.Sprintf("%s %s -> %s", field.Name, oldJSON, newJSON))
+		}
+	}
+	return strings.Join(listDetail, ", ")
+}
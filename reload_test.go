@@ -0,0 +1,138 @@
+package apnsservice
+
+import (
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+func TestReloadKeepsCodeSetOptions(t *testing.T) {
+	const appID = 9301
+	sink := &deadLetters{}
+	transport := NewMockTransport()
+	SetConnectionOptions(appID, ConnectionOptions{
+		DeadLetterSink:   sink,
+		PayloadValidator: func(map[string]interface{}) error { return nil },
+		RetryPolicy:      RetryPolicy{Classify: ClassifyFailure},
+	})
+	if err := LaunchConnectionWithTransport(appID, "reload", transport, false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+
+	config := Config{Apps: []AppConfig{{AppID: appID, StringID: "reload", Options: ConnectionOptions{Mock: transport}}}}
+	plan, err := PlanReload(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.IsEmpty() {
+		t.Fatalf("plan for an unchanged config:\n%s", plan)
+	}
+
+	config.Apps[0].Options.Sockets = 2
+	plan, err = PlanReload(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 1 || plan.Changes[0].Action != ReloadOptionChange {
+		t.Fatalf("plan:\n%s", plan)
+	}
+	if err := ApplyReload(plan); err != nil {
+		t.Fatal(err)
+	}
+	opts := getConnection(appID).options
+	if opts.Sockets != 2 || opts.DeadLetterSink == nil || opts.PayloadValidator == nil || opts.RetryPolicy.Classify == nil {
+		t.Fatalf("options after reload lost code-set fields: %+v", opts)
+	}
+}
+
+func TestRelaunchHandsOverHeldPushes(t *testing.T) {
+	const appID = 9302
+	transport := NewMockTransport()
+	SetConnectionOptions(appID, ConnectionOptions{})
+	if err := LaunchConnectionWithTransport(appID, "handover", transport, false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+
+	if err := Pause(appID); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := PushOne(appID, apns.Payload{Token: testToken(i), AlertText: "held"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := LaunchConnectionWithTransport(appID, "handover", transport, false); err != nil {
+		t.Fatal(err)
+	}
+	if !transport.WaitForSent(5, 2*time.Second) {
+		t.Fatalf("sent %d of 5 held pushes after the relaunch", len(transport.Sent()))
+	}
+}
+
+func TestRemoveAppDeadLettersQueuedPushes(t *testing.T) {
+	const appID = 9303
+	sink := &deadLetters{}
+	SetConnectionOptions(appID, ConnectionOptions{DeadLetterSink: sink})
+	if err := LaunchConnectionWithTransport(appID, "removed", NewMockTransport(), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Pause(appID); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := PushOne(appID, apns.Payload{Token: testToken(i), AlertText: "held"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RemoveApp(appID); err != nil {
+		t.Fatal(err)
+	}
+	timeLimit := time.Now().Add(2 * time.Second)
+	for len(sink.reasons()) < 3 && time.Now().Before(timeLimit) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	listReasons := sink.reasons()
+	if len(listReasons) != 3 || listReasons[0] != ReasonAppRemoved {
+		t.Fatalf("dead letters %v, want 3 %s", listReasons, ReasonAppRemoved)
+	}
+}
+
+func TestReloadRemoveKeepsOtherPlatforms(t *testing.T) {
+	const appID = 9304
+	SetConnectionOptions(appID, ConnectionOptions{})
+	if err := LaunchConnectionWithTransport(appID, "platforms", NewMockTransport(), false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+	android := newConnection(appID, "platforms", &AppCert{AppID: appID})
+	android.platform = PlatformAndroid
+	android.options.Mock = NewMockTransport()
+	if err := storeConnection(&android, false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty config removes every APNS app; apply only this app's removal
+	plan, err := PlanReload(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listChanges := plan.Changes[:0]
+	for _, change := range plan.Changes {
+		if change.AppID == appID {
+			listChanges = append(listChanges, change)
+		}
+	}
+	plan.Changes = listChanges
+	if err := ApplyReload(plan); err != nil {
+		t.Fatal(err)
+	}
+	if getConnection(appID) != nil {
+		t.Fatal("APNS connection not removed")
+	}
+	if getPlatformConnection(appID, PlatformAndroid) != &android {
+		t.Fatal("FCM connection removed by a reload of APNS apps")
+	}
+}
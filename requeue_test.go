@@ -0,0 +1,257 @@
+package apnsservice
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// deadLetters collects the dead letters of a test connection.
+type deadLetters struct {
+	mutex       sync.Mutex
+	listRecords []*DeadLetter
+}
+
+func (d *deadLetters) DeadLetter(record *DeadLetter) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.listRecords = append(d.listRecords, record)
+}
+
+// reasons returns the reason codes collected so far.
+func (d *deadLetters) reasons() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	listReasons := make([]string, 0, len(d.listRecords))
+	for _, record := range d.listRecords {
+		listReasons = append(listReasons, record.ReasonCode)
+	}
+	return listReasons
+}
+
+// waitFor waits until a dead letter with strReason arrives or timeout passes.
+func (d *deadLetters) waitFor(strReason string, timeout time.Duration) bool {
+	timeLimit := time.Now().Add(timeout)
+	for time.Now().Before(timeLimit) {
+		for _, strGot := range d.reasons() {
+			if strGot == strReason {
+				return true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// testToken returns a distinct valid device token.
+func testToken(i int) string {
+	return fmt.Sprintf("%064x", i)
+}
+
+// newIdleConnection launches a producer connection for appID, which has
+// lanes but no workers draining them.
+func newIdleConnection(t *testing.T, appID int, opts ConnectionOptions) *connectionAPNS {
+	t.Helper()
+	opts.SharedQueue = NewMemoryQueue()
+	opts.EnqueueOnly = true
+	SetConnectionOptions(appID, opts)
+	connectionAPNS := newConnection(appID, "idle", &AppCert{AppID: appID})
+	if err := storeConnection(&connectionAPNS, false, true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { RemoveApp(appID) })
+	return &connectionAPNS
+}
+
+// fillLane fills the send channel of a connection.
+func fillLane(a *connectionAPNS) {
+	for len(a.chanSend) < cap(a.chanSend) {
+		a.chanSend <- &notification{}
+	}
+}
+
+func TestRetryTimedOutRequeues(t *testing.T) {
+	sink := &deadLetters{}
+	a := newIdleConnection(t, 9101, ConnectionOptions{DeadLetterSink: sink})
+	n := newNotification(&apns.Payload{Token: testToken(1)}, &PushOptions{}, nil)
+
+	a.retryTimedOut(1, n)
+	if a.backlog.len() != 1 || n.attempts != 1 {
+		t.Fatalf("backlog %d with %d attempts, want 1 and 1", a.backlog.len(), n.attempts)
+	}
+	if listReasons := sink.reasons(); len(listReasons) != 0 {
+		t.Fatalf("dead letters %v, want none", listReasons)
+	}
+}
+
+func TestRetryTimedOutFullLaneKeepsPush(t *testing.T) {
+	sink := &deadLetters{}
+	a := newIdleConnection(t, 9102, ConnectionOptions{DeadLetterSink: sink})
+	fillLane(a)
+	n := newNotification(&apns.Payload{Token: testToken(1)}, &PushOptions{}, nil)
+
+	chanReturned := make(chan struct{})
+	go func() {
+		a.retryTimedOut(1, n)
+		close(chanReturned)
+	}()
+	select {
+	case <-chanReturned:
+	case <-time.After(time.Second):
+		t.Fatal("retryTimedOut blocked on a full lane")
+	}
+	if a.backlog.len() != 1 {
+		t.Fatalf("backlog %d, want the push kept for retry", a.backlog.len())
+	}
+	if listReasons := sink.reasons(); len(listReasons) != 0 {
+		t.Fatalf("dead letters %v, want none", listReasons)
+	}
+}
+
+func TestRetryTimedOutExhaustedDeadLetters(t *testing.T) {
+	sink := &deadLetters{}
+	a := newIdleConnection(t, 9103, ConnectionOptions{
+		DeadLetterSink: sink,
+		RetryPolicy:    RetryPolicy{MaxAttempts: 2},
+	})
+	n := newNotification(&apns.Payload{Token: testToken(1)}, &PushOptions{}, nil)
+	n.recordAttempt()
+
+	a.retryTimedOut(1, n)
+	if a.backlog.len() != 0 {
+		t.Fatalf("backlog %d, want 0", a.backlog.len())
+	}
+	if listReasons := sink.reasons(); len(listReasons) != 1 || listReasons[0] != ReasonSendTimeout {
+		t.Fatalf("dead letters %v, want [%s]", listReasons, ReasonSendTimeout)
+	}
+}
+
+func TestRetryTimedOutExpiredIsDropped(t *testing.T) {
+	sink := &deadLetters{}
+	a := newIdleConnection(t, 9104, ConnectionOptions{DeadLetterSink: sink})
+	n := newNotification(&apns.Payload{Token: testToken(1)}, &PushOptions{}, nil)
+	n.deadline = time.Now().Add(-time.Second)
+
+	a.retryTimedOut(1, n)
+	if a.backlog.len() != 0 || len(sink.reasons()) != 0 {
+		t.Fatalf("backlog %d with dead letters %v, want neither", a.backlog.len(), sink.reasons())
+	}
+}
+
+// waitForAttempt waits until transport has seen a push.
+func waitForAttempt(t *testing.T, transport *MockTransport) {
+	t.Helper()
+	timeLimit := time.Now().Add(time.Second)
+	for len(transport.Pushes()) == 0 {
+		if time.Now().After(timeLimit) {
+			t.Fatal("no push attempted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHTTP2BackoffFullLaneDelivers(t *testing.T) {
+	const appID = 9105
+	sink := &deadLetters{}
+	transport := NewMockTransport()
+	SetConnectionOptions(appID, ConnectionOptions{
+		Protocol:       ProtocolHTTP2,
+		Sockets:        1,
+		DeadLetterSink: sink,
+		RetryPolicy:    RetryPolicy{BaseDelay: 200 * time.Millisecond},
+	})
+	if err := LaunchConnectionWithTransport(appID, "backoff", transport, false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+
+	transport.FailNext(1, 503, "ServiceUnavailable")
+	if err := PushOne(appID, apns.Payload{Token: testToken(0), AlertText: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForAttempt(t, transport)
+
+	// fill the lanes while the only worker backs off
+	intQueued := 0
+	for i := 1; ; i++ {
+		err := TryPushOne(appID, apns.Payload{Token: testToken(i), AlertText: "more"}, PushOptions{})
+		if err == ErrQueueFull {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		intQueued++
+	}
+
+	if !transport.WaitForSent(intQueued+1, 2*time.Second) {
+		t.Fatalf("sent %d of %d", len(transport.Sent()), intQueued+1)
+	}
+	if listReasons := sink.reasons(); len(listReasons) != 0 {
+		t.Fatalf("dead letters %v, want none", listReasons)
+	}
+	if strToken := transport.Sent()[0].Token; strToken != testToken(0) {
+		t.Fatalf("first sent %s, want the retried push first", strToken)
+	}
+}
+
+func TestHTTP2BackoffRelaunchDelivers(t *testing.T) {
+	const appID = 9106
+	sink := &deadLetters{}
+	transport := NewMockTransport()
+	SetConnectionOptions(appID, ConnectionOptions{
+		Protocol:       ProtocolHTTP2,
+		Sockets:        1,
+		DeadLetterSink: sink,
+		RetryPolicy:    RetryPolicy{BaseDelay: time.Hour},
+	})
+	if err := LaunchConnectionWithTransport(appID, "backoff", transport, false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+
+	transport.FailNext(1, 503, "ServiceUnavailable")
+	if err := PushOne(appID, apns.Payload{Token: testToken(0), AlertText: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForAttempt(t, transport)
+	if err := LaunchConnectionWithTransport(appID, "backoff", transport, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if !transport.WaitForSent(1, 2*time.Second) {
+		t.Fatal("push in backoff was not delivered by the relaunched connection")
+	}
+	if listReasons := sink.reasons(); len(listReasons) != 0 {
+		t.Fatalf("dead letters %v, want none", listReasons)
+	}
+}
+
+func TestHTTP2BackoffRemoveDeadLetters(t *testing.T) {
+	const appID = 9107
+	sink := &deadLetters{}
+	transport := NewMockTransport()
+	SetConnectionOptions(appID, ConnectionOptions{
+		Protocol:       ProtocolHTTP2,
+		Sockets:        1,
+		DeadLetterSink: sink,
+		RetryPolicy:    RetryPolicy{BaseDelay: time.Hour},
+	})
+	if err := LaunchConnectionWithTransport(appID, "backoff", transport, false); err != nil {
+		t.Fatal(err)
+	}
+
+	transport.FailNext(1, 503, "ServiceUnavailable")
+	if err := PushOne(appID, apns.Payload{Token: testToken(0), AlertText: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForAttempt(t, transport)
+	RemoveApp(appID)
+
+	if !sink.waitFor(ReasonAppRemoved, 2*time.Second) {
+		t.Fatalf("dead letters %v, want %s", sink.reasons(), ReasonAppRemoved)
+	}
+}
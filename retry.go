@@ -0,0 +1,176 @@
+package apnsservice
+
+// This source code includes the retry policy of a connection. Each failure is
+// classified as transient, permanent for the payload or fatal for the
+// connection. Only transient failures back off, with jitter, and a payload
+// that runs out of attempts is dead-lettered instead of retried forever.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// These are the retry defaults, matching the original fixed backoff.
+const (
+	defaultRetryBaseDelay = time.Second
+	defaultRetryMaxDelay  = 128 * time.Second
+)
+
+// ReasonRetriesExhausted is the dead-letter reason of a payload that ran out of attempts.
+const ReasonRetriesExhausted = "RetriesExhausted"
+
+// RetryClass is how a failure is treated.
+type RetryClass int
+
+// These are the failure classes.
+// RetryPermanent drops the payload but keeps the connection, e.g. an invalid token.
+// RetryFatal closes the connection, e.g. a bad certificate.
+const (
+	RetryTransient RetryClass = iota
+	RetryPermanent
+	RetryFatal
+)
+
+// Failure describes one failure to classify.
+type Failure struct {
+	Err    error  // dial or request error, nil when Apple answered
+	Status int    // HTTP status or binary protocol status
+	Reason string // Apple's reason string
+}
+
+// RetryPolicy controls how a connection retries. The zero value backs off from
+// one second to 128 seconds without jitter and retries a payload indefinitely.
+type RetryPolicy struct {
+	BaseDelay   time.Duration              `json:"baseDelay"`
+	MaxDelay    time.Duration              `json:"maxDelay"`
+	Jitter      float64                    `json:"jitter"`      // 0 to 1, the fraction of each delay randomized away
+	MaxAttempts int                        `json:"maxAttempts"` // send attempts per payload, 0 for no limit
+	Classify    func(f Failure) RetryClass `json:"-"`           // optional, replaces the default classification
+}
+
+// UnmarshalJSON accepts durations as strings such as "500ms" or as nanoseconds.
+func (p *RetryPolicy) UnmarshalJSON(data []byte) error {
+	type plain RetryPolicy
+	return unmarshalDurations(data, (*plain)(p))
+}
+
+// delay returns the wait after intFailures consecutive transient failures.
+func (p RetryPolicy) delay(intFailures int) time.Duration {
+	base := p.BaseDelay
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	limit := p.MaxDelay
+	if limit <= 0 {
+		limit = defaultRetryMaxDelay
+	}
+	delay := base
+	for i := 0; i < intFailures && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		delay -= time.Duration(jitter * rand.Float64() * float64(delay))
+	}
+	return delay
+}
+
+// classify returns the class of a failure.
+func (p RetryPolicy) classify(f Failure) RetryClass {
+	if p.Classify != nil {
+		return p.Classify(f)
+	}
+	return ClassifyFailure(f)
+}
+
+// isExhausted reports whether a notification has used all of its attempts.
+func (p RetryPolicy) isExhausted(n *notification) bool {
+	return p.MaxAttempts > 0 && n.attempts >= p.MaxAttempts
+}
+
+// ClassifyFailure is the default classification. Certificate and provider
+// token failures are fatal, throttling, server errors and network errors are
+// transient and any other rejection is permanent for the payload.
+func ClassifyFailure(f Failure) RetryClass {
+	if f.Err != nil {
+		if isCertError(f.Err) {
+			return RetryFatal
+		}
+		return RetryTransient
+	}
+	switch f.Reason {
+	case "BadCertificate", "BadCertificateEnvironment", "Forbidden",
+		"InvalidProviderToken", "MissingProviderToken", "TopicDisallowed",
+		"UNAUTHENTICATED", "PERMISSION_DENIED":
+		return RetryFatal
+	}
+	switch {
+	case f.Status == 0, f.Status == binaryStatusProcessing,
+		f.Status == binaryStatusShutdown, f.Status == binaryStatusUnknown:
+		return RetryTransient
+	case f.Status == http.StatusTooManyRequests, f.Status >= http.StatusInternalServerError:
+		return RetryTransient
+	}
+	return RetryPermanent
+}
+
+// These are the TLS alerts a gateway sends for a certificate it will not accept.
+const (
+	alertBadCertificate     = 42
+	alertCertificateRevoked = 44
+	alertCertificateExpired = 45
+)
+
+// isCertError reports whether err means the certificate will never be accepted.
+func isCertError(err error) bool {
+	var errAuthority x509.UnknownAuthorityError
+	var errInvalid x509.CertificateInvalidError
+	var errHostname x509.HostnameError
+	if errors.As(err, &errAuthority) || errors.As(err, &errInvalid) || errors.As(err, &errHostname) {
+		return true
+	}
+	var errAlert tls.AlertError
+	if errors.As(err, &errAlert) {
+		return isCertAlert(uint64(errAlert))
+	}
+	// crypto/tls returns an alert from the gateway as a "remote error"
+	// net.OpError around its unexported alert type, a uint8
+	var errOp *net.OpError
+	if errors.As(err, &errOp) && errOp.Op == "remote error" && errOp.Err != nil {
+		value := reflect.ValueOf(errOp.Err)
+		return value.Kind() == reflect.Uint8 && isCertAlert(value.Uint())
+	}
+	return false
+}
+
+// isCertAlert reports whether a TLS alert code rejects the certificate.
+func isCertAlert(code uint64) bool {
+	switch code {
+	case alertBadCertificate, alertCertificateRevoked, alertCertificateExpired:
+		return true
+	}
+	return false
+}
+
+// fail closes a connection after a fatal failure so its workers stop retrying.
+func (a *connectionAPNS) fail(socketID int, strReason string) {
+	a.logLevelf(LogError, socketID, "Fatal error, closing connection: %s\n", strReason)
+	utils.Warning.Println("apns connection failed", a.stringID, strReason)
+	a.health.recordFatal(strReason)
+	a.event(socketID, EventError, strReason)
+	a.close()
+}
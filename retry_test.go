@@ -0,0 +1,94 @@
+package apnsservice
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedCert returns a throwaway certificate for a TLS handshake that
+// expires at notAfter.
+func selfSignedCert(t *testing.T, notAfter time.Time) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestIsCertErrorMatchesExpiredClientCert(t *testing.T) {
+	certExpired := selfSignedCert(t, time.Now().Add(-time.Hour))
+	poolCA := x509.NewCertPool()
+	poolCA.AddCert(certExpired.Leaf)
+	connClient, connServer := net.Pipe()
+	defer connClient.Close()
+	server := tls.Server(connServer, &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCert(t, time.Now().Add(time.Hour))},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    poolCA,
+		MaxVersion:   tls.VersionTLS12,
+	})
+	go func() {
+		server.Handshake()
+		server.Close()
+	}()
+	client := tls.Client(connClient, &tls.Config{
+		Certificates:       []tls.Certificate{certExpired},
+		InsecureSkipVerify: true,
+	})
+	err := client.Handshake()
+	if err == nil {
+		t.Fatal("handshake succeeded with an expired client cert")
+	}
+	if !isCertError(err) {
+		t.Errorf("isCertError(%v) = false, want true", err)
+	}
+	if ClassifyFailure(Failure{Err: err}) != RetryFatal {
+		t.Errorf("expired client cert is not fatal")
+	}
+}
+
+func TestIsCertError(t *testing.T) {
+	for _, test := range []struct {
+		err        error
+		isCertFail bool
+	}{
+		{fmt.Errorf("dial: %w", x509.UnknownAuthorityError{}), true},
+		{x509.CertificateInvalidError{Reason: x509.Expired}, true},
+		{tls.AlertError(alertCertificateExpired), true},
+		{fmt.Errorf("handshake: %w", tls.AlertError(alertCertificateRevoked)), true},
+		{tls.AlertError(40), false}, // handshake_failure
+		{&net.OpError{Op: "remote error", Err: tls.AlertError(alertBadCertificate)}, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, false},
+		{errors.New("certificate store unavailable"), false},
+		{io.EOF, false},
+	} {
+		if got := isCertError(test.err); got != test.isCertFail {
+			t.Errorf("isCertError(%v) = %v, want %v", test.err, got, test.isCertFail)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package apnsservice
+
+// This source code includes scheduled delivery. Schedule holds a payload in
+// a timer wheel until its delivery time and then pushes it like
+// PushOneWithOptions, so reminders and digests need no external cron. With a
+// ScheduleStore set, scheduled pushes survive a restart.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// These size the timer wheel. An entry further out than one revolution
+// waits for the extra rounds in its slot.
+const (
+	wheelTick  = time.Second
+	wheelSlots = 3600
+)
+
+// ScheduledPush is a push waiting for its delivery time.
+// Record is the serialized payload and options.
+type ScheduledPush struct {
+	ID        string    `json:"id"`
+	AppID     int       `json:"appId"`
+	Platform  Platform  `json:"platform"`
+	DeliverAt time.Time `json:"deliverAt"`
+	Record    []byte    `json:"record"`
+}
+
+// ScheduleStore persists scheduled pushes so they survive a restart.
+type ScheduleStore interface {
+	// Save stores a scheduled push.
+	Save(push ScheduledPush) error
+	// Delete removes a delivered or cancelled push.
+	Delete(id string) error
+	// Load returns every stored push.
+	Load() ([]ScheduledPush, error)
+}
+
+// scheduleEntry is a scheduled push in its wheel slot.
+type scheduleEntry struct {
+	push   ScheduledPush
+	slot   int
+	rounds int // revolutions left before the entry is due
+}
+
+// timerWheel holds scheduled pushes in slots of one tick.
+// The ticker runs only while the wheel holds entries.
+type timerWheel struct {
+	mutex      sync.Mutex
+	listSlots  []map[string]*scheduleEntry
+	mapEntries map[string]*scheduleEntry
+	cursor     int
+	isRunning  bool
+	store      ScheduleStore
+}
+
+// wheel is the service's scheduler.
+var wheel = &timerWheel{
+	listSlots:  make([]map[string]*scheduleEntry, wheelSlots),
+	mapEntries: make(map[string]*scheduleEntry),
+}
+
+// Schedule pushes payload for the specified app at deliverAt and returns the
+// id of the scheduled push. A time in the past delivers at once.
+// The app need not be launched until the delivery time.
+func Schedule(appID int, payload apns.Payload, deliverAt time.Time) (string, error) {
+	return ScheduleWithOptions(appID, PlatformIOS, payload, PushOptions{}, deliverAt)
+}
+
+// ScheduleWithOptions schedules a push with delivery options on any platform.
+func ScheduleWithOptions(appID int, platform Platform, payload apns.Payload, opts PushOptions, deliverAt time.Time) (string, error) {
+	if err := opts.validate(); err != nil {
+		return "", err
+	}
+	record, err := encodeNotification(&notification{payload: payload, options: opts})
+	if err != nil {
+		return "", err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	push := ScheduledPush{
+		ID:        hex.EncodeToString(id),
+		AppID:     appID,
+		Platform:  platform,
+		DeliverAt: deliverAt,
+		Record:    record,
+	}
+
+	wheel.mutex.Lock()
+	store := wheel.store
+	wheel.mutex.Unlock()
+	if store != nil {
+		if err := store.Save(push); err != nil {
+			utils.Warning.Println("ScheduleStore.Save", appID, err.Error())
+			return "", err
+		}
+	}
+	wheel.add(push)
+	return push.ID, nil
+}
+
+// CancelScheduled removes a scheduled push that has not been delivered.
+// It reports whether the push was found.
+func CancelScheduled(id string) bool {
+	wheel.mutex.Lock()
+	entry, ok := wheel.mapEntries[id]
+	if ok {
+		delete(wheel.listSlots[entry.slot], id)
+		delete(wheel.mapEntries, id)
+	}
+	store := wheel.store
+	wheel.mutex.Unlock()
+
+	if ok && store != nil {
+		if err := store.Delete(id); err != nil {
+			utils.Warning.Println("ScheduleStore.Delete", id, err.Error())
+		}
+	}
+	return ok
+}
+
+// ScheduledCount returns the number of pushes waiting for delivery.
+func ScheduledCount() int {
+	wheel.mutex.Lock()
+	defer wheel.mutex.Unlock()
+	return len(wheel.mapEntries)
+}
+
+// SetScheduleStore persists scheduled pushes in store and schedules every
+// push it already holds, so pushes scheduled before a restart are delivered.
+// Overdue pushes are delivered at once. Call it from main before scheduling.
+func SetScheduleStore(store ScheduleStore) error {
+	listPushes, err := store.Load()
+	if err != nil {
+		utils.Warning.Println("ScheduleStore.Load", err.Error())
+		return err
+	}
+	wheel.mutex.Lock()
+	wheel.store = store
+	wheel.mutex.Unlock()
+
+	for _, push := range listPushes {
+		wheel.add(push)
+	}
+	return nil
+}
+
+// add places a push in the slot of its delivery tick.
+func (w *timerWheel) add(push ScheduledPush) {
+	intTicks := int((time.Until(push.DeliverAt) + wheelTick - 1) / wheelTick)
+	if intTicks <= 0 {
+		go w.deliver(push)
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if existing, ok := w.mapEntries[push.ID]; ok {
+		delete(w.listSlots[existing.slot], push.ID)
+	}
+	entry := &scheduleEntry{
+		push:   push,
+		slot:   (w.cursor + intTicks) % wheelSlots,
+		rounds: (intTicks - 1) / wheelSlots,
+	}
+	if w.listSlots[entry.slot] == nil {
+		w.listSlots[entry.slot] = make(map[string]*scheduleEntry)
+	}
+	w.listSlots[entry.slot][push.ID] = entry
+	w.mapEntries[push.ID] = entry
+	if !w.isRunning {
+		w.isRunning = true
+		go w.run()
+	}
+}
+
+// run advances the wheel one slot per tick and delivers the entries due in it.
+// It returns when the wheel is empty.
+func (w *timerWheel) run() {
+	ticker := time.NewTicker(wheelTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		w.mutex.Lock()
+		w.cursor = (w.cursor + 1) % wheelSlots
+		var listDue []ScheduledPush
+		for id, entry := range w.listSlots[w.cursor] {
+			if entry.rounds > 0 {
+				entry.rounds--
+				continue
+			}
+			listDue = append(listDue, entry.push)
+			delete(w.listSlots[w.cursor], id)
+			delete(w.mapEntries, id)
+		}
+		isEmpty := len(w.mapEntries) == 0
+		if isEmpty {
+			w.isRunning = false
+		}
+		w.mutex.Unlock()
+
+		for _, push := range listDue {
+			go w.deliver(push)
+		}
+		if isEmpty {
+			return
+		}
+	}
+}
+
+// deliver pushes a due entry and removes it from the store.
+// A push that fails is logged and not retried.
+func (w *timerWheel) deliver(push ScheduledPush) {
+	n, err := decodeNotification(push.Record)
+	if err == nil {
+		platform := push.Platform
+		if platform == "" {
+			platform = PlatformIOS
+		}
+		err = PushWithOptions(push.AppID, platform, n.payload, n.options)
+	}
+	if err != nil {
+		utils.Warning.Println("scheduled push", push.ID, push.AppID, err.Error())
+	}
+
+	w.mutex.Lock()
+	store := w.store
+	w.mutex.Unlock()
+	if store != nil {
+		if err := store.Delete(push.ID); err != nil {
+			utils.Warning.Println("ScheduleStore.Delete", push.ID, err.Error())
+		}
+	}
+}
+
+// fileScheduleStore keeps each scheduled push in its own JSON file.
+type fileScheduleStore struct {
+	strDir string
+}
+
+// NewFileScheduleStore returns a ScheduleStore that keeps one JSON file per
+// scheduled push in dir, creating dir if needed.
+func NewFileScheduleStore(dir string) (ScheduleStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileScheduleStore{strDir: dir}, nil
+}
+
+func (s *fileScheduleStore) Save(push ScheduledPush) error {
+	data, err := json.Marshal(&push)
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash never leaves a partial file
+	strPath := s.path(push.ID)
+	if err := os.WriteFile(strPath+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(strPath+".tmp", strPath)
+}
+
+func (s *fileScheduleStore) Delete(id string) error {
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileScheduleStore) Load() ([]ScheduledPush, error) {
+	listEntries, err := os.ReadDir(s.strDir)
+	if err != nil {
+		return nil, err
+	}
+	var listPushes []ScheduledPush
+	for _, entry := range listEntries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.strDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var push ScheduledPush
+		if err := json.Unmarshal(data, &push); err != nil {
+			utils.Warning.Println("skipping scheduled push", entry.Name(), err.Error())
+			continue
+		}
+		listPushes = append(listPushes, push)
+	}
+	return listPushes, nil
+}
+
+// path returns the file of a scheduled push.
+func (s *fileScheduleStore) path(id string) string {
+	return filepath.Join(s.strDir, filepath.Base(id)+".json")
+}
@@ -0,0 +1,192 @@
+package apnsservice
+
+// This source code includes the CertProviders for HashiCorp Vault and AWS
+// Secrets Manager. Both speak the stores' HTTP APIs directly so no SDK is
+// needed. The secret holds a JSON document with the fields cert, rsaKey,
+// authKey, keyId, teamId and isDev.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// VaultCertProvider reads a secret from Vault's KV engine, version 1 or 2.
+// Path is the API path under /v1, such as "secret/data/apns/myapp".
+// Token defaults to the VAULT_TOKEN environment variable and Address to VAULT_ADDR.
+type VaultCertProvider struct {
+	Address string
+	Token   string
+	Path    string
+	Client  *http.Client
+}
+
+// FetchCert reads the secret.
+func (p VaultCertProvider) FetchCert(ctx context.Context, appID int) (AppCert, error) {
+	strAddress := p.Address
+	if strAddress == "" {
+		strAddress = os.Getenv("VAULT_ADDR")
+	}
+	strToken := p.Token
+	if strToken == "" {
+		strToken = os.Getenv("VAULT_TOKEN")
+	}
+	strURL := strings.TrimRight(strAddress, "/") + "/v1/" + strings.TrimLeft(p.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strURL, nil)
+	if err != nil {
+		return AppCert{}, err
+	}
+	req.Header.Set("X-Vault-Token", strToken)
+
+	body, err := doSecretRequest(p.Client, req)
+	if err != nil {
+		return AppCert{}, fmt.Errorf("vault %s: %s", p.Path, err.Error())
+	}
+	var reply struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return AppCert{}, fmt.Errorf("vault %s: %s", p.Path, err.Error())
+	}
+	// KV version 2 nests the secret in a second data object
+	var kv2 struct {
+		Data     json.RawMessage `json:"data"`
+		Metadata json.RawMessage `json:"metadata"`
+	}
+	data := []byte(reply.Data)
+	if json.Unmarshal(reply.Data, &kv2) == nil && kv2.Data != nil && kv2.Metadata != nil {
+		data = kv2.Data
+	}
+	return parseCertSecret(data, appID)
+}
+
+// AWSSecretsManagerProvider reads a secret string from AWS Secrets Manager.
+// Credentials default to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, and Region to AWS_REGION.
+type AWSSecretsManagerProvider struct {
+	Region          string
+	SecretID        string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Client          *http.Client
+}
+
+// FetchCert reads the secret.
+func (p AWSSecretsManagerProvider) FetchCert(ctx context.Context, appID int) (AppCert, error) {
+	strRegion := firstNonEmpty(p.Region, os.Getenv("AWS_REGION"))
+	strAccessKey := firstNonEmpty(p.AccessKeyID, os.Getenv("AWS_ACCESS_KEY_ID"))
+	strSecretKey := firstNonEmpty(p.SecretAccessKey, os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	strSession := firstNonEmpty(p.SessionToken, os.Getenv("AWS_SESSION_TOKEN"))
+	if strRegion == "" || strAccessKey == "" || strSecretKey == "" {
+		return AppCert{}, fmt.Errorf("secrets manager %s: region and credentials are required", p.SecretID)
+	}
+
+	payload, _ := json.Marshal(map[string]string{"SecretId": p.SecretID})
+	strHost := "secretsmanager." + strRegion + ".amazonaws.com"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+strHost+"/", bytes.NewReader(payload))
+	if err != nil {
+		return AppCert{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if strSession != "" {
+		req.Header.Set("X-Amz-Security-Token", strSession)
+	}
+	signAWSRequest(req, payload, strHost, strRegion, "secretsmanager", strAccessKey, strSecretKey, time.Now().UTC())
+
+	body, err := doSecretRequest(p.Client, req)
+	if err != nil {
+		return AppCert{}, fmt.Errorf("secrets manager %s: %s", p.SecretID, err.Error())
+	}
+	var reply struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return AppCert{}, fmt.Errorf("secrets manager %s: %s", p.SecretID, err.Error())
+	}
+	return parseCertSecret([]byte(reply.SecretString), appID)
+}
+
+// doSecretRequest sends a request to a secret store and returns the body of a 200 reply.
+func doSecretRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// signAWSRequest adds an AWS Signature Version 4 Authorization header.
+func signAWSRequest(req *http.Request, payload []byte, strHost string, strRegion string, strService string,
+	strAccessKey string, strSecretKey string, now time.Time) {
+
+	strDate := now.Format("20060102")
+	strStamp := now.Format("20060102T150405Z")
+	req.Header.Set("Host", strHost)
+	req.Header.Set("X-Amz-Date", strStamp)
+
+	listNames := []string{"content-type", "host", "x-amz-date", "x-amz-target"}
+	if req.Header.Get("X-Amz-Security-Token") != "" {
+		listNames = append(listNames, "x-amz-security-token")
+	}
+	strSigned := strings.Join(listNames, ";")
+	var sbHeaders strings.Builder
+	for _, strName := range listNames {
+		sbHeaders.WriteString(strName + ":" + strings.TrimSpace(req.Header.Get(strName)) + "\n")
+	}
+
+	hashPayload := sha256.Sum256(payload)
+	strCanonical := strings.Join([]string{
+		req.Method, "/", "", sbHeaders.String(), strSigned, hex.EncodeToString(hashPayload[:]),
+	}, "\n")
+	hashCanonical := sha256.Sum256([]byte(strCanonical))
+	strScope := strDate + "/" + strRegion + "/" + strService + "/aws4_request"
+	strToSign := "AWS4-HMAC-SHA256\n" + strStamp + "\n" + strScope + "\n" + hex.EncodeToString(hashCanonical[:])
+
+	key := hmacSHA256([]byte("AWS4"+strSecretKey), strDate)
+	key = hmacSHA256(key, strRegion)
+	key = hmacSHA256(key, strService)
+	key = hmacSHA256(key, "aws4_request")
+	strSignature := hex.EncodeToString(hmacSHA256(key, strToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+strAccessKey+"/"+strScope+
+		", SignedHeaders="+strSigned+", Signature="+strSignature)
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// firstNonEmpty returns the first non-empty string.
+func firstNonEmpty(listValues ...string) string {
+	for _, strValue := range listValues {
+		if strValue != "" {
+			return strValue
+		}
+	}
+	return ""
+}
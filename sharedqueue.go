@@ -0,0 +1,253 @@
+package apnsservice
+
+// This source code includes cooperative mode, where several processes
+// configured for the same app share one queue backend. Pushes are enqueued
+// to the backend and every process leases records from it, renewing its
+// leases with heartbeats until the payload is delivered and acknowledged.
+// A process that dies stops renewing and its records are leased by another.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SharedQueue is a queue backend shared by every process serving an app.
+// Lease must be atomic across processes so a record is held by one owner at a time.
+type SharedQueue interface {
+	// Enqueue appends a record for appID.
+	Enqueue(appID int, record []byte) error
+	// Lease holds the next unleased or expired record for owner until ttl elapses.
+	// It returns nil and no error when nothing is available.
+	Lease(appID int, owner string, ttl time.Duration) (*Lease, error)
+	// Renew extends a lease still held by its owner.
+	Renew(lease *Lease, ttl time.Duration) error
+	// Ack deletes the record of a delivered lease.
+	Ack(lease *Lease) error
+}
+
+// Lease is a record held by one process.
+type Lease struct {
+	ID      string    `json:"id"`
+	AppID   int       `json:"appId"`
+	Owner   string    `json:"owner"`
+	Record  []byte    `json:"record"`
+	Expires time.Time `json:"expires"`
+}
+
+// ErrLeaseLost is returned by Renew and Ack when the lease expired and was taken by another owner.
+var ErrLeaseLost = errors.New("lease lost")
+
+// These are the cooperative mode defaults.
+const (
+	defaultLeaseTTL   = 30 * time.Second
+	leasePollInterval = 500 * time.Millisecond
+)
+
+// leaseTracker holds the leases a connection has taken but not yet settled.
+type leaseTracker struct {
+	mutex     sync.Mutex
+	mapLeases map[string]*Lease
+}
+
+// defaultInstanceID identifies this process as a lease owner.
+func defaultInstanceID() string {
+	strHost, _ := os.Hostname()
+	return strHost + ":" + strconv.Itoa(os.Getpid())
+}
+
+// leaseTTL returns the configured lease ttl or the default.
+func (a *connectionAPNS) leaseTTL() time.Duration {
+	if a.options.LeaseTTL > 0 {
+		return a.options.LeaseTTL
+	}
+	return defaultLeaseTTL
+}
+
+// isEnqueueOnly reports whether the connection only produces to a shared queue.
+func (a *connectionAPNS) isEnqueueOnly() bool {
+	return a.options.EnqueueOnly && a.options.SharedQueue != nil
+}
+
+// enqueueShared writes a notification to the shared queue instead of the send channel.
+func (a *connectionAPNS) enqueueShared(n *notification) error {
+	record, err := encodeNotification(n)
+	if err == nil {
+		err = a.options.SharedQueue.Enqueue(a.appID, record)
+	}
+	if err != nil {
+		a.logLevelf(LogWarn, 0, "Shared queue enqueue failed %s\n", err.Error())
+	}
+	return err
+}
+
+// leaseListener leases records from the shared queue into the send channel
+// while the send channel has room, and renews held leases on a heartbeat.
+func (a *connectionAPNS) leaseListener() {
+	defer a.wgWorkers.Done()
+
+	ttl := a.leaseTTL()
+	strOwner := a.options.InstanceID
+	if strOwner == "" {
+		strOwner = defaultInstanceID()
+	}
+	heartbeat := time.NewTicker(ttl / 3)
+	defer heartbeat.Stop()
+
+	for {
+		if len(a.chanSend) < cap(a.chanSend)/2 && !a.pause.isPausedNow() {
+			lease, err := a.options.SharedQueue.Lease(a.appID, strOwner, ttl)
+			if err != nil {
+				a.logLevelf(LogWarn, 0, "Shared queue lease failed %s\n", err.Error())
+			} else if lease != nil {
+				n, err := decodeNotification(lease.Record)
+				if err != nil {
+					// an unreadable record can never be delivered
+					a.logLevelf(LogWarn, 0, "Shared queue record %s dropped %s\n", lease.ID, err.Error())
+					a.options.SharedQueue.Ack(lease)
+					continue
+				}
+				n.lease = lease
+				a.leases.mutex.Lock()
+				a.leases.mapLeases[lease.ID] = lease
+				a.leases.mutex.Unlock()
+				if !a.requeue(n) {
+					a.release(n) // the connection closed; another process takes the lease
+					recycle(n)
+				}
+				continue
+			}
+		}
+
+		select {
+		case <-time.After(leasePollInterval):
+		case <-heartbeat.C:
+			a.renewLeases(ttl)
+		case <-a.chanDone:
+			return
+		}
+	}
+}
+
+// renewLeases extends every held lease and forgets the ones that were lost.
+func (a *connectionAPNS) renewLeases(ttl time.Duration) {
+	a.leases.mutex.Lock()
+	listLeases := make([]*Lease, 0, len(a.leases.mapLeases))
+	for _, lease := range a.leases.mapLeases {
+		listLeases = append(listLeases, lease)
+	}
+	a.leases.mutex.Unlock()
+
+	for _, lease := range listLeases {
+		if err := a.options.SharedQueue.Renew(lease, ttl); err != nil {
+			a.logLevelf(LogWarn, 0, "Shared queue renew %s failed %s\n", lease.ID, err.Error())
+			a.leases.mutex.Lock()
+			delete(a.leases.mapLeases, lease.ID)
+			a.leases.mutex.Unlock()
+		}
+	}
+}
+
+// settle acknowledges a delivered notification that came from the shared queue.
+func (a *connectionAPNS) settle(n *notification) {
+	if n.lease == nil {
+		return
+	}
+	a.release(n)
+	if err := a.options.SharedQueue.Ack(n.lease); err != nil {
+		a.logLevelf(LogWarn, 0, "Shared queue ack %s failed %s\n", n.lease.ID, err.Error())
+	}
+	n.lease = nil // a resend after a close error is local to this process
+}
+
+// release stops renewing a lease so it expires and another process can take it.
+func (a *connectionAPNS) release(n *notification) {
+	if n.lease == nil {
+		return
+	}
+	a.leases.mutex.Lock()
+	delete(a.leases.mapLeases, n.lease.ID)
+	a.leases.mutex.Unlock()
+}
+
+// memoryQueue is an in-process SharedQueue.
+type memoryQueue struct {
+	mutex    sync.Mutex
+	nextID   int64
+	mapItems map[int][]*Lease
+}
+
+// NewMemoryQueue returns a SharedQueue held in process memory.
+// It suits tests and several connections within one process;
+// processes on different hosts need a networked backend.
+func NewMemoryQueue() SharedQueue {
+	return &memoryQueue{mapItems: make(map[int][]*Lease)}
+}
+
+func (q *memoryQueue) Enqueue(appID int, record []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.nextID++
+	q.mapItems[appID] = append(q.mapItems[appID], &Lease{
+		ID:     strconv.FormatInt(q.nextID, 10),
+		AppID:  appID,
+		Record: record,
+	})
+	return nil
+}
+
+func (q *memoryQueue) Lease(appID int, owner string, ttl time.Duration) (*Lease, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	now := time.Now()
+	for _, item := range q.mapItems[appID] {
+		if item.Owner == "" || now.After(item.Expires) {
+			item.Owner = owner
+			item.Expires = now.Add(ttl)
+			lease := *item
+			return &lease, nil
+		}
+	}
+	return nil, nil
+}
+
+func (q *memoryQueue) Renew(lease *Lease, ttl time.Duration) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	item := q.find(lease)
+	if item == nil || item.Owner != lease.Owner {
+		return ErrLeaseLost
+	}
+	item.Expires = time.Now().Add(ttl)
+	lease.Expires = item.Expires
+	return nil
+}
+
+func (q *memoryQueue) Ack(lease *Lease) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	listItems := q.mapItems[lease.AppID]
+	for i, item := range listItems {
+		if item.ID == lease.ID {
+			if item.Owner != lease.Owner {
+				return ErrLeaseLost
+			}
+			q.mapItems[lease.AppID] = append(listItems[:i], listItems[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("lease %s not found", lease.ID)
+}
+
+// find returns the stored item for a lease or nil.
+func (q *memoryQueue) find(lease *Lease) *Lease {
+	for _, item := range q.mapItems[lease.AppID] {
+		if item.ID == lease.ID {
+			return item
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package apnsservice
+
+// This source code includes the socket pool of a connection. Each socket
+// records its connection establishment and send latency. An optional
+// SocketPolicy inspects those stats on an interval and may add or remove
+// sockets or force one to re-dial, for tuning throughput on high-latency links.
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// These bound the number of sockets per connection.
+const (
+	defaultSockets        = 2
+	maxSockets            = 8
+	defaultPolicyInterval = 30 * time.Second
+)
+
+// latencyWeight is the weight of a new sample in the send latency moving average.
+const latencyWeight = 0.2
+
+// SocketStat reports observed latency for one socket.
+type SocketStat struct {
+	SocketID       int           `json:"socketId"`
+	Connected      bool          `json:"connected"`
+	ConnectLatency time.Duration `json:"connectLatency"` // last connection establishment
+	SendLatency    time.Duration `json:"sendLatency"`    // moving average per payload
+	Dials          int64         `json:"dials"`
+	Sent           int64         `json:"sent"`
+	LastConnect    time.Time     `json:"lastConnect"`
+	Failures       int           `json:"failures"` // consecutive transient failures, the backoff level
+}
+
+// SocketAction is a pool change requested by a SocketPolicy.
+type SocketAction int
+
+// These are the pool changes a SocketPolicy may request.
+const (
+	SocketKeep SocketAction = iota
+	SocketAdd
+	SocketRemove
+	SocketRedial
+)
+
+// SocketDecision is the outcome of a SocketPolicy.
+// SocketID names the socket to remove or re-dial.
+type SocketDecision struct {
+	Action   SocketAction
+	SocketID int
+}
+
+// SocketPolicy inspects the stats of every socket in a connection and decides
+// one pool change. It runs on the connection's policy interval.
+type SocketPolicy func(stats []SocketStat) SocketDecision
+
+// socketState is the control and stats block of one socket.
+type socketState struct {
+	mutex      sync.Mutex
+	stat       SocketStat
+	chanStop   chan struct{}
+	chanRedial chan struct{}
+}
+
+// socketPool tracks the live sockets of a connection.
+type socketPool struct {
+	mutex      sync.Mutex
+	mapSockets map[int]*socketState
+}
+
+// recordDial records a connection attempt and its latency.
+func (s *socketState) recordDial(latency time.Duration, isConnected bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stat.Dials++
+	s.stat.Connected = isConnected
+	if isConnected {
+		s.stat.ConnectLatency = latency
+		s.stat.LastConnect = time.Now()
+	}
+}
+
+// recordSend folds a send latency sample into the moving average.
+func (s *socketState) recordSend(latency time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stat.Sent++
+	if s.stat.SendLatency == 0 {
+		s.stat.SendLatency = latency
+	} else {
+		s.stat.SendLatency = time.Duration(float64(s.stat.SendLatency)*(1-latencyWeight) + float64(latency)*latencyWeight)
+	}
+}
+
+// setConnected records whether the socket currently holds a connection
+// and reports whether that changed.
+func (s *socketState) setConnected(isConnected bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if isConnected && !s.stat.Connected {
+		s.stat.LastConnect = time.Now()
+	}
+	isChanged := s.stat.Connected != isConnected
+	s.stat.Connected = isConnected
+	return isChanged
+}
+
+// setFailures records the socket's consecutive transient failures.
+func (s *socketState) setFailures(intFailures int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stat.Failures = intFailures
+}
+
+// addSocket starts one more socket worker if the pool has room.
+func (a *connectionAPNS) addSocket() bool {
+	a.pool.mutex.Lock()
+	defer a.pool.mutex.Unlock()
+
+	socketID := 0
+	for id := 1; id <= maxSockets; id++ {
+		if _, ok := a.pool.mapSockets[id]; !ok {
+			socketID = id
+			break
+		}
+	}
+	if socketID == 0 {
+		return false
+	}
+
+	state := &socketState{
+		stat:       SocketStat{SocketID: socketID},
+		chanStop:   make(chan struct{}),
+		chanRedial: make(chan struct{}, 1),
+	}
+	a.pool.mapSockets[socketID] = state
+
+	a.wgWorkers.Add(1)
+	if a.options.Protocol == ProtocolHTTP2 || a.options.Mock != nil || a.platform != PlatformIOS {
+		state.setConnected(true) // the client dials on demand
+		go a.launchWorkerHTTP2(socketID, state)
+	} else {
+		go a.launchSocket(socketID, state)
+	}
+	return true
+}
+
+// removeSocket stops one socket worker, keeping at least one.
+func (a *connectionAPNS) removeSocket(socketID int) bool {
+	a.pool.mutex.Lock()
+	defer a.pool.mutex.Unlock()
+
+	state, ok := a.pool.mapSockets[socketID]
+	if !ok || len(a.pool.mapSockets) <= 1 {
+		return false
+	}
+	delete(a.pool.mapSockets, socketID)
+	close(state.chanStop)
+	return true
+}
+
+// redialSocket asks one socket worker to drop and re-establish its connection.
+func (a *connectionAPNS) redialSocket(socketID int) bool {
+	a.pool.mutex.Lock()
+	defer a.pool.mutex.Unlock()
+
+	state, ok := a.pool.mapSockets[socketID]
+	if !ok {
+		return false
+	}
+	select {
+	case state.chanRedial <- struct{}{}:
+	default: // a re-dial is already pending
+	}
+	return true
+}
+
+// socketStats returns a snapshot of every socket's stats ordered by socketID.
+func (a *connectionAPNS) socketStats() []SocketStat {
+	a.pool.mutex.Lock()
+	listStats := make([]SocketStat, 0, len(a.pool.mapSockets))
+	for _, state := range a.pool.mapSockets {
+		state.mutex.Lock()
+		listStats = append(listStats, state.stat)
+		state.mutex.Unlock()
+	}
+	a.pool.mutex.Unlock()
+
+	sort.Slice(listStats, func(i, j int) bool {
+		return listStats[i].SocketID < listStats[j].SocketID
+	})
+	return listStats
+}
+
+// monitorSockets applies the connection's SocketPolicy on its interval
+// until the done channel is closed.
+func (a *connectionAPNS) monitorSockets() {
+	defer a.wgWorkers.Done()
+
+	interval := a.options.PolicyInterval
+	if interval <= 0 {
+		interval = defaultPolicyInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			decision := a.options.SocketPolicy(a.socketStats())
+			switch decision.Action {
+			case SocketAdd:
+				if a.addSocket() {
+					a.logPrintln(0, "Socket policy added a socket")
+				}
+			case SocketRemove:
+				if a.removeSocket(decision.SocketID) {
+					a.logPrintln(0, "Socket policy removed socket", decision.SocketID)
+				}
+			case SocketRedial:
+				if a.redialSocket(decision.SocketID) {
+					a.logPrintln(0, "Socket policy re-dialing socket", decision.SocketID)
+				}
+			}
+		case <-a.chanDone:
+			return
+		}
+	}
+}
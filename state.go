@@ -0,0 +1,253 @@
+package apnsservice
+
+// This source code includes exporting and importing the registry. A state
+// snapshot lists every connection with its environment and options but no
+// secrets, only a fingerprint of the credentials. A blue/green deployment
+// exports the live instance, imports the snapshot into the new one with a
+// CertProvider for the secrets, and compares snapshots to find drift.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// State is a snapshot of the registry without secrets.
+type State struct {
+	Exported    time.Time  `json:"exported"`
+	Environment string     `json:"environment"` // EnvironmentProduction or EnvironmentSandbox
+	Apps        []AppState `json:"apps"`
+}
+
+// AppState is one connection in a State.
+type AppState struct {
+	AppID           int               `json:"appId"`
+	StringID        string            `json:"stringId"`
+	Platform        Platform          `json:"platform"`
+	Sandbox         bool              `json:"sandbox"`
+	IsLogging       bool              `json:"isLogging"`
+	KeyID           string            `json:"keyId,omitempty"`
+	TeamID          string            `json:"teamId,omitempty"`
+	CertFingerprint string            `json:"certFingerprint"` // compares credentials without revealing them
+	EgressProfile   string            `json:"egressProfile,omitempty"`
+	State           ConnectionState   `json:"state"`
+	Options         ConnectionOptions `json:"options"` // hooks and stores are not exported
+}
+
+// ExportState returns the registry as State JSON ordered by appID and platform.
+func ExportState() ([]byte, error) {
+	return json.MarshalIndent(currentState(), "", "  ")
+}
+
+// currentState builds the State of the registry.
+func currentState() State {
+	state := State{Exported: time.Now().UTC(), Environment: EnvironmentProduction}
+	if isDevServer {
+		state.Environment = EnvironmentSandbox
+	}
+
+	mutexAPNS.RLock()
+	listConnections := make([]*connectionAPNS, 0, len(mapAPNS))
+	for _, connectionAPNS := range mapAPNS {
+		listConnections = append(listConnections, connectionAPNS)
+	}
+	mutexAPNS.RUnlock()
+
+	mutexEgress.RLock()
+	for _, a := range listConnections {
+		state.Apps = append(state.Apps, AppState{
+			AppID:           a.appID,
+			StringID:        a.stringID,
+			Platform:        a.platform,
+			Sandbox:         a.cert.IsDev != 0,
+			IsLogging:       a.isLogging,
+			KeyID:           a.cert.KeyID,
+			TeamID:          a.cert.TeamID,
+			CertFingerprint: certFingerprint(a.cert),
+			EgressProfile:   mapEgressApps[a.appID],
+			State:           a.connectionStatus().State,
+			Options:         a.options,
+		})
+	}
+	mutexEgress.RUnlock()
+
+	sort.Slice(state.Apps, func(i, j int) bool {
+		if state.Apps[i].AppID != state.Apps[j].AppID {
+			return state.Apps[i].AppID < state.Apps[j].AppID
+		}
+		return state.Apps[i].Platform < state.Apps[j].Platform
+	})
+	return state
+}
+
+// ImportState launches every APNS app in State JSON with credentials fetched
+// from provider, replacing existing connections, and applies the snapshot's
+// environment and egress assignments. Egress profiles must be registered first.
+// A fingerprint that differs from the snapshot is logged but not an error.
+// Android and Web apps need their own credentials and are reported as *AppError.
+func ImportState(data []byte, provider CertProvider) error {
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	switch state.Environment {
+	case EnvironmentProduction, EnvironmentSandbox:
+		InitURLs(state.Environment == EnvironmentSandbox)
+	case "":
+	default:
+		return fmt.Errorf("unknown environment %q", state.Environment)
+	}
+
+	var listErrors []error
+	intLaunched := 0
+	for _, app := range state.Apps {
+		err := importApp(app, provider)
+		if err != nil {
+			listErrors = append(listErrors, &AppError{AppID: app.AppID, StringID: app.StringID, Err: err})
+			continue
+		}
+		intLaunched++
+	}
+	utils.Info.Println("imported", intLaunched, "of", len(state.Apps), "apps from state")
+	return errors.Join(listErrors...)
+}
+
+// importApp launches one app of a State.
+func importApp(app AppState, provider CertProvider) error {
+	if app.Platform != PlatformIOS && app.Platform != "" {
+		return fmt.Errorf("%s apps are not imported", app.Platform)
+	}
+	appCert, err := fetchCert(provider, app.AppID)
+	if err != nil {
+		return err
+	}
+	if app.CertFingerprint != "" && certFingerprint(&appCert) != app.CertFingerprint {
+		utils.Warning.Println("ImportState", app.StringID, "credentials differ from the snapshot")
+	}
+	if app.EgressProfile != "" {
+		if err := AssignEgressProfile(app.AppID, app.EgressProfile); err != nil {
+			return err
+		}
+	}
+	SetConnectionOptions(app.AppID, mergeOptions(lookupOptions(app.AppID), app.Options))
+	return registerConnection(app.AppID, app.StringID, appCert, app.IsLogging, true)
+}
+
+// mergeOptions returns imported options with the hooks and stores already
+// set on the app, which a snapshot cannot carry.
+func mergeOptions(current ConnectionOptions, imported ConnectionOptions) ConnectionOptions {
+	imported.RetryPolicy.Classify = current.RetryPolicy.Classify
+	imported.TokenStore = current.TokenStore
+	imported.BadgeStore = current.BadgeStore
+	imported.PreferenceStore = current.PreferenceStore
+	imported.MuteHandler = current.MuteHandler
+	imported.DeadLetterSink = current.DeadLetterSink
+	imported.AuditSink = current.AuditSink
+	imported.OverflowHandler = current.OverflowHandler
+	imported.UnsentHandler = current.UnsentHandler
+	imported.SocketPolicy = current.SocketPolicy
+	imported.SharedQueue = current.SharedQueue
+	imported.FeedbackLock = current.FeedbackLock
+	imported.Middleware = current.Middleware
+	imported.PayloadValidator = current.PayloadValidator
+	imported.GatewayRootCAs = current.GatewayRootCAs
+	imported.LogWriter = current.LogWriter
+	return imported
+}
+
+// CompareState reports the drift between State JSON exported elsewhere and
+// the local registry. Add means the snapshot has an app missing here and
+// remove means the reverse.
+func CompareState(data []byte) ([]ReloadChange, error) {
+	var other State
+	if err := json.Unmarshal(data, &other); err != nil {
+		return nil, err
+	}
+	local := currentState()
+
+	type stateKey struct {
+		appID    int
+		platform Platform
+	}
+	mapLocal := make(map[stateKey]AppState)
+	for _, app := range local.Apps {
+		mapLocal[stateKey{app.AppID, app.Platform}] = app
+	}
+
+	var listChanges []ReloadChange
+	for _, app := range other.Apps {
+		key := stateKey{app.AppID, app.Platform}
+		appLocal, ok := mapLocal[key]
+		delete(mapLocal, key)
+		if !ok {
+			listChanges = append(listChanges, ReloadChange{AppID: app.AppID, StringID: app.StringID, Action: ReloadAdd, Detail: string(app.Platform)})
+			continue
+		}
+		if appLocal.CertFingerprint != app.CertFingerprint || appLocal.Sandbox != app.Sandbox {
+			listChanges = append(listChanges, ReloadChange{AppID: app.AppID, StringID: app.StringID, Action: ReloadCertChange,
+				Detail: fmt.Sprintf("fingerprint %s -> %s, sandbox %v -> %v", appLocal.CertFingerprint, app.CertFingerprint, appLocal.Sandbox, app.Sandbox)})
+		}
+		if strDetail := stateDiff(appLocal, app); strDetail != "" {
+			listChanges = append(listChanges, ReloadChange{AppID: app.AppID, StringID: app.StringID, Action: ReloadOptionChange, Detail: strDetail})
+		}
+	}
+	for _, app := range mapLocal {
+		listChanges = append(listChanges, ReloadChange{AppID: app.AppID, StringID: app.StringID, Action: ReloadRemove, Detail: string(app.Platform)})
+	}
+	if other.Environment != local.Environment {
+		listChanges = append(listChanges, ReloadChange{Action: ReloadOptionChange,
+			Detail: fmt.Sprintf("environment %s -> %s", local.Environment, other.Environment)})
+	}
+
+	sort.Slice(listChanges, func(i, j int) bool {
+		if listChanges[i].AppID != listChanges[j].AppID {
+			return listChanges[i].AppID < listChanges[j].AppID
+		}
+		return listChanges[i].Action < listChanges[j].Action
+	})
+	return listChanges, nil
+}
+
+// stateDiff names the exported settings that differ between two AppStates or returns "".
+// Options are compared field by field in their JSON form.
+func stateDiff(appLocal AppState, app AppState) string {
+	var listDetail []string
+	if appLocal.StringID != app.StringID {
+		listDetail = append(listDetail, fmt.Sprintf("stringId %s -> %s", appLocal.StringID, app.StringID))
+	}
+	if appLocal.IsLogging != app.IsLogging {
+		listDetail = append(listDetail, fmt.Sprintf("isLogging %v -> %v", appLocal.IsLogging, app.IsLogging))
+	}
+	if appLocal.EgressProfile != app.EgressProfile {
+		listDetail = append(listDetail, fmt.Sprintf("egressProfile %s -> %s", appLocal.EgressProfile, app.EgressProfile))
+	}
+	mapLocal, mapOther := optionFields(appLocal.Options), optionFields(app.Options)
+	listNames := make([]string, 0, len(mapLocal))
+	for strName := range mapLocal {
+		listNames = append(listNames, strName)
+	}
+	sort.Strings(listNames)
+	for _, strName := range listNames {
+		if mapLocal[strName] != mapOther[strName] {
+			listDetail = append(listDetail, fmt.Sprintf("%s %s -> %s", strName, mapLocal[strName], mapOther[strName]))
+		}
+	}
+	return strings.Join(listDetail, ", ")
+}
+
+// optionFields returns the JSON encoding of each exported option keyed by its JSON name.
+func optionFields(opts ConnectionOptions) map[string]string {
+	data, _ := json.Marshal(opts)
+	var mapRaw map[string]json.RawMessage
+	json.Unmarshal(data, &mapRaw)
+	mapFields := make(map[string]string, len(mapRaw))
+	for strName, raw := range mapRaw {
+		mapFields[strName] = string(raw)
+	}
+	return mapFields
+}
@@ -0,0 +1,159 @@
+package apnsservice
+
+// This source code includes the content fingerprint suppressor. It catches
+// duplicate notifications produced by at-least-once upstream pipelines when
+// the caller has no idempotency key to offer. A second suppressor keyed by
+// PushOptions.IdempotencyKey catches retried calls that do offer one.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// ErrDuplicate is returned for a push whose idempotency key was already
+// accepted within the connection's IdempotencyWindow.
+var ErrDuplicate = errors.New("duplicate idempotency key")
+
+// defaultIdempotencyWindow is used when IdempotencyWindow is not set.
+const defaultIdempotencyWindow = 10 * time.Minute
+
+// suppressor remembers recent payload fingerprints for one connection.
+type suppressor struct {
+	mutex     sync.Mutex
+	window    time.Duration
+	mapSeen   map[[sha256.Size]byte]time.Time
+	lastSweep time.Time
+	count     int64
+}
+
+// newSuppressor returns a suppressor for the window or nil if window is not positive.
+func newSuppressor(window time.Duration) *suppressor {
+	if window <= 0 {
+		return nil
+	}
+	return &suppressor{
+		window:    window,
+		mapSeen:   make(map[[sha256.Size]byte]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// isDuplicate records the payload fingerprint and reports whether the same
+// fingerprint was seen within the window. Duplicates are counted. A payload
+// without a fingerprint is never a duplicate and is not recorded.
+func (s *suppressor) isDuplicate(payload *apns.Payload) bool {
+	key, err := fingerprint(payload)
+	if err != nil {
+		return false
+	}
+	return s.claim(key)
+}
+
+// isDuplicateKey is isDuplicate for an idempotency key.
+func (s *suppressor) isDuplicateKey(strKey string) bool {
+	return s.claim(sha256.Sum256([]byte(strKey)))
+}
+
+// forgetKey releases an idempotency key whose push was not accepted,
+// so the caller may retry it.
+func (s *suppressor) forgetKey(strKey string) {
+	s.forget(sha256.Sum256([]byte(strKey)))
+}
+
+// forgetPayload is forgetKey for a payload fingerprint.
+func (s *suppressor) forgetPayload(payload *apns.Payload) {
+	if key, err := fingerprint(payload); err == nil {
+		s.forget(key)
+	}
+}
+
+// forget releases a recorded key.
+func (s *suppressor) forget(key [sha256.Size]byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.mapSeen, key)
+}
+
+// claim records key and reports whether it was seen within the window.
+func (s *suppressor) claim(key [sha256.Size]byte) bool {
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if now.Sub(s.lastSweep) > s.window {
+		for k, seen := range s.mapSeen {
+			if now.Sub(seen) > s.window {
+				delete(s.mapSeen, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if seen, ok := s.mapSeen[key]; ok && now.Sub(seen) <= s.window {
+		s.count++
+		return true
+	}
+	s.mapSeen[key] = now
+	return false
+}
+
+// suppressedCount returns the duplicates both suppressors of a connection caught.
+func (a *connectionAPNS) suppressedCount() int64 {
+	var count int64
+	for _, s := range []*suppressor{a.suppressor, a.idempotency} {
+		if s != nil {
+			count += s.suppressedCount()
+		}
+	}
+	return count
+}
+
+// suppressedCount returns the number of duplicates suppressed so far.
+func (s *suppressor) suppressedCount() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.count
+}
+
+// fingerprint hashes the token and every field sameBody compares, so pushes
+// that differ only in their badge, sound or localization are not duplicates.
+// json.Marshal sorts map keys so equal custom data hashes equally. Custom data
+// that cannot be marshalled returns an error, since it would hash as empty.
+func fingerprint(payload *apns.Payload) ([sha256.Size]byte, error) {
+	var key [sha256.Size]byte
+	extra, err := json.Marshal(payload.ExtraData)
+	if err != nil {
+		return key, err
+	}
+	locArgs, err := json.Marshal(payload.LocArgs)
+	if err != nil {
+		return key, err
+	}
+	h := sha256.New()
+	for _, strField := range []string{
+		payload.Token, payload.AlertText, payload.ActionLocKey, payload.LocKey,
+		payload.LaunchImage, payload.Sound, payload.Category,
+	} {
+		h.Write([]byte(strField))
+		h.Write([]byte{0})
+	}
+	var badge [9]byte
+	if payload.Badge.IsSet() {
+		badge[0] = 1
+		binary.BigEndian.PutUint32(badge[1:5], payload.Badge.Number())
+	}
+	binary.BigEndian.PutUint32(badge[5:], uint32(payload.ContentAvailable))
+	h.Write(badge[:])
+	h.Write(locArgs)
+	h.Write([]byte{0})
+	h.Write(extra)
+	copy(key[:], h.Sum(nil))
+	return key, nil
+}
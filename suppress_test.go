@@ -0,0 +1,97 @@
+package apnsservice
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+func TestSuppressorComparesWholeBody(t *testing.T) {
+	s := newSuppressor(time.Minute)
+	payload := apns.Payload{Token: testToken(1), AlertText: "hi", LocKey: "GREETING"}
+	if s.isDuplicate(&payload) {
+		t.Fatal("first push suppressed")
+	}
+	if !s.isDuplicate(&payload) {
+		t.Fatal("identical push not suppressed")
+	}
+
+	for _, variant := range []func(p *apns.Payload){
+		func(p *apns.Payload) { p.Badge = apns.NewBadgeNumber(3) },
+		func(p *apns.Payload) { p.Badge = apns.NewBadgeNumber(0) },
+		func(p *apns.Payload) { p.Sound = "default" },
+		func(p *apns.Payload) { p.Category = "REPLY" },
+		func(p *apns.Payload) { p.ContentAvailable = 1 },
+		func(p *apns.Payload) { p.LocArgs = []string{"Ann"} },
+		func(p *apns.Payload) { p.LocKey = "FAREWELL" },
+	} {
+		payloadVariant := payload
+		variant(&payloadVariant)
+		if s.isDuplicate(&payloadVariant) {
+			t.Errorf("variant %+v suppressed as a duplicate", payloadVariant)
+		}
+	}
+}
+
+func TestRefusedPushIsNotSuppressed(t *testing.T) {
+	const appID = 9201
+	transport := NewMockTransport()
+	SetConnectionOptions(appID, ConnectionOptions{
+		SuppressionWindow: time.Minute,
+		RateLimit:         RateLimit{PerSecond: 10, Burst: 1, Drop: true},
+	})
+	if err := LaunchConnectionWithTransport(appID, "suppress", transport, false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+
+	if err := PushOne(appID, apns.Payload{Token: testToken(1), AlertText: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	payload := apns.Payload{Token: testToken(2), AlertText: "second"}
+	if err := PushOne(appID, payload); err != ErrRateLimited {
+		t.Fatalf("got %v, want ErrRateLimited", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err := PushOne(appID, payload); err != nil {
+		t.Fatal(err)
+	}
+	if !transport.WaitForSent(2, time.Second) {
+		t.Fatalf("sent %d, want the retried push delivered", len(transport.Sent()))
+	}
+}
+
+func TestUnmarshallablePayloadIsNotSuppressed(t *testing.T) {
+	s := newSuppressor(time.Minute)
+	payload := apns.Payload{Token: testToken(1), ExtraData: map[string]interface{}{"ratio": math.Inf(1)}}
+	if s.isDuplicate(&payload) || s.isDuplicate(&payload) {
+		t.Fatal("payload without a fingerprint suppressed as a duplicate")
+	}
+}
+
+func TestMutedPushIsNotRecorded(t *testing.T) {
+	const appID = 9202
+	store := NewMemoryPreferenceStore()
+	store.SetPreferences(appID, "u1", Preferences{OptOut: []string{"promo"}})
+	transport := NewMockTransport()
+	SetConnectionOptions(appID, ConnectionOptions{SuppressionWindow: time.Minute, PreferenceStore: store})
+	if err := LaunchConnectionWithTransport(appID, "muted", transport, false); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveApp(appID)
+
+	payload := apns.Payload{Token: testToken(1), AlertText: "sale"}
+	opts := PushOptions{IdempotencyKey: "sale-1", Class: "promo", UserID: "u1"}
+	if err := PushWithOptions(appID, PlatformIOS, payload, opts); err != nil {
+		t.Fatal(err)
+	}
+	store.SetPreferences(appID, "u1", Preferences{})
+	if err := PushWithOptions(appID, PlatformIOS, payload, opts); err != nil {
+		t.Fatalf("push after opting back in = %v, want it accepted", err)
+	}
+	if !transport.WaitForSent(1, time.Second) {
+		t.Fatal("push after opting back in was not sent")
+	}
+}
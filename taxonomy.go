@@ -0,0 +1,135 @@
+package apnsservice
+
+// This source code includes the notification taxonomy. Callers tag each push
+// with a class such as order_update, marketing or security in PushOptions.Class.
+// The class is counted in per-class stats and copied into dead-letter records,
+// so reporting and policy can work per notification class rather than per app.
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ClassUnclassified is the class reported for pushes sent without one.
+const ClassUnclassified = "unclassified"
+
+// maxClassLength caps the length of a class name in bytes.
+const maxClassLength = 64
+
+// ClassStat counts the outcomes of one notification class.
+type ClassStat struct {
+	Class      string `json:"class"`
+	Pushed     int64  `json:"pushed"`     // accepted by PushOne and friends
+	Suppressed int64  `json:"suppressed"` // dropped as duplicates
+	Sent       int64  `json:"sent"`       // handed to Apple
+	Rejected   int64  `json:"rejected"`   // rejected by Apple and dead-lettered
+	Expired    int64  `json:"expired"`    // dropped after the deadline passed
+	Muted      int64  `json:"muted"`      // dropped by the user's preferences
+}
+
+// classEvent is one outcome counted in a ClassStat.
+type classEvent int
+
+const (
+	classPushed classEvent = iota
+	classSuppressed
+	classSent
+	classRejected
+	classExpired
+	classMuted
+)
+
+// classStats holds the per-class counters of one connection.
+type classStats struct {
+	mutex    sync.Mutex
+	mapStats map[string]*ClassStat
+}
+
+// newClassStats returns empty per-class counters.
+func newClassStats() *classStats {
+	return &classStats{mapStats: make(map[string]*ClassStat)}
+}
+
+// count records one event for a class. A nil classStats counts nothing.
+func (c *classStats) count(strClass string, event classEvent) {
+	if c == nil {
+		return
+	}
+	if strClass == "" {
+		strClass = ClassUnclassified
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stat, ok := c.mapStats[strClass]
+	if !ok {
+		stat = &ClassStat{Class: strClass}
+		c.mapStats[strClass] = stat
+	}
+	switch event {
+	case classPushed:
+		stat.Pushed++
+	case classSuppressed:
+		stat.Suppressed++
+	case classSent:
+		stat.Sent++
+	case classRejected:
+		stat.Rejected++
+	case classExpired:
+		stat.Expired++
+	case classMuted:
+		stat.Muted++
+	}
+}
+
+// snapshot returns a copy of the counters sorted by class.
+func (c *classStats) snapshot() []ClassStat {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	listStats := make([]ClassStat, 0, len(c.mapStats))
+	for _, stat := range c.mapStats {
+		listStats = append(listStats, *stat)
+	}
+	c.mutex.Unlock()
+	sort.Slice(listStats, func(i, j int) bool {
+		return listStats[i].Class < listStats[j].Class
+	})
+	return listStats
+}
+
+// validateClass checks a class name and, when the app declares its taxonomy
+// in ConnectionOptions.Classes, that the class is one of them.
+func validateClass(strClass string, listClasses []string) error {
+	if strClass == "" {
+		return nil
+	}
+	if len(strClass) > maxClassLength {
+		return fmt.Errorf("class exceeds %d bytes", maxClassLength)
+	}
+	for _, r := range strClass {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.') {
+			return fmt.Errorf("class %q may only use a-z, 0-9, _, - and .", strClass)
+		}
+	}
+	if len(listClasses) == 0 {
+		return nil
+	}
+	for _, strAllowed := range listClasses {
+		if strAllowed == strClass {
+			return nil
+		}
+	}
+	return fmt.Errorf("class %q is not in the app's taxonomy", strClass)
+}
+
+// ClassStats returns the per-class counters for the specified app
+// since its connection was launched.
+func ClassStats(appID int) []ClassStat {
+	connectionAPNS := getConnection(appID)
+	if connectionAPNS == nil {
+		return nil
+	}
+	return connectionAPNS.classes.snapshot()
+}
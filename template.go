@@ -0,0 +1,139 @@
+package apnsservice
+
+// This source code includes the notification template registry. A template
+// is defined once with a default body and optional bodies per locale, written
+// in Go text/template syntax. Alternatively a loc-key template sends Apple's
+// loc-key and loc-args so the device localizes the text from its bundle.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// ErrTemplateNotFound is returned for an unregistered template name.
+var ErrTemplateNotFound = errors.New("template is not registered")
+
+// notificationTemplate holds the parsed bodies of one template keyed by
+// locale, with the default body under "". A loc-key template has locKey set instead.
+type notificationTemplate struct {
+	mapBodies   map[string]*template.Template
+	locKey      string
+	listArgKeys []string // vars copied into loc-args in order
+}
+
+// mapTemplates stores registered templates keyed by name.
+var (
+	mutexTemplates sync.RWMutex
+	mapTemplates   = make(map[string]*notificationTemplate)
+)
+
+// RegisterTemplate registers or replaces the default body of a template.
+// The body uses text/template syntax; a var it names but PushTemplate does
+// not supply is an error.
+func RegisterTemplate(name string, body string) error {
+	return RegisterTemplateLocale(name, "", body)
+}
+
+// RegisterTemplateLocale registers or replaces the body of a template for a
+// locale such as "fr" or "pt-BR". An empty locale sets the default body.
+func RegisterTemplateLocale(name string, locale string, body string) error {
+	parsed, err := template.New(name).Option("missingkey=error").Parse(body)
+	if err != nil {
+		return err
+	}
+	mutexTemplates.Lock()
+	defer mutexTemplates.Unlock()
+	t := mapTemplates[name]
+	if t == nil || t.locKey != "" {
+		t = &notificationTemplate{mapBodies: make(map[string]*template.Template)}
+		mapTemplates[name] = t
+	}
+	t.mapBodies[normalizeLocale(locale)] = parsed
+	return nil
+}
+
+// RegisterLocKeyTemplate registers or replaces a template that sends locKey
+// with the values of argKeys from vars as loc-args. The device looks locKey
+// up in the app's Localizable.strings, so locale is not used.
+func RegisterLocKeyTemplate(name string, locKey string, argKeys ...string) error {
+	if locKey == "" {
+		return errors.New("loc-key is required")
+	}
+	mutexTemplates.Lock()
+	defer mutexTemplates.Unlock()
+	mapTemplates[name] = &notificationTemplate{locKey: locKey, listArgKeys: argKeys}
+	return nil
+}
+
+// RenderTemplate renders a template for token in locale without pushing it.
+// The body for the exact locale is preferred, then its language, then the default.
+func RenderTemplate(token string, templateName string, vars map[string]interface{}, locale string) (apns.Payload, error) {
+	mutexTemplates.RLock()
+	t := mapTemplates[templateName]
+	mutexTemplates.RUnlock()
+	if t == nil {
+		return apns.Payload{}, fmt.Errorf("%s: %w", templateName, ErrTemplateNotFound)
+	}
+
+	payload := apns.Payload{Token: token}
+	if t.locKey != "" {
+		payload.LocKey = t.locKey
+		for _, strKey := range t.listArgKeys {
+			value, ok := vars[strKey]
+			if !ok {
+				return apns.Payload{}, fmt.Errorf("%s: missing var %s", templateName, strKey)
+			}
+			payload.LocArgs = append(payload.LocArgs, fmt.Sprint(value))
+		}
+		return payload, nil
+	}
+
+	body := t.body(locale)
+	if body == nil {
+		return apns.Payload{}, fmt.Errorf("%s has no body for locale %q", templateName, locale)
+	}
+	var sb strings.Builder
+	if err := body.Execute(&sb, vars); err != nil {
+		return apns.Payload{}, err
+	}
+	payload.AlertText = sb.String()
+	return payload, nil
+}
+
+// PushTemplate renders a template for token in locale and pushes it for the specified app.
+func PushTemplate(appID int, token string, templateName string, vars map[string]interface{}, locale string) error {
+	payload, err := RenderTemplate(token, templateName, vars, locale)
+	if err != nil {
+		utils.Warning.Println("PushTemplate", appID, err.Error())
+		return err
+	}
+	return PushOneWithOptions(appID, payload, PushOptions{})
+}
+
+// body returns the body for locale, falling back to its language and then the default.
+// It takes the registry lock because RegisterTemplateLocale adds to mapBodies.
+func (t *notificationTemplate) body(locale string) *template.Template {
+	mutexTemplates.RLock()
+	defer mutexTemplates.RUnlock()
+	strLocale := normalizeLocale(locale)
+	if body, ok := t.mapBodies[strLocale]; ok {
+		return body
+	}
+	if i := strings.Index(strLocale, "-"); i > 0 {
+		if body, ok := t.mapBodies[strLocale[:i]]; ok {
+			return body
+		}
+	}
+	return t.mapBodies[""]
+}
+
+// normalizeLocale lowercases a locale and uses - as its separator, so "pt_BR" matches "pt-BR".
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
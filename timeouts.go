@@ -0,0 +1,84 @@
+package apnsservice
+
+// This source code includes the connection timeouts. ConnectionOptions tune
+// how long a dial may take, how sockets are kept alive, when an idle socket
+// is re-dialed and how long a binary socket buffers payloads before a write.
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// These are the defaults of the timeout options.
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultKeepAlive      = 30 * time.Second
+)
+
+// connectTimeout returns ConnectTimeout or its default.
+func (o ConnectionOptions) connectTimeout() time.Duration {
+	if o.ConnectTimeout <= 0 {
+		return defaultConnectTimeout
+	}
+	return o.ConnectTimeout
+}
+
+// keepAlive returns KeepAlive or its default. A negative KeepAlive is kept
+// because it disables keepalive probes.
+func (o ConnectionOptions) keepAlive() time.Duration {
+	if o.KeepAlive == 0 {
+		return defaultKeepAlive
+	}
+	return o.KeepAlive
+}
+
+// dialGateway opens a TCP connection to address, through egress if it is not
+// nil, within the options' connect timeout and with their keepalive.
+func dialGateway(ctx context.Context, egress *EgressProfile, options ConnectionOptions, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, options.connectTimeout())
+	defer cancel()
+	if egress != nil {
+		return egress.dial(ctx, address, options.keepAlive())
+	}
+	d := &net.Dialer{KeepAlive: options.keepAlive()}
+	return d.DialContext(ctx, "tcp", address)
+}
+
+// applyTimeouts copies the timeout options into the binary protocol config.
+// Unset options keep the library defaults.
+func (a *connectionAPNS) applyTimeouts() {
+	if a.options.ConnectTimeout > 0 {
+		intSeconds := int((a.options.ConnectTimeout + time.Second - 1) / time.Second)
+		a.cfgAPNS.SocketTimeout = intSeconds
+		a.cfgAPNS.TlsTimeout = intSeconds
+		a.cfgFeedback.SocketTimeout = intSeconds
+		a.cfgFeedback.TlsTimeout = intSeconds
+	}
+	if a.options.FlushInterval > 0 {
+		a.cfgAPNS.FramingTimeout = int(a.options.FlushInterval / time.Millisecond)
+		if a.cfgAPNS.FramingTimeout == 0 {
+			a.cfgAPNS.FramingTimeout = 1
+		}
+	}
+}
+
+// dialsItself reports whether binary sockets are dialed by the service
+// rather than the library, which has no keepalive or proxy support.
+func (a *connectionAPNS) dialsItself() bool {
+	return a.egress != nil || a.options.KeepAlive != 0
+}
+
+// resetTimer restarts t for d. A nil timer is ignored.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if t == nil {
+		return
+	}
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
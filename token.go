@@ -0,0 +1,93 @@
+package apnsservice
+
+// This source code includes token-based authentication for the HTTP/2
+// provider API. A connection whose AppCert carries a p8 auth key signs a
+// short-lived ES256 JSON web token and sends it as the bearer token on each
+// request. Apple rejects tokens older than an hour, so the token is refreshed
+// well before that.
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// tokenRefresh is how long a signed token is reused.
+const tokenRefresh = 50 * time.Minute
+
+// tokenSigner signs and caches the provider authentication token of one app.
+type tokenSigner struct {
+	mutex  sync.Mutex
+	key    *ecdsa.PrivateKey
+	keyID  string
+	teamID string
+	token  string
+	issued time.Time
+}
+
+// hasAuthKey reports whether the cert carries token-based credentials.
+func (c *AppCert) hasAuthKey() bool {
+	return len(c.AuthKey) > 0
+}
+
+// newTokenSigner parses the p8 auth key of an AppCert.
+func newTokenSigner(appCert *AppCert) (*tokenSigner, error) {
+	if appCert.KeyID == "" || appCert.TeamID == "" {
+		return nil, errors.New("token authentication requires keyId and teamId")
+	}
+	block, _ := pem.Decode(appCert.AuthKey)
+	if block == nil {
+		return nil, errors.New("auth key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("auth key is not an ECDSA key")
+	}
+	return &tokenSigner{key: key, keyID: appCert.KeyID, teamID: appCert.TeamID}, nil
+}
+
+// bearer returns a current token, signing a new one when the cached one is due.
+func (s *tokenSigner) bearer() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if s.token != "" && now.Sub(s.issued) < tokenRefresh {
+		return s.token, nil
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": s.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": s.teamID, "iat": now.Unix()})
+	strSigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(strSigned))
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	fillBigEndian(signature[:32], r)
+	fillBigEndian(signature[32:], sig)
+
+	s.token = strSigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	s.issued = now
+	return s.token, nil
+}
+
+// fillBigEndian writes n right aligned into buf as JWS requires for ES256.
+func fillBigEndian(buf []byte, n *big.Int) {
+	b := n.Bytes()
+	copy(buf[len(buf)-len(b):], b)
+}
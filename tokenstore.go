@@ -0,0 +1,119 @@
+package apnsservice
+
+// This source code includes the token store integration. An app whose options
+// name a TokenStore has its device bookkeeping done by the service: tokens
+// reported by the feedback service or rejected as invalid are removed, other
+// rejections are marked as failures, and PushToUser resolves a user's tokens.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// TokenStore is the caller's registry of device tokens.
+// Its methods are called from connection workers and must be safe for concurrent use.
+type TokenStore interface {
+	// LookupTokens returns the device tokens registered to a user.
+	LookupTokens(appID int, userID string) ([]string, error)
+	// RemoveToken forgets a token Apple reported as invalid or uninstalled.
+	RemoveToken(appID int, token string) error
+	// MarkFailed records a rejection that does not invalidate the token.
+	MarkFailed(appID int, token string, reason string) error
+}
+
+// binaryStatusInvalidToken is the binary protocol status of an invalid token.
+const binaryStatusInvalidToken = 8
+
+// isInvalidToken reports whether a rejection means the token will never work again.
+func isInvalidToken(strReason string, intStatus int) bool {
+	switch strReason {
+	case "BadDeviceToken", "Unregistered", "DeviceTokenNotForTopic",
+		"UNREGISTERED", "SENDER_ID_MISMATCH", ReasonSubscriptionGone:
+		return true
+	}
+	return intStatus == binaryStatusInvalidToken || intStatus == http.StatusGone
+}
+
+// updateTokenStore reports a rejected token to the app's token store,
+// publishes invalid tokens to feedback subscribers and unsubscribes them from topics.
+func (a *connectionAPNS) updateTokenStore(socketID int, strToken string, strReason string, intStatus int) {
+	isInvalid := isInvalidToken(strReason, intStatus)
+	if isInvalid {
+		feedback := Feedback{AppID: a.appID, Token: strToken, Reason: strReason, Timestamp: time.Now()}
+		a.rememberBadToken(feedback)
+		publishFeedback(feedback)
+		a.publishEvent(ConnectionEvent{Type: EventFeedback, SocketID: socketID, Reason: strReason, Status: intStatus, Token: strToken})
+		removeSubscriptions(a.appID, strToken)
+	}
+	store := a.options.TokenStore
+	if store == nil {
+		return
+	}
+	var err error
+	if isInvalid {
+		err = store.RemoveToken(a.appID, strToken)
+	} else {
+		err = store.MarkFailed(a.appID, strToken, strReason)
+	}
+	if err != nil {
+		a.logLevelf(LogWarn, socketID, "TokenStore %s %s\n", strToken, err.Error())
+	}
+}
+
+// removeFeedbackToken caches, publishes and removes a token reported by the feedback service.
+func (a *connectionAPNS) removeFeedbackToken(strToken string, timestamp time.Time) {
+	feedback := Feedback{AppID: a.appID, Token: strToken, Reason: ReasonFeedback, Timestamp: timestamp}
+	a.rememberBadToken(feedback)
+	publishFeedback(feedback)
+	a.publishEvent(ConnectionEvent{Type: EventFeedback, Reason: ReasonFeedback, Token: strToken})
+	removeSubscriptions(a.appID, strToken)
+	if a.options.TokenStore == nil {
+		return
+	}
+	if err := a.options.TokenStore.RemoveToken(a.appID, strToken); err != nil {
+		utils.Warning.Println("TokenStore.RemoveToken", a.stringID, err.Error())
+	}
+}
+
+// PushToUser pushes payload to every device token the app's token store
+// holds for userID and returns the number of tokens pushed.
+// Tokens in the bad token cache are skipped.
+func PushToUser(appID int, userID string, payload apns.Payload) (int, error) {
+	connectionAPNS, err := lookupActive(appID)
+	if err != nil {
+		return 0, err
+	}
+	store := connectionAPNS.options.TokenStore
+	if store == nil {
+		return 0, errors.New("app has no token store")
+	}
+	listTokens, err := store.LookupTokens(appID, userID)
+	if err != nil {
+		utils.Warning.Println("TokenStore.LookupTokens", connectionAPNS.stringID, err.Error())
+		return 0, err
+	}
+	intPushed := 0
+	cache := &bodyCache{}
+	for _, strToken := range listTokens {
+		payloadToken := payload
+		payloadToken.Token = strToken
+		opts := PushOptions{UserID: userID}
+		body, err := connectionAPNS.prepare(context.Background(), &payloadToken, &opts, cache)
+		if errors.Is(err, ErrKnownBadToken) {
+			continue
+		}
+		if err != nil {
+			return intPushed, err
+		}
+		if err := connectionAPNS.pushOne(&payloadToken, &opts, body); err != nil {
+			return intPushed, err
+		}
+		intPushed++
+	}
+	return intPushed, nil
+}
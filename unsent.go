@@ -0,0 +1,105 @@
+package apnsservice
+
+// This source code includes unsent payload recovery. When Apple closes a
+// binary connection, the payloads written after the one it rejected were
+// never processed. The service replays those it still holds in its resend
+// cache, whose size is set per connection; an UnsentHandler sees the complete
+// list so an application can persist or re-route bursts larger than the cache.
+// Every overflow is counted in ConnectionStatus and reported to the OverflowHandler.
+
+import (
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// UnsentBatch describes the payloads left unsent when Apple closed a binary connection.
+type UnsentBatch struct {
+	AppID        int
+	StringID     string
+	SocketID     int
+	ErrorStatus  int           // Apple's binary status code, 0 if Apple gave none
+	ErrorReason  string        // Apple's error string, empty if Apple gave none
+	ErrorPayload *apns.Payload // the payload Apple rejected, or nil
+	Unsent       []apns.Payload
+	Overflow     bool // more payloads were unsent than the library could track
+	Time         time.Time
+}
+
+// UnsentHandler receives every UnsentBatch of a connection. It is called
+// from the socket worker, so it should return quickly. Returning true takes
+// responsibility for the unsent payloads: the service then neither replays
+// them from its resend cache nor dead-letters those that overflowed it.
+// The rejected ErrorPayload is dead-lettered either way.
+type UnsentHandler func(batch *UnsentBatch) bool
+
+// newUnsentBatch copies a close error into an UnsentBatch.
+func newUnsentBatch(a *connectionAPNS, socketID int, closeError *apns.ConnectionClose) *UnsentBatch {
+	batch := &UnsentBatch{
+		AppID:        a.appID,
+		StringID:     a.stringID,
+		SocketID:     socketID,
+		ErrorPayload: closeError.ErrorPayload,
+		Overflow:     closeError.UnsentPayloadBufferOverflow,
+		Time:         time.Now(),
+	}
+	if closeError.Error != nil {
+		batch.ErrorStatus = int(closeError.Error.Status)
+		batch.ErrorReason = closeError.Error.ErrorString
+	}
+	if closeError.UnsentPayloads != nil {
+		batch.Unsent = make([]apns.Payload, 0, closeError.UnsentPayloads.Len())
+		for e := closeError.UnsentPayloads.Front(); e != nil; e = e.Next() {
+			if payload, ok := e.Value.(*apns.Payload); ok {
+				batch.Unsent = append(batch.Unsent, *payload)
+			}
+		}
+	}
+	return batch
+}
+
+// defaultPayloadCacheSize is the resend cache size of a binary socket
+// when PayloadCacheSize is not set.
+const defaultPayloadCacheSize = 32
+
+// CacheOverflow reports unsent payloads a binary socket could not replay.
+// Dropped counts those older than the resend cache, which are dead-lettered.
+// LibraryOverflow means more payloads were unsent than the library tracked,
+// so some were lost without a record.
+type CacheOverflow struct {
+	AppID           int
+	StringID        string
+	SocketID        int
+	Unsent          int
+	CacheSize       int
+	Dropped         int
+	LibraryOverflow bool
+}
+
+// OverflowHandler hears about every CacheOverflow of a connection, for
+// tuning PayloadCacheSize. It is called from the socket worker, so it should return quickly.
+type OverflowHandler func(overflow CacheOverflow)
+
+// reportOverflow counts, logs and reports a resend cache overflow.
+func (a *connectionAPNS) reportOverflow(socketID int, intUnsent int, intCacheSize int, intDropped int, isLibraryOverflow bool) {
+	if a.health != nil {
+		a.health.mutex.Lock()
+		a.health.overflows += int64(intDropped)
+		a.health.mutex.Unlock()
+	}
+	a.queue.add(&a.queue.dropped, intDropped)
+	utils.Warning.Printf("%s socket %d unsent payload overflow: unsent=%d cache=%d dropped=%d library=%v\n",
+		a.stringID, socketID, intUnsent, intCacheSize, intDropped, isLibraryOverflow)
+	if a.options.OverflowHandler != nil {
+		a.options.OverflowHandler(CacheOverflow{
+			AppID:           a.appID,
+			StringID:        a.stringID,
+			SocketID:        socketID,
+			Unsent:          intUnsent,
+			CacheSize:       intCacheSize,
+			Dropped:         intDropped,
+			LibraryOverflow: isLibraryOverflow,
+		})
+	}
+}
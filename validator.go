@@ -0,0 +1,353 @@
+package apnsservice
+
+// This source code includes the custom data validators. An app may declare a
+// JSON Schema for the custom keys of its payloads, a callback, or both, and a
+// push whose custom data fails them is refused before it is enqueued, so a
+// malformed key is caught here rather than by the app on the device.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// ErrInvalidPayload is matched by pushes refused by an app's payload validators.
+var ErrInvalidPayload = errors.New("invalid custom data")
+
+// PayloadValidator checks the custom data of a push, without the reserved aps
+// key, and returns an error to refuse it. It is called from the pushing
+// goroutine and must be safe for concurrent use.
+type PayloadValidator func(extraData map[string]interface{}) error
+
+// ValidationError reports custom data that fails an app's payload schema.
+// Path locates the offending value, such as "order.items[2].sku".
+type ValidationError struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// Is matches ErrInvalidPayload.
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidPayload
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("invalid custom data: %s", e.Reason)
+	}
+	return fmt.Sprintf("invalid custom data: %s %s", e.Path, e.Reason)
+}
+
+// payloadSchema is a compiled JSON Schema. It supports the keywords custom
+// data needs: type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, minLength, maxLength, pattern, minimum and maximum.
+// Other keywords are ignored.
+type payloadSchema struct {
+	listTypes            []string
+	listEnum             []interface{}
+	valueConst           interface{}
+	hasConst             bool
+	mapProperties        map[string]*payloadSchema
+	listRequired         []string
+	isClosed             bool           // additionalProperties is false
+	additionalProperties *payloadSchema // schema of keys missing from properties
+	items                *payloadSchema
+	minItems, maxItems   *int
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+	minimum, maximum     *float64
+}
+
+// rawSchema is the JSON form of a payloadSchema.
+type rawSchema struct {
+	Type                 json.RawMessage            `json:"type"`
+	Enum                 []interface{}              `json:"enum"`
+	Const                json.RawMessage            `json:"const"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+	Items                json.RawMessage            `json:"items"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Pattern              string                     `json:"pattern"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+}
+
+// compileSchema parses a JSON Schema. An empty schema returns nil.
+func compileSchema(data json.RawMessage) (*payloadSchema, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	schema, err := parseSchema(data, "")
+	if err != nil {
+		return nil, fmt.Errorf("payload schema: %w", err)
+	}
+	return schema, nil
+}
+
+// parseSchema parses the schema at strPath of the document.
+func parseSchema(data json.RawMessage, strPath string) (*payloadSchema, error) {
+	var raw rawSchema
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", schemaPath(strPath), err)
+	}
+	schema := &payloadSchema{
+		listEnum:     raw.Enum,
+		listRequired: raw.Required,
+		minItems:     raw.MinItems,
+		maxItems:     raw.MaxItems,
+		minLength:    raw.MinLength,
+		maxLength:    raw.MaxLength,
+		minimum:      raw.Minimum,
+		maximum:      raw.Maximum,
+	}
+
+	if len(raw.Type) > 0 {
+		var strType string
+		if err := json.Unmarshal(raw.Type, &strType); err == nil {
+			schema.listTypes = []string{strType}
+		} else if err := json.Unmarshal(raw.Type, &schema.listTypes); err != nil {
+			return nil, fmt.Errorf("%s: type must be a string or a list of strings", schemaPath(strPath))
+		}
+		for _, strType := range schema.listTypes {
+			switch strType {
+			case "object", "array", "string", "number", "integer", "boolean", "null":
+			default:
+				return nil, fmt.Errorf("%s: unknown type %q", schemaPath(strPath), strType)
+			}
+		}
+	}
+	if len(raw.Const) > 0 {
+		schema.hasConst = true
+		if err := json.Unmarshal(raw.Const, &schema.valueConst); err != nil {
+			return nil, fmt.Errorf("%s: %w", schemaPath(strPath), err)
+		}
+	}
+	if raw.Pattern != "" {
+		pattern, err := regexp.Compile(raw.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", schemaPath(strPath), err)
+		}
+		schema.pattern = pattern
+	}
+
+	if len(raw.Properties) > 0 {
+		schema.mapProperties = make(map[string]*payloadSchema, len(raw.Properties))
+		for strKey, rawProperty := range raw.Properties {
+			property, err := parseSchema(rawProperty, joinPath(strPath, strKey))
+			if err != nil {
+				return nil, err
+			}
+			schema.mapProperties[strKey] = property
+		}
+	}
+	switch strings.TrimSpace(string(raw.AdditionalProperties)) {
+	case "", "true":
+	case "false":
+		schema.isClosed = true
+	default:
+		additional, err := parseSchema(raw.AdditionalProperties, joinPath(strPath, "*"))
+		if err != nil {
+			return nil, err
+		}
+		schema.additionalProperties = additional
+	}
+	if len(raw.Items) > 0 {
+		items, err := parseSchema(raw.Items, strPath+"[]")
+		if err != nil {
+			return nil, err
+		}
+		schema.items = items
+	}
+	return schema, nil
+}
+
+// validate checks a decoded JSON value against the schema.
+func (s *payloadSchema) validate(value interface{}, strPath string) error {
+	if len(s.listTypes) > 0 && !s.matchesType(value) {
+		return &ValidationError{Path: strPath, Reason: fmt.Sprintf("is %s, want %s", jsonType(value), strings.Join(s.listTypes, " or "))}
+	}
+	if s.hasConst && !jsonEqual(value, s.valueConst) {
+		return &ValidationError{Path: strPath, Reason: fmt.Sprintf("must be %v", s.valueConst)}
+	}
+	if len(s.listEnum) > 0 {
+		isFound := false
+		for _, valueEnum := range s.listEnum {
+			if jsonEqual(value, valueEnum) {
+				isFound = true
+				break
+			}
+		}
+		if !isFound {
+			return &ValidationError{Path: strPath, Reason: fmt.Sprintf("%v is not one of %v", value, s.listEnum)}
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, strKey := range s.listRequired {
+			if _, ok := v[strKey]; !ok {
+				return &ValidationError{Path: joinPath(strPath, strKey), Reason: "is required"}
+			}
+		}
+		listKeys := make([]string, 0, len(v))
+		for strKey := range v {
+			listKeys = append(listKeys, strKey)
+		}
+		sort.Strings(listKeys) // report the same key first on every push
+		for _, strKey := range listKeys {
+			property, ok := s.mapProperties[strKey]
+			switch {
+			case ok:
+			case s.isClosed:
+				return &ValidationError{Path: joinPath(strPath, strKey), Reason: "is not allowed"}
+			case s.additionalProperties != nil:
+				property = s.additionalProperties
+			default:
+				continue
+			}
+			if err := property.validate(v[strKey], joinPath(strPath, strKey)); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			return &ValidationError{Path: strPath, Reason: fmt.Sprintf("has %d items, want at least %d", len(v), *s.minItems)}
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			return &ValidationError{Path: strPath, Reason: fmt.Sprintf("has %d items, want at most %d", len(v), *s.maxItems)}
+		}
+		if s.items != nil {
+			for i, item := range v {
+				if err := s.items.validate(item, fmt.Sprintf("%s[%d]", strPath, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		intLength := utf8.RuneCountInString(v)
+		if s.minLength != nil && intLength < *s.minLength {
+			return &ValidationError{Path: strPath, Reason: fmt.Sprintf("is %d characters, want at least %d", intLength, *s.minLength)}
+		}
+		if s.maxLength != nil && intLength > *s.maxLength {
+			return &ValidationError{Path: strPath, Reason: fmt.Sprintf("is %d characters, want at most %d", intLength, *s.maxLength)}
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return &ValidationError{Path: strPath, Reason: fmt.Sprintf("does not match %s", s.pattern.String())}
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			return &ValidationError{Path: strPath, Reason: fmt.Sprintf("is %v, want at least %v", v, *s.minimum)}
+		}
+		if s.maximum != nil && v > *s.maximum {
+			return &ValidationError{Path: strPath, Reason: fmt.Sprintf("is %v, want at most %v", v, *s.maximum)}
+		}
+	}
+	return nil
+}
+
+// matchesType reports whether value is one of the schema's types.
+func (s *payloadSchema) matchesType(value interface{}) bool {
+	strType := jsonType(value)
+	for _, strWant := range s.listTypes {
+		if strWant == strType || (strWant == "number" && strType == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType returns the JSON Schema type of a decoded JSON value.
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// jsonEqual reports whether two decoded JSON values are equal.
+func jsonEqual(value1 interface{}, value2 interface{}) bool {
+	data1, err1 := json.Marshal(value1)
+	data2, err2 := json.Marshal(value2)
+	return err1 == nil && err2 == nil && string(data1) == string(data2)
+}
+
+// joinPath appends a key to a value path.
+func joinPath(strPath string, strKey string) string {
+	if strPath == "" {
+		return strKey
+	}
+	return strPath + "." + strKey
+}
+
+// schemaPath names a schema location in errors.
+func schemaPath(strPath string) string {
+	if strPath == "" {
+		return "root"
+	}
+	return strPath
+}
+
+// validateCustomData runs the app's payload schema and validator on the
+// custom data of payload. The reserved aps key is not custom data.
+func (a *connectionAPNS) validateCustomData(payload *apns.Payload) error {
+	if a.schema == nil && a.options.PayloadValidator == nil {
+		return nil
+	}
+	mapCustom := make(map[string]interface{}, len(payload.ExtraData))
+	for strKey, value := range payload.ExtraData {
+		if strKey != apsKey {
+			mapCustom[strKey] = value
+		}
+	}
+
+	if a.schema != nil {
+		// round trip through JSON so values are checked as the device decodes them
+		data, err := json.Marshal(mapCustom)
+		if err != nil {
+			return &ValidationError{Reason: err.Error()}
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			return &ValidationError{Reason: err.Error()}
+		}
+		if err := a.schema.validate(decoded, ""); err != nil {
+			a.logLevelf(LogDebug, 0, "Payload schema rejected %s %s\n", payload.Token, err.Error())
+			return err
+		}
+	}
+	if a.options.PayloadValidator != nil {
+		if err := a.options.PayloadValidator(mapCustom); err != nil {
+			a.logLevelf(LogDebug, 0, "Payload validator rejected %s %s\n", payload.Token, err.Error())
+			if errors.Is(err, ErrInvalidPayload) {
+				return err
+			}
+			return fmt.Errorf("%w: %s", ErrInvalidPayload, err.Error())
+		}
+	}
+	return nil
+}
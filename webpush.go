@@ -0,0 +1,355 @@
+package apnsservice
+
+// This source code includes the Web Push transport (RFC 8030). A Web Push
+// connection is a connectionAPNS registered under PlatformWeb, so it shares
+// the send queue, logging, retries and stats of the other platforms. The
+// token of a web payload is the browser's PushSubscription JSON. Each payload
+// is encrypted for the subscription (RFC 8291) and the request is signed with
+// the app's VAPID key (RFC 8292).
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/knousere/web-service-commons/utils"
+)
+
+// ReasonSubscriptionGone is the dead-letter reason of a web subscription the push service no longer accepts.
+const ReasonSubscriptionGone = "SubscriptionGone"
+
+// These bound Web Push messages.
+const (
+	maxWebPushPayload = 3993              // 4096 byte record less the encryption header, tag and delimiter
+	webPushRecordSize = 4096              // aes128gcm record size
+	defaultWebPushTTL = 4 * 7 * 24 * 3600 // seconds the push service keeps an undelivered message
+	vapidValidity     = 12 * time.Hour
+	vapidRefresh      = 11 * time.Hour
+)
+
+// VAPIDKeys identify an application server to Web Push services.
+// PublicKey is the uncompressed P-256 point and PrivateKey the 32 byte
+// scalar, both base64url encoded. Subject is a mailto: or https: contact.
+type VAPIDKeys struct {
+	PublicKey  string `json:"publicKey"`
+	PrivateKey string `json:"privateKey"`
+	Subject    string `json:"subject"`
+}
+
+// WebSubscription is a browser's PushSubscription as serialized by its toJSON.
+// Marshal it to use as the token of a web payload.
+type WebSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// webPushClient signs and posts Web Push requests for one app.
+type webPushClient struct {
+	client       *http.Client
+	key          *ecdsa.PrivateKey
+	strPublicKey string
+	strSubject   string
+	mutex        sync.Mutex
+	mapTokens    map[string]vapidToken // keyed by push service origin
+}
+
+// vapidToken is a signed VAPID JWT for one audience.
+type vapidToken struct {
+	strToken string
+	issued   time.Time
+}
+
+// GenerateVAPIDKeys creates a new VAPID key pair for subject.
+func GenerateVAPIDKeys(subject string) (VAPIDKeys, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return VAPIDKeys{}, err
+	}
+	return VAPIDKeys{
+		PublicKey:  base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+		PrivateKey: base64.RawURLEncoding.EncodeToString(key.Bytes()),
+		Subject:    subject,
+	}, nil
+}
+
+// LaunchWebPush creates a Web Push connection for an app and adds it to the
+// map under PlatformWeb. The connection uses the app's ConnectionOptions and
+// logs to logs/webpush. An existing Web Push connection for the app is replaced.
+func LaunchWebPush(appID int, appString string, keys VAPIDKeys, isLogging bool) error {
+	client, err := newWebPushClient(keys)
+	if err != nil {
+		utils.Warning.Println("LaunchWebPush", appString, err.Error())
+		return err
+	}
+	connectionAPNS := newConnection(appID, appString, &AppCert{AppID: appID})
+	connectionAPNS.platform = PlatformWeb
+	connectionAPNS.options.Mock = nil
+	connectionAPNS.webPush = client
+	return storeConnection(&connectionAPNS, isLogging, true)
+}
+
+// newWebPushClient parses the VAPID keys.
+func newWebPushClient(keys VAPIDKeys) (*webPushClient, error) {
+	if keys.Subject == "" {
+		return nil, errors.New("vapid subject is required")
+	}
+	bytesPrivate, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(keys.PrivateKey, "="))
+	if err != nil {
+		return nil, fmt.Errorf("vapid private key: %s", err.Error())
+	}
+	keyECDH, err := ecdh.P256().NewPrivateKey(bytesPrivate)
+	if err != nil {
+		return nil, fmt.Errorf("vapid private key: %s", err.Error())
+	}
+	bytesPublic := keyECDH.PublicKey().Bytes()
+	strPublicKey := base64.RawURLEncoding.EncodeToString(bytesPublic)
+	if keys.PublicKey != "" && strings.TrimRight(keys.PublicKey, "=") != strPublicKey {
+		return nil, errors.New("vapid public key does not match the private key")
+	}
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(bytesPublic[1:33]),
+			Y:     new(big.Int).SetBytes(bytesPublic[33:]),
+		},
+		D: new(big.Int).SetBytes(bytesPrivate),
+	}
+	return &webPushClient{
+		client:       newRequestClient(nil, ConnectionOptions{}),
+		key:          key,
+		strPublicKey: strPublicKey,
+		strSubject:   keys.Subject,
+		mapTokens:    make(map[string]vapidToken),
+	}, nil
+}
+
+// initWebPush routes the Web Push client through the app's egress profile if it has one.
+func (a *connectionAPNS) initWebPush() {
+	a.webPush.client = newRequestClient(a.egress, a.options)
+}
+
+// authorization returns the VAPID Authorization header for a push service
+// origin, signing a new token when the cached one is due.
+func (c *webPushClient) authorization(strOrigin string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	cached, ok := c.mapTokens[strOrigin]
+	if !ok || now.Sub(cached.issued) >= vapidRefresh {
+		header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+		claims, _ := json.Marshal(map[string]interface{}{
+			"aud": strOrigin,
+			"exp": now.Add(vapidValidity).Unix(),
+			"sub": c.strSubject,
+		})
+		strSigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+		digest := sha256.Sum256([]byte(strSigned))
+		r, sig, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+		if err != nil {
+			return "", err
+		}
+		signature := make([]byte, 64)
+		fillBigEndian(signature[:32], r)
+		fillBigEndian(signature[32:], sig)
+		cached = vapidToken{strToken: strSigned + "." + base64.RawURLEncoding.EncodeToString(signature), issued: now}
+		c.mapTokens[strOrigin] = cached
+	}
+	return "vapid t=" + cached.strToken + ", k=" + c.strPublicKey, nil
+}
+
+// parseSubscription decodes the subscription JSON carried as a web payload's token.
+func parseSubscription(strToken string) (WebSubscription, error) {
+	var subscription WebSubscription
+	if err := json.Unmarshal([]byte(strToken), &subscription); err != nil {
+		return subscription, fmt.Errorf("%w: not a web subscription: %s", ErrInvalidToken, err.Error())
+	}
+	if subscription.Endpoint == "" || subscription.Keys.P256dh == "" || subscription.Keys.Auth == "" {
+		return subscription, fmt.Errorf("%w: web subscription requires endpoint, p256dh and auth", ErrInvalidToken)
+	}
+	return subscription, nil
+}
+
+// webPushBody builds the JSON message a service worker receives.
+func webPushBody(payload *apns.Payload) ([]byte, error) {
+	message := map[string]interface{}{}
+	if payload.AlertText != "" {
+		message["body"] = payload.AlertText
+	}
+	if payload.Badge.IsSet() {
+		message["badge"] = payload.Badge.Number()
+	}
+	if payload.Sound != "" {
+		message["sound"] = payload.Sound
+	}
+	if payload.Category != "" {
+		message["category"] = payload.Category
+	}
+	if len(payload.ExtraData) > 0 {
+		message["data"] = payload.ExtraData
+	}
+	return json.Marshal(message)
+}
+
+// validateWebPush checks that a web payload has a subscription and fits in one record.
+func validateWebPush(payload *apns.Payload) error {
+	if _, err := parseSubscription(payload.Token); err != nil {
+		return err
+	}
+	body, err := webPushBody(payload)
+	if err != nil {
+		return err
+	}
+	if len(body) > maxWebPushPayload {
+		return &PayloadSizeError{Size: len(body), Limit: maxWebPushPayload}
+	}
+	return nil
+}
+
+// sendWebPush encrypts and posts one notification and returns the push
+// service's status code. Any 2xx reply is reported as 200.
+func (a *connectionAPNS) sendWebPush(n *notification) (int, string, error) {
+	subscription, err := parseSubscription(n.payload.Token)
+	if err != nil {
+		return 0, "", err
+	}
+	plaintext, err := webPushBody(&n.payload)
+	if err != nil {
+		return 0, "", err
+	}
+	body, err := encryptWebPush(subscription, plaintext)
+	if err != nil {
+		return 0, "", err
+	}
+	urlEndpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil {
+		return 0, "", err
+	}
+	strAuthorization, err := a.webPush.authorization(urlEndpoint.Scheme + "://" + urlEndpoint.Host)
+	if err != nil {
+		return 0, "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Authorization", strAuthorization)
+	intTTL := defaultWebPushTTL
+	if !n.options.Expiration.IsZero() {
+		intTTL = int(time.Until(n.options.Expiration) / time.Second)
+		if intTTL < 0 {
+			intTTL = 0
+		}
+	}
+	req.Header.Set("TTL", strconv.Itoa(intTTL))
+	switch n.options.Priority {
+	case PriorityImmediate:
+		req.Header.Set("Urgency", "high")
+	case PriorityConserve:
+		req.Header.Set("Urgency", "low")
+	}
+	if n.options.CollapseID != "" {
+		req.Header.Set("Topic", n.options.CollapseID)
+	}
+
+	resp, err := a.webPush.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return http.StatusOK, "", nil
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusGone:
+		return resp.StatusCode, ReasonSubscriptionGone, nil
+	}
+	return resp.StatusCode, http.StatusText(resp.StatusCode), nil
+}
+
+// encryptWebPush encrypts plaintext for a subscription as one aes128gcm record (RFC 8291).
+func encryptWebPush(subscription WebSubscription, plaintext []byte) ([]byte, error) {
+	bytesUA, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(subscription.Keys.P256dh, "="))
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %s", err.Error())
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(subscription.Keys.Auth, "="))
+	if err != nil {
+		return nil, fmt.Errorf("auth: %s", err.Error())
+	}
+	keyAS, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return sealWebPush(bytesUA, authSecret, keyAS, salt, plaintext)
+}
+
+// sealWebPush encrypts plaintext with the application server key keyAS and salt.
+func sealWebPush(bytesUA []byte, authSecret []byte, keyAS *ecdh.PrivateKey, salt []byte, plaintext []byte) ([]byte, error) {
+	keyUA, err := ecdh.P256().NewPublicKey(bytesUA)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %s", err.Error())
+	}
+	ecdhSecret, err := keyAS.ECDH(keyUA)
+	if err != nil {
+		return nil, err
+	}
+	bytesAS := keyAS.PublicKey().Bytes()
+
+	keyInfo := append([]byte("WebPush: info\x00"), bytesUA...)
+	keyInfo = append(keyInfo, bytesAS...)
+	ikm := hkdfSHA256(authSecret, ecdhSecret, keyInfo, 32)
+	cek := hkdfSHA256(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfSHA256(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	record := append(append([]byte{}, plaintext...), 0x02) // delimiter of the last record
+
+	header := make([]byte, 0, 16+4+1+len(bytesAS))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(bytesAS)))
+	header = append(header, bytesAS...)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+// hkdfSHA256 derives length bytes, at most 32, with HKDF-SHA-256.
+func hkdfSHA256(salt []byte, ikm []byte, info []byte, length int) []byte {
+	prk := hmacSHA256(salt, string(ikm))
+	okm := hmacSHA256(prk, string(info)+"\x01")
+	return okm[:length]
+}